@@ -0,0 +1,162 @@
+package veneur
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// overflowTag marks the series that a metric's samples are aggregated
+// into once the metric has exceeded the cardinality limit.
+const overflowTag = "overflow:true"
+
+const (
+	cardinalityActionOverflow = "overflow"
+	cardinalityActionDrop     = "drop"
+)
+
+// cardinalityLimiter limits the number of series (distinct tag sets)
+// that each metric name may have in an interval, across all the
+// workers that share it.
+type cardinalityLimiter struct {
+	limit int
+	drop  bool
+
+	mtx sync.Mutex
+	// series are the series of each metric name that were admitted
+	// in this interval.
+	series  map[string]map[samplers.MetricKey]struct{}
+	limited map[string]int64
+}
+
+func newCardinalityLimiter(limit int, action string) (*cardinalityLimiter, error) {
+	cl := &cardinalityLimiter{
+		limit:   limit,
+		series:  map[string]map[samplers.MetricKey]struct{}{},
+		limited: map[string]int64{},
+	}
+	switch action {
+	case "", cardinalityActionOverflow:
+	case cardinalityActionDrop:
+		cl.drop = true
+	default:
+		return nil, fmt.Errorf("unknown cardinality_limit_action %q, must be %q or %q",
+			action, cardinalityActionOverflow, cardinalityActionDrop)
+	}
+	return cl, nil
+}
+
+// admit returns true if the series was already admitted in this
+// interval, or if another series of its metric name may be created,
+// and counts it. Otherwise, it records that a sample of the metric was
+// limited. Admitting a series again, e.g. for a bucket of timestamped
+// samples, doesn't count against the limit.
+func (cl *cardinalityLimiter) admit(mk samplers.MetricKey) bool {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	series := cl.series[mk.Name]
+	if _, ok := series[mk]; ok {
+		return true
+	}
+	if len(series) < cl.limit {
+		if series == nil {
+			series = map[samplers.MetricKey]struct{}{}
+			cl.series[mk.Name] = series
+		}
+		series[mk] = struct{}{}
+		return true
+	}
+	cl.limited[mk.Name]++
+	return false
+}
+
+// limitedMetric is a metric name that exceeded the cardinality limit,
+// and the number of samples that were overflowed or dropped because of
+// it.
+type limitedMetric struct {
+	name    string
+	samples int64
+}
+
+// reset starts a new interval, and returns the metrics that exceeded
+// the limit in the last one, sorted by name.
+func (cl *cardinalityLimiter) reset() []limitedMetric {
+	cl.mtx.Lock()
+	limited := cl.limited
+	cl.series = map[string]map[samplers.MetricKey]struct{}{}
+	cl.limited = map[string]int64{}
+	cl.mtx.Unlock()
+
+	ret := make([]limitedMetric, 0, len(limited))
+	for name, samples := range limited {
+		ret = append(ret, limitedMetric{name: name, samples: samples})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+	return ret
+}
+
+// isOverflow returns true if the key is that of an overflow series.
+func isOverflow(key samplers.MetricKey) bool {
+	return key.JoinedTags == overflowTag
+}
+
+// moveOverflow moves the overflow series out of from and merges them
+// into wm. Every worker that a metric's limited series hash to has an
+// overflow series of its own; moving them all into one WorkerMetrics
+// flushes a single overflow series per metric name.
+func (wm WorkerMetrics) moveOverflow(from WorkerMetrics) {
+	overflow := NewWorkerMetrics()
+	for key, c := range from.counters {
+		if isOverflow(key) {
+			overflow.counters[key] = c
+			delete(from.counters, key)
+		}
+	}
+	for key, c := range from.globalCounters {
+		if isOverflow(key) {
+			overflow.globalCounters[key] = c
+			delete(from.globalCounters, key)
+		}
+	}
+	for key, g := range from.gauges {
+		if isOverflow(key) {
+			overflow.gauges[key] = g
+			delete(from.gauges, key)
+		}
+	}
+	for key, g := range from.globalGauges {
+		if isOverflow(key) {
+			overflow.globalGauges[key] = g
+			delete(from.globalGauges, key)
+		}
+	}
+	moveOverflowSets(overflow.sets, from.sets)
+	moveOverflowSets(overflow.localSets, from.localSets)
+	moveOverflowHistos(overflow.histograms, from.histograms)
+	moveOverflowHistos(overflow.globalHistograms, from.globalHistograms)
+	moveOverflowHistos(overflow.localHistograms, from.localHistograms)
+	moveOverflowHistos(overflow.timers, from.timers)
+	moveOverflowHistos(overflow.globalTimers, from.globalTimers)
+	moveOverflowHistos(overflow.localTimers, from.localTimers)
+	wm.merge(overflow)
+}
+
+func moveOverflowSets(into, from map[samplers.MetricKey]*samplers.Set) {
+	for key, s := range from {
+		if isOverflow(key) {
+			into[key] = s
+			delete(from, key)
+		}
+	}
+}
+
+func moveOverflowHistos(into, from map[samplers.MetricKey]*samplers.Histo) {
+	for key, h := range from {
+		if isOverflow(key) {
+			into[key] = h
+			delete(from, key)
+		}
+	}
+}
@@ -88,12 +88,16 @@ func main() {
 		}
 		trace.DefaultClient = server.TraceClient
 	}
+	server.EnableConfigReload(*configFile)
 	go server.FlushWatchdog()
 	server.Start()
 
 	if conf.HTTPAddress != "" || conf.GrpcAddress != "" {
 		server.Serve()
 	} else {
-		select {}
+		// Without servers to wait for, run until a hot restart shuts
+		// the server down:
+		<-server.ShuttingDown()
 	}
+	server.Shutdown()
 }
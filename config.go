@@ -1,77 +1,158 @@
 package veneur
 
 type Config struct {
-	Aggregates                    []string  `yaml:"aggregates"`
-	AwsAccessKeyID                string    `yaml:"aws_access_key_id"`
-	AwsRegion                     string    `yaml:"aws_region"`
-	AwsS3Bucket                   string    `yaml:"aws_s3_bucket"`
-	AwsSecretAccessKey            string    `yaml:"aws_secret_access_key"`
-	BlockProfileRate              int       `yaml:"block_profile_rate"`
-	DatadogAPIHostname            string    `yaml:"datadog_api_hostname"`
-	DatadogAPIKey                 string    `yaml:"datadog_api_key"`
-	DatadogFlushMaxPerBody        int       `yaml:"datadog_flush_max_per_body"`
-	DatadogSpanBufferSize         int       `yaml:"datadog_span_buffer_size"`
-	DatadogTraceAPIAddress        string    `yaml:"datadog_trace_api_address"`
-	Debug                         bool      `yaml:"debug"`
-	DebugFlushedMetrics           bool      `yaml:"debug_flushed_metrics"`
-	DebugIngestedSpans            bool      `yaml:"debug_ingested_spans"`
-	EnableProfiling               bool      `yaml:"enable_profiling"`
-	FalconerAddress               string    `yaml:"falconer_address"`
-	FlushFile                     string    `yaml:"flush_file"`
-	FlushMaxPerBody               int       `yaml:"flush_max_per_body"`
-	FlushWatchdogMissedFlushes    int       `yaml:"flush_watchdog_missed_flushes"`
-	ForwardAddress                string    `yaml:"forward_address"`
-	ForwardUseGrpc                bool      `yaml:"forward_use_grpc"`
-	GrpcAddress                   string    `yaml:"grpc_address"`
-	Hostname                      string    `yaml:"hostname"`
-	HTTPAddress                   string    `yaml:"http_address"`
-	IndicatorSpanTimerName        string    `yaml:"indicator_span_timer_name"`
-	Interval                      string    `yaml:"interval"`
-	KafkaBroker                   string    `yaml:"kafka_broker"`
-	KafkaCheckTopic               string    `yaml:"kafka_check_topic"`
-	KafkaEventTopic               string    `yaml:"kafka_event_topic"`
-	KafkaMetricBufferBytes        int       `yaml:"kafka_metric_buffer_bytes"`
-	KafkaMetricBufferFrequency    string    `yaml:"kafka_metric_buffer_frequency"`
-	KafkaMetricBufferMessages     int       `yaml:"kafka_metric_buffer_messages"`
-	KafkaMetricRequireAcks        string    `yaml:"kafka_metric_require_acks"`
-	KafkaMetricTopic              string    `yaml:"kafka_metric_topic"`
-	KafkaPartitioner              string    `yaml:"kafka_partitioner"`
-	KafkaRetryMax                 int       `yaml:"kafka_retry_max"`
-	KafkaSpanBufferBytes          int       `yaml:"kafka_span_buffer_bytes"`
-	KafkaSpanBufferFrequency      string    `yaml:"kafka_span_buffer_frequency"`
-	KafkaSpanBufferMesages        int       `yaml:"kafka_span_buffer_mesages"`
-	KafkaSpanRequireAcks          string    `yaml:"kafka_span_require_acks"`
-	KafkaSpanSampleRatePercent    int       `yaml:"kafka_span_sample_rate_percent"`
-	KafkaSpanSampleTag            string    `yaml:"kafka_span_sample_tag"`
-	KafkaSpanSerializationFormat  string    `yaml:"kafka_span_serialization_format"`
-	KafkaSpanTopic                string    `yaml:"kafka_span_topic"`
-	LightstepAccessToken          string    `yaml:"lightstep_access_token"`
-	LightstepCollectorHost        string    `yaml:"lightstep_collector_host"`
-	LightstepMaximumSpans         int       `yaml:"lightstep_maximum_spans"`
-	LightstepNumClients           int       `yaml:"lightstep_num_clients"`
-	LightstepReconnectPeriod      string    `yaml:"lightstep_reconnect_period"`
-	MetricMaxLength               int       `yaml:"metric_max_length"`
-	MutexProfileFraction          int       `yaml:"mutex_profile_fraction"`
-	NumReaders                    int       `yaml:"num_readers"`
-	NumSpanWorkers                int       `yaml:"num_span_workers"`
-	NumWorkers                    int       `yaml:"num_workers"`
-	ObjectiveSpanTimerName        string    `yaml:"objective_span_timer_name"`
-	OmitEmptyHostname             bool      `yaml:"omit_empty_hostname"`
-	Percentiles                   []float64 `yaml:"percentiles"`
-	ReadBufferSizeBytes           int       `yaml:"read_buffer_size_bytes"`
-	SentryDsn                     string    `yaml:"sentry_dsn"`
-	SignalfxAPIKey                string    `yaml:"signalfx_api_key"`
-	SignalfxEndpointBase          string    `yaml:"signalfx_endpoint_base"`
-	SignalfxFlushMaxPerBody       int       `yaml:"signalfx_flush_max_per_body"`
-	SignalfxHostnameTag           string    `yaml:"signalfx_hostname_tag"`
-	SignalfxMetricNamePrefixDrops []string  `yaml:"signalfx_metric_name_prefix_drops"`
-	SignalfxMetricTagPrefixDrops  []string  `yaml:"signalfx_metric_tag_prefix_drops"`
-	SignalfxPerTagAPIKeys         []struct {
+	Aggregates                   []string `yaml:"aggregates"`
+	AggregationStateFile         string   `yaml:"aggregation_state_file"`
+	AwsAccessKeyID               string   `yaml:"aws_access_key_id"`
+	AwsRegion                    string   `yaml:"aws_region"`
+	AwsS3Bucket                  string   `yaml:"aws_s3_bucket"`
+	AwsSecretAccessKey           string   `yaml:"aws_secret_access_key"`
+	BlockProfileRate             int      `yaml:"block_profile_rate"`
+	CardinalityLimit             int      `yaml:"cardinality_limit"`
+	CardinalityLimitAction       string   `yaml:"cardinality_limit_action"`
+	DatadogAPIHostname           string   `yaml:"datadog_api_hostname"`
+	DatadogAPIKey                string   `yaml:"datadog_api_key"`
+	DatadogFlushMaxPerBody       int      `yaml:"datadog_flush_max_per_body"`
+	DatadogSpanBufferSize        int      `yaml:"datadog_span_buffer_size"`
+	DatadogTraceAPIAddress       string   `yaml:"datadog_trace_api_address"`
+	Debug                        bool     `yaml:"debug"`
+	DebugFlushedMetrics          bool     `yaml:"debug_flushed_metrics"`
+	DebugIngestedSpans           bool     `yaml:"debug_ingested_spans"`
+	EnableProfiling              bool     `yaml:"enable_profiling"`
+	FalconerAddress              string   `yaml:"falconer_address"`
+	FlushFile                    string   `yaml:"flush_file"`
+	FlushMaxPerBody              int      `yaml:"flush_max_per_body"`
+	FlushWatchdogMissedFlushes   int      `yaml:"flush_watchdog_missed_flushes"`
+	ForwardAddress               string   `yaml:"forward_address"`
+	ForwardUseGrpc               bool     `yaml:"forward_use_grpc"`
+	GraphiteTemplates            []string `yaml:"graphite_templates"`
+	GrpcAddress                  string   `yaml:"grpc_address"`
+	Hostname                     string   `yaml:"hostname"`
+	HotRestartSocket             string   `yaml:"hot_restart_socket"`
+	HTTPAddress                  string   `yaml:"http_address"`
+	InfluxdbAddress              string   `yaml:"influxdb_address"`
+	InfluxdbBucket               string   `yaml:"influxdb_bucket"`
+	InfluxdbDatabase             string   `yaml:"influxdb_database"`
+	InfluxdbFlushMaxPerBody      int      `yaml:"influxdb_flush_max_per_body"`
+	InfluxdbOrg                  string   `yaml:"influxdb_org"`
+	InfluxdbPassword             string   `yaml:"influxdb_password"`
+	InfluxdbRetentionPolicy      string   `yaml:"influxdb_retention_policy"`
+	InfluxdbToken                string   `yaml:"influxdb_token"`
+	InfluxdbUsername             string   `yaml:"influxdb_username"`
+	IndicatorSpanTimerName       string   `yaml:"indicator_span_timer_name"`
+	Interval                     string   `yaml:"interval"`
+	JaegerAddress                string   `yaml:"jaeger_address"`
+	JaegerFlushMaxPerBody        int      `yaml:"jaeger_flush_max_per_body"`
+	JaegerSpanBufferSize         int      `yaml:"jaeger_span_buffer_size"`
+	KafkaBroker                  string   `yaml:"kafka_broker"`
+	KafkaCheckTopic              string   `yaml:"kafka_check_topic"`
+	KafkaEventTopic              string   `yaml:"kafka_event_topic"`
+	KafkaMetricBufferBytes       int      `yaml:"kafka_metric_buffer_bytes"`
+	KafkaMetricBufferFrequency   string   `yaml:"kafka_metric_buffer_frequency"`
+	KafkaMetricBufferMessages    int      `yaml:"kafka_metric_buffer_messages"`
+	KafkaMetricRequireAcks       string   `yaml:"kafka_metric_require_acks"`
+	KafkaMetricTopic             string   `yaml:"kafka_metric_topic"`
+	KafkaPartitioner             string   `yaml:"kafka_partitioner"`
+	KafkaRetryMax                int      `yaml:"kafka_retry_max"`
+	KafkaSpanBufferBytes         int      `yaml:"kafka_span_buffer_bytes"`
+	KafkaSpanBufferFrequency     string   `yaml:"kafka_span_buffer_frequency"`
+	KafkaSpanBufferMesages       int      `yaml:"kafka_span_buffer_mesages"`
+	KafkaSpanRequireAcks         string   `yaml:"kafka_span_require_acks"`
+	KafkaSpanSampleRatePercent   int      `yaml:"kafka_span_sample_rate_percent"`
+	KafkaSpanSampleTag           string   `yaml:"kafka_span_sample_tag"`
+	KafkaSpanSerializationFormat string   `yaml:"kafka_span_serialization_format"`
+	KafkaSpanTopic               string   `yaml:"kafka_span_topic"`
+	LightstepAccessToken         string   `yaml:"lightstep_access_token"`
+	LightstepCollectorHost       string   `yaml:"lightstep_collector_host"`
+	LightstepMaximumSpans        int      `yaml:"lightstep_maximum_spans"`
+	LightstepNumClients          int      `yaml:"lightstep_num_clients"`
+	LightstepReconnectPeriod     string   `yaml:"lightstep_reconnect_period"`
+	MetricMaxLength              int      `yaml:"metric_max_length"`
+	MetricRelabelRules           []struct {
+		AddTags      map[string]string            `yaml:"add_tags"`
+		Drop         bool                         `yaml:"drop"`
+		DropTags     []string                     `yaml:"drop_tags"`
+		MapTagValues map[string]map[string]string `yaml:"map_tag_values"`
+		MatchName    string                       `yaml:"match_name"`
+		MatchTags    map[string]string            `yaml:"match_tags"`
+		Rename       string                       `yaml:"rename"`
+	} `yaml:"metric_relabel_rules"`
+	MetricRoutingRules []struct {
+		ExcludeSinks    []string          `yaml:"exclude_sinks"`
+		MatchName       string            `yaml:"match_name"`
+		MatchNamePrefix string            `yaml:"match_name_prefix"`
+		MatchTags       map[string]string `yaml:"match_tags"`
+		Sinks           []string          `yaml:"sinks"`
+	} `yaml:"metric_routing_rules"`
+	MetricSinks []struct {
+		Config map[string]interface{} `yaml:"config"`
+		Kind   string                 `yaml:"kind"`
+		Name   string                 `yaml:"name"`
+		Retry  struct {
+			AttemptTimeout   string `yaml:"attempt_timeout"`
+			BreakerCooldown  string `yaml:"breaker_cooldown"`
+			BreakerThreshold int    `yaml:"breaker_threshold"`
+			InitialBackoff   string `yaml:"initial_backoff"`
+			MaxAttempts      int    `yaml:"max_attempts"`
+			MaxBackoff       string `yaml:"max_backoff"`
+		} `yaml:"retry"`
+	} `yaml:"metric_sinks"`
+	MutexProfileFraction                 int       `yaml:"mutex_profile_fraction"`
+	NumReaders                           int       `yaml:"num_readers"`
+	NumSpanWorkers                       int       `yaml:"num_span_workers"`
+	NumWorkers                           int       `yaml:"num_workers"`
+	ObjectiveSpanTimerName               string    `yaml:"objective_span_timer_name"`
+	OmitEmptyHostname                    bool      `yaml:"omit_empty_hostname"`
+	OtlpGrpcAddress                      string    `yaml:"otlp_grpc_address"`
+	OtlpHTTPAddress                      string    `yaml:"otlp_http_address"`
+	OtlpSinkAddress                      string    `yaml:"otlp_sink_address"`
+	OtlpSinkFlushMaxPerBody              int       `yaml:"otlp_sink_flush_max_per_body"`
+	OtlpSinkSpanBufferSize               int       `yaml:"otlp_sink_span_buffer_size"`
+	Percentiles                          []float64 `yaml:"percentiles"`
+	PrometheusRemoteWriteAddress         string    `yaml:"prometheus_remote_write_address"`
+	PrometheusRemoteWriteFlushMaxPerBody int       `yaml:"prometheus_remote_write_flush_max_per_body"`
+	PrometheusScrapeAddress              string    `yaml:"prometheus_scrape_address"`
+	PrometheusScrapeEnabled              bool      `yaml:"prometheus_scrape_enabled"`
+	PrometheusScrapeExpireIntervals      int       `yaml:"prometheus_scrape_expire_intervals"`
+	ReadBufferSizeBytes                  int       `yaml:"read_buffer_size_bytes"`
+	SentryDsn                            string    `yaml:"sentry_dsn"`
+	ShutdownTimeout                      string    `yaml:"shutdown_timeout"`
+	SignalfxAPIKey                       string    `yaml:"signalfx_api_key"`
+	SignalfxEndpointBase                 string    `yaml:"signalfx_endpoint_base"`
+	SignalfxFlushMaxPerBody              int       `yaml:"signalfx_flush_max_per_body"`
+	SignalfxHostnameTag                  string    `yaml:"signalfx_hostname_tag"`
+	SignalfxMetricNamePrefixDrops        []string  `yaml:"signalfx_metric_name_prefix_drops"`
+	SignalfxMetricTagPrefixDrops         []string  `yaml:"signalfx_metric_tag_prefix_drops"`
+	SignalfxPerTagAPIKeys                []struct {
 		APIKey string `yaml:"api_key"`
 		Name   string `yaml:"name"`
 	} `yaml:"signalfx_per_tag_api_keys"`
-	SignalfxVaryKeyBy                 string   `yaml:"signalfx_vary_key_by"`
-	SpanChannelCapacity               int      `yaml:"span_channel_capacity"`
+	SignalfxVaryKeyBy       string            `yaml:"signalfx_vary_key_by"`
+	SinkBreakerCooldown     string            `yaml:"sink_breaker_cooldown"`
+	SinkBreakerThreshold    int               `yaml:"sink_breaker_threshold"`
+	SinkFlushTimeout        string            `yaml:"sink_flush_timeout"`
+	SinkIntervals           map[string]string `yaml:"sink_intervals"`
+	SinkRetryAttemptTimeout string            `yaml:"sink_retry_attempt_timeout"`
+	SinkRetryInitialBackoff string            `yaml:"sink_retry_initial_backoff"`
+	SinkRetryMaxAttempts    int               `yaml:"sink_retry_max_attempts"`
+	SinkRetryMaxBackoff     string            `yaml:"sink_retry_max_backoff"`
+	SinkSpoolDirectory      string            `yaml:"sink_spool_directory"`
+	SinkSpoolMaxBytes       int               `yaml:"sink_spool_max_bytes"`
+	SinkSpoolTTL            string            `yaml:"sink_spool_ttl"`
+	SpanChannelCapacity     int               `yaml:"span_channel_capacity"`
+	SpanSinks               []struct {
+		Config map[string]interface{} `yaml:"config"`
+		Kind   string                 `yaml:"kind"`
+		Name   string                 `yaml:"name"`
+		Retry  struct {
+			AttemptTimeout   string `yaml:"attempt_timeout"`
+			BreakerCooldown  string `yaml:"breaker_cooldown"`
+			BreakerThreshold int    `yaml:"breaker_threshold"`
+			InitialBackoff   string `yaml:"initial_backoff"`
+			MaxAttempts      int    `yaml:"max_attempts"`
+			MaxBackoff       string `yaml:"max_backoff"`
+		} `yaml:"retry"`
+	} `yaml:"span_sinks"`
 	SplunkHecAddress                  string   `yaml:"splunk_hec_address"`
 	SplunkHecBatchSize                int      `yaml:"splunk_hec_batch_size"`
 	SplunkHecConnectionLifetimeJitter string   `yaml:"splunk_hec_connection_lifetime_jitter"`
@@ -89,6 +170,7 @@ type Config struct {
 	SynchronizeWithInterval           bool     `yaml:"synchronize_with_interval"`
 	Tags                              []string `yaml:"tags"`
 	TagsExclude                       []string `yaml:"tags_exclude"`
+	TimestampLateness                 string   `yaml:"timestamp_lateness"`
 	TLSAuthorityCertificate           string   `yaml:"tls_authority_certificate"`
 	TLSCertificate                    string   `yaml:"tls_certificate"`
 	TLSKey                            string   `yaml:"tls_key"`
@@ -106,7 +188,10 @@ type Config struct {
 		Set       string `yaml:"set"`
 		Status    string `yaml:"status"`
 	} `yaml:"veneur_metrics_scopes"`
-	XrayAddress          string   `yaml:"xray_address"`
-	XrayAnnotationTags   []string `yaml:"xray_annotation_tags"`
-	XraySamplePercentage int      `yaml:"xray_sample_percentage"`
+	XrayAddress           string   `yaml:"xray_address"`
+	XrayAnnotationTags    []string `yaml:"xray_annotation_tags"`
+	XraySamplePercentage  int      `yaml:"xray_sample_percentage"`
+	ZipkinAddress         string   `yaml:"zipkin_address"`
+	ZipkinFlushMaxPerBody int      `yaml:"zipkin_flush_max_per_body"`
+	ZipkinSpanBufferSize  int      `yaml:"zipkin_span_buffer_size"`
 }
@@ -12,14 +12,23 @@ import (
 )
 
 var defaultConfig = Config{
-	Aggregates:                     []string{"min", "max", "count"},
-	DatadogFlushMaxPerBody:         25000,
-	Interval:                       "10s",
-	MetricMaxLength:                4096,
-	ReadBufferSizeBytes:            1048576 * 2, // 2 MiB
-	SpanChannelCapacity:            100,
-	SplunkHecBatchSize:             100,
-	SplunkHecMaxConnectionLifetime: "10s", // same as Interval
+	Aggregates:                           []string{"min", "max", "count"},
+	DatadogFlushMaxPerBody:               25000,
+	InfluxdbFlushMaxPerBody:              5000,
+	Interval:                             "10s",
+	JaegerFlushMaxPerBody:                1000,
+	JaegerSpanBufferSize:                 16384,
+	MetricMaxLength:                      4096,
+	OtlpSinkFlushMaxPerBody:              1000,
+	OtlpSinkSpanBufferSize:               16384,
+	PrometheusRemoteWriteFlushMaxPerBody: 5000,
+	PrometheusScrapeExpireIntervals:      10,
+	ReadBufferSizeBytes:                  1048576 * 2, // 2 MiB
+	SpanChannelCapacity:                  100,
+	SplunkHecBatchSize:                   100,
+	SplunkHecMaxConnectionLifetime:       "10s", // same as Interval
+	ZipkinFlushMaxPerBody:                1000,
+	ZipkinSpanBufferSize:                 16384,
 }
 
 var defaultProxyConfig = ProxyConfig{
@@ -212,6 +221,34 @@ func (c *Config) applyDefaults() {
 		c.DatadogFlushMaxPerBody = defaultConfig.DatadogFlushMaxPerBody
 	}
 
+	if c.InfluxdbFlushMaxPerBody == 0 {
+		c.InfluxdbFlushMaxPerBody = defaultConfig.InfluxdbFlushMaxPerBody
+	}
+
+	if c.JaegerFlushMaxPerBody == 0 {
+		c.JaegerFlushMaxPerBody = defaultConfig.JaegerFlushMaxPerBody
+	}
+
+	if c.JaegerSpanBufferSize == 0 {
+		c.JaegerSpanBufferSize = defaultConfig.JaegerSpanBufferSize
+	}
+
+	if c.OtlpSinkFlushMaxPerBody == 0 {
+		c.OtlpSinkFlushMaxPerBody = defaultConfig.OtlpSinkFlushMaxPerBody
+	}
+
+	if c.OtlpSinkSpanBufferSize == 0 {
+		c.OtlpSinkSpanBufferSize = defaultConfig.OtlpSinkSpanBufferSize
+	}
+
+	if c.PrometheusRemoteWriteFlushMaxPerBody == 0 {
+		c.PrometheusRemoteWriteFlushMaxPerBody = defaultConfig.PrometheusRemoteWriteFlushMaxPerBody
+	}
+
+	if c.PrometheusScrapeExpireIntervals == 0 {
+		c.PrometheusScrapeExpireIntervals = defaultConfig.PrometheusScrapeExpireIntervals
+	}
+
 	if c.SpanChannelCapacity == 0 {
 		c.SpanChannelCapacity = defaultConfig.SpanChannelCapacity
 	}
@@ -223,6 +260,14 @@ func (c *Config) applyDefaults() {
 	if c.SplunkHecMaxConnectionLifetime == "" {
 		c.SplunkHecMaxConnectionLifetime = defaultConfig.SplunkHecMaxConnectionLifetime
 	}
+
+	if c.ZipkinFlushMaxPerBody == 0 {
+		c.ZipkinFlushMaxPerBody = defaultConfig.ZipkinFlushMaxPerBody
+	}
+
+	if c.ZipkinSpanBufferSize == 0 {
+		c.ZipkinSpanBufferSize = defaultConfig.ZipkinSpanBufferSize
+	}
 }
 
 // ParseInterval handles parsing the flush interval as a time.Duration
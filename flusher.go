@@ -25,9 +25,21 @@ import (
 
 // Flush collects sampler's metrics and passes them to sinks.
 func (s *Server) Flush(ctx context.Context) {
+	s.flush(ctx)
+}
+
+// flush does the work of Flush. It returns a WaitGroup for the parts of
+// the flush that it leaves running in the background: flushing the span
+// sinks and the plugins.
+func (s *Server) flush(ctx context.Context) *sync.WaitGroup {
+	background := &sync.WaitGroup{}
 	span := tracer.StartSpan("flush").(*trace.Span)
 	defer span.ClientFinish(s.TraceClient)
 
+	// a configuration reload waits for the flush to finish:
+	s.reloadMtx.RLock()
+	defer s.reloadMtx.RUnlock()
+
 	mem := &runtime.MemStats{}
 	runtime.ReadMemStats(mem)
 
@@ -40,15 +52,27 @@ func (s *Server) Flush(ctx context.Context) {
 	s.Statsd.Gauge("gc.pause_total_ns", float64(mem.PauseTotalNs), nil, 1.0)
 	s.Statsd.Gauge("mem.heap_alloc_bytes", float64(mem.HeapAlloc), nil, 1.0)
 	s.Statsd.Gauge("flush.flush_timestamp_ns", float64(flushTime), nil, 1.0)
+	s.Statsd.Count("relabel.metrics_dropped_total", atomic.SwapInt64(&s.relabelDropped, 0), nil, 1.0)
 
 	samples := s.EventWorker.Flush()
 
-	// TODO Concurrency
+	others := sync.WaitGroup{}
+	defer others.Wait()
 	for _, sink := range s.metricSinks {
-		sink.FlushOtherSamples(span.Attach(ctx), samples)
+		others.Add(1)
+		go func(ms sinks.MetricSink) {
+			defer others.Done()
+			s.flushSink(span.Attach(ctx), background, ms, "other_samples", func(ctx context.Context) {
+				ms.FlushOtherSamples(ctx, samples)
+			})
+		}(sink)
 	}
 
-	go s.flushTraces(span.Attach(ctx))
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		s.flushTraces(span.Attach(ctx))
+	}()
 
 	var finalMetrics []samplers.InterMetric
 
@@ -68,8 +92,25 @@ func (s *Server) Flush(ctx context.Context) {
 	}
 
 	tempMetrics, ms := s.tallyMetrics(percentiles)
+	s.reportCardinalityLimits()
+
+	// the sinks and plugins with a longer interval get the metrics of
+	// all the intervals since they last flushed:
+	slow := sync.WaitGroup{}
+	defer slow.Wait()
+	final := s.isFinalFlush()
+	for _, sf := range s.slowFlushes {
+		if wm, due := sf.add(tempMetrics, flushTime/int64(time.Second), final); due {
+			slow.Add(1)
+			go func(sf *slowFlush, wm WorkerMetrics) {
+				defer slow.Done()
+				s.flushSlow(span.Attach(ctx), background, sf, wm, percentiles, aggregates)
+			}(sf, wm)
+		}
+	}
 
-	finalMetrics = s.generateInterMetrics(span.Attach(ctx), percentiles, aggregates, tempMetrics, ms)
+	finalMetrics = s.generateInterMetrics(span.Attach(ctx), s.interval, percentiles, aggregates, tempMetrics, ms)
+	s.metricRouter.Route(finalMetrics)
 
 	s.reportMetricsFlushCounts(ms)
 
@@ -94,36 +135,171 @@ func (s *Server) Flush(ctx context.Context) {
 
 	// If there's nothing to flush, don't bother calling the plugins and stuff.
 	if len(finalMetrics) == 0 {
-		return
+		return background
 	}
 
-	for _, sink := range s.metricSinks {
-		wg.Add(1)
-		go func(ms sinks.MetricSink) {
-			err := ms.Flush(span.Attach(ctx), finalMetrics)
-			if err != nil {
-				log.WithError(err).WithField("sink", ms.Name()).Warn("Error flushing sink")
-			}
-			wg.Done()
-		}(sink)
-	}
+	s.flushMetricSinks(span.Attach(ctx), background, finalMetrics, 1)
 	wg.Wait()
 
-	go func() {
-		samples := &ssf.Samples{}
-		defer metrics.Report(s.TraceClient, samples)
+	s.flushPlugins(span.Attach(ctx), background, finalMetrics, 1)
+	return background
+}
 
-		tags := map[string]string{"part": "post"}
-		for _, p := range s.getPlugins() {
-			start := time.Now()
-			err := p.Flush(span.Attach(ctx), finalMetrics)
-			samples.Add(ssf.Timing(fmt.Sprintf("flush.plugins.%s.total_duration_ns", p.Name()), time.Since(start), time.Nanosecond, tags))
-			if err != nil {
-				samples.Add(ssf.Count(fmt.Sprintf("flush.plugins.%s.error_total", p.Name()), 1, nil))
-			}
-			samples.Add(ssf.Gauge(fmt.Sprintf("flush.plugins.%s.post_metrics_total", p.Name()), float32(len(finalMetrics)), nil))
+// flushMetricSink flushes metrics to a metric sink. If sinks are spooled,
+// the metrics that failed to flush are spooled, unless they failed
+// permanently, and spooled metrics are flushed again once the sink
+// succeeds.
+func (s *Server) flushMetricSink(ctx context.Context, ms sinks.MetricSink, metrics []samplers.InterMetric) {
+	err := ms.Flush(ctx, metrics)
+	if err != nil {
+		log.WithError(err).WithField("sink", ms.Name()).Warn("Error flushing sink")
+	}
+	if s.spools == nil {
+		return
+	}
+
+	now := time.Now()
+	if err != nil {
+		if failed := sinks.FailedMetrics(err, metrics); len(failed) > 0 {
+			s.spoolMetrics(ms, failed, now)
 		}
+		return
+	}
+	spool, err := s.spools.get(ms.Name())
+	if err != nil {
+		log.WithError(err).WithField("sink", ms.Name()).Error("Could not open sink spool")
+		return
+	}
+	if err := spool.replay(ctx, ms, now); err != nil {
+		log.WithError(err).WithField("sink", ms.Name()).Warn("Error flushing spooled metrics to sink")
+	}
+	s.reportSpool(ms.Name(), spool, now)
+}
+
+// spoolMetrics adds the metrics that are routed to a sink to the sink's
+// spool, if sinks are spooled.
+func (s *Server) spoolMetrics(ms sinks.MetricSink, metrics []samplers.InterMetric, now time.Time) {
+	if s.spools == nil {
+		return
+	}
+	logger := log.WithField("sink", ms.Name())
+	spool, err := s.spools.get(ms.Name())
+	if err != nil {
+		logger.WithError(err).Error("Could not open sink spool")
+		return
+	}
+	routed := make([]samplers.InterMetric, 0, len(metrics))
+	for _, m := range metrics {
+		if m.Sinks.RouteTo(ms.Name()) {
+			routed = append(routed, m)
+		}
+	}
+	if len(routed) > 0 {
+		if err := spool.add(routed, now); err != nil {
+			logger.WithError(err).Error("Could not spool metrics")
+		}
+	}
+	s.reportSpool(ms.Name(), spool, now)
+}
+
+// reportSpool reports the depth, size and age of a sink's spool.
+func (s *Server) reportSpool(name string, spool *sinkSpool, now time.Time) {
+	st := spool.stats(now)
+	tags := []string{"sink:" + name}
+	s.Statsd.Gauge("sink.spool.depth", float64(st.depth), tags, 1.0)
+	s.Statsd.Gauge("sink.spool.size_bytes", float64(st.bytes), tags, 1.0)
+	s.Statsd.Gauge("sink.spool.oldest_age_ns", float64(st.age), tags, 1.0)
+	for reason, count := range st.dropped {
+		s.Statsd.Count("sink.spool.dropped_total", count, append(tags, "reason:"+reason), 1.0)
+	}
+}
+
+// flushSink runs flush for a sink in the background, under the sink's
+// flush deadline, and waits until it's done or the deadline passed. A
+// sink that overruns its deadline keeps flushing in the background, but
+// its next flush is skipped if it's still busy by then: flushSink
+// returns false and doesn't run flush. part tells the sink's kinds of
+// flushes apart.
+func (s *Server) flushSink(ctx context.Context, background *sync.WaitGroup, sink sinks.MetricSink, part string, flush func(context.Context)) bool {
+	tags := []string{"sink:" + sink.Name(), "part:" + part}
+	logger := log.WithFields(logrus.Fields{"sink": sink.Name(), "part": part})
+	if !s.busySinks.start(part, sink) {
+		s.Statsd.Count("flush.sink_skipped_total", 1, tags, 1.0)
+		logger.Warn("Skipping flush, the sink is still busy with the previous one")
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.sinkFlushTimeout)
+	done := make(chan struct{})
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		defer s.busySinks.done(part, sink)
+		defer cancel()
+		defer close(done)
+		flush(ctx)
 	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.Statsd.Count("flush.sink_overrun_total", 1, tags, 1.0)
+		logger.WithError(ctx.Err()).Warn("Sink flush overran its deadline, continuing without it")
+	}
+	return true
+}
+
+// busySinks are the sinks that are still flushing. They're tracked by
+// instance rather than by name, since a reload can replace a sink with
+// one of the same name.
+type busySinks struct {
+	mtx  sync.Mutex
+	busy map[busySink]bool
+	// idle is signaled whenever a sink is done flushing.
+	idle *sync.Cond
+}
+
+// busySink is a sink that's busy with a part of the flush.
+type busySink struct {
+	part string
+	sink sinks.MetricSink
+}
+
+// start marks a sink busy with a part of the flush, or returns false if
+// it's busy already.
+func (bs *busySinks) start(part string, sink sinks.MetricSink) bool {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	key := busySink{part: part, sink: sink}
+	if bs.busy[key] {
+		return false
+	}
+	if bs.busy == nil {
+		bs.busy = map[busySink]bool{}
+	}
+	bs.busy[key] = true
+	return true
+}
+
+func (bs *busySinks) done(part string, sink sinks.MetricSink) {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	delete(bs.busy, busySink{part: part, sink: sink})
+	if bs.idle != nil {
+		bs.idle.Broadcast()
+	}
+}
+
+// wait waits until sink isn't busy with any part of a flush.
+func (bs *busySinks) wait(sink sinks.MetricSink) {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	if bs.idle == nil {
+		bs.idle = sync.NewCond(&bs.mtx)
+	}
+	for bs.busy[busySink{part: "metrics", sink: sink}] || bs.busy[busySink{part: "other_samples", sink: sink}] {
+		bs.idle.Wait()
+	}
 }
 
 type metricsSummary struct {
@@ -146,6 +322,55 @@ type metricsSummary struct {
 	totalLength int
 }
 
+// flushMetricSinks flushes metrics to the metric sinks that flush every
+// multiple intervals, and waits for them.
+func (s *Server) flushMetricSinks(ctx context.Context, background *sync.WaitGroup, finalMetrics []samplers.InterMetric, multiple int) {
+	wg := sync.WaitGroup{}
+	for _, sink := range s.metricSinks {
+		if s.sinkMultiple(sink.Name()) != multiple {
+			continue
+		}
+		wg.Add(1)
+		go func(ms sinks.MetricSink) {
+			defer wg.Done()
+			flushed := s.flushSink(ctx, background, ms, "metrics", func(ctx context.Context) {
+				s.flushMetricSink(ctx, ms, finalMetrics)
+			})
+			if !flushed {
+				// the sink gets these metrics with a later flush,
+				// if it has a spool:
+				s.spoolMetrics(ms, finalMetrics, time.Now())
+			}
+		}(sink)
+	}
+	wg.Wait()
+}
+
+// flushPlugins flushes metrics to the plugins that flush every multiple
+// intervals, in the background.
+func (s *Server) flushPlugins(ctx context.Context, background *sync.WaitGroup, finalMetrics []samplers.InterMetric, multiple int) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		samples := &ssf.Samples{}
+		defer metrics.Report(s.TraceClient, samples)
+
+		tags := map[string]string{"part": "post"}
+		for _, p := range s.getPlugins() {
+			if s.sinkMultiple(p.Name()) != multiple {
+				continue
+			}
+			start := time.Now()
+			err := p.Flush(ctx, finalMetrics)
+			samples.Add(ssf.Timing(fmt.Sprintf("flush.plugins.%s.total_duration_ns", p.Name()), time.Since(start), time.Nanosecond, tags))
+			if err != nil {
+				samples.Add(ssf.Count(fmt.Sprintf("flush.plugins.%s.error_total", p.Name()), 1, nil))
+			}
+			samples.Add(ssf.Gauge(fmt.Sprintf("flush.plugins.%s.post_metrics_total", p.Name()), float32(len(finalMetrics)), nil))
+		}
+	}()
+}
+
 // tallyMetrics gives a slight overestimate of the number
 // of metrics we'll be reporting, so that we can pre-allocate
 // a slice of the correct length instead of constantly appending
@@ -157,11 +382,16 @@ func (s *Server) tallyMetrics(percentiles []float64) ([]WorkerMetrics, metricsSu
 
 	ms := metricsSummary{}
 
+	now := time.Now()
+	final := s.isFinalFlush()
 	for i, w := range s.Workers {
 		log.WithField("worker", i).Debug("Flushing")
-		wm := w.Flush()
-		tempMetrics = append(tempMetrics, wm)
+		tempMetrics = append(tempMetrics, w.Flush())
+		tempMetrics = append(tempMetrics, w.FlushBuckets(now, final)...)
+	}
+	tempMetrics = append(tempMetrics, s.mergeOverflow(tempMetrics)...)
 
+	for _, wm := range tempMetrics {
 		ms.totalCounters += len(wm.counters)
 		ms.totalGauges += len(wm.gauges)
 		ms.totalHistograms += len(wm.histograms)
@@ -205,16 +435,18 @@ func (s *Server) tallyMetrics(percentiles []float64) ([]WorkerMetrics, metricsSu
 
 // generateInterMetrics calls the Flush method on each
 // counter/gauge/histogram/timer/set in order to
-// generate an InterMetric corresponding to that value
-func (s *Server) generateInterMetrics(ctx context.Context, percentiles []float64, aggregates samplers.HistogramAggregates, tempMetrics []WorkerMetrics, ms metricsSummary) []samplers.InterMetric {
+// generate an InterMetric corresponding to that value, for sinks that
+// flush every interval
+func (s *Server) generateInterMetrics(ctx context.Context, interval time.Duration, percentiles []float64, aggregates samplers.HistogramAggregates, tempMetrics []WorkerMetrics, ms metricsSummary) []samplers.InterMetric {
 
 	span, _ := trace.StartSpanFromContext(ctx, "")
 	defer span.ClientFinish(s.TraceClient)
 
 	finalMetrics := make([]samplers.InterMetric, 0, ms.totalLength)
 	for _, wm := range tempMetrics {
+		first := len(finalMetrics)
 		for _, c := range wm.counters {
-			finalMetrics = append(finalMetrics, c.Flush(s.interval)...)
+			finalMetrics = append(finalMetrics, c.Flush(interval)...)
 		}
 		for _, g := range wm.gauges {
 			finalMetrics = append(finalMetrics, g.Flush()...)
@@ -224,10 +456,10 @@ func (s *Server) generateInterMetrics(ctx context.Context, percentiles []float64
 		//
 		// if we're a global veneur, aggregates will be nil.
 		for _, h := range wm.histograms {
-			finalMetrics = append(finalMetrics, h.Flush(s.interval, percentiles, s.HistogramAggregates, false)...)
+			finalMetrics = append(finalMetrics, h.Flush(interval, percentiles, s.HistogramAggregates, false)...)
 		}
 		for _, t := range wm.timers {
-			finalMetrics = append(finalMetrics, t.Flush(s.interval, percentiles, s.HistogramAggregates, false)...)
+			finalMetrics = append(finalMetrics, t.Flush(interval, percentiles, s.HistogramAggregates, false)...)
 		}
 
 		// local-only samplers should be flushed in their entirety, since they
@@ -235,13 +467,13 @@ func (s *Server) generateInterMetrics(ctx context.Context, percentiles []float64
 		// we still want percentiles for these, even if we're a local veneur, so
 		// we use the original percentile list when flushing them
 		for _, h := range wm.localHistograms {
-			finalMetrics = append(finalMetrics, h.Flush(s.interval, s.HistogramPercentiles, s.HistogramAggregates, false)...)
+			finalMetrics = append(finalMetrics, h.Flush(interval, s.HistogramPercentiles, s.HistogramAggregates, false)...)
 		}
 		for _, s := range wm.localSets {
 			finalMetrics = append(finalMetrics, s.Flush()...)
 		}
 		for _, t := range wm.localTimers {
-			finalMetrics = append(finalMetrics, t.Flush(s.interval, s.HistogramPercentiles, s.HistogramAggregates, false)...)
+			finalMetrics = append(finalMetrics, t.Flush(interval, s.HistogramPercentiles, s.HistogramAggregates, false)...)
 		}
 
 		for _, status := range wm.localStatusChecks {
@@ -261,7 +493,7 @@ func (s *Server) generateInterMetrics(ctx context.Context, percentiles []float64
 			// global counters have no local parts, so if we're a local veneur,
 			// there's nothing to flush
 			for _, gc := range wm.globalCounters {
-				finalMetrics = append(finalMetrics, gc.Flush(s.interval)...)
+				finalMetrics = append(finalMetrics, gc.Flush(interval)...)
 			}
 
 			// and global gauges
@@ -270,10 +502,18 @@ func (s *Server) generateInterMetrics(ctx context.Context, percentiles []float64
 			}
 
 			for _, h := range wm.globalHistograms {
-				finalMetrics = append(finalMetrics, h.Flush(s.interval, s.HistogramPercentiles, s.HistogramAggregates, true)...)
+				finalMetrics = append(finalMetrics, h.Flush(interval, s.HistogramPercentiles, s.HistogramAggregates, true)...)
 			}
 			for _, h := range wm.globalTimers {
-				finalMetrics = append(finalMetrics, h.Flush(s.interval, s.HistogramPercentiles, s.HistogramAggregates, true)...)
+				finalMetrics = append(finalMetrics, h.Flush(interval, s.HistogramPercentiles, s.HistogramAggregates, true)...)
+			}
+		}
+
+		// metrics bucketed into an earlier interval are stamped with
+		// that interval's time, not the time of this flush:
+		if wm.timestamp != 0 {
+			for i := first; i < len(finalMetrics); i++ {
+				finalMetrics[i].Timestamp = wm.timestamp
 			}
 		}
 	}
@@ -281,6 +521,51 @@ func (s *Server) generateInterMetrics(ctx context.Context, percentiles []float64
 	return finalMetrics
 }
 
+// mergeOverflow moves the overflow series of the cardinality limit out
+// of the workers' metrics, and returns them merged into one
+// WorkerMetrics per interval.
+func (s *Server) mergeOverflow(wms []WorkerMetrics) []WorkerMetrics {
+	if s.cardinalityLimiter == nil || s.cardinalityLimiter.drop {
+		return nil
+	}
+	byTimestamp := map[int64]WorkerMetrics{}
+	var merged []WorkerMetrics
+	for _, wm := range wms {
+		overflow, ok := byTimestamp[wm.timestamp]
+		if !ok {
+			overflow = NewWorkerMetrics()
+			overflow.timestamp = wm.timestamp
+			byTimestamp[wm.timestamp] = overflow
+			merged = append(merged, overflow)
+		}
+		overflow.moveOverflow(wm)
+	}
+	return merged
+}
+
+// reportCardinalityLimits reports the metrics that exceeded the
+// cardinality limit in the interval that was just flushed, and starts
+// counting series anew.
+func (s *Server) reportCardinalityLimits() {
+	if s.cardinalityLimiter == nil {
+		return
+	}
+	action := cardinalityActionOverflow
+	if s.cardinalityLimiter.drop {
+		action = cardinalityActionDrop
+	}
+	for _, m := range s.cardinalityLimiter.reset() {
+		s.Statsd.Count("worker.cardinality_limited_total", m.samples,
+			[]string{"metric_name:" + m.name, "action:" + action}, 1.0)
+		log.WithFields(logrus.Fields{
+			"metric":  m.name,
+			"samples": m.samples,
+			"limit":   s.cardinalityLimiter.limit,
+			"action":  action,
+		}).Warn("Metric exceeded the cardinality limit")
+	}
+}
+
 const flushTotalMetric = "worker.metrics_flushed_total"
 
 // reportMetricsFlushCounts reports the counts of
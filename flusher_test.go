@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/stripe/veneur/routing"
 	"github.com/stripe/veneur/samplers"
 	"github.com/stripe/veneur/ssf"
 	"github.com/stripe/veneur/trace"
@@ -178,3 +179,95 @@ func TestGlobalAcceptsHistogramsOverUDP(t *testing.T) {
 		t.Fatal("timed out waiting for global veneur flush")
 	}
 }
+
+func TestFlushTimestampedBuckets(t *testing.T) {
+	server := setupVeneurServer(t, localConfig(), nil, nil, nil, nil)
+	defer server.Shutdown()
+
+	w := NewWorker(1, nil, nullLogger(), nil)
+	w.interval = server.interval
+	w.lateness = time.Minute
+	then := time.Now().Add(-3 * server.interval)
+	w.ProcessMetric(&samplers.UDPMetric{
+		MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "counter"},
+		Value:      1.0,
+		SampleRate: 1.0,
+		Timestamp:  then.Unix(),
+	})
+	w.ProcessMetric(&samplers.UDPMetric{
+		MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "gauge"},
+		Value:      1.0,
+		SampleRate: 1.0,
+	})
+
+	buckets := w.FlushBuckets(time.Now().Add(2*time.Minute), false)
+	require.Len(t, buckets, 1)
+	wms := append([]WorkerMetrics{w.Flush()}, buckets...)
+	metrics := server.generateInterMetrics(context.Background(), server.interval, nil, server.HistogramAggregates, wms, metricsSummary{})
+	require.Len(t, metrics, 2)
+	for _, m := range metrics {
+		switch m.Type {
+		case samplers.CounterMetric:
+			// timestamps only have a resolution of seconds:
+			start := time.Unix(then.Unix(), 0).Truncate(server.interval)
+			assert.Equal(t, start.Add(server.interval).Unix(), m.Timestamp)
+		case samplers.GaugeMetric:
+			assert.InDelta(t, time.Now().Unix(), m.Timestamp, 2)
+		}
+	}
+}
+
+func TestFinalFlushFlushesBuckets(t *testing.T) {
+	config := localConfig()
+	config.TimestampLateness = "1h"
+	ch := make(chan []samplers.InterMetric, 20)
+	sink, _ := NewChannelMetricSink(ch)
+	server := setupVeneurServer(t, config, nil, sink, nil, nil)
+	server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+		MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "counter"},
+		Value:      1.0,
+		SampleRate: 1.0,
+		Timestamp:  time.Now().Add(-3 * server.interval).Unix(),
+	})
+	server.Shutdown()
+
+	select {
+	case metrics := <-ch:
+		require.Len(t, metrics, 1)
+		assert.Equal(t, "a.b.c", metrics[0].Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the final flush didn't flush the bucket")
+	}
+}
+
+func TestFlushRoutesMetrics(t *testing.T) {
+	ch := make(chan []samplers.InterMetric, 20)
+	sink, _ := NewChannelMetricSink(ch)
+	server := setupVeneurServer(t, localConfig(), nil, sink, nil, nil)
+	defer server.Shutdown()
+
+	var err error
+	server.metricRouter, err = routing.New([]routing.Rule{
+		{MatchNamePrefix: "billing.", ExcludeSinks: []string{"kafka"}},
+	}, []string{sink.Name(), "kafka"})
+	require.NoError(t, err)
+
+	for _, m := range []samplers.UDPMetric{
+		samplers.NewUDPMetric("billing.charges", "gauge", 1.0, nil),
+		samplers.NewUDPMetric("billing.refunds", "gauge", 1.0, []string{"veneursinkonly:kafka"}),
+		samplers.NewUDPMetric("api.requests", "gauge", 1.0, nil),
+	} {
+		server.Workers[0].ProcessMetric(&m)
+	}
+	server.Flush(context.Background())
+
+	routes := map[string]samplers.RouteInformation{}
+	for _, m := range <-ch {
+		routes[m.Name] = m.Sinks
+	}
+	assert.Equal(t, map[string]samplers.RouteInformation{
+		"billing.charges": {sink.Name(): {}},
+		"billing.refunds": {"kafka": {}},
+		"api.requests":    nil,
+	}, routes)
+}
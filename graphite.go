@@ -0,0 +1,118 @@
+package veneur
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/stripe/veneur/graphite"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+// HandleGraphiteLine parses a line of Graphite's plaintext protocol and
+// sends the resulting gauge to the appropriate worker.
+func (s *Server) HandleGraphiteLine(line []byte) error {
+	if len(line) == 0 {
+		return nil
+	}
+	metric, err := s.graphiteParser.ParseLine(line)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+			"line":          string(line),
+		}).Warn("Could not parse graphite line")
+		metrics.ReportOne(s.TraceClient, ssf.Count("packet.error_total", 1, map[string]string{"packet_type": "graphite", "reason": "parse"}))
+		return err
+	}
+	s.ingestUDPMetric(metric)
+	return nil
+}
+
+// ReadGraphiteSocket reads packets of newline-separated Graphite
+// plaintext lines off a packet connection.
+func (s *Server) ReadGraphiteSocket(serverConn net.PacketConn, packetPool *sync.Pool) {
+	for {
+		buf := packetPool.Get().([]byte)
+		n, _, err := serverConn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.shutdown:
+				log.WithError(err).Info("Ignoring ReadFrom error while shutting down")
+				return
+			default:
+				log.WithError(err).Error("Error reading from UDP graphite socket")
+				continue
+			}
+		}
+		splitPacket := samplers.NewSplitBytes(buf[:n], '\n')
+		for splitPacket.Next() {
+			s.HandleGraphiteLine(splitPacket.Chunk())
+		}
+		packetPool.Put(buf)
+	}
+}
+
+// handleGraphiteConn reads Graphite data points off a TCP connection,
+// in either the plaintext or the pickle protocol. Unlike statsd over
+// TCP, lines that don't parse are skipped rather than closing the
+// connection, the same as carbon does.
+func (s *Server) handleGraphiteConn(conn net.Conn, pickle bool) {
+	defer func() {
+		ConsumePanic(s.Sentry, s.TraceClient, s.Hostname, recover())
+	}()
+	defer conn.Close()
+	log.WithField("peer", conn.RemoteAddr()).Debug("Starting graphite connection")
+
+	timeout := defaultTCPReadTimeout
+	if s.tcpReadTimeout != 0 {
+		timeout = s.tcpReadTimeout
+	}
+	r := bufio.NewReader(conn)
+
+	if pickle {
+		for {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			payload, err := graphite.ReadPickle(r)
+			if err != nil {
+				// usually io.EOF; anything else means we can't find the
+				// next frame, so there's no point in continuing.
+				log.WithFields(logrus.Fields{
+					logrus.ErrorKey: err,
+					"peer":          conn.RemoteAddr(),
+				}).Debug("Closing graphite pickle connection")
+				return
+			}
+			points, err := s.graphiteParser.ParsePickle(payload)
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					logrus.ErrorKey: err,
+					"peer":          conn.RemoteAddr(),
+				}).Warn("Could not parse graphite pickle")
+				metrics.ReportOne(s.TraceClient, ssf.Count("packet.error_total", 1, map[string]string{"packet_type": "graphite_pickle", "reason": "parse"}))
+			}
+			for _, metric := range points {
+				s.ingestUDPMetric(metric)
+			}
+		}
+	}
+
+	buf := bufio.NewScanner(r)
+	scanWithDeadline := func() bool {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		return buf.Scan()
+	}
+	for scanWithDeadline() {
+		s.HandleGraphiteLine(buf.Bytes())
+	}
+	if buf.Err() != nil {
+		log.WithFields(logrus.Fields{
+			logrus.ErrorKey: buf.Err(),
+			"peer":          conn.RemoteAddr(),
+		}).Info("Error reading from graphite client")
+	}
+}
@@ -0,0 +1,83 @@
+// Package graphite parses the plaintext and pickle protocols that
+// Graphite's carbon daemons accept, turning each data point into a
+// veneur gauge.
+package graphite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// Parser converts Graphite data points into gauges, using a set of
+// templates to extract tags from their paths.
+type Parser struct {
+	templates templates
+}
+
+// NewParser creates a Parser that applies the given templates. See the
+// template type for their syntax.
+func NewParser(templateSpecs []string) (*Parser, error) {
+	ts, err := parseTemplates(templateSpecs)
+	if err != nil {
+		return nil, err
+	}
+	return &Parser{templates: ts}, nil
+}
+
+// ParseLine parses a line of the plaintext protocol, which looks like
+// "path value [timestamp]". Paths may carry Graphite tags, as in
+// "path;tag1=value1;tag2=value2"; those are added to the tags that the
+// templates extract.
+func (p *Parser) ParseLine(line []byte) (samplers.UDPMetric, error) {
+	fields := bytes.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return samplers.UDPMetric{}, fmt.Errorf("invalid graphite line %q: expected \"path value [timestamp]\"", line)
+	}
+	value, err := strconv.ParseFloat(string(fields[1]), 64)
+	if err != nil {
+		return samplers.UDPMetric{}, fmt.Errorf("invalid graphite value %q: %v", fields[1], err)
+	}
+	var timestamp float64
+	if len(fields) == 3 {
+		timestamp, err = strconv.ParseFloat(string(fields[2]), 64)
+		if err != nil {
+			return samplers.UDPMetric{}, fmt.Errorf("invalid graphite timestamp %q: %v", fields[2], err)
+		}
+	}
+	return p.metric(string(fields[0]), value, timestamp)
+}
+
+// metric builds the gauge for a single data point. Timestamps that
+// aren't positive (carbon clients conventionally send -1) mean "now".
+func (p *Parser) metric(path string, value, timestamp float64) (samplers.UDPMetric, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return samplers.UDPMetric{}, fmt.Errorf("invalid graphite value %v for %q", value, path)
+	}
+	var graphiteTags []string
+	if semi := strings.IndexByte(path, ';'); semi >= 0 {
+		for _, tag := range strings.Split(path[semi+1:], ";") {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return samplers.UDPMetric{}, fmt.Errorf("invalid graphite tag %q in %q", tag, path)
+			}
+			graphiteTags = append(graphiteTags, kv[0]+":"+kv[1])
+		}
+		path = path[:semi]
+	}
+	if path == "" {
+		return samplers.UDPMetric{}, errors.New("graphite path is empty")
+	}
+
+	name, tags := p.templates.apply(path)
+	m := samplers.NewUDPMetric(name, "gauge", value, append(tags, graphiteTags...))
+	if timestamp > 0 {
+		m.Timestamp = int64(timestamp)
+	}
+	return m, nil
+}
@@ -0,0 +1,151 @@
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	p, err := NewParser(nil)
+	require.NoError(t, err)
+
+	m, err := p.ParseLine([]byte("servers.web01.cpu 1.5 1700000000"))
+	require.NoError(t, err)
+	assert.Equal(t, "servers.web01.cpu", m.Name)
+	assert.Equal(t, "gauge", m.Type)
+	assert.Equal(t, 1.5, m.Value)
+	assert.Equal(t, int64(1700000000), m.Timestamp)
+	assert.Empty(t, m.Tags)
+
+	m, err = p.ParseLine([]byte("servers.web01.cpu;env=prod;dc=east 2 -1"))
+	require.NoError(t, err)
+	assert.Equal(t, "servers.web01.cpu", m.Name)
+	assert.Equal(t, []string{"dc:east", "env:prod"}, m.Tags)
+	assert.Equal(t, int64(0), m.Timestamp)
+
+	m, err = p.ParseLine([]byte("no.timestamp 3"))
+	require.NoError(t, err)
+	assert.Equal(t, float64(3), m.Value)
+
+	for _, line := range []string{
+		"",
+		"just.a.path",
+		"a.path notanumber 1700000000",
+		"a.path 1 notatimestamp",
+		"a.path nan 1700000000",
+		"a.path;broken 1 1700000000",
+		"a.path 1 2 3",
+	} {
+		_, err := p.ParseLine([]byte(line))
+		assert.Error(t, err, "%q should not parse", line)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	p, err := NewParser([]string{
+		"servers.* .host.measurement* env=prod,team=web",
+		"servers.*.disk .host..device.measurement",
+		"stats.counters.*.* ..service.measurement*",
+		"region.measurement.measurement",
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		path string
+		name string
+		tags []string
+	}{
+		{"servers.web01.cpu.user", "cpu.user", []string{"env:prod", "host:web01", "team:web"}},
+		{"servers.web01.disk.sda.used", "used", []string{"device:sda", "host:web01"}},
+		{"stats.counters.api.requests.total", "requests.total", []string{"service:api"}},
+		{"us-east.http.requests", "http.requests", []string{"region:us-east"}},
+		// shorter than the template:
+		{"servers.web01", "servers.web01", []string{"env:prod", "host:web01", "team:web"}},
+	}
+	for _, test := range tests {
+		m, err := p.ParseLine([]byte(test.path + " 1 1700000000"))
+		require.NoError(t, err)
+		assert.Equal(t, test.name, m.Name, test.path)
+		assert.Equal(t, test.tags, m.Tags, test.path)
+	}
+
+	for _, spec := range []string{
+		"a b c d",
+		"measurement*.host",
+		"[ measurement",
+		"filter measurement notatag",
+		"measurement =nokey",
+	} {
+		_, err := NewParser([]string{spec})
+		assert.Error(t, err, "%q should not parse", spec)
+	}
+}
+
+func TestParsePickle(t *testing.T) {
+	p, err := NewParser([]string{"servers.* .host.measurement*"})
+	require.NoError(t, err)
+
+	fixtures := map[string]string{
+		// generated with pickle.dumps(data, protocol=n) for
+		// data = [('servers.web01.cpu', (1700000000, 1.5)),
+		//         ('servers.web01.mem;env=prod', (1700000000.0, 42)),
+		//         ('big', (1700000000, 2**70))]
+		"protocol 0": "286c70300a2856736572766572732e77656230312e6370750a70310a2849313730303030303030300a46312e350a7470320a7470330a612856736572766572732e77656230312e6d656d3b656e763d70726f640a70340a2846313730303030303030302e300a4934320a7470350a7470360a6128566269670a70370a2849313730303030303030300a4c313138303539313632303731373431313330333432344c0a7470380a7470390a612e",
+		"protocol 2": "80025d7100285811000000736572766572732e77656230312e63707571014a00f15365473ff8000000000000867102867103581a000000736572766572732e77656230312e6d656d3b656e763d70726f6471044741d954fc400000004b2a867105867106580300000062696771074a00f153658a09000000000000000040867108867109652e",
+		"protocol 4": "80049571000000000000005d94288c11736572766572732e77656230312e637075944a00f15365473ff8000000000000869486948c1a736572766572732e77656230312e6d656d3b656e763d70726f64944741d954fc400000004b2a869486948c03626967944a00f153658a0900000000000000004086948694652e",
+	}
+	for name, fixture := range fixtures {
+		payload, err := hex.DecodeString(fixture)
+		require.NoError(t, err)
+		metrics, err := p.ParsePickle(payload)
+		require.NoError(t, err, name)
+		require.Len(t, metrics, 3, name)
+
+		assert.Equal(t, "cpu", metrics[0].Name, name)
+		assert.Equal(t, []string{"host:web01"}, metrics[0].Tags, name)
+		assert.Equal(t, 1.5, metrics[0].Value, name)
+		assert.Equal(t, int64(1700000000), metrics[0].Timestamp, name)
+
+		assert.Equal(t, "mem", metrics[1].Name, name)
+		assert.Equal(t, []string{"env:prod", "host:web01"}, metrics[1].Tags, name)
+		assert.Equal(t, float64(42), metrics[1].Value, name)
+
+		assert.Equal(t, "big", metrics[2].Name, name)
+		assert.Equal(t, float64(1<<70), metrics[2].Value, name)
+	}
+
+	// Python 2 clients pickle paths as quoted strings:
+	metrics, err := p.ParsePickle([]byte("(lp0\n(S'a.b'\np1\n(I1700000000\nF2.5\ntp2\ntp3\na(S'bad'\np4\nI1\ntp5\na."))
+	require.Error(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "a.b", metrics[0].Name)
+	assert.Equal(t, 2.5, metrics[0].Value)
+
+	for _, payload := range []string{"", "(lp0\n", "\x80\x02c__builtin__\neval\n.", "I1\n."} {
+		_, err := p.ParsePickle([]byte(payload))
+		assert.Error(t, err, "%q should not parse", payload)
+	}
+}
+
+func TestReadPickle(t *testing.T) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(3))
+	buf.WriteString("abcdef")
+	payload, err := ReadPickle(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("abc"), payload)
+
+	// truncated:
+	_, err = ReadPickle(&buf)
+	assert.Error(t, err)
+
+	buf.Reset()
+	binary.Write(&buf, binary.BigEndian, uint32(MaxPickleSize+1))
+	_, err = ReadPickle(&buf)
+	assert.Error(t, err)
+}
@@ -0,0 +1,535 @@
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// MaxPickleSize is the largest pickle payload that ReadPickle accepts,
+// the same limit that carbon enforces.
+const MaxPickleSize = 1 << 20
+
+// ReadPickle reads a single frame of the pickle protocol: a 4-byte,
+// big-endian length, followed by a pickled list of
+// (path, (timestamp, value)) tuples.
+func ReadPickle(r io.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length > MaxPickleSize {
+		return nil, fmt.Errorf("pickle payload of %d bytes exceeds the limit of %d", length, MaxPickleSize)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// ParsePickle parses the payload of a pickle frame. It returns the
+// data points that it could convert and an error describing the first
+// one that it couldn't, if any.
+func (p *Parser) ParsePickle(payload []byte) ([]samplers.UDPMetric, error) {
+	obj, err := unpickle(payload)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := obj.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("pickle payload is a %T, not a list", obj)
+	}
+
+	metrics := make([]samplers.UDPMetric, 0, len(list))
+	var firstErr error
+	for _, elt := range list {
+		m, err := p.pickledMetric(elt)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, firstErr
+}
+
+func (p *Parser) pickledMetric(elt interface{}) (samplers.UDPMetric, error) {
+	outer, ok := elt.([]interface{})
+	if !ok || len(outer) != 2 {
+		return samplers.UDPMetric{}, fmt.Errorf("pickled data point %v is not a (path, (timestamp, value)) tuple", elt)
+	}
+	path, ok := outer[0].(string)
+	if !ok {
+		return samplers.UDPMetric{}, fmt.Errorf("pickled path %v is not a string", outer[0])
+	}
+	inner, ok := outer[1].([]interface{})
+	if !ok || len(inner) != 2 {
+		return samplers.UDPMetric{}, fmt.Errorf("pickled data point for %q is not a (timestamp, value) tuple", path)
+	}
+	timestamp, err := pickledNumber(inner[0])
+	if err != nil {
+		return samplers.UDPMetric{}, fmt.Errorf("invalid pickled timestamp for %q: %v", path, err)
+	}
+	value, err := pickledNumber(inner[1])
+	if err != nil {
+		return samplers.UDPMetric{}, fmt.Errorf("invalid pickled value for %q: %v", path, err)
+	}
+	return p.metric(path, value, timestamp)
+}
+
+func pickledNumber(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(n).Float64()
+		return f, nil
+	case string:
+		// some clients pickle their values as strings:
+		return strconv.ParseFloat(n, 64)
+	}
+	return 0, fmt.Errorf("%v is a %T, not a number", v, v)
+}
+
+// Opcodes of the pickle protocol, up to protocol 4. Only the ones that
+// are needed to represent lists, tuples, strings and numbers are
+// supported.
+const (
+	opMark            = '('
+	opStop            = '.'
+	opPop             = '0'
+	opPopMark         = '1'
+	opDup             = '2'
+	opFloat           = 'F'
+	opInt             = 'I'
+	opBinInt          = 'J'
+	opBinInt1         = 'K'
+	opLong            = 'L'
+	opBinInt2         = 'M'
+	opNone            = 'N'
+	opString          = 'S'
+	opBinString       = 'T'
+	opShortBinString  = 'U'
+	opUnicode         = 'V'
+	opBinUnicode      = 'X'
+	opAppend          = 'a'
+	opGet             = 'g'
+	opBinGet          = 'h'
+	opLongBinGet      = 'j'
+	opList            = 'l'
+	opEmptyList       = ']'
+	opAppends         = 'e'
+	opPut             = 'p'
+	opBinPut          = 'q'
+	opLongBinPut      = 'r'
+	opTuple           = 't'
+	opEmptyTuple      = ')'
+	opBinFloat        = 'G'
+	opProto           = '\x80'
+	opTuple1          = '\x85'
+	opTuple2          = '\x86'
+	opTuple3          = '\x87'
+	opNewTrue         = '\x88'
+	opNewFalse        = '\x89'
+	opLong1           = '\x8a'
+	opLong4           = '\x8b'
+	opBinBytes        = 'B'
+	opShortBinBytes   = 'C'
+	opShortBinUnicode = '\x8c'
+	opBinUnicode8     = '\x8d'
+	opMemoize         = '\x94'
+	opFrame           = '\x95'
+)
+
+// mark is the marker that opMark pushes onto the stack.
+type mark struct{}
+
+var errPickleTruncated = errors.New("pickle payload is truncated")
+
+// unpickle decodes a pickle into Go values: lists and tuples become
+// []interface{}, strings and bytes become strings, and numbers become
+// int64, *big.Int or float64. It deliberately doesn't support any
+// opcode that could instantiate arbitrary objects.
+func unpickle(data []byte) (interface{}, error) {
+	r := bytes.NewReader(data)
+	var stack []interface{}
+	memo := map[int64]interface{}{}
+
+	pop := func() (interface{}, error) {
+		if len(stack) == 0 {
+			return nil, errors.New("pickle stack underflow")
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v, nil
+	}
+	popMark := func() ([]interface{}, error) {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if _, ok := stack[i].(mark); ok {
+				items := append([]interface{}{}, stack[i+1:]...)
+				stack = stack[:i]
+				return items, nil
+			}
+		}
+		return nil, errors.New("pickle mark not found")
+	}
+	read := func(n int64) ([]byte, error) {
+		if n < 0 || n > int64(r.Len()) {
+			return nil, errPickleTruncated
+		}
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+	readLine := func() (string, error) {
+		var line []byte
+		for {
+			c, err := r.ReadByte()
+			if err != nil {
+				return "", errPickleTruncated
+			}
+			if c == '\n' {
+				return string(line), nil
+			}
+			line = append(line, c)
+		}
+	}
+	readUint := func(n int) (uint64, error) {
+		b, err := read(int64(n))
+		if err != nil {
+			return 0, err
+		}
+		var v uint64
+		for i := n - 1; i >= 0; i-- {
+			v = v<<8 | uint64(b[i])
+		}
+		return v, nil
+	}
+	appendTo := func(list interface{}, items ...interface{}) error {
+		l, ok := list.([]interface{})
+		if !ok {
+			return fmt.Errorf("can't append to a pickled %T", list)
+		}
+		stack[len(stack)-1] = append(l, items...)
+		return nil
+	}
+
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return nil, errPickleTruncated
+		}
+		switch op {
+		case opStop:
+			return pop()
+		case opProto:
+			if _, err := r.ReadByte(); err != nil {
+				return nil, errPickleTruncated
+			}
+		case opFrame:
+			if _, err := readUint(8); err != nil {
+				return nil, err
+			}
+		case opMark:
+			stack = append(stack, mark{})
+		case opPop:
+			if _, err := pop(); err != nil {
+				return nil, err
+			}
+		case opPopMark:
+			if _, err := popMark(); err != nil {
+				return nil, err
+			}
+		case opDup:
+			if len(stack) == 0 {
+				return nil, errors.New("pickle stack underflow")
+			}
+			stack = append(stack, stack[len(stack)-1])
+
+		case opNone:
+			stack = append(stack, nil)
+		case opNewTrue:
+			stack = append(stack, true)
+		case opNewFalse:
+			stack = append(stack, false)
+		case opInt:
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			switch line {
+			case "00":
+				stack = append(stack, false)
+			case "01":
+				stack = append(stack, true)
+			default:
+				n, err := strconv.ParseInt(line, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid pickled int %q", line)
+				}
+				stack = append(stack, n)
+			}
+		case opLong:
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			n, ok := new(big.Int).SetString(strings.TrimSuffix(line, "L"), 10)
+			if !ok {
+				return nil, fmt.Errorf("invalid pickled long %q", line)
+			}
+			stack = append(stack, normalizeInt(n))
+		case opBinInt:
+			v, err := readUint(4)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, int64(int32(v)))
+		case opBinInt1:
+			v, err := readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, int64(v))
+		case opBinInt2:
+			v, err := readUint(2)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, int64(v))
+		case opLong1, opLong4:
+			size := 1
+			if op == opLong4 {
+				size = 4
+			}
+			n, err := readUint(size)
+			if err != nil {
+				return nil, err
+			}
+			b, err := read(int64(n))
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, decodeLong(b))
+		case opFloat:
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			f, err := strconv.ParseFloat(line, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pickled float %q", line)
+			}
+			stack = append(stack, f)
+		case opBinFloat:
+			b, err := read(8)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(b)))
+
+		case opString:
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			s, err := strconv.Unquote(pythonToGoQuotes(line))
+			if err != nil {
+				return nil, fmt.Errorf("invalid pickled string %q", line)
+			}
+			stack = append(stack, s)
+		case opUnicode:
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, line)
+		case opBinString, opBinUnicode, opBinBytes:
+			n, err := readUint(4)
+			if err != nil {
+				return nil, err
+			}
+			b, err := read(int64(n))
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, string(b))
+		case opShortBinString, opShortBinUnicode, opShortBinBytes:
+			n, err := readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			b, err := read(int64(n))
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, string(b))
+		case opBinUnicode8:
+			n, err := readUint(8)
+			if err != nil {
+				return nil, err
+			}
+			b, err := read(int64(n))
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, string(b))
+
+		case opEmptyList, opEmptyTuple:
+			stack = append(stack, []interface{}{})
+		case opList, opTuple:
+			items, err := popMark()
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, items)
+		case opTuple1, opTuple2, opTuple3:
+			n := int(op-opTuple1) + 1
+			if len(stack) < n {
+				return nil, errors.New("pickle stack underflow")
+			}
+			items := append([]interface{}{}, stack[len(stack)-n:]...)
+			stack = append(stack[:len(stack)-n], items)
+		case opAppend:
+			v, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			if len(stack) == 0 {
+				return nil, errors.New("pickle stack underflow")
+			}
+			if err := appendTo(stack[len(stack)-1], v); err != nil {
+				return nil, err
+			}
+		case opAppends:
+			items, err := popMark()
+			if err != nil {
+				return nil, err
+			}
+			if len(stack) == 0 {
+				return nil, errors.New("pickle stack underflow")
+			}
+			if err := appendTo(stack[len(stack)-1], items...); err != nil {
+				return nil, err
+			}
+
+		case opPut:
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			idx, err := strconv.ParseInt(line, 10, 64)
+			if err != nil || len(stack) == 0 {
+				return nil, fmt.Errorf("invalid pickle memo index %q", line)
+			}
+			memo[idx] = stack[len(stack)-1]
+		case opBinPut, opLongBinPut:
+			size := 1
+			if op == opLongBinPut {
+				size = 4
+			}
+			idx, err := readUint(size)
+			if err != nil {
+				return nil, err
+			}
+			if len(stack) == 0 {
+				return nil, errors.New("pickle stack underflow")
+			}
+			memo[int64(idx)] = stack[len(stack)-1]
+		case opMemoize:
+			if len(stack) == 0 {
+				return nil, errors.New("pickle stack underflow")
+			}
+			memo[int64(len(memo))] = stack[len(stack)-1]
+		case opGet:
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			idx, err := strconv.ParseInt(line, 10, 64)
+			v, ok := memo[idx]
+			if err != nil || !ok {
+				return nil, fmt.Errorf("invalid pickle memo index %q", line)
+			}
+			stack = append(stack, v)
+		case opBinGet, opLongBinGet:
+			size := 1
+			if op == opLongBinGet {
+				size = 4
+			}
+			idx, err := readUint(size)
+			if err != nil {
+				return nil, err
+			}
+			v, ok := memo[int64(idx)]
+			if !ok {
+				return nil, fmt.Errorf("invalid pickle memo index %d", idx)
+			}
+			stack = append(stack, v)
+
+		default:
+			return nil, fmt.Errorf("unsupported pickle opcode %#x", op)
+		}
+	}
+}
+
+// decodeLong decodes the little-endian two's complement integers of
+// the LONG1 and LONG4 opcodes.
+func decodeLong(b []byte) interface{} {
+	if len(b) == 0 {
+		return int64(0)
+	}
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	n := new(big.Int).SetBytes(be)
+	if b[len(b)-1]&0x80 != 0 {
+		n.Sub(n, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+	return normalizeInt(n)
+}
+
+func normalizeInt(n *big.Int) interface{} {
+	if n.IsInt64() {
+		return n.Int64()
+	}
+	return n
+}
+
+// pythonToGoQuotes turns the repr of a Python 2 string, which may be
+// single-quoted, into something strconv.Unquote understands.
+func pythonToGoQuotes(s string) string {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		inner := s[1 : len(s)-1]
+		var buf bytes.Buffer
+		buf.WriteByte('"')
+		for i := 0; i < len(inner); i++ {
+			switch c := inner[i]; {
+			case c == '\\' && i+1 < len(inner) && inner[i+1] == '\'':
+				buf.WriteByte('\'')
+				i++
+			case c == '"':
+				buf.WriteString(`\"`)
+			default:
+				buf.WriteByte(c)
+			}
+		}
+		buf.WriteByte('"')
+		return buf.String()
+	}
+	return s
+}
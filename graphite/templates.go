@@ -0,0 +1,152 @@
+package graphite
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// A template describes how the dot-separated parts of a Graphite path
+// map onto a metric name and tags.
+//
+// Templates are written as "[filter] template [tags]", for example
+// "servers.* .host.measurement* env=prod":
+//
+//   - The optional filter is a dot-separated pattern (where each part
+//     may contain shell-style wildcards) that a path must start with
+//     for the template to apply.
+//   - The template has one entry per part of the path. "measurement"
+//     makes the part a part of the metric name, "measurement*" does
+//     the same for it and all the parts that follow it, an empty entry
+//     drops the part, and anything else makes the part the value of
+//     the tag by that name.
+//   - The optional tags are comma-separated key=value pairs that are
+//     added to every metric the template applies to.
+//
+// Paths that no template applies to are used as the metric name
+// verbatim.
+type template struct {
+	filter []string
+	parts  []string
+	tags   []string
+}
+
+// parseTemplate parses a template specification.
+func parseTemplate(spec string) (template, error) {
+	fields := strings.Fields(spec)
+	tmpl := template{}
+	switch {
+	case len(fields) == 1:
+		tmpl.parts = strings.Split(fields[0], ".")
+	case len(fields) == 2 && strings.Contains(fields[1], "="):
+		tmpl.parts = strings.Split(fields[0], ".")
+		tmpl.tags = strings.Split(fields[1], ",")
+	case len(fields) == 2:
+		tmpl.filter = strings.Split(fields[0], ".")
+		tmpl.parts = strings.Split(fields[1], ".")
+	case len(fields) == 3:
+		tmpl.filter = strings.Split(fields[0], ".")
+		tmpl.parts = strings.Split(fields[1], ".")
+		tmpl.tags = strings.Split(fields[2], ",")
+	default:
+		return tmpl, fmt.Errorf("invalid graphite template %q", spec)
+	}
+
+	for _, pattern := range tmpl.filter {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return tmpl, fmt.Errorf("invalid filter in graphite template %q: %v", spec, err)
+		}
+	}
+	for i, part := range tmpl.parts {
+		if part == "measurement*" && i != len(tmpl.parts)-1 {
+			return tmpl, fmt.Errorf("\"measurement*\" must be the last part of graphite template %q", spec)
+		}
+	}
+	for i, tag := range tmpl.tags {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return tmpl, fmt.Errorf("invalid tag %q in graphite template %q", tag, spec)
+		}
+		tmpl.tags[i] = kv[0] + ":" + kv[1]
+	}
+	return tmpl, nil
+}
+
+// matches returns true if the template's filter matches the path.
+func (t template) matches(parts []string) bool {
+	if len(t.filter) > len(parts) {
+		return false
+	}
+	for i, pattern := range t.filter {
+		if ok, _ := path.Match(pattern, parts[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns the metric name and tags that the template extracts
+// from the parts of a path.
+func (t template) apply(parts []string) (string, []string) {
+	var name []string
+	tagValues := map[string][]string{}
+	var tagOrder []string
+	for i, part := range parts {
+		if i >= len(t.parts) {
+			break
+		}
+		switch key := t.parts[i]; key {
+		case "":
+		case "measurement":
+			name = append(name, part)
+		case "measurement*":
+			name = append(name, parts[i:]...)
+		default:
+			if _, ok := tagValues[key]; !ok {
+				tagOrder = append(tagOrder, key)
+			}
+			tagValues[key] = append(tagValues[key], part)
+		}
+	}
+	if len(name) == 0 {
+		name = parts
+	}
+
+	tags := make([]string, 0, len(tagOrder)+len(t.tags))
+	for _, key := range tagOrder {
+		tags = append(tags, key+":"+strings.Join(tagValues[key], "."))
+	}
+	tags = append(tags, t.tags...)
+	return strings.Join(name, "."), tags
+}
+
+// templates is a set of templates, ordered from the most to the least
+// specific filter.
+type templates []template
+
+func parseTemplates(specs []string) (templates, error) {
+	ret := make(templates, 0, len(specs))
+	for _, spec := range specs {
+		tmpl, err := parseTemplate(spec)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, tmpl)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return len(ret[i].filter) > len(ret[j].filter)
+	})
+	return ret, nil
+}
+
+// apply applies the most specific template that matches the path.
+func (ts templates) apply(p string) (string, []string) {
+	parts := strings.Split(p, ".")
+	for _, t := range ts {
+		if t.matches(parts) {
+			return t.apply(parts)
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,35 @@
+// +build !linux
+
+package veneur
+
+import (
+	"net"
+	"os"
+
+	flock "github.com/theckman/go-flock"
+)
+
+// hotRestartSupported is true if veneur can hand its listeners to a
+// new process on this platform.
+const hotRestartSupported = false
+
+// lockSocketFile tries to lock the file at path exclusively, without
+// blocking.
+func lockSocketFile(path string) (socketLock, bool, error) {
+	lock := flock.NewFlock(path)
+	locked, err := lock.TryLock()
+	if err != nil || !locked {
+		return nil, locked, err
+	}
+	return lock, true, nil
+}
+
+func adoptLock(file *os.File) socketLock {
+	panic("hot restarts are only supported on Linux")
+}
+
+func (s *Server) takeOverListeners() *net.UnixConn {
+	return nil
+}
+
+func (s *Server) serveHotRestart(handoff *net.UnixConn) {}
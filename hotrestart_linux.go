@@ -0,0 +1,352 @@
+package veneur
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// hotRestartSupported is true if veneur can hand its listeners to a
+// new process on this platform.
+const hotRestartSupported = true
+
+// hotRestartTimeout is how long each side of a hot restart waits for
+// the other one.
+const hotRestartTimeout = time.Minute
+
+// fileLock is an flock(2) lock on the lock file of a unix socket. It
+// can be handed to another process along with the socket.
+type fileLock struct {
+	mtx       sync.Mutex
+	file      *os.File
+	handedOff bool
+}
+
+// lockSocketFile tries to lock the file at path exclusively, without
+// blocking.
+func lockSocketFile(path string) (socketLock, bool, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		file.Close()
+		return nil, false, nil
+	}
+	if err != nil {
+		file.Close()
+		return nil, false, err
+	}
+	return &fileLock{file: file}, true, nil
+}
+
+// adoptLock returns the lock whose lock file was handed over by the
+// previous process. The lock is held already.
+func adoptLock(file *os.File) socketLock {
+	return &fileLock{file: file}
+}
+
+// File returns a duplicate of the lock file's descriptor, which shares
+// the lock.
+func (l *fileLock) File() (*os.File, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.file == nil {
+		return nil, fmt.Errorf("lock is released")
+	}
+	syscall.ForkLock.RLock()
+	fd, err := unix.Dup(int(l.file.Fd()))
+	if err == nil {
+		unix.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), l.file.Name()), nil
+}
+
+func (l *fileLock) handOff() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.handedOff = true
+}
+
+// Unlock releases the lock and closes the lock file. If the lock was
+// handed to another process, it only closes the file, so that the
+// other process keeps holding the lock.
+func (l *fileLock) Unlock() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	var err error
+	if !l.handedOff {
+		err = unix.Flock(int(l.file.Fd()), unix.LOCK_UN)
+	}
+	l.file.Close()
+	l.file = nil
+	return err
+}
+
+// takeOverListeners connects to the hot restart socket of the veneur
+// that this server replaces, and receives its listeners. It returns
+// the connection to the old veneur, or nil if there is no veneur to
+// take over from.
+func (s *Server) takeOverListeners() *net.UnixConn {
+	logger := log.WithField("socket", s.hotRestartSocket)
+	conn, err := net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: s.hotRestartSocket, Net: "unixpacket"})
+	if err != nil {
+		if !isNotListening(err) {
+			logger.WithError(err).Error("Could not connect to the hot restart socket, starting fresh")
+		}
+		return nil
+	}
+	conn.SetReadDeadline(time.Now().Add(hotRestartTimeout))
+
+	received := 0
+	buf := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(4))
+	for {
+		n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			logger.WithError(err).Error("Could not receive the listeners, starting fresh")
+			s.listeners.closeInherited()
+			conn.Close()
+			return nil
+		}
+		key := string(buf[:n])
+		if key == handoffEnd {
+			break
+		}
+		file, err := receivedFile(key, oob[:oobn])
+		if err != nil {
+			logger.WithError(err).Error("Could not receive the listeners, starting fresh")
+			s.listeners.closeInherited()
+			conn.Close()
+			return nil
+		}
+		s.listeners.inherit(key, file)
+		received++
+	}
+	conn.SetReadDeadline(time.Time{})
+	logger.WithField("listeners", received).Info("Took over the listeners of the running veneur")
+	return conn
+}
+
+// receivedFile returns the file descriptor that came with a message.
+func receivedFile(key string, oob []byte) (*os.File, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("no file descriptor for %s", key)
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+		return nil, fmt.Errorf("expected one file descriptor for %s, got %d", key, len(fds))
+	}
+	unix.CloseOnExec(fds[0])
+	return os.NewFile(uintptr(fds[0]), key), nil
+}
+
+// isNotListening returns true if dialing failed because nobody listens
+// on the socket.
+func isNotListening(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	return ok && (sysErr.Err == syscall.ENOENT || sysErr.Err == syscall.ECONNREFUSED)
+}
+
+// serveHotRestart listens on the hot restart socket until the server
+// shuts down, and hands the listeners to the first new veneur that
+// connects. On SIGUSR1, it starts that new veneur itself, by running
+// the current executable again with the same arguments.
+//
+// If this server took over from another veneur over handoff, it first
+// tells the old veneur that it's ready, and waits for it to finish.
+func (s *Server) serveHotRestart(handoff *net.UnixConn) {
+	if handoff != nil {
+		s.completeTakeOver(handoff)
+	}
+
+	key := listenerKey("hot_restart", "unixpacket", s.hotRestartSocket)
+	ln, err := s.listeners.listen(key, func() (net.Listener, error) {
+		// Nobody listens on a socket file that's left over,
+		// or we would have taken over from them:
+		_ = os.Remove(s.hotRestartSocket)
+		return net.ListenUnix("unixpacket", &net.UnixAddr{Name: s.hotRestartSocket, Net: "unixpacket"})
+	})
+	if err != nil {
+		log.WithError(err).WithField("socket", s.hotRestartSocket).Error("Could not listen for hot restarts")
+		return
+	}
+	listener := ln.(*net.UnixListener)
+	log.WithField("socket", s.hotRestartSocket).Info("Listening for hot restarts")
+
+	sigusr1 := make(chan os.Signal, 1)
+	signal.Notify(sigusr1, syscall.SIGUSR1)
+	go func() {
+		defer signal.Stop(sigusr1)
+		for {
+			select {
+			case <-sigusr1:
+				execHotRestart()
+			case <-s.shutdown:
+				listener.Close()
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer func() {
+			ConsumePanic(s.Sentry, s.TraceClient, s.Hostname, recover())
+		}()
+		for {
+			conn, err := listener.AcceptUnix()
+			if err != nil {
+				select {
+				case <-s.shutdown:
+					// occurs when cleanly shutting down the server e.g. in tests; ignore errors
+					log.WithError(err).Info("Ignoring Accept error while shutting down")
+					return
+				default:
+					log.WithError(err).Error("Hot restart accept failed")
+					continue
+				}
+			}
+			if err := s.handOffListeners(conn); err != nil {
+				log.WithError(err).Error("Hot restart failed, continuing to run")
+				conn.Close()
+				continue
+			}
+			return
+		}
+	}()
+}
+
+// completeTakeOver tells the old veneur that this server is listening,
+// and waits for it to shut down. Once it did, this server restores the
+// aggregation state that the old veneur saved.
+func (s *Server) completeTakeOver(conn *net.UnixConn) {
+	defer conn.Close()
+	logger := log.WithField("socket", s.hotRestartSocket)
+
+	if _, err := conn.Write([]byte(handoffReady)); err != nil {
+		logger.WithError(err).Error("Could not tell the old veneur to shut down")
+	} else {
+		conn.SetReadDeadline(time.Now().Add(hotRestartTimeout))
+		buf := make([]byte, len(handoffDone))
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != handoffDone {
+			logger.WithError(err).Error("The old veneur did not shut down cleanly")
+		} else {
+			logger.Info("The old veneur shut down")
+		}
+	}
+
+	if s.stateFile != "" {
+		if err := s.restoreState(time.Now()); err != nil {
+			log.WithError(err).Error("Could not restore aggregation state")
+		}
+	}
+
+	// The HTTP and gRPC listeners are taken into use once the server
+	// serves them, and the hot restart socket right after this;
+	// anything else was left over by a config change:
+	s.listeners.closeInherited(
+		listenerKey("http", "tcp", s.HTTPAddr),
+		listenerKey("grpc", "tcp", s.grpcListenAddress),
+		listenerKey("hot_restart", "unixpacket", s.hotRestartSocket),
+	)
+}
+
+// handOffListeners sends all the listeners to a new veneur over conn,
+// and shuts the server down once the new veneur is ready.
+func (s *Server) handOffListeners(conn *net.UnixConn) error {
+	keys, files, err := s.listeners.files()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	conn.SetDeadline(time.Now().Add(hotRestartTimeout))
+	for i, file := range files {
+		if _, _, err := conn.WriteMsgUnix([]byte(keys[i]), unix.UnixRights(int(file.Fd())), nil); err != nil {
+			return err
+		}
+	}
+	if _, err := conn.Write([]byte(handoffEnd)); err != nil {
+		return err
+	}
+	log.WithField("listeners", len(files)).Info("Handed over the listeners, waiting for the new veneur")
+
+	buf := make([]byte, len(handoffReady))
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	if string(buf[:n]) != handoffReady {
+		return fmt.Errorf("unexpected message %q from the new veneur", buf[:n])
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The new veneur reads from the same sockets now; stop reading
+	// and hand it what we aggregated so far:
+	log.Info("The new veneur is ready, shutting down")
+	s.listeners.detach(conn)
+	s.Shutdown()
+	return nil
+}
+
+// execHotRestart starts a new veneur from the current executable, with
+// the same arguments, to hand the listeners to.
+func execHotRestart() {
+	exe, err := os.Executable()
+	if err != nil {
+		log.WithError(err).Error("Could not find the veneur executable to restart")
+		return
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		log.WithError(err).WithField("executable", exe).Error("Could not start a new veneur")
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"executable": exe,
+		"pid":        cmd.Process.Pid,
+	}).Info("Started a new veneur to hand the listeners to")
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.WithError(err).Error("The new veneur exited")
+		}
+	}()
+}
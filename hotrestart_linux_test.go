@@ -0,0 +1,84 @@
+package veneur
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestHotRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-hot-restart")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ssfSocket := filepath.Join(dir, "ssf.sock")
+
+	config := globalConfig()
+	config.Interval = "10s"
+	config.NumReaders = 2
+	config.SsfListenAddresses = []string{"udp://127.0.0.1:0", fmt.Sprintf("unix://%s", ssfSocket)}
+	config.HotRestartSocket = filepath.Join(dir, "hot-restart.sock")
+	config.AggregationStateFile = filepath.Join(dir, "state")
+
+	old := setupVeneurServer(t, config, nil, nil, nil, nil)
+	old.Workers[0].ProcessMetric(&samplers.UDPMetric{
+		MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "counter"},
+		Value:      5.0,
+		SampleRate: 1.0,
+	})
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(config.HotRestartSocket); err == nil {
+			break
+		}
+		require.True(t, time.Since(start) < 5*time.Second, "the old server listens for hot restarts")
+	}
+
+	ch := make(chan []samplers.InterMetric, 20)
+	sink, _ := NewChannelMetricSink(ch)
+	server := setupVeneurServer(t, config, nil, sink, nil, nil)
+	defer server.Shutdown()
+	select {
+	case <-old.shutdown:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the old server did not shut down")
+	}
+
+	assert.Equal(t, old.StatsdListenAddrs, server.StatsdListenAddrs, "the UDP sockets are handed over")
+	assert.Equal(t, old.SSFListenAddrs, server.SSFListenAddrs)
+	_, err = os.Stat(ssfSocket)
+	assert.NoError(t, err, "the unix socket is left in place")
+	_, locked, err := lockSocketFile(ssfSocket + ".lock")
+	require.NoError(t, err)
+	assert.False(t, locked, "the new server holds the lock")
+
+	conn, err := net.Dial("udp", server.StatsdListenAddrs[0].String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("a.b.c:3|c"))
+	require.NoError(t, err)
+
+	// The new server gets both the packet and the old server's state:
+	total := 0.0
+	for start := time.Now(); total < 8.0; time.Sleep(10 * time.Millisecond) {
+		require.True(t, time.Since(start) < 5*time.Second, "got %v", total)
+		server.Flush(context.Background())
+		select {
+		case metrics := <-ch:
+			for _, m := range metrics {
+				if m.Name == "a.b.c" {
+					total += m.Value
+				}
+			}
+		case <-time.After(time.Second):
+		}
+	}
+	assert.Equal(t, 8.0, total)
+}
@@ -1,6 +1,7 @@
 package veneur
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/pprof"
 	"sort"
@@ -38,7 +39,35 @@ func (s *Server) Handler() http.Handler {
 		w.Write([]byte("ok\n"))
 	})
 
+	mux.HandleFuncC(pat.Post("/config/reload"), func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		if s.configFile == "" {
+			http.Error(w, "configuration reloading is not enabled", http.StatusNotFound)
+			return
+		}
+		result, err := s.reloadConfigFile()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
 	mux.Handle(pat.Post("/import"), handleImport(s))
+	mux.Handle(pat.Post("/write"), handleInfluxWrite(s))
+	mux.Handle(pat.Post("/api/v2/spans"), handleZipkinSpans(s))
+
+	// Sinks that serve their data over HTTP (rather than pushing
+	// it somewhere) get mounted on our mux:
+	type handlerSink interface {
+		http.Handler
+		HandlerPath() string
+	}
+	for _, sink := range s.getMetricSinks() {
+		if hs, ok := sink.(handlerSink); ok && hs.HandlerPath() != "" {
+			mux.Handle(pat.Get(hs.HandlerPath()), hs)
+		}
+	}
 
 	mux.Handle(pat.Get("/debug/pprof/cmdline"), http.HandlerFunc(pprof.Cmdline))
 	mux.Handle(pat.Get("/debug/pprof/profile"), http.HandlerFunc(pprof.Profile))
@@ -19,9 +19,13 @@ import (
 
 	"github.com/stripe/veneur/trace"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/zipkin/zipkinpb"
 )
 
 func TestSortableJSONMetrics(t *testing.T) {
@@ -256,6 +260,125 @@ func TestServerImportEmptyListError(t *testing.T) {
 	testServerImportHelper(t, data)
 }
 
+func TestServerInfluxWrite(t *testing.T) {
+	config := localConfig()
+	config.NumWorkers = 1
+	ch := make(chan []samplers.InterMetric, 20)
+	sink, _ := NewChannelMetricSink(ch)
+	s := setupVeneurServer(t, config, nil, sink, nil, nil)
+	defer s.Shutdown()
+	handler := handleInfluxWrite(s)
+
+	var data bytes.Buffer
+	gz := gzip.NewWriter(&data)
+	io.WriteString(gz, "cpu,host=web01 usage=12.5,note=\"idle\" 1556813561\nmem,host=web01 used=3i 1556813561\n")
+	gz.Close()
+	r := httptest.NewRequest(http.MethodPost, "/write?db=telegraf&precision=s", &data)
+	r.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	r = httptest.NewRequest(http.MethodPost, "/write", bytes.NewBufferString("disk free=1\nnot line protocol\n"))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "partial write")
+
+	r = httptest.NewRequest(http.MethodPost, "/write?precision=fortnights", bytes.NewBufferString("disk free=1\n"))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	keepFlushing(ctx, s)
+	values := map[string]float64{}
+	for len(values) < 3 {
+		select {
+		case metrics := <-ch:
+			for _, m := range metrics {
+				values[m.Name] = m.Value
+			}
+		case <-ctx.Done():
+			t.Fatalf("only received %v", values)
+		}
+	}
+	assert.Equal(t, map[string]float64{"cpu.usage": 12.5, "mem.used": 3, "disk.free": 1}, values)
+}
+
+func TestServerZipkinSpans(t *testing.T) {
+	config := localConfig()
+	ch := make(chan *ssf.SSFSpan, 20)
+	s := setupVeneurServer(t, config, nil, nil, &channelSpanSink{spansChannel: ch}, nil)
+	defer s.Shutdown()
+	handler := handleZipkinSpans(s)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v2/spans", bytes.NewBufferString(`[{
+		"traceId": "5af7183fb1d4cf5f", "id": "352bff9a74ca9ad2", "parentId": "6b221d5bc9e6496c",
+		"name": "get /api", "kind": "SERVER", "timestamp": 1556604172355737, "duration": 1431,
+		"localEndpoint": {"serviceName": "backend"}, "tags": {"http.method": "GET"}
+	}, {"traceId": "nope", "id": "352bff9a74ca9ad2"}]`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	payload, err := proto.Marshal(&zipkinpb.ListOfSpans{Spans: []*zipkinpb.Span{{
+		TraceId:       []byte{0x5a, 0xf7, 0x18, 0x3f, 0xb1, 0xd4, 0xcf, 0x5f},
+		Id:            []byte{0, 0, 0, 0, 0, 0, 0, 2},
+		Name:          "select",
+		Kind:          zipkinpb.KindClient,
+		Timestamp:     1556604172355737,
+		Duration:      10,
+		LocalEndpoint: &zipkinpb.Endpoint{ServiceName: "backend"},
+	}}})
+	require.NoError(t, err)
+	var data bytes.Buffer
+	gz := gzip.NewWriter(&data)
+	gz.Write(payload)
+	gz.Close()
+	r = httptest.NewRequest(http.MethodPost, "/api/v2/spans", &data)
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	r.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	r = httptest.NewRequest(http.MethodPost, "/api/v2/spans", bytes.NewBufferString("not json"))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	r = httptest.NewRequest(http.MethodPost, "/api/v2/spans", bytes.NewBufferString("[]"))
+	r.Header.Set("Content-Type", "application/thrift")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	spans := map[string]*ssf.SSFSpan{}
+	timeout := time.After(5 * time.Second)
+	for len(spans) < 2 {
+		select {
+		case span := <-ch:
+			if span.Service == "backend" {
+				spans[span.Name] = span
+			}
+		case <-timeout:
+			t.Fatalf("only received %v", spans)
+		}
+	}
+	require.Contains(t, spans, "get /api")
+	require.Contains(t, spans, "select")
+	assert.Equal(t, int64(0x5af7183fb1d4cf5f), spans["get /api"].TraceId)
+	assert.Equal(t, int64(0x6b221d5bc9e6496c), spans["get /api"].ParentId)
+	assert.Equal(t, "server", spans["get /api"].Tags["span.kind"])
+	assert.Equal(t, "GET", spans["get /api"].Tags["http.method"])
+	assert.Equal(t, spans["get /api"].TraceId, spans["select"].TraceId)
+	assert.Equal(t, int64(2), spans["select"].Id)
+	assert.Equal(t, "client", spans["select"].Tags["span.kind"])
+}
+
 func TestGeneralHealthCheck(t *testing.T) {
 	r := httptest.NewRequest(http.MethodGet, "/healthcheck", nil)
 
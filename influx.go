@@ -0,0 +1,155 @@
+package veneur
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+// maxInfluxWriteBytes limits the size of the (decompressed) body of a
+// request to the /write endpoint.
+const maxInfluxWriteBytes = 32 << 20
+
+// maxInfluxLineBytes limits the length of a single line of the
+// InfluxDB line protocol.
+const maxInfluxLineBytes = 1 << 20
+
+// HandleInfluxLine parses a line of the InfluxDB line protocol, whose
+// timestamp is in units of precision, and sends the resulting gauges to
+// the appropriate workers.
+func (s *Server) HandleInfluxLine(line []byte, precision time.Duration) error {
+	parsed, err := samplers.ParseInfluxLine(line, precision)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+			"line":          string(line),
+		}).Warn("Could not parse influx line")
+		metrics.ReportOne(s.TraceClient, ssf.Count("packet.error_total", 1, map[string]string{"packet_type": "influx", "reason": "parse"}))
+		return err
+	}
+	for _, metric := range parsed {
+		s.ingestUDPMetric(metric)
+	}
+	return nil
+}
+
+// ReadInfluxSocket reads packets of newline-separated InfluxDB line
+// protocol off a packet connection.
+func (s *Server) ReadInfluxSocket(serverConn net.PacketConn, packetPool *sync.Pool) {
+	for {
+		buf := packetPool.Get().([]byte)
+		n, _, err := serverConn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.shutdown:
+				log.WithError(err).Info("Ignoring ReadFrom error while shutting down")
+				return
+			default:
+				log.WithError(err).Error("Error reading from UDP influx socket")
+				continue
+			}
+		}
+		splitPacket := samplers.NewSplitBytes(buf[:n], '\n')
+		for splitPacket.Next() {
+			s.HandleInfluxLine(splitPacket.Chunk(), time.Nanosecond)
+		}
+		packetPool.Put(buf)
+	}
+}
+
+// handleInfluxConn reads InfluxDB line protocol off a TCP connection.
+// Like the graphite listener, lines that don't parse are skipped.
+func (s *Server) handleInfluxConn(conn net.Conn) {
+	defer func() {
+		ConsumePanic(s.Sentry, s.TraceClient, s.Hostname, recover())
+	}()
+	defer conn.Close()
+	log.WithField("peer", conn.RemoteAddr()).Debug("Starting influx connection")
+
+	timeout := defaultTCPReadTimeout
+	if s.tcpReadTimeout != 0 {
+		timeout = s.tcpReadTimeout
+	}
+	buf := bufio.NewScanner(conn)
+	buf.Buffer(nil, maxInfluxLineBytes)
+	scanWithDeadline := func() bool {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		return buf.Scan()
+	}
+	for scanWithDeadline() {
+		s.HandleInfluxLine(buf.Bytes(), time.Nanosecond)
+	}
+	if buf.Err() != nil {
+		log.WithFields(logrus.Fields{
+			logrus.ErrorKey: buf.Err(),
+			"peer":          conn.RemoteAddr(),
+		}).Info("Error reading from influx client")
+	}
+}
+
+// handleInfluxWrite implements the /write endpoint of the InfluxDB 1.x
+// HTTP API, which Telegraf and most other line protocol clients can
+// write to. The db, rp and credentials parameters are ignored.
+func handleInfluxWrite(s *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		precision, ok := samplers.InfluxPrecisions[r.URL.Query().Get("precision")]
+		if !ok {
+			writeInfluxError(w, http.StatusBadRequest, fmt.Sprintf("invalid precision %q", r.URL.Query().Get("precision")))
+			return
+		}
+
+		var body io.Reader = http.MaxBytesReader(w, r.Body, maxInfluxWriteBytes)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(body)
+			if err != nil {
+				writeInfluxError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			defer gz.Close()
+			body = io.LimitReader(gz, maxInfluxWriteBytes)
+		}
+
+		var firstErr error
+		failed := 0
+		buf := bufio.NewScanner(body)
+		buf.Buffer(nil, maxInfluxLineBytes)
+		for buf.Scan() {
+			if err := s.HandleInfluxLine(buf.Bytes(), precision); err != nil {
+				failed++
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		if err := buf.Err(); err != nil {
+			writeInfluxError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if firstErr != nil {
+			writeInfluxError(w, http.StatusBadRequest, fmt.Sprintf("partial write: %d lines could not be parsed; the first error was: %v", failed, firstErr))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// writeInfluxError responds with an error in the same format as
+// InfluxDB does.
+func writeInfluxError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Error", msg)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
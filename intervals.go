@@ -0,0 +1,270 @@
+package veneur
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// parseSinkIntervals converts the intervals of sink_intervals into
+// multiples of the flush interval.
+func parseSinkIntervals(intervals map[string]string, base time.Duration) (map[string]int, error) {
+	multiples := map[string]int{}
+	for name, value := range intervals {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("sink_intervals: %s: %v", name, err)
+		}
+		if d < base || d%base != 0 {
+			return nil, fmt.Errorf("sink_intervals: %s: %s is not a multiple of the interval %s", name, d, base)
+		}
+		multiples[name] = int(d / base)
+	}
+	return multiples, nil
+}
+
+// sinkMultiple returns after how many intervals the named metric sink
+// or plugin flushes.
+func (s *Server) sinkMultiple(name string) int {
+	if m, ok := s.sinkMultiples[name]; ok {
+		return m
+	}
+	return 1
+}
+
+// sinkInterval returns how often the named metric sink or plugin
+// flushes.
+func (s *Server) sinkInterval(name string) time.Duration {
+	return time.Duration(s.sinkMultiple(name)) * s.interval
+}
+
+// newSlowFlushes returns an accumulator for each interval of the sinks
+// and plugins that don't flush every interval, ordered by interval.
+func newSlowFlushes(multiples map[string]int) []*slowFlush {
+	seen := map[int]bool{}
+	var slow []*slowFlush
+	for _, m := range multiples {
+		if m > 1 && !seen[m] {
+			seen[m] = true
+			sf := &slowFlush{multiple: m}
+			sf.reset()
+			slow = append(slow, sf)
+		}
+	}
+	sort.Slice(slow, func(i, j int) bool {
+		return slow[i].multiple < slow[j].multiple
+	})
+	return slow
+}
+
+// checkSinkIntervals warns about sink_intervals entries that name no
+// metric sink or plugin.
+func (s *Server) checkSinkIntervals() {
+	names := map[string]bool{}
+	for _, sink := range s.getMetricSinks() {
+		names[sink.Name()] = true
+	}
+	for _, p := range s.getPlugins() {
+		names[p.Name()] = true
+	}
+	for name := range s.sinkMultiples {
+		if !names[name] {
+			log.WithField("sink", name).Warn("sink_intervals names no metric sink or plugin")
+		}
+	}
+}
+
+// A slowFlush re-aggregates the metrics of several intervals, for the
+// sinks and plugins that flush every multiple intervals.
+type slowFlush struct {
+	multiple int
+
+	mtx       sync.Mutex
+	metrics   WorkerMetrics
+	intervals int
+
+	// the unix timestamps of the values of the gauges and status
+	// checks in metrics, so that a late bucket of an earlier interval
+	// doesn't overwrite a newer value:
+	gaugeTimes       map[samplers.MetricKey]int64
+	globalGaugeTimes map[samplers.MetricKey]int64
+	checkTimes       map[samplers.MetricKey]int64
+}
+
+func (sf *slowFlush) reset() {
+	sf.metrics = NewWorkerMetrics()
+	sf.intervals = 0
+	sf.gaugeTimes = map[samplers.MetricKey]int64{}
+	sf.globalGaugeTimes = map[samplers.MetricKey]int64{}
+	sf.checkTimes = map[samplers.MetricKey]int64{}
+}
+
+// add merges the metrics of the interval flushed at the unix timestamp
+// now. It returns the metrics of all intervals since the last flush if
+// they're due to be flushed, because multiple intervals passed or
+// because final is set; they're stamped with now.
+func (sf *slowFlush) add(wms []WorkerMetrics, now int64, final bool) (WorkerMetrics, bool) {
+	sf.mtx.Lock()
+	defer sf.mtx.Unlock()
+	for _, wm := range wms {
+		at := wm.timestamp
+		if at == 0 {
+			at = now
+		}
+		wm.gauges = newerGauges(wm.gauges, sf.gaugeTimes, at)
+		wm.globalGauges = newerGauges(wm.globalGauges, sf.globalGaugeTimes, at)
+		wm.localStatusChecks = newerStatusChecks(wm.localStatusChecks, sf.checkTimes, at)
+		sf.metrics.merge(wm)
+	}
+	sf.intervals++
+	if sf.intervals < sf.multiple && !final {
+		return WorkerMetrics{}, false
+	}
+	due := sf.metrics
+	due.timestamp = now
+	sf.reset()
+	return due, true
+}
+
+// newerGauges returns the gauges whose value at the unix timestamp at
+// is at least as recent as the one recorded in times, and records at
+// for them.
+func newerGauges(gauges map[samplers.MetricKey]*samplers.Gauge, times map[samplers.MetricKey]int64, at int64) map[samplers.MetricKey]*samplers.Gauge {
+	newer := make(map[samplers.MetricKey]*samplers.Gauge, len(gauges))
+	for key, g := range gauges {
+		if last, ok := times[key]; ok && last > at {
+			continue
+		}
+		times[key] = at
+		newer[key] = g
+	}
+	return newer
+}
+
+// newerStatusChecks is newerGauges for status checks.
+func newerStatusChecks(checks map[samplers.MetricKey]*samplers.StatusCheck, times map[samplers.MetricKey]int64, at int64) map[samplers.MetricKey]*samplers.StatusCheck {
+	newer := make(map[samplers.MetricKey]*samplers.StatusCheck, len(checks))
+	for key, c := range checks {
+		if last, ok := times[key]; ok && last > at {
+			continue
+		}
+		times[key] = at
+		newer[key] = c
+	}
+	return newer
+}
+
+// merge adds other's metrics into wm: counters are summed, gauges and
+// status checks take the later value, and sets and histograms are
+// merged, including the local aggregates of histograms. Metrics that
+// other bucketed into an earlier interval lose their timestamp.
+func (wm WorkerMetrics) merge(other WorkerMetrics) {
+	mergeCounters(wm.counters, other.counters)
+	mergeCounters(wm.globalCounters, other.globalCounters)
+	mergeGauges(wm.gauges, other.gauges)
+	mergeGauges(wm.globalGauges, other.globalGauges)
+	mergeSets(wm.sets, other.sets)
+	mergeSets(wm.localSets, other.localSets)
+	mergeHistos(wm.histograms, other.histograms)
+	mergeHistos(wm.globalHistograms, other.globalHistograms)
+	mergeHistos(wm.localHistograms, other.localHistograms)
+	mergeHistos(wm.timers, other.timers)
+	mergeHistos(wm.globalTimers, other.globalTimers)
+	mergeHistos(wm.localTimers, other.localTimers)
+	for key, check := range other.localStatusChecks {
+		latest := *check
+		wm.localStatusChecks[key] = &latest
+	}
+}
+
+func mergeCounters(into, from map[samplers.MetricKey]*samplers.Counter) {
+	for key, c := range from {
+		m, err := c.Metric()
+		if err != nil {
+			continue
+		}
+		if into[key] == nil {
+			into[key] = samplers.NewCounter(c.Name, c.Tags)
+		}
+		into[key].Merge(m.GetCounter())
+	}
+}
+
+func mergeGauges(into, from map[samplers.MetricKey]*samplers.Gauge) {
+	for key, g := range from {
+		m, err := g.Metric()
+		if err != nil {
+			continue
+		}
+		if into[key] == nil {
+			into[key] = samplers.NewGauge(g.Name, g.Tags)
+		}
+		into[key].Merge(m.GetGauge())
+	}
+}
+
+func mergeSets(into, from map[samplers.MetricKey]*samplers.Set) {
+	for key, s := range from {
+		m, err := s.Metric()
+		if err != nil {
+			log.WithError(err).WithField("name", s.Name).Error("Could not merge set")
+			continue
+		}
+		if into[key] == nil {
+			into[key] = samplers.NewSet(s.Name, s.Tags)
+		}
+		if err := into[key].Merge(m.GetSet()); err != nil {
+			log.WithError(err).WithField("name", s.Name).Error("Could not merge set")
+		}
+	}
+}
+
+func mergeHistos(into, from map[samplers.MetricKey]*samplers.Histo) {
+	for key, h := range from {
+		m, err := h.Metric()
+		if err != nil {
+			continue
+		}
+		acc := into[key]
+		if acc == nil {
+			acc = samplers.NewHist(h.Name, h.Tags)
+			into[key] = acc
+		}
+		acc.Merge(m.GetHistogram())
+		acc.LocalWeight += h.LocalWeight
+		acc.LocalMin = math.Min(acc.LocalMin, h.LocalMin)
+		acc.LocalMax = math.Max(acc.LocalMax, h.LocalMax)
+		acc.LocalSum += h.LocalSum
+		acc.LocalReciprocalSum += h.LocalReciprocalSum
+	}
+}
+
+// isFinalFlush returns true if the server is shutting down, so that
+// this flush is the last one.
+func (s *Server) isFinalFlush() bool {
+	select {
+	case <-s.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// flushSlow flushes the metrics that sf aggregated over several
+// intervals to the sinks and plugins with its interval.
+func (s *Server) flushSlow(ctx context.Context, background *sync.WaitGroup, sf *slowFlush, wm WorkerMetrics, percentiles []float64, aggregates samplers.HistogramAggregates) {
+	interval := time.Duration(sf.multiple) * s.interval
+	finalMetrics := s.generateInterMetrics(ctx, interval, percentiles, aggregates, []WorkerMetrics{wm}, metricsSummary{})
+	s.metricRouter.Route(finalMetrics)
+	s.Statsd.Gauge("flush.slow_metrics_total", float64(len(finalMetrics)), []string{"interval:" + interval.String()}, 1.0)
+	if len(finalMetrics) == 0 {
+		return
+	}
+	s.flushMetricSinks(ctx, background, finalMetrics, sf.multiple)
+	s.flushPlugins(ctx, background, finalMetrics, sf.multiple)
+}
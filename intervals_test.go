@@ -0,0 +1,147 @@
+package veneur
+
+import (
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks/datadog"
+)
+
+func TestParseSinkIntervals(t *testing.T) {
+	multiples, err := parseSinkIntervals(map[string]string{"datadog": "10s", "s3": "5m"}, 10*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"datadog": 1, "s3": 30}, multiples)
+
+	_, err = parseSinkIntervals(map[string]string{"s3": "15s"}, 10*time.Second)
+	assert.Error(t, err, "intervals must be multiples of the interval")
+	_, err = parseSinkIntervals(map[string]string{"s3": "5s"}, 10*time.Second)
+	assert.Error(t, err)
+	_, err = parseSinkIntervals(map[string]string{"s3": "often"}, 10*time.Second)
+	assert.Error(t, err)
+}
+
+func TestSlowSinkReaggregates(t *testing.T) {
+	config := globalConfig()
+	config.SinkIntervals = map[string]string{"channel": (3 * DefaultFlushInterval).String()}
+	ch := make(chan []samplers.InterMetric, 10)
+	sink, _ := NewChannelMetricSink(ch)
+	server := setupVeneurServer(t, config, nil, sink, nil, nil)
+	defer server.Shutdown()
+
+	sample := func(name, typ string, value float64) {
+		server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: name, Type: typ},
+			Value:      value,
+			SampleRate: 1.0,
+		})
+	}
+	for i := 1; i <= 3; i++ {
+		sample("a.counter", "counter", float64(i))
+		sample("a.gauge", "gauge", float64(i))
+		for j := 0; j < 10; j++ {
+			sample("a.histo", "histogram", float64(i*10))
+		}
+		server.Flush(context.Background())
+		if i < 3 {
+			assert.Empty(t, ch, "the sink doesn't flush before its interval")
+		}
+	}
+
+	require.Len(t, ch, 1)
+	values := map[string]float64{}
+	for _, m := range <-ch {
+		values[m.Name] = m.Value
+	}
+	assert.Equal(t, 6.0, values["a.counter"], "counters are summed")
+	assert.Equal(t, 3.0, values["a.gauge"], "the last gauge is kept")
+	assert.InDelta(t, 20.0, values["a.histo.50percentile"], 1.0, "percentiles come from the merged digests")
+	assert.InDelta(t, 30.0, values["a.histo.99percentile"], 1.0)
+
+	// the final flush flushes what the slow sink has so far:
+	sample("a.counter", "counter", 4.0)
+	server.Shutdown()
+	require.Len(t, ch, 1)
+	metrics := <-ch
+	require.Len(t, metrics, 1)
+	assert.Equal(t, 4.0, metrics[0].Value)
+}
+
+func TestSlowFlushLateGauge(t *testing.T) {
+	sf := newSlowFlushes(map[string]int{"s3": 2})[0]
+	key := samplers.MetricKey{Name: "a.gauge", Type: "gauge"}
+	gauge := func(value float64, timestamp int64) WorkerMetrics {
+		wm := NewWorkerMetrics()
+		wm.timestamp = timestamp
+		wm.gauges[key] = samplers.NewGauge(key.Name, nil)
+		wm.gauges[key].Sample(value, 1.0)
+		return wm
+	}
+
+	// the late buckets come after the interval's own metrics:
+	_, due := sf.add([]WorkerMetrics{gauge(3, 0), gauge(1, 990)}, 1000, false)
+	require.False(t, due)
+	wm, due := sf.add([]WorkerMetrics{gauge(2, 995)}, 1010, false)
+	require.True(t, due)
+
+	assert.Equal(t, int64(1010), wm.timestamp, "the metrics are stamped with the end of the slow interval")
+	metrics := wm.gauges[key].Flush()
+	require.Len(t, metrics, 1)
+	assert.Equal(t, 3.0, metrics[0].Value, "late buckets don't overwrite a newer gauge")
+
+	_, due = sf.add([]WorkerMetrics{gauge(1, 1005), gauge(4, 0)}, 1020, false)
+	require.False(t, due)
+	wm, _ = sf.add([]WorkerMetrics{gauge(5, 0)}, 1030, false)
+	assert.Equal(t, 5.0, wm.gauges[key].Flush()[0].Value, "the newest gauge wins")
+}
+
+func TestSlowSinkRatesAndTimestamps(t *testing.T) {
+	series := make(chan []datadog.DDMetric, 10)
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := zlib.NewReader(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		var body map[string][]datadog.DDMetric
+		assert.NoError(t, json.NewDecoder(zr).Decode(&body))
+		series <- body["series"]
+	}))
+	defer remote.Close()
+
+	config := globalConfig()
+	config.DatadogAPIKey = "secret"
+	config.DatadogAPIHostname = remote.URL
+	config.SinkIntervals = map[string]string{"datadog": (3 * DefaultFlushInterval).String()}
+	server := setupVeneurServer(t, config, nil, nil, nil, nil)
+	defer server.Shutdown()
+
+	var last time.Time
+	for i := 1; i <= 3; i++ {
+		server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: "a.counter", Type: "counter"},
+			Value:      float64(i),
+			SampleRate: 1.0,
+		})
+		last = time.Now()
+		server.Flush(context.Background())
+	}
+
+	var metrics []datadog.DDMetric
+	select {
+	case metrics = <-series:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the slow sink didn't flush")
+	}
+	require.Len(t, metrics, 1)
+	point := metrics[0].Value[0]
+	assert.Equal(t, "rate", metrics[0].MetricType)
+	assert.InDelta(t, 6/(3*DefaultFlushInterval).Seconds(), point[1], 1e-9, "the rate is over the slow interval")
+	assert.InDelta(t, float64(last.Unix()), point[0], 1, "the timestamp is the end of the slow interval")
+}
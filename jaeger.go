@@ -0,0 +1,61 @@
+package veneur
+
+import (
+	"net"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/stripe/veneur/jaeger"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+// HandleJaegerPacket decodes a Jaeger agent emitBatch packet, converts
+// its spans to SSF and sends them to the span workers, the same as
+// HandleTracePacket does for SSF packets.
+func (s *Server) HandleJaegerPacket(packet []byte) {
+	batch, err := jaeger.DecodeEmitBatch(packet)
+	if err != nil {
+		log.WithError(err).Warn("Could not decode jaeger packet")
+		metrics.ReportOne(s.TraceClient, ssf.Count("ssf.error_total", 1, map[string]string{"ssf_format": "jaeger", "packet_type": "jaeger_batch", "reason": "decode"}))
+		return
+	}
+	rejected := 0
+	for _, span := range batch.Spans {
+		ssfSpan, err := jaeger.ToSSF(span, batch.Process)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				logrus.ErrorKey: err,
+				"service":       batch.Process.ServiceName,
+			}).Debug("Could not convert jaeger span")
+			rejected++
+			continue
+		}
+		s.handleSSF(ssfSpan, "jaeger")
+	}
+	if rejected > 0 {
+		metrics.ReportOne(s.TraceClient, ssf.Count("ssf.error_total", float32(rejected), map[string]string{"ssf_format": "jaeger", "packet_type": "jaeger_span", "reason": "invalid"}))
+	}
+}
+
+// ReadJaegerSocket reads Jaeger agent emitBatch packets off a packet
+// connection.
+func (s *Server) ReadJaegerSocket(serverConn net.PacketConn, packetPool *sync.Pool) {
+	for {
+		buf := packetPool.Get().([]byte)
+		n, _, err := serverConn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.shutdown:
+				log.WithError(err).Info("Ignoring ReadFrom error while shutting down")
+				return
+			default:
+				log.WithError(err).Error("Error reading from UDP jaeger socket")
+				continue
+			}
+		}
+		s.HandleJaegerPacket(buf[:n])
+		packetPool.Put(buf)
+	}
+}
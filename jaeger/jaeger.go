@@ -0,0 +1,465 @@
+// Package jaeger converts between Jaeger's Thrift spans and SSF spans.
+//
+// It decodes the emitBatch messages that Jaeger clients send to the
+// local agent over UDP, in the Thrift compact protocol, and encodes
+// batches in the Thrift binary protocol, as accepted by the collector's
+// /api/traces HTTP endpoint. The Thrift codec is hand-written, and only
+// supports the parts of jaeger.thrift and agent.thrift that are needed
+// for that.
+package jaeger
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/stripe/veneur/ssf"
+)
+
+const (
+	// TraceIDTag is the span tag that holds the full, hex-encoded
+	// 128-bit Jaeger trace ID of a span.
+	TraceIDTag = "jaeger.trace_id"
+
+	// errorTag is the tag that Jaeger clients set to true on failed
+	// spans.
+	errorTag = "error"
+)
+
+// TagType is the type of the value of a Tag.
+type TagType int32
+
+const (
+	TagTypeString TagType = 0
+	TagTypeDouble TagType = 1
+	TagTypeBool   TagType = 2
+	TagTypeLong   TagType = 3
+	TagTypeBinary TagType = 4
+)
+
+// SpanRefType is the kind of relationship a SpanRef describes.
+type SpanRefType int32
+
+const (
+	SpanRefChildOf     SpanRefType = 0
+	SpanRefFollowsFrom SpanRefType = 1
+)
+
+// Tag is a typed key/value pair.
+type Tag struct {
+	Key     string
+	VType   TagType
+	VStr    string
+	VDouble float64
+	VBool   bool
+	VLong   int64
+	VBinary []byte
+}
+
+// String returns the tag's value as a string.
+func (t Tag) String() string {
+	switch t.VType {
+	case TagTypeDouble:
+		return strconv.FormatFloat(t.VDouble, 'g', -1, 64)
+	case TagTypeBool:
+		return strconv.FormatBool(t.VBool)
+	case TagTypeLong:
+		return strconv.FormatInt(t.VLong, 10)
+	case TagTypeBinary:
+		return fmt.Sprintf("%x", t.VBinary)
+	}
+	return t.VStr
+}
+
+// SpanRef is a reference from a span to another span.
+type SpanRef struct {
+	RefType     SpanRefType
+	TraceIDLow  int64
+	TraceIDHigh int64
+	SpanID      int64
+}
+
+// Span is a Jaeger span. Logs are not decoded.
+type Span struct {
+	TraceIDLow    int64
+	TraceIDHigh   int64
+	SpanID        int64
+	ParentSpanID  int64
+	OperationName string
+	References    []SpanRef
+	Flags         int32
+	StartTime     int64 // in microseconds since the epoch
+	Duration      int64 // in microseconds
+	Tags          []Tag
+}
+
+// Process describes the service that emitted a batch of spans.
+type Process struct {
+	ServiceName string
+	Tags        []Tag
+}
+
+// Batch is a list of spans emitted by a single process.
+type Batch struct {
+	Process Process
+	Spans   []Span
+}
+
+// DecodeEmitBatch decodes a UDP packet that a Jaeger client sent to
+// the agent's compact Thrift port: an Agent.emitBatch call.
+func DecodeEmitBatch(packet []byte) (*Batch, error) {
+	r := &compactReader{buf: packet}
+	name, err := r.readMessageBegin()
+	if err != nil {
+		return nil, err
+	}
+	if name != "emitBatch" {
+		return nil, fmt.Errorf("unsupported jaeger agent method %q", name)
+	}
+	var batch *Batch
+	err = r.readStruct(func(id int16, typ byte) error {
+		if id == 1 && typ == compactStruct {
+			batch = &Batch{}
+			return batch.read(r)
+		}
+		return r.skip(typ)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if batch == nil {
+		return nil, fmt.Errorf("emitBatch call has no batch")
+	}
+	return batch, nil
+}
+
+func (b *Batch) read(r *compactReader) error {
+	return r.readStruct(func(id int16, typ byte) error {
+		switch {
+		case id == 1 && typ == compactStruct:
+			return b.Process.read(r)
+		case id == 2 && typ == compactList:
+			return r.readList(func(typ byte) error {
+				if typ != compactStruct {
+					return r.skip(typ)
+				}
+				var span Span
+				if err := span.read(r); err != nil {
+					return err
+				}
+				b.Spans = append(b.Spans, span)
+				return nil
+			})
+		}
+		return r.skip(typ)
+	})
+}
+
+func (p *Process) read(r *compactReader) (err error) {
+	return r.readStruct(func(id int16, typ byte) error {
+		switch {
+		case id == 1 && typ == compactBinary:
+			p.ServiceName, err = r.readString()
+			return err
+		case id == 2 && typ == compactList:
+			p.Tags, err = readTags(r)
+			return err
+		}
+		return r.skip(typ)
+	})
+}
+
+func (s *Span) read(r *compactReader) (err error) {
+	return r.readStruct(func(id int16, typ byte) error {
+		switch {
+		case id == 1 && typ == compactI64:
+			s.TraceIDLow, err = r.readI64()
+		case id == 2 && typ == compactI64:
+			s.TraceIDHigh, err = r.readI64()
+		case id == 3 && typ == compactI64:
+			s.SpanID, err = r.readI64()
+		case id == 4 && typ == compactI64:
+			s.ParentSpanID, err = r.readI64()
+		case id == 5 && typ == compactBinary:
+			s.OperationName, err = r.readString()
+		case id == 6 && typ == compactList:
+			err = r.readList(func(typ byte) error {
+				if typ != compactStruct {
+					return r.skip(typ)
+				}
+				var ref SpanRef
+				if err := ref.read(r); err != nil {
+					return err
+				}
+				s.References = append(s.References, ref)
+				return nil
+			})
+		case id == 7 && typ == compactI32:
+			s.Flags, err = r.readI32()
+		case id == 8 && typ == compactI64:
+			s.StartTime, err = r.readI64()
+		case id == 9 && typ == compactI64:
+			s.Duration, err = r.readI64()
+		case id == 10 && typ == compactList:
+			s.Tags, err = readTags(r)
+		default:
+			err = r.skip(typ)
+		}
+		return err
+	})
+}
+
+func (ref *SpanRef) read(r *compactReader) (err error) {
+	return r.readStruct(func(id int16, typ byte) error {
+		switch {
+		case id == 1 && typ == compactI32:
+			var t int32
+			t, err = r.readI32()
+			ref.RefType = SpanRefType(t)
+		case id == 2 && typ == compactI64:
+			ref.TraceIDLow, err = r.readI64()
+		case id == 3 && typ == compactI64:
+			ref.TraceIDHigh, err = r.readI64()
+		case id == 4 && typ == compactI64:
+			ref.SpanID, err = r.readI64()
+		default:
+			err = r.skip(typ)
+		}
+		return err
+	})
+}
+
+func readTags(r *compactReader) (tags []Tag, err error) {
+	err = r.readList(func(typ byte) error {
+		if typ != compactStruct {
+			return r.skip(typ)
+		}
+		var tag Tag
+		if err := tag.read(r); err != nil {
+			return err
+		}
+		tags = append(tags, tag)
+		return nil
+	})
+	return tags, err
+}
+
+func (t *Tag) read(r *compactReader) (err error) {
+	return r.readStruct(func(id int16, typ byte) error {
+		switch {
+		case id == 1 && typ == compactBinary:
+			t.Key, err = r.readString()
+		case id == 2 && typ == compactI32:
+			var vType int32
+			vType, err = r.readI32()
+			t.VType = TagType(vType)
+		case id == 3 && typ == compactBinary:
+			t.VStr, err = r.readString()
+		case id == 4 && typ == compactDouble:
+			t.VDouble, err = r.readDouble()
+		case id == 5 && (typ == compactTrue || typ == compactFalse):
+			t.VBool = readBool(typ)
+		case id == 6 && typ == compactI64:
+			t.VLong, err = r.readI64()
+		case id == 7 && typ == compactBinary:
+			var b []byte
+			b, err = r.readBinary()
+			t.VBinary = append([]byte(nil), b...)
+		default:
+			err = r.skip(typ)
+		}
+		return err
+	})
+}
+
+// Encode encodes the batch in the Thrift binary protocol.
+func (b *Batch) Encode() []byte {
+	w := &binaryWriter{}
+	w.writeFieldBegin(binaryStruct, 1)
+	w.writeFieldBegin(binaryString, 1)
+	w.writeString(b.Process.ServiceName)
+	writeTags(w, 2, b.Process.Tags)
+	w.writeFieldStop()
+
+	w.writeFieldBegin(binaryList, 2)
+	w.writeListBegin(binaryStruct, len(b.Spans))
+	for _, s := range b.Spans {
+		w.writeFieldBegin(binaryI64, 1)
+		w.writeI64(s.TraceIDLow)
+		w.writeFieldBegin(binaryI64, 2)
+		w.writeI64(s.TraceIDHigh)
+		w.writeFieldBegin(binaryI64, 3)
+		w.writeI64(s.SpanID)
+		w.writeFieldBegin(binaryI64, 4)
+		w.writeI64(s.ParentSpanID)
+		w.writeFieldBegin(binaryString, 5)
+		w.writeString(s.OperationName)
+		if len(s.References) > 0 {
+			w.writeFieldBegin(binaryList, 6)
+			w.writeListBegin(binaryStruct, len(s.References))
+			for _, ref := range s.References {
+				w.writeFieldBegin(binaryI32, 1)
+				w.writeI32(int32(ref.RefType))
+				w.writeFieldBegin(binaryI64, 2)
+				w.writeI64(ref.TraceIDLow)
+				w.writeFieldBegin(binaryI64, 3)
+				w.writeI64(ref.TraceIDHigh)
+				w.writeFieldBegin(binaryI64, 4)
+				w.writeI64(ref.SpanID)
+				w.writeFieldStop()
+			}
+		}
+		w.writeFieldBegin(binaryI32, 7)
+		w.writeI32(s.Flags)
+		w.writeFieldBegin(binaryI64, 8)
+		w.writeI64(s.StartTime)
+		w.writeFieldBegin(binaryI64, 9)
+		w.writeI64(s.Duration)
+		writeTags(w, 10, s.Tags)
+		w.writeFieldStop()
+	}
+	w.writeFieldStop()
+	return w.Bytes()
+}
+
+func writeTags(w *binaryWriter, id int16, tags []Tag) {
+	if len(tags) == 0 {
+		return
+	}
+	w.writeFieldBegin(binaryList, id)
+	w.writeListBegin(binaryStruct, len(tags))
+	for _, t := range tags {
+		w.writeFieldBegin(binaryString, 1)
+		w.writeString(t.Key)
+		w.writeFieldBegin(binaryI32, 2)
+		w.writeI32(int32(t.VType))
+		switch t.VType {
+		case TagTypeString:
+			w.writeFieldBegin(binaryString, 3)
+			w.writeString(t.VStr)
+		case TagTypeDouble:
+			w.writeFieldBegin(binaryDouble, 4)
+			w.writeDouble(t.VDouble)
+		case TagTypeBool:
+			w.writeFieldBegin(binaryBool, 5)
+			w.writeBool(t.VBool)
+		case TagTypeLong:
+			w.writeFieldBegin(binaryI64, 6)
+			w.writeI64(t.VLong)
+		case TagTypeBinary:
+			w.writeFieldBegin(binaryString, 7)
+			w.writeBinary(t.VBinary)
+		}
+		w.writeFieldStop()
+	}
+}
+
+// ToSSF converts a span of a batch into an SSF span.
+//
+// SSF IDs are (positive) int64s, so the top bit of Jaeger's IDs is
+// cleared, and the high half of 128-bit trace IDs is dropped; the full
+// trace ID of such spans is kept in the TraceIDTag tag. Spans without
+// a parentSpanID get the span of their first CHILD_OF reference as
+// their parent.
+//
+// The process's service name becomes the span's service, and the
+// process's and the span's tags become its tags. A true "error" tag
+// marks the span as an error instead. Logs are dropped.
+func ToSSF(span Span, process Process) (*ssf.SSFSpan, error) {
+	traceID := span.TraceIDLow & math.MaxInt64
+	id := span.SpanID & math.MaxInt64
+	if traceID == 0 || id == 0 {
+		return nil, fmt.Errorf("span %x of trace %x has a zero ID", span.SpanID, span.TraceIDLow)
+	}
+	if span.StartTime <= 0 {
+		return nil, fmt.Errorf("span %x has no start time", span.SpanID)
+	}
+
+	ret := &ssf.SSFSpan{
+		TraceId:        traceID,
+		Id:             id,
+		ParentId:       span.ParentSpanID & math.MaxInt64,
+		Name:           span.OperationName,
+		Service:        process.ServiceName,
+		StartTimestamp: span.StartTime * 1000,
+		EndTimestamp:   (span.StartTime + span.Duration) * 1000,
+		Tags:           make(map[string]string, len(process.Tags)+len(span.Tags)+1),
+	}
+	if ret.ParentId == 0 {
+		for _, ref := range span.References {
+			if ref.RefType == SpanRefChildOf && ref.TraceIDLow == span.TraceIDLow {
+				ret.ParentId = ref.SpanID & math.MaxInt64
+				break
+			}
+		}
+	}
+	if span.TraceIDHigh != 0 {
+		ret.Tags[TraceIDTag] = fmt.Sprintf("%016x%016x", uint64(span.TraceIDHigh), uint64(span.TraceIDLow))
+	}
+	for _, tags := range [][]Tag{process.Tags, span.Tags} {
+		for _, tag := range tags {
+			if tag.Key == errorTag && tag.VType == TagTypeBool {
+				ret.Error = ret.Error || tag.VBool
+				continue
+			}
+			ret.Tags[tag.Key] = tag.String()
+		}
+	}
+	return ret, nil
+}
+
+// FromSSF converts an SSF span into a Jaeger span, undoing what ToSSF
+// does. Indicator spans are tagged with "indicator".
+func FromSSF(span *ssf.SSFSpan) Span {
+	ret := Span{
+		TraceIDLow:    span.TraceId,
+		SpanID:        span.Id,
+		ParentSpanID:  span.ParentId,
+		OperationName: span.Name,
+		Flags:         1, // sampled
+		StartTime:     span.StartTimestamp / 1000,
+	}
+	if d := span.EndTimestamp - span.StartTimestamp; d > 0 {
+		ret.Duration = (d + 999) / 1000
+	}
+
+	keys := make([]string, 0, len(span.Tags))
+	for k := range span.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := span.Tags[k]
+		if k == TraceIDTag {
+			if high, low, ok := parseTraceID(v); ok && low&math.MaxInt64 == span.TraceId {
+				ret.TraceIDHigh, ret.TraceIDLow = high, low
+				continue
+			}
+		}
+		ret.Tags = append(ret.Tags, Tag{Key: k, VType: TagTypeString, VStr: v})
+	}
+	if span.Error {
+		ret.Tags = append(ret.Tags, Tag{Key: errorTag, VType: TagTypeBool, VBool: true})
+	}
+	if span.Indicator {
+		ret.Tags = append(ret.Tags, Tag{Key: "indicator", VType: TagTypeBool, VBool: true})
+	}
+	return ret
+}
+
+// parseTraceID parses a hex-encoded 128-bit trace ID.
+func parseTraceID(id string) (high, low int64, ok bool) {
+	if len(id) != 32 {
+		return 0, 0, false
+	}
+	h, err := strconv.ParseUint(id[:16], 16, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	l, err := strconv.ParseUint(id[16:], 16, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return int64(h), int64(l), true
+}
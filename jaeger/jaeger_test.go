@@ -0,0 +1,357 @@
+package jaeger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stripe/veneur/ssf"
+)
+
+// compactWriter encodes just enough of the Thrift compact protocol to
+// build emitBatch packets, the way Jaeger clients do.
+type compactWriter struct {
+	bytes.Buffer
+	lastID []int16
+}
+
+func (w *compactWriter) varint(n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutUvarint(b[:], n)])
+}
+
+func (w *compactWriter) i64(n int64) { w.varint(uint64((n << 1) ^ (n >> 63))) }
+
+func (w *compactWriter) str(s string) {
+	w.varint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (w *compactWriter) field(id int16, typ byte) {
+	last := w.lastID[len(w.lastID)-1]
+	if delta := id - last; delta > 0 && delta <= 15 {
+		w.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		w.WriteByte(typ)
+		w.i64(int64(id))
+	}
+	w.lastID[len(w.lastID)-1] = id
+}
+
+func (w *compactWriter) begin() { w.lastID = append(w.lastID, 0) }
+
+func (w *compactWriter) end() {
+	w.WriteByte(compactStop)
+	w.lastID = w.lastID[:len(w.lastID)-1]
+}
+
+func (w *compactWriter) list(typ byte, size int) {
+	if size < 15 {
+		w.WriteByte(byte(size)<<4 | typ)
+		return
+	}
+	w.WriteByte(0xf0 | typ)
+	w.varint(uint64(size))
+}
+
+func (w *compactWriter) tag(key string, vType TagType, write func()) {
+	w.begin()
+	w.field(1, compactBinary)
+	w.str(key)
+	w.field(2, compactI32)
+	w.i64(int64(vType))
+	write()
+	w.end()
+}
+
+func emitBatchPacket() []byte {
+	w := &compactWriter{}
+	w.WriteByte(compactProtocol)
+	w.WriteByte(4<<compactTypeShift | compactVersion) // oneway
+	w.varint(1)
+	w.str("emitBatch")
+	w.begin()
+	w.field(1, compactStruct)
+	w.begin() // Batch
+
+	w.field(1, compactStruct)
+	w.begin() // Process
+	w.field(1, compactBinary)
+	w.str("frontend")
+	w.field(2, compactList)
+	w.list(compactStruct, 1)
+	w.tag("hostname", TagTypeString, func() {
+		w.field(3, compactBinary)
+		w.str("web01")
+	})
+	w.end()
+
+	w.field(2, compactList)
+	w.list(compactStruct, 2)
+
+	w.begin() // a span with a 128-bit trace ID and every kind of tag
+	w.field(1, compactI64)
+	w.i64(-2)
+	w.field(2, compactI64)
+	w.i64(0x463ac35c9f6413ad)
+	w.field(3, compactI64)
+	w.i64(3)
+	w.field(4, compactI64)
+	w.i64(2)
+	w.field(5, compactBinary)
+	w.str("GET /")
+	w.field(7, compactI32)
+	w.i64(1)
+	w.field(8, compactI64)
+	w.i64(1500000000000000)
+	w.field(9, compactI64)
+	w.i64(2500)
+	w.field(10, compactList)
+	w.list(compactStruct, 6)
+	w.tag("span.kind", TagTypeString, func() {
+		w.field(3, compactBinary)
+		w.str("server")
+	})
+	w.tag("ratio", TagTypeDouble, func() {
+		w.field(4, compactDouble)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(0.5))
+		w.Write(b[:])
+	})
+	w.tag("cached", TagTypeBool, func() {
+		w.field(5, compactFalse)
+	})
+	w.tag("http.status_code", TagTypeLong, func() {
+		w.field(6, compactI64)
+		w.i64(500)
+	})
+	w.tag("blob", TagTypeBinary, func() {
+		w.field(7, compactBinary)
+		w.str("\x01\x02")
+	})
+	w.tag("error", TagTypeBool, func() {
+		w.field(5, compactTrue)
+	})
+	w.field(11, compactList) // logs, which are skipped
+	w.list(compactStruct, 1)
+	w.begin()
+	w.field(1, compactI64)
+	w.i64(1500000000000001)
+	w.field(2, compactList)
+	w.list(compactStruct, 1)
+	w.tag("event", TagTypeString, func() {
+		w.field(3, compactBinary)
+		w.str("retry")
+	})
+	w.end()
+	w.field(300, compactMap) // an unknown field
+	w.varint(1)
+	w.WriteByte(compactBinary<<4 | compactI32)
+	w.str("k")
+	w.i64(1)
+	w.end()
+
+	w.begin() // a span that only has a reference to its parent
+	w.field(1, compactI64)
+	w.i64(0x10)
+	w.field(3, compactI64)
+	w.i64(0x11)
+	w.field(4, compactI64)
+	w.i64(0)
+	w.field(5, compactBinary)
+	w.str("render")
+	w.field(6, compactList)
+	w.list(compactStruct, 1)
+	w.begin()
+	w.field(1, compactI32)
+	w.i64(int64(SpanRefChildOf))
+	w.field(2, compactI64)
+	w.i64(0x10)
+	w.field(3, compactI64)
+	w.i64(0)
+	w.field(4, compactI64)
+	w.i64(0x12)
+	w.end()
+	w.field(8, compactI64)
+	w.i64(1500000000000000)
+	w.field(9, compactI64)
+	w.i64(1)
+	w.end()
+
+	w.field(3, compactI64) // seqNo
+	w.i64(7)
+	w.end() // Batch
+	w.end() // emitBatch_args
+	return w.Bytes()
+}
+
+func TestDecodeEmitBatch(t *testing.T) {
+	batch, err := DecodeEmitBatch(emitBatchPacket())
+	require.NoError(t, err)
+	assert.Equal(t, Process{
+		ServiceName: "frontend",
+		Tags:        []Tag{{Key: "hostname", VType: TagTypeString, VStr: "web01"}},
+	}, batch.Process)
+	require.Len(t, batch.Spans, 2)
+	assert.Equal(t, Span{
+		TraceIDLow:    -2,
+		TraceIDHigh:   0x463ac35c9f6413ad,
+		SpanID:        3,
+		ParentSpanID:  2,
+		OperationName: "GET /",
+		Flags:         1,
+		StartTime:     1500000000000000,
+		Duration:      2500,
+		Tags: []Tag{
+			{Key: "span.kind", VType: TagTypeString, VStr: "server"},
+			{Key: "ratio", VType: TagTypeDouble, VDouble: 0.5},
+			{Key: "cached", VType: TagTypeBool, VBool: false},
+			{Key: "http.status_code", VType: TagTypeLong, VLong: 500},
+			{Key: "blob", VType: TagTypeBinary, VBinary: []byte{1, 2}},
+			{Key: "error", VType: TagTypeBool, VBool: true},
+		},
+	}, batch.Spans[0])
+	assert.Equal(t, []SpanRef{{RefType: SpanRefChildOf, TraceIDLow: 0x10, SpanID: 0x12}}, batch.Spans[1].References)
+}
+
+func TestDecodeEmitBatchErrors(t *testing.T) {
+	packet := emitBatchPacket()
+	for i := 0; i < len(packet)-1; i++ {
+		_, err := DecodeEmitBatch(packet[:i])
+		assert.Error(t, err, "truncated to %d bytes", i)
+	}
+
+	_, err := DecodeEmitBatch([]byte("\x80\x01\x00\x04"))
+	assert.Error(t, err, "binary protocol")
+
+	w := &compactWriter{}
+	w.WriteByte(compactProtocol)
+	w.WriteByte(4<<compactTypeShift | compactVersion)
+	w.varint(1)
+	w.str("emitZipkinBatch")
+	w.begin()
+	w.end()
+	_, err = DecodeEmitBatch(w.Bytes())
+	assert.Error(t, err)
+}
+
+func TestToSSF(t *testing.T) {
+	batch, err := DecodeEmitBatch(emitBatchPacket())
+	require.NoError(t, err)
+
+	span, err := ToSSF(batch.Spans[0], batch.Process)
+	require.NoError(t, err)
+	assert.Equal(t, &ssf.SSFSpan{
+		TraceId:        math.MaxInt64 - 1,
+		Id:             3,
+		ParentId:       2,
+		Name:           "GET /",
+		Service:        "frontend",
+		StartTimestamp: 1500000000000000000,
+		EndTimestamp:   1500000000002500000,
+		Error:          true,
+		Tags: map[string]string{
+			"hostname":         "web01",
+			"span.kind":        "server",
+			"ratio":            "0.5",
+			"cached":           "false",
+			"http.status_code": "500",
+			"blob":             "0102",
+			"jaeger.trace_id":  "463ac35c9f6413adfffffffffffffffe",
+		},
+	}, span)
+
+	span, err = ToSSF(batch.Spans[1], batch.Process)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0x12), span.ParentId)
+
+	_, err = ToSSF(Span{TraceIDLow: 1, StartTime: 1}, batch.Process)
+	assert.Error(t, err)
+	_, err = ToSSF(Span{TraceIDLow: 1, SpanID: 1}, batch.Process)
+	assert.Error(t, err)
+}
+
+func TestFromSSF(t *testing.T) {
+	span := FromSSF(&ssf.SSFSpan{
+		TraceId:        math.MaxInt64 - 1,
+		Id:             3,
+		ParentId:       2,
+		Name:           "GET /",
+		Service:        "frontend",
+		StartTimestamp: 1500000000000000000,
+		EndTimestamp:   1500000000002500001,
+		Error:          true,
+		Indicator:      true,
+		Tags: map[string]string{
+			"span.kind":       "server",
+			"jaeger.trace_id": "463ac35c9f6413adfffffffffffffffe",
+		},
+	})
+	assert.Equal(t, Span{
+		TraceIDLow:    -2,
+		TraceIDHigh:   0x463ac35c9f6413ad,
+		SpanID:        3,
+		ParentSpanID:  2,
+		OperationName: "GET /",
+		Flags:         1,
+		StartTime:     1500000000000000,
+		Duration:      2501,
+		Tags: []Tag{
+			{Key: "span.kind", VType: TagTypeString, VStr: "server"},
+			{Key: "error", VType: TagTypeBool, VBool: true},
+			{Key: "indicator", VType: TagTypeBool, VBool: true},
+		},
+	}, span)
+
+	// a trace ID tag that doesn't match the span's trace ID is
+	// passed on as a tag:
+	span = FromSSF(&ssf.SSFSpan{
+		TraceId: 1,
+		Id:      1,
+		Tags:    map[string]string{"jaeger.trace_id": "463ac35c9f6413adfffffffffffffffe"},
+	})
+	assert.Equal(t, int64(1), span.TraceIDLow)
+	assert.Equal(t, int64(0), span.TraceIDHigh)
+	assert.Equal(t, []Tag{{Key: "jaeger.trace_id", VType: TagTypeString, VStr: "463ac35c9f6413adfffffffffffffffe"}}, span.Tags)
+}
+
+func TestEncode(t *testing.T) {
+	batch := &Batch{
+		Process: Process{ServiceName: "a"},
+		Spans: []Span{{
+			TraceIDLow:    1,
+			SpanID:        2,
+			OperationName: "op",
+			Flags:         1,
+			StartTime:     3,
+			Duration:      4,
+			Tags:          []Tag{{Key: "k", VType: TagTypeBool, VBool: true}},
+		}},
+	}
+	expected := []byte{
+		12, 0, 1, // process
+		11, 0, 1, 0, 0, 0, 1, 'a', // serviceName
+		0,
+		15, 0, 2, 12, 0, 0, 0, 1, // spans
+		10, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, // traceIdLow
+		10, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, // traceIdHigh
+		10, 0, 3, 0, 0, 0, 0, 0, 0, 0, 2, // spanId
+		10, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, // parentSpanId
+		11, 0, 5, 0, 0, 0, 2, 'o', 'p', // operationName
+		8, 0, 7, 0, 0, 0, 1, // flags
+		10, 0, 8, 0, 0, 0, 0, 0, 0, 0, 3, // startTime
+		10, 0, 9, 0, 0, 0, 0, 0, 0, 0, 4, // duration
+		15, 0, 10, 12, 0, 0, 0, 1, // tags
+		11, 0, 1, 0, 0, 0, 1, 'k', // key
+		8, 0, 2, 0, 0, 0, 2, // vType
+		2, 0, 5, 1, // vBool
+		0,
+		0,
+		0,
+	}
+	assert.Equal(t, expected, batch.Encode())
+}
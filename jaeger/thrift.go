@@ -0,0 +1,310 @@
+package jaeger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Type IDs of the Thrift compact protocol.
+const (
+	compactStop      = 0
+	compactTrue      = 1
+	compactFalse     = 2
+	compactByte      = 3
+	compactI16       = 4
+	compactI32       = 5
+	compactI64       = 6
+	compactDouble    = 7
+	compactBinary    = 8
+	compactList      = 9
+	compactSet       = 10
+	compactMap       = 11
+	compactStruct    = 12
+	compactProtocol  = 0x82
+	compactVersion   = 1
+	compactTypeShift = 5
+)
+
+// Type IDs of the Thrift binary protocol.
+const (
+	binaryStop   = 0
+	binaryBool   = 2
+	binaryDouble = 4
+	binaryI32    = 8
+	binaryI64    = 10
+	binaryString = 11
+	binaryStruct = 12
+	binaryList   = 15
+)
+
+// maxSkipDepth limits how deeply nested the unknown fields that
+// compactReader skips may be.
+const maxSkipDepth = 32
+
+var errTruncated = errors.New("truncated thrift message")
+
+// compactReader decodes values in the Thrift compact protocol from a
+// byte slice. Only the parts of the protocol that Jaeger's messages
+// use are supported; unknown fields (of any type) are skipped.
+type compactReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *compactReader) readByte() (byte, error) {
+	if r.pos >= len(r.buf) {
+		return 0, errTruncated
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *compactReader) readVarint() (uint64, error) {
+	n, size := binary.Uvarint(r.buf[r.pos:])
+	if size <= 0 {
+		return 0, errTruncated
+	}
+	r.pos += size
+	return n, nil
+}
+
+func (r *compactReader) readI64() (int64, error) {
+	n, err := r.readVarint()
+	return int64(n>>1) ^ -int64(n&1), err
+}
+
+func (r *compactReader) readI32() (int32, error) {
+	n, err := r.readI64()
+	if n < math.MinInt32 || n > math.MaxInt32 {
+		return 0, fmt.Errorf("thrift i32 %d is out of range", n)
+	}
+	return int32(n), err
+}
+
+func (r *compactReader) readDouble() (float64, error) {
+	if len(r.buf)-r.pos < 8 {
+		return 0, errTruncated
+	}
+	bits := binary.LittleEndian.Uint64(r.buf[r.pos:])
+	r.pos += 8
+	return math.Float64frombits(bits), nil
+}
+
+func (r *compactReader) readBinary() ([]byte, error) {
+	n, err := r.readVarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.buf)-r.pos) {
+		return nil, errTruncated
+	}
+	b := r.buf[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+func (r *compactReader) readString() (string, error) {
+	b, err := r.readBinary()
+	return string(b), err
+}
+
+// readBool reads the value of a bool field, which the compact protocol
+// encodes in the field's type.
+func readBool(typ byte) bool {
+	return typ == compactTrue
+}
+
+// readMessageBegin reads the header of a message and returns its
+// name.
+func (r *compactReader) readMessageBegin() (string, error) {
+	protocol, err := r.readByte()
+	if err != nil {
+		return "", err
+	}
+	if protocol != compactProtocol {
+		return "", fmt.Errorf("not a thrift compact message (protocol ID %#x)", protocol)
+	}
+	versionAndType, err := r.readByte()
+	if err != nil {
+		return "", err
+	}
+	if versionAndType&0x1f != compactVersion {
+		return "", fmt.Errorf("unsupported thrift compact protocol version %d", versionAndType&0x1f)
+	}
+	if _, err := r.readVarint(); err != nil { // the sequence ID
+		return "", err
+	}
+	return r.readString()
+}
+
+// readStruct reads the fields of a struct, calling field with the ID
+// and type of each. field must consume the field's value, either by
+// reading it or by calling skip.
+func (r *compactReader) readStruct(field func(id int16, typ byte) error) error {
+	var lastID int16
+	for {
+		b, err := r.readByte()
+		if err != nil {
+			return err
+		}
+		typ := b & 0x0f
+		if typ == compactStop {
+			return nil
+		}
+		id := lastID + int16(b>>4)
+		if b>>4 == 0 {
+			n, err := r.readI64()
+			if err != nil {
+				return err
+			}
+			id = int16(n)
+		}
+		lastID = id
+		if err := field(id, typ); err != nil {
+			return err
+		}
+	}
+}
+
+// readList reads the header of a list, and calls elem for each of
+// its elements, which must consume the element.
+func (r *compactReader) readList(elem func(typ byte) error) error {
+	b, err := r.readByte()
+	if err != nil {
+		return err
+	}
+	typ := b & 0x0f
+	size := uint64(b >> 4)
+	if size == 15 {
+		if size, err = r.readVarint(); err != nil {
+			return err
+		}
+	}
+	// every element takes up at least one byte:
+	if size > uint64(len(r.buf)-r.pos) {
+		return errTruncated
+	}
+	for i := uint64(0); i < size; i++ {
+		if err := elem(typ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skip consumes a value of the given type.
+func (r *compactReader) skip(typ byte) error {
+	return r.skipDepth(typ, 0)
+}
+
+func (r *compactReader) skipDepth(typ byte, depth int) error {
+	if depth > maxSkipDepth {
+		return errors.New("thrift message is nested too deeply")
+	}
+	var err error
+	switch typ {
+	case compactTrue, compactFalse:
+		// bool fields have no value beyond their type
+	case compactByte:
+		_, err = r.readByte()
+	case compactI16, compactI32, compactI64:
+		_, err = r.readVarint()
+	case compactDouble:
+		_, err = r.readDouble()
+	case compactBinary:
+		_, err = r.readBinary()
+	case compactList, compactSet:
+		err = r.readList(func(elem byte) error {
+			if elem == compactTrue || elem == compactFalse {
+				// bools in lists take up a byte
+				_, err := r.readByte()
+				return err
+			}
+			return r.skipDepth(elem, depth+1)
+		})
+	case compactMap:
+		var size uint64
+		if size, err = r.readVarint(); err != nil || size == 0 {
+			return err
+		}
+		var kv byte
+		if kv, err = r.readByte(); err != nil {
+			return err
+		}
+		for i := uint64(0); i < size && err == nil; i++ {
+			if err = r.skipDepth(kv>>4, depth+1); err == nil {
+				err = r.skipDepth(kv&0x0f, depth+1)
+			}
+		}
+	case compactStruct:
+		err = r.readStruct(func(_ int16, typ byte) error {
+			return r.skipDepth(typ, depth+1)
+		})
+	default:
+		err = fmt.Errorf("unknown thrift compact type %d", typ)
+	}
+	return err
+}
+
+// binaryWriter encodes values in the Thrift binary protocol.
+type binaryWriter struct {
+	bytes.Buffer
+}
+
+func (w *binaryWriter) writeFieldBegin(typ byte, id int16) {
+	w.WriteByte(typ)
+	w.writeI16(id)
+}
+
+func (w *binaryWriter) writeFieldStop() {
+	w.WriteByte(binaryStop)
+}
+
+func (w *binaryWriter) writeI16(n int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(n))
+	w.Write(b[:])
+}
+
+func (w *binaryWriter) writeI32(n int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(n))
+	w.Write(b[:])
+}
+
+func (w *binaryWriter) writeI64(n int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	w.Write(b[:])
+}
+
+func (w *binaryWriter) writeDouble(f float64) {
+	w.writeI64(int64(math.Float64bits(f)))
+}
+
+func (w *binaryWriter) writeBool(v bool) {
+	if v {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+}
+
+func (w *binaryWriter) writeBinary(b []byte) {
+	w.writeI32(int32(len(b)))
+	w.Write(b)
+}
+
+func (w *binaryWriter) writeString(s string) {
+	w.writeI32(int32(len(s)))
+	w.WriteString(s)
+}
+
+func (w *binaryWriter) writeListBegin(elemType byte, size int) {
+	w.WriteByte(elemType)
+	w.writeI32(int32(size))
+}
@@ -0,0 +1,253 @@
+package veneur
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	// The messages that the old and the new process exchange on the
+	// hot restart socket, once the listeners are handed over:
+	handoffEnd   = "end"
+	handoffReady = "ready"
+	handoffDone  = "done"
+)
+
+// socketLock is the exclusive lock on a unix socket's lock file.
+type socketLock interface {
+	Unlock() error
+}
+
+// handoffFile is a listening socket, or the lock file of a unix socket,
+// that can be passed to another process.
+type handoffFile interface {
+	File() (*os.File, error)
+}
+
+// handoffLock is a lock that can be left for the new process: once
+// handOff was called, unlocking it only closes the lock file.
+type handoffLock interface {
+	handOff()
+}
+
+type openListener struct {
+	key  string
+	file handoffFile
+}
+
+// listenerSet keeps track of the listening sockets that the server
+// opened, and of the locks on its unix sockets, so that they can be
+// handed to a new veneur on a hot restart. It also holds the sockets
+// that were handed to this server, until it takes them into use. The
+// zero value is ready to use.
+type listenerSet struct {
+	mtx       sync.Mutex
+	open      []openListener
+	inherited map[string][]*os.File
+	// handoff is the connection to the process that the listeners
+	// were handed to.
+	handoff net.Conn
+}
+
+// listenerKey identifies a listener across restarts, by what it
+// listens for and its configured (not its concrete) address.
+func listenerKey(protocol, network, address string) string {
+	return fmt.Sprintf("%s %s %s", protocol, network, address)
+}
+
+// add records a listener so that it's handed over on a hot restart.
+// Listeners that can't be passed to another process are ignored.
+func (ls *listenerSet) add(key string, listener interface{}) {
+	file, ok := listener.(handoffFile)
+	if !ok {
+		return
+	}
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+	ls.open = append(ls.open, openListener{key: key, file: file})
+}
+
+// inherit holds on to a file that the previous process handed over.
+func (ls *listenerSet) inherit(key string, file *os.File) {
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+	if ls.inherited == nil {
+		ls.inherited = map[string][]*os.File{}
+	}
+	ls.inherited[key] = append(ls.inherited[key], file)
+}
+
+// take removes the files that were handed over for key and returns
+// them.
+func (ls *listenerSet) take(key string) []*os.File {
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+	files := ls.inherited[key]
+	delete(ls.inherited, key)
+	return files
+}
+
+// listen takes over the listener that was handed over for key, or
+// creates a new one with create.
+func (ls *listenerSet) listen(key string, create func() (net.Listener, error)) (net.Listener, error) {
+	var listener net.Listener
+	var err error
+	if files := ls.take(key); len(files) > 0 {
+		listener, err = net.FileListener(files[0])
+		for _, file := range files {
+			file.Close()
+		}
+		if ul, ok := listener.(*net.UnixListener); ok {
+			// Clean up the socket file when we're done with it,
+			// the same as if we had created it:
+			ul.SetUnlinkOnClose(true)
+		}
+	} else {
+		listener, err = create()
+	}
+	if err != nil {
+		return nil, err
+	}
+	ls.add(key, listener)
+	return listener, nil
+}
+
+// listenPacket takes over the packet connection that was handed over
+// for key, or creates a new one with create.
+func (ls *listenerSet) listenPacket(key string, create func() (net.PacketConn, error)) (net.PacketConn, error) {
+	conns, err := ls.adoptPacketConns(key, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(conns) > 0 {
+		return conns[0], nil
+	}
+	conn, err := create()
+	if err != nil {
+		return nil, err
+	}
+	ls.add(key, conn)
+	return conn, nil
+}
+
+// adoptPacketConns takes over up to max of the packet connections
+// that were handed over for key, and closes the rest.
+func (ls *listenerSet) adoptPacketConns(key string, max int) ([]net.PacketConn, error) {
+	files := ls.take(key)
+	conns := make([]net.PacketConn, 0, len(files))
+	var err error
+	for i, file := range files {
+		if err == nil && i < max {
+			var conn net.PacketConn
+			conn, err = net.FilePacketConn(file)
+			if err == nil {
+				ls.add(key, conn)
+				conns = append(conns, conn)
+			}
+		}
+		file.Close()
+	}
+	if err != nil {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return nil, err
+	}
+	return conns, nil
+}
+
+// files duplicates the file descriptors of all open listeners, to hand
+// them to another process. The caller closes the files.
+func (ls *listenerSet) files() ([]string, []*os.File, error) {
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+	keys := make([]string, 0, len(ls.open))
+	files := make([]*os.File, 0, len(ls.open))
+	for _, l := range ls.open {
+		file, err := l.file.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, fmt.Errorf("could not hand over %s: %v", l.key, err)
+		}
+		keys = append(keys, l.key)
+		files = append(files, file)
+	}
+	return keys, files, nil
+}
+
+// detach makes closing the listeners leave their sockets to the
+// process that they were handed to over conn: unix socket files stay
+// in place, and their locks stay locked.
+func (ls *listenerSet) detach(conn net.Conn) {
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+	ls.handoff = conn
+	for _, l := range ls.open {
+		switch f := l.file.(type) {
+		case *net.UnixListener:
+			f.SetUnlinkOnClose(false)
+		case handoffLock:
+			f.handOff()
+		}
+	}
+}
+
+// handoffConn returns the connection to the process that the listeners
+// were handed to, if they were, and forgets it.
+func (ls *listenerSet) handoffConn() net.Conn {
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+	conn := ls.handoff
+	ls.handoff = nil
+	return conn
+}
+
+// closePacketConns closes the open packet connections, which makes
+// their readers stop once the server is shutting down.
+func (ls *listenerSet) closePacketConns() {
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+	for _, l := range ls.open {
+		if conn, ok := l.file.(net.PacketConn); ok {
+			conn.Close()
+		}
+	}
+}
+
+// closeInherited closes the files that were handed over, but that the
+// server didn't take into use, except for the keys in keep.
+func (ls *listenerSet) closeInherited(keep ...string) {
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+	kept := map[string][]*os.File{}
+	unused := []string{}
+	for key, files := range ls.inherited {
+		if contains(keep, key) {
+			kept[key] = files
+			continue
+		}
+		unused = append(unused, key)
+		for _, file := range files {
+			file.Close()
+		}
+	}
+	ls.inherited = kept
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		log.WithField("listeners", unused).Info("Closed listeners that the configuration doesn't use any more")
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
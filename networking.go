@@ -8,7 +8,8 @@ import (
 	"sync"
 
 	"github.com/sirupsen/logrus"
-	flock "github.com/theckman/go-flock"
+
+	"github.com/stripe/veneur/protocol"
 )
 
 // StartStatsd spawns a goroutine that listens for metrics in statsd
@@ -24,8 +25,12 @@ func StartStatsd(s *Server, a net.Addr, packetPool *sync.Pool) net.Addr {
 	case *net.UnixAddr:
 		_, b := startStatsdUnix(s, addr, packetPool)
 		return b
+	case *protocol.GraphiteAddr:
+		return startGraphite(s, addr, packetPool)
+	case *protocol.InfluxAddr:
+		return startInflux(s, addr, packetPool)
 	default:
-		panic(fmt.Sprintf("Can't listen on %v: only TCP, UDP and unixgram:// are supported", a))
+		panic(fmt.Sprintf("Can't listen on %v: only TCP, UDP, unixgram://, graphite:// and influx:// are supported", a))
 	}
 }
 
@@ -39,11 +44,20 @@ type udpProcessor func(net.PacketConn, *sync.Pool)
 // listener.
 func startProcessingOnUDP(s *Server, protocol string, addr *net.UDPAddr, pool *sync.Pool, proc udpProcessor) net.Addr {
 	reusePort := s.numReaders != 1
-	// If we're reusing the port, make sure we're listening on the
-	// exact same address always; this is mostly relevant for
-	// tests, where port is typically 0 and the initial ListenUDP
-	// call results in a contrete port.
-	if reusePort {
+	key := listenerKey(protocol, addr.Network(), addr.String())
+	// Sockets that the previous veneur handed over are read from
+	// first; they're already bound to the concrete address:
+	inherited, err := s.listeners.adoptPacketConns(key, s.numReaders)
+	if err != nil {
+		panic(fmt.Sprintf("couldn't take over UDP socket %v: %v", addr, err))
+	}
+	if len(inherited) > 0 {
+		addr = inherited[0].LocalAddr().(*net.UDPAddr)
+	} else if reusePort {
+		// If we're reusing the port, make sure we're listening on the
+		// exact same address always; this is mostly relevant for
+		// tests, where port is typically 0 and the initial ListenUDP
+		// call results in a contrete port.
 		sock, err := NewSocket(addr, s.RcvbufBytes, reusePort)
 		if err != nil {
 			panic(fmt.Sprintf("couldn't listen on UDP socket %v: %v", addr, err))
@@ -54,6 +68,10 @@ func startProcessingOnUDP(s *Server, protocol string, addr *net.UDPAddr, pool *s
 	addrChan := make(chan net.Addr, 1)
 	once := sync.Once{}
 	for i := 0; i < s.numReaders; i++ {
+		var sock net.PacketConn
+		if i < len(inherited) {
+			sock = inherited[i]
+		}
 		go func() {
 			defer func() {
 				ConsumePanic(s.Sentry, s.TraceClient, s.Hostname, recover())
@@ -62,13 +80,17 @@ func startProcessingOnUDP(s *Server, protocol string, addr *net.UDPAddr, pool *s
 			// if the sockets support SO_REUSEPORT, then this will cause the
 			// kernel to distribute datagrams across them, for better read
 			// performance
-			sock, err := NewSocket(addr, s.RcvbufBytes, reusePort)
-			if err != nil {
-				// if any goroutine fails to create the socket, we can't really
-				// recover, so we just blow up
-				// this probably indicates a systemic issue, eg lack of
-				// SO_REUSEPORT support
-				panic(fmt.Sprintf("couldn't listen on UDP socket %v: %v", addr, err))
+			if sock == nil {
+				var err error
+				sock, err = NewSocket(addr, s.RcvbufBytes, reusePort)
+				if err != nil {
+					// if any goroutine fails to create the socket, we can't really
+					// recover, so we just blow up
+					// this probably indicates a systemic issue, eg lack of
+					// SO_REUSEPORT support
+					panic(fmt.Sprintf("couldn't listen on UDP socket %v: %v", addr, err))
+				}
+				s.listeners.add(key, sock)
 			}
 			// Pass the address that we are listening on
 			// back to whoever spawned this goroutine so
@@ -94,10 +116,9 @@ func startStatsdUDP(s *Server, addr *net.UDPAddr, packetPool *sync.Pool) net.Add
 }
 
 func startStatsdTCP(s *Server, addr *net.TCPAddr, packetPool *sync.Pool) net.Addr {
-	var listener net.Listener
-	var err error
-
-	listener, err = net.ListenTCP("tcp", addr)
+	listener, err := s.listeners.listen(listenerKey("statsd", addr.Network(), addr.String()), func() (net.Listener, error) {
+		return net.ListenTCP("tcp", addr)
+	})
 	if err != nil {
 		panic(fmt.Sprintf("couldn't listen on TCP socket %v: %v", addr, err))
 	}
@@ -136,6 +157,79 @@ func startStatsdTCP(s *Server, addr *net.TCPAddr, packetPool *sync.Pool) net.Add
 	return listener.Addr()
 }
 
+// startGraphite starts listening for metrics in one of Graphite's
+// carbon protocols, and returns the concrete listening address.
+func startGraphite(s *Server, addr *protocol.GraphiteAddr, packetPool *sync.Pool) net.Addr {
+	if udpAddr, ok := addr.Addr.(*net.UDPAddr); ok {
+		concrete := startProcessingOnUDP(s, "graphite", udpAddr, packetPool, s.ReadGraphiteSocket)
+		return &protocol.GraphiteAddr{Addr: concrete}
+	}
+	protocolName := "graphite"
+	if addr.Pickle {
+		protocolName = "graphite_pickle"
+	}
+	concrete := startProcessingOnTCP(s, protocolName, addr.Addr.(*net.TCPAddr), func(conn net.Conn) {
+		s.handleGraphiteConn(conn, addr.Pickle)
+	})
+	return &protocol.GraphiteAddr{Addr: concrete, Pickle: addr.Pickle}
+}
+
+// startInflux starts listening for metrics in the InfluxDB line
+// protocol, and returns the concrete listening address.
+func startInflux(s *Server, addr *protocol.InfluxAddr, packetPool *sync.Pool) net.Addr {
+	if udpAddr, ok := addr.Addr.(*net.UDPAddr); ok {
+		concrete := startProcessingOnUDP(s, "influx", udpAddr, packetPool, s.ReadInfluxSocket)
+		return &protocol.InfluxAddr{Addr: concrete}
+	}
+	concrete := startProcessingOnTCP(s, "influx", addr.Addr.(*net.TCPAddr), s.handleInfluxConn)
+	return &protocol.InfluxAddr{Addr: concrete}
+}
+
+// startProcessingOnTCP listens on a TCP address until the server shuts
+// down, handling each connection in its own goroutine. It returns the
+// concrete listening address.
+func startProcessingOnTCP(s *Server, protocol string, addr *net.TCPAddr, handle func(net.Conn)) net.Addr {
+	listener, err := s.listeners.listen(listenerKey(protocol, addr.Network(), addr.String()), func() (net.Listener, error) {
+		return net.ListenTCP("tcp", addr)
+	})
+	if err != nil {
+		panic(fmt.Sprintf("couldn't listen on TCP socket %v: %v", addr, err))
+	}
+	go func() {
+		<-s.shutdown
+		err := listener.Close()
+		if err != nil {
+			log.WithError(err).Warn("Ignoring error closing TCP listener")
+		}
+	}()
+
+	log.WithFields(logrus.Fields{
+		"address":  listener.Addr(),
+		"protocol": protocol,
+	}).Info("Listening on TCP address")
+
+	go func() {
+		defer func() {
+			ConsumePanic(s.Sentry, s.TraceClient, s.Hostname, recover())
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-s.shutdown:
+					// occurs when cleanly shutting down the server e.g. in tests; ignore errors
+					log.WithError(err).Info("Ignoring Accept error while shutting down")
+					return
+				default:
+					log.WithError(err).Fatal("TCP accept failed")
+				}
+			}
+			go handle(conn)
+		}
+	}()
+	return listener.Addr()
+}
+
 // startStatsdUnix starts listening for datagram statsd metric packets
 // on a UNIX domain socket address. It does so until the
 // server's shutdown socket is closed. startStatsdUnix returns a channel
@@ -143,12 +237,15 @@ func startStatsdTCP(s *Server, addr *net.TCPAddr, packetPool *sync.Pool) net.Add
 func startStatsdUnix(s *Server, addr *net.UnixAddr, packetPool *sync.Pool) (<-chan struct{}, net.Addr) {
 	done := make(chan struct{})
 	// ensure we are the only ones locking this socket:
-	lock := acquireLockForSocket(addr)
+	lock := acquireLockForSocket(&s.listeners, addr)
 
-	conn, err := net.ListenUnixgram(addr.Network(), addr)
+	packetConn, err := s.listeners.listenPacket(listenerKey("statsd", addr.Network(), addr.String()), func() (net.PacketConn, error) {
+		return net.ListenUnixgram(addr.Network(), addr)
+	})
 	if err != nil {
 		panic(fmt.Sprintf("Couldn't listen on UNIX socket %v: %v", addr, err))
 	}
+	conn := packetConn.(*net.UnixConn)
 
 	// Make the socket connectable by everyone with access to the socket pathname:
 	err = os.Chmod(addr.String(), 0666)
@@ -184,8 +281,10 @@ func StartSSF(s *Server, a net.Addr, tracePool *sync.Pool) net.Addr {
 		a = startSSFUDP(s, addr, tracePool)
 	case *net.UnixAddr:
 		_, a = startSSFUnix(s, addr)
+	case *protocol.JaegerAddr:
+		a = startJaeger(s, addr, tracePool)
 	default:
-		panic(fmt.Sprintf("Can't listen for SSF on %v: only udp:// & unix:// are supported", a))
+		panic(fmt.Sprintf("Can't listen for SSF on %v: only udp://, unix:// & jaeger+udp:// are supported", a))
 	}
 	log.WithFields(logrus.Fields{
 		"address": a.String(),
@@ -198,6 +297,13 @@ func startSSFUDP(s *Server, addr *net.UDPAddr, tracePool *sync.Pool) net.Addr {
 	return startProcessingOnUDP(s, "ssf", addr, tracePool, s.ReadSSFPacketSocket)
 }
 
+// startJaeger starts listening for Jaeger agent emitBatch packets, and
+// returns the concrete listening address.
+func startJaeger(s *Server, addr *protocol.JaegerAddr, tracePool *sync.Pool) net.Addr {
+	concrete := startProcessingOnUDP(s, "jaeger", addr.Addr.(*net.UDPAddr), tracePool, s.ReadJaegerSocket)
+	return &protocol.JaegerAddr{Addr: concrete}
+}
+
 // startSSFUnix starts listening for connections that send framed SSF
 // spans on a UNIX domain socket address. It does so until the
 // server's shutdown socket is closed. startSSFUnix returns a channel
@@ -208,12 +314,15 @@ func startSSFUnix(s *Server, addr *net.UnixAddr) (<-chan struct{}, net.Addr) {
 		panic(fmt.Sprintf("Can't listen for SSF on %v: only udp:// and unix:// addresses are supported", addr))
 	}
 	// ensure we are the only ones locking this socket:
-	lock := acquireLockForSocket(addr)
+	lock := acquireLockForSocket(&s.listeners, addr)
 
-	listener, err := net.ListenUnix(addr.Network(), addr)
+	ln, err := s.listeners.listen(listenerKey("ssf", addr.Network(), addr.String()), func() (net.Listener, error) {
+		return net.ListenUnix(addr.Network(), addr)
+	})
 	if err != nil {
 		panic(fmt.Sprintf("Couldn't listen on UNIX socket %v: %v", addr, err))
 	}
+	listener := ln.(*net.UnixListener)
 
 	// Make the socket connectable by everyone with access to the socket pathname:
 	err = os.Chmod(addr.String(), 0666)
@@ -259,16 +368,24 @@ func startSSFUnix(s *Server, addr *net.UnixAddr) (<-chan struct{}, net.Addr) {
 
 // Acquires exclusive use lock for a given socket file and returns the lock
 // Panic's if unable to acquire lock
-func acquireLockForSocket(addr *net.UnixAddr) *flock.Flock {
+func acquireLockForSocket(listeners *listenerSet, addr *net.UnixAddr) socketLock {
 	lockname := fmt.Sprintf("%s.lock", addr.String())
-	lock := flock.NewFlock(lockname)
-	locked, err := lock.TryLock()
+	key := listenerKey("lock", "file", lockname)
+	// The previous veneur handed over its lock, so the socket is
+	// ours and still in use:
+	if files := listeners.take(key); len(files) > 0 {
+		lock := adoptLock(files[0])
+		listeners.add(key, lock)
+		return lock
+	}
+	lock, locked, err := lockSocketFile(lockname)
 	if err != nil {
 		panic(fmt.Sprintf("Could not acquire the lock %q to listen on %v: %v", lockname, addr, err))
 	}
 	if !locked {
 		panic(fmt.Sprintf("Lock file %q for %v is in use by another process already", lockname, addr))
 	}
+	listeners.add(key, lock)
 	// We have the exclusive use of the socket, clear away any old sockets and listen:
 	_ = os.Remove(addr.String())
 	return lock
@@ -0,0 +1,364 @@
+package otlp
+
+import (
+	"encoding/base64"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/veneur/otlp/otlppb"
+	"github.com/stripe/veneur/samplers"
+)
+
+const (
+	// cumulativeExpiry is how long the baseline of a cumulative
+	// series is kept around after its last data point.
+	cumulativeExpiry = 10 * time.Minute
+)
+
+// convertMetrics turns the data points in an export request into
+// UDPMetrics, calling emit for each of them. It returns the number of
+// data points that it could not convert.
+//
+// Gauges become gauges. Monotonic sums become counters, and
+// non-monotonic ones become counters if they're deltas and gauges
+// otherwise. Both kinds of histograms are fed into veneur histograms,
+// bucket by bucket: all the values in a bucket are treated as the
+// bucket's midpoint. Cumulative sums and histograms are converted to
+// deltas against the previous data point of the same series.
+func (s *Server) convertMetrics(req *otlppb.ExportMetricsServiceRequest, emit func(samplers.UDPMetric)) (rejected int64) {
+	for _, rm := range req.ResourceMetrics {
+		var resourceAttrs []*otlppb.KeyValue
+		if rm.Resource != nil {
+			resourceAttrs = rm.Resource.Attributes
+		}
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				rejected += s.convertMetric(m, resourceAttrs, emit)
+			}
+		}
+	}
+	s.cumulative.expire(time.Now())
+	return rejected
+}
+
+func (s *Server) convertMetric(m *otlppb.Metric, resourceAttrs []*otlppb.KeyValue, emit func(samplers.UDPMetric)) (rejected int64) {
+	switch {
+	case m.Gauge != nil:
+		for _, dp := range m.Gauge.DataPoints {
+			if dp.AsDouble == nil && dp.AsInt == nil {
+				rejected++
+				continue
+			}
+			um := samplers.NewUDPMetric(m.Name, "gauge", dp.Value(), attributeTags(resourceAttrs, dp.Attributes))
+			um.Timestamp = unixSeconds(dp.TimeUnixNano)
+			emit(um)
+		}
+
+	case m.Sum != nil:
+		cumulative := m.Sum.AggregationTemporality == otlppb.AggregationTemporalityCumulative
+		typ := "counter"
+		if cumulative && !m.Sum.IsMonotonic {
+			// an up-down counter's current value is a gauge:
+			typ = "gauge"
+		}
+		for _, dp := range m.Sum.DataPoints {
+			if dp.AsDouble == nil && dp.AsInt == nil {
+				rejected++
+				continue
+			}
+			um := samplers.NewUDPMetric(m.Name, typ, dp.Value(), attributeTags(resourceAttrs, dp.Attributes))
+			um.Timestamp = unixSeconds(dp.TimeUnixNano)
+			if typ == "counter" && cumulative {
+				deltas, ok := s.cumulative.delta(um.MetricKey, dp.StartTimeUnixNano, s.started, "", map[float64]float64{0: dp.Value()})
+				if !ok {
+					continue
+				}
+				um.Value = deltas[0]
+			}
+			emit(um)
+		}
+
+	case m.Histogram != nil:
+		cumulative := m.Histogram.AggregationTemporality == otlppb.AggregationTemporalityCumulative
+		for _, dp := range m.Histogram.DataPoints {
+			buckets, layout := histogramBuckets(dp)
+			s.emitHistogram(m.Name, attributeTags(resourceAttrs, dp.Attributes), dp.StartTimeUnixNano, dp.TimeUnixNano, cumulative, buckets, layout, emit)
+		}
+
+	case m.ExponentialHistogram != nil:
+		cumulative := m.ExponentialHistogram.AggregationTemporality == otlppb.AggregationTemporalityCumulative
+		for _, dp := range m.ExponentialHistogram.DataPoints {
+			buckets, layout := exponentialHistogramBuckets(dp)
+			s.emitHistogram(m.Name, attributeTags(resourceAttrs, dp.Attributes), dp.StartTimeUnixNano, dp.TimeUnixNano, cumulative, buckets, layout, emit)
+		}
+
+	case m.Summary != nil:
+		// veneur can't aggregate pre-computed quantiles:
+		rejected += int64(len(m.Summary.DataPoints))
+	}
+	return rejected
+}
+
+// emitHistogram sends one histogram sample per non-empty bucket,
+// weighted by the bucket's count.
+func (s *Server) emitHistogram(name string, tags []string, start, ts uint64, cumulative bool, buckets map[float64]float64, layout string, emit func(samplers.UDPMetric)) {
+	tmpl := samplers.NewUDPMetric(name, "histogram", float64(0), tags)
+	tmpl.Timestamp = unixSeconds(ts)
+	if cumulative {
+		var ok bool
+		if buckets, ok = s.cumulative.delta(tmpl.MetricKey, start, s.started, layout, buckets); !ok {
+			return
+		}
+	}
+
+	values := make([]float64, 0, len(buckets))
+	for value := range buckets {
+		values = append(values, value)
+	}
+	sort.Float64s(values)
+	for _, value := range values {
+		count := buckets[value]
+		if count <= 0 {
+			continue
+		}
+		um := tmpl
+		um.Value = value
+		um.SampleRate = float32(1 / count)
+		emit(um)
+	}
+}
+
+// histogramBuckets returns the counts of an explicit-bucket histogram
+// keyed by a representative value of each bucket, along with a string
+// describing the bucket layout.
+func histogramBuckets(dp *otlppb.HistogramDataPoint) (map[float64]float64, string) {
+	buckets := map[float64]float64{}
+	bounds := dp.ExplicitBounds
+	if len(dp.BucketCounts) != len(bounds)+1 {
+		// malformed, or no buckets at all. The best we can do is
+		// the average:
+		if dp.Count > 0 && dp.Sum != nil {
+			buckets[*dp.Sum/float64(dp.Count)] = float64(dp.Count)
+		}
+		return buckets, "avg"
+	}
+
+	for i, count := range dp.BucketCounts {
+		if count == 0 {
+			continue
+		}
+		var value float64
+		switch {
+		case len(bounds) == 0:
+			value = 0
+			if dp.Sum != nil {
+				value = *dp.Sum / float64(count)
+			}
+		case i == 0:
+			// (-inf, bounds[0]]
+			value = bounds[0]
+			if dp.Min != nil {
+				value = *dp.Min
+			}
+		case i == len(bounds):
+			// (bounds[n-1], +inf)
+			value = bounds[i-1]
+			if dp.Max != nil {
+				value = *dp.Max
+			}
+		default:
+			value = (bounds[i-1] + bounds[i]) / 2
+		}
+		buckets[clamp(value, dp.Min, dp.Max)] += float64(count)
+	}
+
+	layout := make([]string, len(bounds))
+	for i, b := range bounds {
+		layout[i] = strconv.FormatFloat(b, 'g', -1, 64)
+	}
+	return buckets, strings.Join(layout, ",")
+}
+
+// exponentialHistogramBuckets returns the counts of an exponential
+// histogram keyed by the geometric midpoint of each bucket, along with
+// a string describing the bucket layout.
+func exponentialHistogramBuckets(dp *otlppb.ExponentialHistogramDataPoint) (map[float64]float64, string) {
+	buckets := map[float64]float64{}
+	if dp.ZeroCount > 0 {
+		buckets[0] = float64(dp.ZeroCount)
+	}
+	base := math.Pow(2, math.Pow(2, -float64(dp.Scale)))
+	add := func(b *otlppb.ExponentialHistogramDataPoint_Buckets, sign float64) {
+		if b == nil {
+			return
+		}
+		for i, count := range b.BucketCounts {
+			if count == 0 {
+				continue
+			}
+			// bucket index i covers (base^i, base^(i+1)]:
+			idx := float64(b.Offset) + float64(i)
+			value := sign * math.Pow(base, idx+0.5)
+			buckets[clamp(value, dp.Min, dp.Max)] += float64(count)
+		}
+	}
+	add(dp.Positive, 1)
+	add(dp.Negative, -1)
+	return buckets, strconv.Itoa(int(dp.Scale))
+}
+
+func clamp(value float64, min, max *float64) float64 {
+	if min != nil && value < *min {
+		return *min
+	}
+	if max != nil && value > *max {
+		return *max
+	}
+	return value
+}
+
+func unixSeconds(nanos uint64) int64 {
+	return int64(nanos / uint64(time.Second))
+}
+
+// attributeTags converts OTLP resource and data point attributes into
+// veneur tags. Data point attributes take precedence over resource
+// attributes of the same name.
+func attributeTags(resourceAttrs, attrs []*otlppb.KeyValue) []string {
+	values := make(map[string]string, len(resourceAttrs)+len(attrs))
+	for _, kv := range resourceAttrs {
+		values[kv.Key] = anyValueString(kv.Value)
+	}
+	for _, kv := range attrs {
+		values[kv.Key] = anyValueString(kv.Value)
+	}
+	tags := make([]string, 0, len(values))
+	for k, v := range values {
+		if v == "" {
+			tags = append(tags, k)
+			continue
+		}
+		tags = append(tags, k+":"+v)
+	}
+	return tags
+}
+
+// anyValueString renders an attribute value as a string.
+func anyValueString(v *otlppb.AnyValue) string {
+	switch {
+	case v == nil:
+		return ""
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(*v.IntValue, 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'g', -1, 64)
+	case v.ArrayValue != nil:
+		parts := make([]string, len(v.ArrayValue.Values))
+		for i, elt := range v.ArrayValue.Values {
+			parts[i] = anyValueString(elt)
+		}
+		return "[" + strings.Join(parts, ",") + "]"
+	case v.KvlistValue != nil:
+		parts := make([]string, len(v.KvlistValue.Values))
+		for i, kv := range v.KvlistValue.Values {
+			parts[i] = kv.Key + "=" + anyValueString(kv.Value)
+		}
+		return "{" + strings.Join(parts, ",") + "}"
+	case v.BytesValue != nil:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	}
+	return ""
+}
+
+// cumulativeSeries is the last data point seen for a cumulative sum or
+// histogram.
+type cumulativeSeries struct {
+	start    uint64
+	layout   string
+	values   map[float64]float64
+	lastSeen time.Time
+}
+
+// cumulativeState tracks the last data point of each cumulative
+// series, so that they can be turned into the deltas that veneur's
+// counters and histograms expect.
+type cumulativeState struct {
+	mtx        sync.Mutex
+	series     map[samplers.MetricKey]*cumulativeSeries
+	lastExpiry time.Time
+}
+
+func newCumulativeState() *cumulativeState {
+	return &cumulativeState{
+		series:     map[samplers.MetricKey]*cumulativeSeries{},
+		lastExpiry: time.Now(),
+	}
+}
+
+// delta records the values of a cumulative data point and returns the
+// difference to the previous data point of the series. The values are
+// keyed by bucket (or 0 for sums); layout identifies the bucket
+// boundaries, which must match for the difference to make sense.
+//
+// If the series hasn't been seen before, delta only returns the values
+// if the series started after serverStart; otherwise, they may already
+// have been counted by a previous veneur process, and the data point
+// only serves as the baseline. The same happens when the layout
+// changes. If the series has been reset since the previous data point,
+// all its values are returned.
+func (cs *cumulativeState) delta(key samplers.MetricKey, start, serverStart uint64, layout string, values map[float64]float64) (map[float64]float64, bool) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+
+	prev, ok := cs.series[key]
+	cs.series[key] = &cumulativeSeries{
+		start:    start,
+		layout:   layout,
+		values:   values,
+		lastSeen: time.Now(),
+	}
+	if !ok {
+		return values, start != 0 && start >= serverStart
+	}
+	if prev.layout != layout {
+		return nil, false
+	}
+	if start != prev.start {
+		return values, true
+	}
+
+	deltas := make(map[float64]float64, len(values))
+	for k, v := range values {
+		d := v - prev.values[k]
+		if d < 0 {
+			// the series was reset without a new start time:
+			return values, true
+		}
+		deltas[k] = d
+	}
+	return deltas, true
+}
+
+// expire forgets about the series that haven't been seen for a while.
+// It does the actual work at most once a minute.
+func (cs *cumulativeState) expire(now time.Time) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	if now.Sub(cs.lastExpiry) < time.Minute {
+		return
+	}
+	cs.lastExpiry = now
+	for key, series := range cs.series {
+		if now.Sub(series.lastSeen) > cumulativeExpiry {
+			delete(cs.series, key)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package otlp
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/trace"
+)
+
+// WithTraceClient sets the trace client for the server.  Otherwise it uses
+// trace.DefaultClient.
+func WithTraceClient(c *trace.Client) Option {
+	return func(opts *options) {
+		opts.traceClient = c
+	}
+}
+
+// WithLogger sets the logger for the server. Otherwise it uses the
+// standard logrus logger.
+func WithLogger(log *logrus.Logger) Option {
+	return func(opts *options) {
+		opts.log = log
+	}
+}
+
+// WithSpanIngester enables the OTLP TraceService, sending the spans
+// it receives to the given SpanIngester.
+func WithSpanIngester(ingester SpanIngester) Option {
+	return func(opts *options) {
+		opts.spanOut = ingester
+	}
+}
@@ -0,0 +1,13 @@
+// Package otlppb contains the subset of the OpenTelemetry protocol
+// (OTLP) messages and services that veneur speaks.
+//
+// The types mirror the .proto files in this directory, which are
+// trimmed-down copies of the ones in
+// github.com/open-telemetry/opentelemetry-proto (v1.0.0). Fields that
+// veneur has no use for, like exemplars, are left out; protobuf
+// decoders skip them on the wire. The types rely on the reflection-based
+// marshalers of github.com/golang/protobuf and
+// github.com/gogo/protobuf, which means that members of a oneof are
+// represented as separate pointer fields: exactly one of them should be
+// set.
+package otlppb
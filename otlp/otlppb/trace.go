@@ -0,0 +1,130 @@
+package otlppb
+
+import (
+	"github.com/golang/protobuf/proto"
+)
+
+// SpanKind describes the relationship of a span to its parent and
+// children.
+type SpanKind int32
+
+const (
+	SpanKindUnspecified SpanKind = 0
+	SpanKindInternal    SpanKind = 1
+	SpanKindServer      SpanKind = 2
+	SpanKindClient      SpanKind = 3
+	SpanKindProducer    SpanKind = 4
+	SpanKindConsumer    SpanKind = 5
+)
+
+var spanKindNames = map[SpanKind]string{
+	SpanKindUnspecified: "unspecified",
+	SpanKindInternal:    "internal",
+	SpanKindServer:      "server",
+	SpanKindClient:      "client",
+	SpanKindProducer:    "producer",
+	SpanKindConsumer:    "consumer",
+}
+
+// String returns the lower-case name of the span kind, as used by
+// the OpenTelemetry semantic conventions.
+func (k SpanKind) String() string {
+	if name, ok := spanKindNames[k]; ok {
+		return name
+	}
+	return "unspecified"
+}
+
+// StatusCode is the outcome of a span.
+type StatusCode int32
+
+const (
+	StatusCodeUnset StatusCode = 0
+	StatusCodeOk    StatusCode = 1
+	StatusCodeError StatusCode = 2
+)
+
+// ExportTraceServiceRequest is the request of TraceService.Export,
+// and the body of OTLP/HTTP trace requests.
+type ExportTraceServiceRequest struct {
+	ResourceSpans []*ResourceSpans `protobuf:"bytes,1,rep,name=resource_spans,json=resourceSpans,proto3" json:"resource_spans,omitempty"`
+}
+
+func (m *ExportTraceServiceRequest) Reset()         { *m = ExportTraceServiceRequest{} }
+func (m *ExportTraceServiceRequest) String() string { return proto.CompactTextString(m) }
+func (*ExportTraceServiceRequest) ProtoMessage()    {}
+
+// ExportTraceServiceResponse is the response of TraceService.Export.
+type ExportTraceServiceResponse struct {
+	PartialSuccess *ExportTracePartialSuccess `protobuf:"bytes,1,opt,name=partial_success,json=partialSuccess,proto3" json:"partial_success,omitempty"`
+}
+
+func (m *ExportTraceServiceResponse) Reset()         { *m = ExportTraceServiceResponse{} }
+func (m *ExportTraceServiceResponse) String() string { return proto.CompactTextString(m) }
+func (*ExportTraceServiceResponse) ProtoMessage()    {}
+
+// ExportTracePartialSuccess reports spans that the server accepted
+// the request but could not process.
+type ExportTracePartialSuccess struct {
+	RejectedSpans int64  `protobuf:"varint,1,opt,name=rejected_spans,json=rejectedSpans,proto3" json:"rejected_spans,omitempty"`
+	ErrorMessage  string `protobuf:"bytes,2,opt,name=error_message,json=errorMessage,proto3" json:"error_message,omitempty"`
+}
+
+func (m *ExportTracePartialSuccess) Reset()         { *m = ExportTracePartialSuccess{} }
+func (m *ExportTracePartialSuccess) String() string { return proto.CompactTextString(m) }
+func (*ExportTracePartialSuccess) ProtoMessage()    {}
+
+// ResourceSpans is the set of spans produced by one resource.
+type ResourceSpans struct {
+	Resource   *Resource     `protobuf:"bytes,1,opt,name=resource,proto3" json:"resource,omitempty"`
+	ScopeSpans []*ScopeSpans `protobuf:"bytes,2,rep,name=scope_spans,json=scopeSpans,proto3" json:"scope_spans,omitempty"`
+	SchemaUrl  string        `protobuf:"bytes,3,opt,name=schema_url,json=schemaUrl,proto3" json:"schema_url,omitempty"`
+}
+
+func (m *ResourceSpans) Reset()         { *m = ResourceSpans{} }
+func (m *ResourceSpans) String() string { return proto.CompactTextString(m) }
+func (*ResourceSpans) ProtoMessage()    {}
+
+// ScopeSpans is the set of spans produced by one instrumentation
+// scope.
+type ScopeSpans struct {
+	Scope     *InstrumentationScope `protobuf:"bytes,1,opt,name=scope,proto3" json:"scope,omitempty"`
+	Spans     []*Span               `protobuf:"bytes,2,rep,name=spans,proto3" json:"spans,omitempty"`
+	SchemaUrl string                `protobuf:"bytes,3,opt,name=schema_url,json=schemaUrl,proto3" json:"schema_url,omitempty"`
+}
+
+func (m *ScopeSpans) Reset()         { *m = ScopeSpans{} }
+func (m *ScopeSpans) String() string { return proto.CompactTextString(m) }
+func (*ScopeSpans) ProtoMessage()    {}
+
+// Span is a single operation within a trace. TraceId is 16 bytes
+// long, and SpanId and ParentSpanId are 8 bytes long; ParentSpanId is
+// empty for root spans.
+type Span struct {
+	TraceId                []byte      `protobuf:"bytes,1,opt,name=trace_id,json=traceId,proto3" json:"trace_id,omitempty"`
+	SpanId                 []byte      `protobuf:"bytes,2,opt,name=span_id,json=spanId,proto3" json:"span_id,omitempty"`
+	TraceState             string      `protobuf:"bytes,3,opt,name=trace_state,json=traceState,proto3" json:"trace_state,omitempty"`
+	ParentSpanId           []byte      `protobuf:"bytes,4,opt,name=parent_span_id,json=parentSpanId,proto3" json:"parent_span_id,omitempty"`
+	Name                   string      `protobuf:"bytes,5,opt,name=name,proto3" json:"name,omitempty"`
+	Kind                   SpanKind    `protobuf:"varint,6,opt,name=kind,proto3" json:"kind,omitempty"`
+	StartTimeUnixNano      uint64      `protobuf:"fixed64,7,opt,name=start_time_unix_nano,json=startTimeUnixNano,proto3" json:"start_time_unix_nano,omitempty"`
+	EndTimeUnixNano        uint64      `protobuf:"fixed64,8,opt,name=end_time_unix_nano,json=endTimeUnixNano,proto3" json:"end_time_unix_nano,omitempty"`
+	Attributes             []*KeyValue `protobuf:"bytes,9,rep,name=attributes,proto3" json:"attributes,omitempty"`
+	DroppedAttributesCount uint32      `protobuf:"varint,10,opt,name=dropped_attributes_count,json=droppedAttributesCount,proto3" json:"dropped_attributes_count,omitempty"`
+	Status                 *Status     `protobuf:"bytes,15,opt,name=status,proto3" json:"status,omitempty"`
+}
+
+func (m *Span) Reset()         { *m = Span{} }
+func (m *Span) String() string { return proto.CompactTextString(m) }
+func (*Span) ProtoMessage()    {}
+
+// Status is the outcome of a span, along with an optional
+// description.
+type Status struct {
+	Message string     `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	Code    StatusCode `protobuf:"varint,3,opt,name=code,proto3" json:"code,omitempty"`
+}
+
+func (m *Status) Reset()         { *m = Status{} }
+func (m *Status) String() string { return proto.CompactTextString(m) }
+func (*Status) ProtoMessage()    {}
@@ -0,0 +1,273 @@
+// Package otlp receives telemetry over the OpenTelemetry protocol
+// (OTLP) and sends it to workers.
+//
+// The Server implements the OTLP MetricsService and TraceService
+// both as gRPC services and as the OTLP/HTTP protobuf endpoints (POST
+// /v1/metrics and /v1/traces). It converts the data points it
+// receives into samplers.UDPMetric values, and hashes them to a
+// specific "MetricIngester" in the same way that packets read from
+// statsd sockets are. Spans are converted to SSF and handed to a
+// "SpanIngester".
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context" // This can be replace with "context" after Go 1.8 support is dropped
+	"google.golang.org/grpc"
+
+	"github.com/stripe/veneur/otlp/otlppb"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+const (
+	// MetricsPath is the path of the OTLP/HTTP metrics endpoint.
+	MetricsPath = "/v1/metrics"
+
+	// TracesPath is the path of the OTLP/HTTP traces endpoint.
+	TracesPath = "/v1/traces"
+
+	// maxHTTPBodySize limits the size of OTLP/HTTP request bodies,
+	// after decompression.
+	maxHTTPBodySize = 32 * 1024 * 1024
+
+	protobufContentType = "application/x-protobuf"
+)
+
+// MetricIngester receives metrics that were converted from OTLP.
+type MetricIngester interface {
+	IngestUDP(samplers.UDPMetric)
+}
+
+// SpanIngester receives spans that were converted from OTLP.
+type SpanIngester interface {
+	IngestSpan(*ssf.SSFSpan)
+}
+
+// Server wraps a gRPC server and an HTTP server that implement the
+// OTLP MetricsService and, if a SpanIngester is configured, the OTLP
+// TraceService. A unique metric (name, tags, and type) is always
+// routed to the same MetricIngester.
+type Server struct {
+	grpcServer *grpc.Server
+	httpServer *http.Server
+	metricOuts []MetricIngester
+	opts       *options
+
+	// started is the time (in nanoseconds since the epoch) that
+	// the server was created; cumulative series that started after
+	// it are assumed not to have been reported before.
+	started    uint64
+	cumulative *cumulativeState
+}
+
+type options struct {
+	traceClient *trace.Client
+	log         *logrus.Logger
+	spanOut     SpanIngester
+}
+
+// Option is returned by functions that serve as options to New, like
+// "With..."
+type Option func(*options)
+
+// New creates an unstarted Server with the input MetricIngesters to
+// send output to.
+func New(metricOuts []MetricIngester, opts ...Option) *Server {
+	res := &Server{
+		grpcServer: grpc.NewServer(),
+		metricOuts: metricOuts,
+		opts:       &options{},
+		started:    uint64(time.Now().UnixNano()),
+		cumulative: newCumulativeState(),
+	}
+	for _, opt := range opts {
+		opt(res.opts)
+	}
+
+	if res.opts.traceClient == nil {
+		res.opts.traceClient = trace.DefaultClient
+	}
+	if res.opts.log == nil {
+		res.opts.log = logrus.StandardLogger()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(MetricsPath, res.handleHTTPMetrics)
+	otlppb.RegisterMetricsServiceServer(res.grpcServer, &metricsService{res})
+	if res.opts.spanOut != nil {
+		mux.HandleFunc(TracesPath, res.handleHTTPTraces)
+		otlppb.RegisterTraceServiceServer(res.grpcServer, &traceService{res})
+	}
+	res.httpServer = &http.Server{Handler: mux}
+	return res
+}
+
+// ServeGRPC accepts OTLP/gRPC connections on the listener, and blocks
+// until Stop is called or the listener fails.
+func (s *Server) ServeGRPC(ln net.Listener) error {
+	return s.grpcServer.Serve(ln)
+}
+
+// ServeHTTPListener accepts OTLP/HTTP connections on the listener,
+// and blocks until Stop is called or the listener fails.
+func (s *Server) ServeHTTPListener(ln net.Listener) error {
+	err := s.httpServer.Serve(ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Stop gracefully stops both the gRPC and the HTTP servers, waiting
+// at most for the given timeout before closing the connections that
+// are still in use.
+func (s *Server) Stop(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		done := make(chan struct{})
+		go func() {
+			s.grpcServer.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			s.grpcServer.Stop()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			s.httpServer.Close()
+		}
+	}()
+	wg.Wait()
+}
+
+// metricsService implements the OTLP MetricsService on behalf of a
+// Server. It is a separate type so that Server's own exported
+// methods don't have to match the gRPC service's.
+type metricsService struct {
+	*Server
+}
+
+// Export converts the metrics in the request and sends them to the
+// Server's ingesters.
+func (ms *metricsService) Export(ctx context.Context, req *otlppb.ExportMetricsServiceRequest) (*otlppb.ExportMetricsServiceResponse, error) {
+	return ms.exportMetrics(ctx, req, "grpc"), nil
+}
+
+// exportMetrics is the common implementation of the gRPC and HTTP
+// flavors of MetricsService.Export.
+func (s *Server) exportMetrics(ctx context.Context, req *otlppb.ExportMetricsServiceRequest, protocol string) *otlppb.ExportMetricsServiceResponse {
+	span, _ := trace.StartSpanFromContext(ctx, "veneur.opentracing.otlp.handle_export_metrics")
+	span.SetTag("protocol", protocol)
+	defer span.ClientFinish(s.opts.traceClient)
+
+	// group the metrics by their destination, so each ingester
+	// gets them in the order they were sent:
+	dests := make([][]samplers.UDPMetric, len(s.metricOuts))
+	received := 0
+	rejected := s.convertMetrics(req, func(m samplers.UDPMetric) {
+		received++
+		idx := m.Digest % uint32(len(dests))
+		dests[idx] = append(dests[idx], m)
+	})
+	for i, ms := range dests {
+		for _, m := range ms {
+			s.metricOuts[i].IngestUDP(m)
+		}
+	}
+
+	tags := map[string]string{"protocol": protocol}
+	span.Add(ssf.Count("otlp.metrics_received_total", float32(received), tags))
+	resp := &otlppb.ExportMetricsServiceResponse{}
+	if rejected > 0 {
+		span.Add(ssf.Count("otlp.data_points_rejected_total", float32(rejected), tags))
+		resp.PartialSuccess = &otlppb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: rejected,
+			ErrorMessage:       "summary data points and data points without a value are not supported",
+		}
+	}
+	return resp
+}
+
+// handleHTTPMetrics implements the OTLP/HTTP protobuf flavor of
+// MetricsService.Export.
+func (s *Server) handleHTTPMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	req := &otlppb.ExportMetricsServiceRequest{}
+	if status, err := readProtoRequest(r, req); err != nil {
+		s.opts.log.WithError(err).Debug("Could not read OTLP/HTTP metrics request")
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeProtoResponse(w, s.exportMetrics(r.Context(), req, "http"), s.opts.log)
+}
+
+// readProtoRequest decodes the (possibly gzipped) protobuf body of an
+// OTLP/HTTP request into msg. On failure, it returns the HTTP status
+// that the request should be answered with.
+func readProtoRequest(r *http.Request, msg proto.Message) (int, error) {
+	if ct := r.Header.Get("Content-Type"); ct != protobufContentType {
+		return http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q, only %s is supported", ct, protobufContentType)
+	}
+
+	var body io.Reader = r.Body
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("could not decompress request: %v", err)
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		return http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content encoding %q", r.Header.Get("Content-Encoding"))
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(body, maxHTTPBodySize+1))
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("could not read request: %v", err)
+	}
+	if len(buf) > maxHTTPBodySize {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("request exceeds %d bytes", maxHTTPBodySize)
+	}
+	if err := proto.Unmarshal(buf, msg); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("could not decode request: %v", err)
+	}
+	return http.StatusOK, nil
+}
+
+func writeProtoResponse(w http.ResponseWriter, msg proto.Message, log *logrus.Logger) {
+	buf, err := proto.Marshal(msg)
+	if err != nil {
+		log.WithError(err).Error("Could not encode OTLP/HTTP response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", protobufContentType)
+	io.Copy(w, bytes.NewReader(buf))
+}
@@ -0,0 +1,285 @@
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/stripe/veneur/otlp/otlppb"
+	"github.com/stripe/veneur/samplers"
+)
+
+type testMetricIngester struct {
+	mtx     sync.Mutex
+	metrics []samplers.UDPMetric
+}
+
+func (mi *testMetricIngester) IngestUDP(m samplers.UDPMetric) {
+	mi.mtx.Lock()
+	defer mi.mtx.Unlock()
+	mi.metrics = append(mi.metrics, m)
+}
+
+func newTestServer() (*Server, []*testMetricIngester) {
+	ingesters := []*testMetricIngester{{}, {}}
+	casted := make([]MetricIngester, len(ingesters))
+	for i, ingester := range ingesters {
+		casted[i] = ingester
+	}
+	return New(casted), ingesters
+}
+
+func ingested(ingesters []*testMetricIngester) []samplers.UDPMetric {
+	var all []samplers.UDPMetric
+	for _, ingester := range ingesters {
+		ingester.mtx.Lock()
+		all = append(all, ingester.metrics...)
+		ingester.mtx.Unlock()
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Name < all[j].Name
+	})
+	return all
+}
+
+func metricsRequest(resource []*otlppb.KeyValue, metrics ...*otlppb.Metric) *otlppb.ExportMetricsServiceRequest {
+	return &otlppb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*otlppb.ResourceMetrics{{
+			Resource:     &otlppb.Resource{Attributes: resource},
+			ScopeMetrics: []*otlppb.ScopeMetrics{{Metrics: metrics}},
+		}},
+	}
+}
+
+func TestExportGaugesAndSums(t *testing.T) {
+	s, ingesters := newTestServer()
+	now := uint64(time.Now().UnixNano())
+
+	req := metricsRequest(
+		[]*otlppb.KeyValue{otlppb.StringAttribute("service.name", "frontend")},
+		&otlppb.Metric{
+			Name: "a.gauge",
+			Gauge: &otlppb.Gauge{DataPoints: []*otlppb.NumberDataPoint{{
+				TimeUnixNano: now,
+				AsDouble:     proto.Float64(1.5),
+				Attributes: []*otlppb.KeyValue{
+					otlppb.StringAttribute("service.name", "override"),
+					{Key: "shard", Value: &otlppb.AnyValue{IntValue: proto.Int64(3)}},
+				},
+			}}},
+		},
+		&otlppb.Metric{
+			Name: "a.delta",
+			Sum: &otlppb.Sum{
+				AggregationTemporality: otlppb.AggregationTemporalityDelta,
+				IsMonotonic:            true,
+				DataPoints:             []*otlppb.NumberDataPoint{{AsInt: proto.Int64(4)}},
+			},
+		},
+		&otlppb.Metric{
+			Name: "a.updown",
+			Sum: &otlppb.Sum{
+				AggregationTemporality: otlppb.AggregationTemporalityCumulative,
+				DataPoints:             []*otlppb.NumberDataPoint{{AsInt: proto.Int64(-2)}},
+			},
+		},
+		&otlppb.Metric{
+			Name: "a.summary",
+			Summary: &otlppb.Summary{
+				DataPoints: []*otlppb.SummaryDataPoint{{Count: 1}},
+			},
+		},
+	)
+	resp, err := (&metricsService{s}).Export(context.Background(), req)
+	require.NoError(t, err)
+	require.NotNil(t, resp.PartialSuccess)
+	assert.Equal(t, int64(1), resp.PartialSuccess.RejectedDataPoints)
+
+	metrics := ingested(ingesters)
+	require.Len(t, metrics, 3)
+
+	assert.Equal(t, "a.delta", metrics[0].Name)
+	assert.Equal(t, "counter", metrics[0].Type)
+	assert.Equal(t, float64(4), metrics[0].Value)
+	assert.Equal(t, []string{"service.name:frontend"}, metrics[0].Tags)
+
+	assert.Equal(t, "a.gauge", metrics[1].Name)
+	assert.Equal(t, "gauge", metrics[1].Type)
+	assert.Equal(t, 1.5, metrics[1].Value)
+	assert.Equal(t, []string{"service.name:override", "shard:3"}, metrics[1].Tags)
+	assert.Equal(t, int64(now/uint64(time.Second)), metrics[1].Timestamp)
+
+	assert.Equal(t, "a.updown", metrics[2].Name)
+	assert.Equal(t, "gauge", metrics[2].Type)
+	assert.Equal(t, float64(-2), metrics[2].Value)
+}
+
+func TestExportCumulativeSums(t *testing.T) {
+	s, ingesters := newTestServer()
+	before := s.started - uint64(time.Hour)
+	after := s.started + 1
+
+	sum := func(name string, start uint64, value int64) *otlppb.Metric {
+		return &otlppb.Metric{
+			Name: name,
+			Sum: &otlppb.Sum{
+				AggregationTemporality: otlppb.AggregationTemporalityCumulative,
+				IsMonotonic:            true,
+				DataPoints: []*otlppb.NumberDataPoint{{
+					StartTimeUnixNano: start,
+					AsInt:             proto.Int64(value),
+				}},
+			},
+		}
+	}
+	export := func(metrics ...*otlppb.Metric) []float64 {
+		for _, ingester := range ingesters {
+			ingester.metrics = nil
+		}
+		s.exportMetrics(context.Background(), metricsRequest(nil, metrics...), "test")
+		var values []float64
+		for _, m := range ingested(ingesters) {
+			values = append(values, m.Value.(float64))
+		}
+		return values
+	}
+
+	// a series that started before veneur did only sets the
+	// baseline, one that started after is counted in full:
+	assert.Equal(t, []float64{3}, export(sum("a.old", before, 10), sum("b.new", after, 3)))
+	assert.Equal(t, []float64{5, 1}, export(sum("a.old", before, 15), sum("b.new", after, 4)))
+	// resets, with and without a new start time:
+	assert.Equal(t, []float64{2, 6}, export(sum("a.old", before, 2), sum("b.new", after+1, 6)))
+}
+
+func TestExportHistograms(t *testing.T) {
+	s, ingesters := newTestServer()
+
+	req := metricsRequest(nil,
+		&otlppb.Metric{
+			Name: "a.histogram",
+			Histogram: &otlppb.Histogram{
+				AggregationTemporality: otlppb.AggregationTemporalityDelta,
+				DataPoints: []*otlppb.HistogramDataPoint{{
+					Count:          7,
+					ExplicitBounds: []float64{1, 5, 10},
+					BucketCounts:   []uint64{1, 4, 0, 2},
+					Min:            proto.Float64(0.5),
+					Max:            proto.Float64(20),
+				}},
+			},
+		},
+		&otlppb.Metric{
+			Name: "b.exponential",
+			ExponentialHistogram: &otlppb.ExponentialHistogram{
+				AggregationTemporality: otlppb.AggregationTemporalityDelta,
+				DataPoints: []*otlppb.ExponentialHistogramDataPoint{{
+					Count:     4,
+					Scale:     0,
+					ZeroCount: 1,
+					Positive: &otlppb.ExponentialHistogramDataPoint_Buckets{
+						Offset:       1,
+						BucketCounts: []uint64{2, 1},
+					},
+				}},
+			},
+		},
+	)
+	s.exportMetrics(context.Background(), req, "test")
+
+	type sample struct {
+		value float64
+		rate  float32
+	}
+	samples := map[string][]sample{}
+	for _, m := range ingested(ingesters) {
+		assert.Equal(t, "histogram", m.Type)
+		samples[m.Name] = append(samples[m.Name], sample{m.Value.(float64), m.SampleRate})
+	}
+	assert.Equal(t, []sample{{0.5, 1}, {3, 0.25}, {20, 0.5}}, samples["a.histogram"])
+
+	require.Len(t, samples["b.exponential"], 3)
+	assert.Equal(t, sample{0, 1}, samples["b.exponential"][0])
+	// bucket 1 covers (2, 4], bucket 2 covers (4, 8]:
+	assert.InDelta(t, 2.83, samples["b.exponential"][1].value, 0.01)
+	assert.Equal(t, float32(0.5), samples["b.exponential"][1].rate)
+	assert.InDelta(t, 5.66, samples["b.exponential"][2].value, 0.01)
+	assert.Equal(t, float32(1), samples["b.exponential"][2].rate)
+}
+
+func TestExportConsistentHash(t *testing.T) {
+	s, ingesters := newTestServer()
+	req := metricsRequest(nil,
+		&otlppb.Metric{Name: "a", Gauge: &otlppb.Gauge{DataPoints: []*otlppb.NumberDataPoint{{AsDouble: proto.Float64(1)}}}},
+		&otlppb.Metric{Name: "b", Gauge: &otlppb.Gauge{DataPoints: []*otlppb.NumberDataPoint{{AsDouble: proto.Float64(1)}}}},
+		&otlppb.Metric{Name: "c", Gauge: &otlppb.Gauge{DataPoints: []*otlppb.NumberDataPoint{{AsDouble: proto.Float64(1)}}}},
+	)
+	for i := 0; i < 3; i++ {
+		s.exportMetrics(context.Background(), req, "test")
+	}
+	for i, ingester := range ingesters {
+		for _, m := range ingester.metrics {
+			assert.Equal(t, uint32(i), m.Digest%uint32(len(ingesters)), "%s went to the wrong ingester", m.Name)
+		}
+	}
+}
+
+func TestServeGRPCAndHTTP(t *testing.T) {
+	s, ingesters := newTestServer()
+	grpcLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	httpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.ServeGRPC(grpcLn)
+	go s.ServeHTTPListener(httpLn)
+	defer s.Stop(time.Second)
+
+	req := metricsRequest(nil, &otlppb.Metric{
+		Name:  "a.gauge",
+		Gauge: &otlppb.Gauge{DataPoints: []*otlppb.NumberDataPoint{{AsDouble: proto.Float64(1)}}},
+	})
+
+	conn, err := grpc.Dial(grpcLn.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	resp, err := otlppb.NewMetricsServiceClient(conn).Export(context.Background(), req)
+	require.NoError(t, err)
+	assert.Nil(t, resp.PartialSuccess)
+
+	body, err := proto.Marshal(req)
+	require.NoError(t, err)
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(body)
+	gz.Close()
+	httpReq, err := http.NewRequest(http.MethodPost, "http://"+httpLn.Addr().String()+MetricsPath, &gzipped)
+	require.NoError(t, err)
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("Content-Encoding", "gzip")
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	require.NoError(t, err)
+	defer httpResp.Body.Close()
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	respBody, err := ioutil.ReadAll(httpResp.Body)
+	require.NoError(t, err)
+	require.NoError(t, proto.Unmarshal(respBody, &otlppb.ExportMetricsServiceResponse{}))
+
+	httpResp, err = http.Post("http://"+httpLn.Addr().String()+MetricsPath, "application/json", bytes.NewReader([]byte("{}")))
+	require.NoError(t, err)
+	httpResp.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, httpResp.StatusCode)
+
+	assert.Len(t, ingested(ingesters), 2)
+}
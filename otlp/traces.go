@@ -0,0 +1,161 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"net/http"
+
+	"golang.org/x/net/context"
+
+	"github.com/stripe/veneur/otlp/otlppb"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+const (
+	// serviceNameAttribute is the resource attribute that names
+	// the service which produced a span.
+	serviceNameAttribute = "service.name"
+
+	// unknownService is the service name that OpenTelemetry SDKs
+	// use if none is configured.
+	unknownService = "unknown_service"
+
+	// TraceIDTag is the span tag that holds the full, hex-encoded
+	// 128-bit OTLP trace ID.
+	TraceIDTag = "otlp.trace_id"
+)
+
+// traceService implements the OTLP TraceService on behalf of a
+// Server.
+type traceService struct {
+	*Server
+}
+
+// Export converts the spans in the request and sends them to the
+// Server's SpanIngester.
+func (ts *traceService) Export(ctx context.Context, req *otlppb.ExportTraceServiceRequest) (*otlppb.ExportTraceServiceResponse, error) {
+	return ts.exportTraces(ctx, req, "grpc"), nil
+}
+
+// exportTraces is the common implementation of the gRPC and HTTP
+// flavors of TraceService.Export.
+func (s *Server) exportTraces(ctx context.Context, req *otlppb.ExportTraceServiceRequest, protocol string) *otlppb.ExportTraceServiceResponse {
+	span, _ := trace.StartSpanFromContext(ctx, "veneur.opentracing.otlp.handle_export_traces")
+	span.SetTag("protocol", protocol)
+	defer span.ClientFinish(s.opts.traceClient)
+
+	received := 0
+	var rejected int64
+	for _, rs := range req.ResourceSpans {
+		var resourceAttrs []*otlppb.KeyValue
+		if rs.Resource != nil {
+			resourceAttrs = rs.Resource.Attributes
+		}
+		for _, ss := range rs.ScopeSpans {
+			for _, otlpSpan := range ss.Spans {
+				ssfSpan, ok := convertSpan(otlpSpan, resourceAttrs)
+				if !ok {
+					rejected++
+					continue
+				}
+				received++
+				s.opts.spanOut.IngestSpan(ssfSpan)
+			}
+		}
+	}
+
+	tags := map[string]string{"protocol": protocol}
+	span.Add(ssf.Count("otlp.spans_received_total", float32(received), tags))
+	resp := &otlppb.ExportTraceServiceResponse{}
+	if rejected > 0 {
+		span.Add(ssf.Count("otlp.spans_rejected_total", float32(rejected), tags))
+		resp.PartialSuccess = &otlppb.ExportTracePartialSuccess{
+			RejectedSpans: rejected,
+			ErrorMessage:  "spans must have a 16-byte trace ID and an 8-byte span ID",
+		}
+	}
+	return resp
+}
+
+// handleHTTPTraces implements the OTLP/HTTP protobuf flavor of
+// TraceService.Export.
+func (s *Server) handleHTTPTraces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	req := &otlppb.ExportTraceServiceRequest{}
+	if status, err := readProtoRequest(r, req); err != nil {
+		s.opts.log.WithError(err).Debug("Could not read OTLP/HTTP traces request")
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeProtoResponse(w, s.exportTraces(r.Context(), req, "http"), s.opts.log)
+}
+
+// convertSpan converts an OTLP span into an SSF span. It returns
+// false if the span's IDs are invalid.
+//
+// SSF IDs are (positive) int64s, so the trace ID is made up of the
+// lower 64 bits of the OTLP trace ID, which is the same convention
+// other 64-bit tracers use when interoperating with W3C trace
+// contexts. The full trace ID is kept in the TraceIDTag tag.
+//
+// The service.name resource attribute becomes the span's service,
+// and the other resource attributes and the span's attributes become
+// its tags.
+func convertSpan(span *otlppb.Span, resourceAttrs []*otlppb.KeyValue) (*ssf.SSFSpan, bool) {
+	if len(span.TraceId) != 16 || len(span.SpanId) != 8 {
+		return nil, false
+	}
+	traceID := spanID(span.TraceId[8:])
+	id := spanID(span.SpanId)
+	if traceID == 0 || id == 0 {
+		return nil, false
+	}
+
+	ret := &ssf.SSFSpan{
+		TraceId:        traceID,
+		Id:             id,
+		Name:           span.Name,
+		StartTimestamp: int64(span.StartTimeUnixNano),
+		EndTimestamp:   int64(span.EndTimeUnixNano),
+		Service:        unknownService,
+		Tags:           make(map[string]string, len(resourceAttrs)+len(span.Attributes)+3),
+	}
+	if len(span.ParentSpanId) == 8 {
+		ret.ParentId = spanID(span.ParentSpanId)
+	}
+
+	for _, kv := range resourceAttrs {
+		if kv.Key == serviceNameAttribute {
+			if name := anyValueString(kv.Value); name != "" {
+				ret.Service = name
+			}
+			continue
+		}
+		ret.Tags[kv.Key] = anyValueString(kv.Value)
+	}
+	for _, kv := range span.Attributes {
+		ret.Tags[kv.Key] = anyValueString(kv.Value)
+	}
+	ret.Tags[TraceIDTag] = hex.EncodeToString(span.TraceId)
+	if span.Kind != otlppb.SpanKindUnspecified {
+		ret.Tags["span.kind"] = span.Kind.String()
+	}
+	if span.Status != nil {
+		ret.Error = span.Status.Code == otlppb.StatusCodeError
+		if span.Status.Message != "" {
+			ret.Tags["status.message"] = span.Status.Message
+		}
+	}
+	return ret, true
+}
+
+// spanID converts 8 bytes of an OTLP ID into a positive int64, as
+// used in SSF.
+func spanID(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b) & math.MaxInt64)
+}
@@ -0,0 +1,152 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/stripe/veneur/otlp/otlppb"
+	"github.com/stripe/veneur/ssf"
+)
+
+type testSpanIngester struct {
+	mtx   sync.Mutex
+	spans []*ssf.SSFSpan
+}
+
+func (si *testSpanIngester) IngestSpan(span *ssf.SSFSpan) {
+	si.mtx.Lock()
+	defer si.mtx.Unlock()
+	si.spans = append(si.spans, span)
+}
+
+func TestConvertSpan(t *testing.T) {
+	start := time.Now()
+	span := &otlppb.Span{
+		TraceId:           []byte{0xff, 0xee, 0xdd, 0xcc, 0xbb, 0xaa, 0x99, 0x88, 0x80, 0, 0, 0, 0, 0, 0, 0x2a},
+		SpanId:            []byte{0, 0, 0, 0, 0, 0, 0, 0x2b},
+		ParentSpanId:      []byte{0, 0, 0, 0, 0, 0, 0, 0x2c},
+		Name:              "GET /",
+		Kind:              otlppb.SpanKindServer,
+		StartTimeUnixNano: uint64(start.UnixNano()),
+		EndTimeUnixNano:   uint64(start.Add(time.Second).UnixNano()),
+		Attributes: []*otlppb.KeyValue{
+			otlppb.StringAttribute("http.method", "GET"),
+			{Key: "http.status_code", Value: &otlppb.AnyValue{IntValue: proto.Int64(500)}},
+		},
+		Status: &otlppb.Status{Code: otlppb.StatusCodeError, Message: "oops"},
+	}
+	resource := []*otlppb.KeyValue{
+		otlppb.StringAttribute("service.name", "frontend"),
+		otlppb.StringAttribute("host.name", "box"),
+	}
+
+	ssfSpan, ok := convertSpan(span, resource)
+	require.True(t, ok)
+	// the sign bit of the lower 64 bits is dropped:
+	assert.Equal(t, int64(0x2a), ssfSpan.TraceId)
+	assert.Equal(t, int64(0x2b), ssfSpan.Id)
+	assert.Equal(t, int64(0x2c), ssfSpan.ParentId)
+	assert.Equal(t, "frontend", ssfSpan.Service)
+	assert.Equal(t, "GET /", ssfSpan.Name)
+	assert.Equal(t, start.UnixNano(), ssfSpan.StartTimestamp)
+	assert.Equal(t, start.Add(time.Second).UnixNano(), ssfSpan.EndTimestamp)
+	assert.True(t, ssfSpan.Error)
+	assert.Equal(t, "ffeeddccbbaa9988800000000000002a", ssfSpan.Tags[TraceIDTag])
+	assert.Equal(t, "GET", ssfSpan.Tags["http.method"])
+	assert.Equal(t, "box", ssfSpan.Tags["host.name"])
+	assert.Equal(t, "500", ssfSpan.Tags["http.status_code"])
+	assert.Equal(t, "server", ssfSpan.Tags["span.kind"])
+	assert.Equal(t, "oops", ssfSpan.Tags["status.message"])
+	assert.NotContains(t, ssfSpan.Tags, "service.name")
+}
+
+func TestConvertSpanInvalid(t *testing.T) {
+	valid := func() *otlppb.Span {
+		return &otlppb.Span{
+			TraceId: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+			SpanId:  []byte{0, 0, 0, 0, 0, 0, 0, 1},
+		}
+	}
+	span, ok := convertSpan(valid(), nil)
+	require.True(t, ok)
+	assert.Equal(t, unknownService, span.Service)
+	assert.Equal(t, int64(0), span.ParentId)
+
+	short := valid()
+	short.TraceId = short.TraceId[8:]
+	_, ok = convertSpan(short, nil)
+	assert.False(t, ok)
+
+	zero := valid()
+	zero.SpanId = make([]byte, 8)
+	_, ok = convertSpan(zero, nil)
+	assert.False(t, ok)
+}
+
+func TestServeTraces(t *testing.T) {
+	spans := &testSpanIngester{}
+	s := New(nil, WithSpanIngester(spans))
+	grpcLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	httpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.ServeGRPC(grpcLn)
+	go s.ServeHTTPListener(httpLn)
+	defer s.Stop(time.Second)
+
+	req := &otlppb.ExportTraceServiceRequest{
+		ResourceSpans: []*otlppb.ResourceSpans{{
+			ScopeSpans: []*otlppb.ScopeSpans{{
+				Spans: []*otlppb.Span{
+					{
+						TraceId: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+						SpanId:  []byte{0, 0, 0, 0, 0, 0, 0, 1},
+					},
+					{Name: "invalid"},
+				},
+			}},
+		}},
+	}
+
+	conn, err := grpc.Dial(grpcLn.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	resp, err := otlppb.NewTraceServiceClient(conn).Export(context.Background(), req)
+	require.NoError(t, err)
+	require.NotNil(t, resp.PartialSuccess)
+	assert.Equal(t, int64(1), resp.PartialSuccess.RejectedSpans)
+
+	body, err := proto.Marshal(req)
+	require.NoError(t, err)
+	httpResp, err := http.Post("http://"+httpLn.Addr().String()+TracesPath, "application/x-protobuf", bytes.NewReader(body))
+	require.NoError(t, err)
+	httpResp.Body.Close()
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+
+	spans.mtx.Lock()
+	defer spans.mtx.Unlock()
+	assert.Len(t, spans.spans, 2)
+}
+
+func TestTracesDisabledWithoutIngester(t *testing.T) {
+	s, _ := newTestServer()
+	httpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.ServeHTTPListener(httpLn)
+	defer s.Stop(time.Second)
+
+	httpResp, err := http.Post("http://"+httpLn.Addr().String()+TracesPath, "application/x-protobuf", bytes.NewReader(nil))
+	require.NoError(t, err)
+	httpResp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, httpResp.StatusCode)
+}
@@ -46,6 +46,18 @@ func TestValidMetric(t *testing.T) {
 	assert.False(t, samplers.ValidMetric(m))
 }
 
+func TestParseSSFTimestamp(t *testing.T) {
+	metric := freshSSFMetric()
+	m, err := samplers.ParseMetricSSF(metric)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), m.Timestamp)
+
+	metric.Timestamp = 1700000000123456789
+	m, err = samplers.ParseMetricSSF(metric)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1700000000), m.Timestamp)
+}
+
 func TestValidTrace(t *testing.T) {
 	trace := &ssf.SSFSpan{}
 	assert.False(t, protocol.ValidTrace(trace))
@@ -503,6 +515,62 @@ func TestParser(t *testing.T) {
 	assert.Equal(t, "counter", m.Type, "Type")
 }
 
+func TestNewUDPMetric(t *testing.T) {
+	parsed, err := samplers.ParseMetric([]byte("a.b.c:1|c|#foo:bar,baz:quz,veneurglobalonly"))
+	require.NoError(t, err)
+
+	m := samplers.NewUDPMetric("a.b.c", "counter", float64(1), []string{"veneurglobalonly", "foo:bar", "baz:quz"})
+	assert.Equal(t, *parsed, m, "should be equivalent to the parsed metric")
+}
+
+func TestParseInfluxLine(t *testing.T) {
+	metrics, err := samplers.ParseInfluxLine([]byte(`cpu,host=web01,region=us\ east usage_user=12.5,usage_idle=80i,ok=true,note="a, b=c" 1556813561098000000`), time.Nanosecond)
+	require.NoError(t, err)
+	require.Len(t, metrics, 3)
+
+	assert.Equal(t, "cpu.usage_user", metrics[0].Name)
+	assert.Equal(t, "gauge", metrics[0].Type)
+	assert.Equal(t, 12.5, metrics[0].Value)
+	assert.Equal(t, []string{"host:web01", "region:us east"}, metrics[0].Tags)
+	assert.Equal(t, int64(1556813561), metrics[0].Timestamp)
+
+	assert.Equal(t, "cpu.usage_idle", metrics[1].Name)
+	assert.Equal(t, float64(80), metrics[1].Value)
+	assert.Equal(t, "cpu.ok", metrics[2].Name)
+	assert.Equal(t, float64(1), metrics[2].Value)
+
+	// escaped measurement and field key, no timestamp, other precision:
+	metrics, err = samplers.ParseInfluxLine([]byte(`disk\,io free\ bytes=3u`), time.Second)
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "disk,io.free bytes", metrics[0].Name)
+	assert.Empty(t, metrics[0].Tags)
+	assert.Equal(t, int64(0), metrics[0].Timestamp)
+
+	metrics, err = samplers.ParseInfluxLine([]byte("mem used=1 1556813561"), time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1556813561), metrics[0].Timestamp)
+
+	for _, line := range []string{"", "   ", "# a comment"} {
+		metrics, err := samplers.ParseInfluxLine([]byte(line), time.Nanosecond)
+		assert.NoError(t, err)
+		assert.Empty(t, metrics)
+	}
+	for _, line := range []string{
+		"cpu",
+		",host=a value=1",
+		"cpu,host value=1",
+		"cpu value",
+		"cpu value=abc",
+		"cpu value=1i2",
+		`cpu value="unterminated`,
+		"cpu value=1 notatimestamp",
+	} {
+		_, err := samplers.ParseInfluxLine([]byte(line), time.Nanosecond)
+		assert.Error(t, err, "%q should not parse", line)
+	}
+}
+
 func TestParserGauge(t *testing.T) {
 	m, _ := samplers.ParseMetric([]byte("a.b.c:1|g"))
 	assert.NotNil(t, m, "Got nil metric!")
@@ -619,6 +687,13 @@ func TestInvalidPackets(t *testing.T) {
 		"foo:1|c|@1.1":                       "<=1",
 		"foo:1|c|@0.5|@0.2":                  "multiple sample rates",
 		"foo:1|c|#foo|#bar":                  "multiple tag sections",
+		"foo:1|c|Tnow":                       "timestamp",
+		"foo:1|c|T-5":                        "timestamp",
+		"foo:1|c|T1|T2":                      "multiple timestamps",
+		"foo:1|c|c:abc|c:def":                "multiple container IDs",
+		"foo:1|c|c:":                         "unknown section",
+		"foo:1::2|d":                         "metric value",
+		"foo:1:2|d":                          "expected 1 value",
 	}
 
 	for packet, errContent := range table {
@@ -628,6 +703,54 @@ func TestInvalidPackets(t *testing.T) {
 	}
 }
 
+func TestParseMultiValue(t *testing.T) {
+	metrics, err := samplers.ParseMetrics([]byte("a.b.c:1:2.5:3|d|@0.5|#foo:bar"))
+	require.NoError(t, err)
+	require.Len(t, metrics, 3)
+	single, err := samplers.ParseMetric([]byte("a.b.c:1|d|@0.5|#foo:bar"))
+	require.NoError(t, err)
+	for i, value := range []float64{1, 2.5, 3} {
+		expected := *single
+		expected.Value = value
+		assert.Equal(t, expected, metrics[i])
+	}
+
+	// set members may contain colons:
+	metrics, err = samplers.ParseMetrics([]byte("a.b.c:user:42|s"))
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "user:42", metrics[0].Value)
+}
+
+func TestParseTimestamp(t *testing.T) {
+	m, err := samplers.ParseMetric([]byte("a.b.c:1|g|#foo:bar|T1700000000"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1700000000), m.Timestamp)
+
+	// the timestamp isn't part of the metric's identity:
+	untimed, err := samplers.ParseMetric([]byte("a.b.c:1|g|#foo:bar"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), untimed.Timestamp)
+	assert.Equal(t, untimed.Digest, m.Digest)
+}
+
+func TestParseContainerID(t *testing.T) {
+	m, err := samplers.ParseMetric([]byte("a.b.c:1|c|c:83c0a99c0a54c0c1|#foo:bar,veneurlocalonly|@0.5"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"container_id:83c0a99c0a54c0c1", "foo:bar"}, m.Tags)
+	assert.Equal(t, samplers.LocalOnly, m.Scope)
+
+	// it's the same as if the client had sent the tag itself:
+	tagged, err := samplers.ParseMetric([]byte("a.b.c:1|c|@0.5|#veneurlocalonly,foo:bar,container_id:83c0a99c0a54c0c1"))
+	require.NoError(t, err)
+	assert.Equal(t, tagged, m)
+
+	m, err = samplers.ParseMetric([]byte("a.b.c:1|c|c:83c0a99c0a54c0c1"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"container_id:83c0a99c0a54c0c1"}, m.Tags)
+	assert.Equal(t, "container_id:83c0a99c0a54c0c1", m.JoinedTags)
+}
+
 func TestLocalOnlyEscape(t *testing.T) {
 	m, err := samplers.ParseMetric([]byte("a.b.c:1|h|#veneurlocalonly,tag2:quacks"))
 	assert.NoError(t, err, "should have no error parsing")
@@ -13,6 +13,8 @@ import (
 // When a plugin is registered, the number of metrics flushed successfully and
 // the number of errors encountered are automatically reported by veneur, using
 // the plugin name.
+// Plugins that need to finish work when veneur shuts down can implement a
+// Stop(context.Context) error method, like sinks.Stopper.
 type Plugin interface {
 	Flush(ctx context.Context, metrics []samplers.InterMetric) error
 	Name() string
@@ -15,6 +15,9 @@ import (
 //   udp6://127.0.0.1:8000
 //   unix:///tmp/foo.sock
 //   tcp://127.0.0.1:9002
+//   graphite://127.0.0.1:2003
+//   influx+udp://127.0.0.1:8089
+//   jaeger+udp://127.0.0.1:6831
 func ResolveAddr(str string) (net.Addr, error) {
 	u, err := url.Parse(str)
 	if err != nil {
@@ -39,6 +42,59 @@ func ResolveAddr(str string) (net.Addr, error) {
 			return nil, err
 		}
 		return addr, nil
+	case "graphite", "graphite+pickle":
+		addr, err := net.ResolveTCPAddr("tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &GraphiteAddr{Addr: addr, Pickle: u.Scheme == "graphite+pickle"}, nil
+	case "graphite+udp":
+		addr, err := net.ResolveUDPAddr("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &GraphiteAddr{Addr: addr}, nil
+	case "influx":
+		addr, err := net.ResolveTCPAddr("tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &InfluxAddr{Addr: addr}, nil
+	case "influx+udp":
+		addr, err := net.ResolveUDPAddr("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &InfluxAddr{Addr: addr}, nil
+	case "jaeger+udp":
+		addr, err := net.ResolveUDPAddr("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &JaegerAddr{Addr: addr}, nil
 	}
 	return nil, fmt.Errorf("unknown address family %q on address %q", u.Scheme, u.String())
 }
+
+// GraphiteAddr is the address of a listener for Graphite's carbon
+// protocols, as opposed to statsd. Addr is a *net.TCPAddr for the
+// plaintext (graphite://) and pickle (graphite+pickle://) protocols, and
+// a *net.UDPAddr for plaintext over UDP (graphite+udp://).
+type GraphiteAddr struct {
+	net.Addr
+	Pickle bool
+}
+
+// InfluxAddr is the address of a listener for the InfluxDB line
+// protocol. Addr is a *net.TCPAddr for influx:// addresses, and a
+// *net.UDPAddr for influx+udp:// addresses.
+type InfluxAddr struct {
+	net.Addr
+}
+
+// JaegerAddr is the address of a listener for the Thrift compact
+// protocol that Jaeger clients send spans to their local agent in. Addr
+// is a *net.UDPAddr.
+type JaegerAddr struct {
+	net.Addr
+}
@@ -18,6 +18,12 @@ func TestListenAddr(t *testing.T) {
 		{"unix:///tmp/foo.sock", "unix", "/tmp/foo.sock"},
 		{"unixgram:///tmp/foo.sock", "unixgram", "/tmp/foo.sock"},
 		{"unixpacket:///tmp/foo.sock", "unixpacket", "/tmp/foo.sock"},
+		{"graphite://127.0.0.1:2003", "tcp", "127.0.0.1:2003"},
+		{"graphite+udp://127.0.0.1:2003", "udp", "127.0.0.1:2003"},
+		{"graphite+pickle://127.0.0.1:2004", "tcp", "127.0.0.1:2004"},
+		{"influx://127.0.0.1:8089", "tcp", "127.0.0.1:8089"},
+		{"influx+udp://127.0.0.1:8089", "udp", "127.0.0.1:8089"},
+		{"jaeger+udp://127.0.0.1:6831", "udp", "127.0.0.1:6831"},
 	}
 	for _, test := range tests {
 		addr, err := ResolveAddr(test.input)
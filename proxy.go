@@ -59,6 +59,10 @@ type Proxy struct {
 	AcceptingGRPCForwards      bool
 	ForwardTimeout             time.Duration
 
+	// forwardBalancer picks the destinations of metrics forwarded over
+	// HTTP on ForwardDestinations.
+	forwardBalancer *proxysrv.Balancer
+
 	usingConsul     bool
 	usingKubernetes bool
 	enableProfiling bool
@@ -157,6 +161,18 @@ func NewProxyFromConfig(logger *logrus.Logger, conf ProxyConfig) (p Proxy, err e
 	p.TraceDestinations = consistent.New()
 	p.ForwardGRPCDestinations = consistent.New()
 
+	if conf.HashRingLoadFactor != 0 && conf.HashRingLoadFactor < 1 {
+		err = fmt.Errorf("hash_ring_load_factor must be at least 1, not %v", conf.HashRingLoadFactor)
+		logger.WithError(err).Error("Invalid hash ring settings")
+		return
+	}
+	if conf.HashRingReplicationFactor < 0 {
+		err = fmt.Errorf("hash_ring_replication_factor must be positive, not %d", conf.HashRingReplicationFactor)
+		logger.WithError(err).Error("Invalid hash ring settings")
+		return
+	}
+	p.forwardBalancer = proxysrv.NewBalancer(conf.HashRingLoadFactor, conf.HashRingReplicationFactor)
+
 	if conf.ForwardTimeout != "" {
 		p.ForwardTimeout, err = time.ParseDuration(conf.ForwardTimeout)
 		if err != nil {
@@ -250,6 +266,8 @@ func NewProxyFromConfig(logger *logrus.Logger, conf ProxyConfig) (p Proxy, err e
 			proxysrv.WithForwardTimeout(p.ForwardTimeout),
 			proxysrv.WithLog(logrus.NewEntry(log)),
 			proxysrv.WithTraceClient(p.TraceClient),
+			proxysrv.WithLoadFactor(conf.HashRingLoadFactor),
+			proxysrv.WithReplicationFactor(conf.HashRingReplicationFactor),
 		)
 		if err != nil {
 			logger.WithError(err).Fatal("Failed to initialize the gRPC server")
@@ -595,13 +613,22 @@ func (p *Proxy) ProxyMetrics(ctx context.Context, jsonMetrics []samplers.JSONMet
 	)...)
 
 	jsonMetricsByDestination := make(map[string][]samplers.JSONMetric)
-	for _, h := range p.ForwardDestinations.Members() {
+	members := p.ForwardDestinations.Members()
+	for _, h := range members {
 		jsonMetricsByDestination[h] = make([]samplers.JSONMetric, 0)
 	}
+	p.forwardBalancer.SetMembers(members)
 
 	for _, jm := range jsonMetrics {
-		dest, _ := p.ForwardDestinations.Get(jm.MetricKey.String())
-		jsonMetricsByDestination[dest] = append(jsonMetricsByDestination[dest], jm)
+		dests, _ := p.forwardBalancer.Destinations(p.ForwardDestinations, jm.MetricKey.String())
+		for i, dest := range dests {
+			replica := jm
+			if tag := p.forwardBalancer.ReplicaTag(i); tag != "" {
+				replica.Tags = append(append(make([]string, 0, len(jm.Tags)+1), jm.Tags...), tag)
+				replica.JoinedTags = strings.Join(replica.Tags, ",")
+			}
+			jsonMetricsByDestination[dest] = append(jsonMetricsByDestination[dest], replica)
+		}
 	}
 
 	// nb The response has already been returned at this point, because we
@@ -656,12 +683,19 @@ func (p *Proxy) doPost(ctx context.Context, wg *sync.WaitGroup, destination stri
 func (p *Proxy) ReportRuntimeMetrics() {
 	mem := &runtime.MemStats{}
 	runtime.ReadMemStats(mem)
-	metrics.ReportBatch(p.TraceClient, []*ssf.SSFSample{
+	samples := []*ssf.SSFSample{
 		ssf.Gauge("mem.heap_alloc_bytes", float32(mem.HeapAlloc), nil),
 		ssf.Gauge("gc.number", float32(mem.NumGC), nil),
 		ssf.Gauge("gc.pause_total_ns", float32(mem.PauseTotalNs), nil),
 		ssf.Gauge("gc.alloc_heap_bytes", float32(mem.HeapAlloc), nil),
-	})
+	}
+	if p.forwardBalancer != nil {
+		for dest, load := range p.forwardBalancer.Loads() {
+			samples = append(samples, ssf.Gauge("proxy.destination_load", float32(load),
+				map[string]string{"destination": dest, "protocol": "http"}))
+		}
+	}
+	metrics.ReportBatch(p.TraceClient, samples)
 }
 
 // Shutdown signals the server to shut down after closing all
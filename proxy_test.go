@@ -3,6 +3,7 @@ package veneur
 import (
 	"compress/zlib"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -192,6 +193,63 @@ func TestConsistentForward(t *testing.T) {
 	}
 }
 
+func TestHashRingSettings(t *testing.T) {
+	cfg := generateProxyConfig()
+	cfg.HashRingLoadFactor = 0.5
+	_, err := NewProxyFromConfig(logrus.New(), cfg)
+	assert.Error(t, err, "a load factor below 1 is invalid")
+
+	cfg = generateProxyConfig()
+	cfg.HashRingReplicationFactor = -1
+	_, err = NewProxyFromConfig(logrus.New(), cfg)
+	assert.Error(t, err)
+}
+
+func TestReplicatedForward(t *testing.T) {
+	cfg := generateProxyConfig()
+	cfg.ConsulTraceServiceName = ""
+	cfg.ConsulForwardServiceName = ""
+	cfg.HashRingReplicationFactor = 2
+
+	var mtx sync.Mutex
+	received := map[string]int{}
+	var tags []string
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			zr, err := zlib.NewReader(r.Body)
+			require.NoError(t, err)
+			var metrics []samplers.JSONMetric
+			require.NoError(t, json.NewDecoder(zr).Decode(&metrics))
+			mtx.Lock()
+			defer mtx.Unlock()
+			received[name]++
+			for _, m := range metrics {
+				tags = append(tags, m.JoinedTags)
+			}
+		}
+	}
+	a := httptest.NewServer(handler("a"))
+	defer a.Close()
+	b := httptest.NewServer(handler("b"))
+	defer b.Close()
+
+	cfg.ForwardAddress = a.URL
+	server, err := NewProxyFromConfig(logrus.New(), cfg)
+	require.NoError(t, err)
+	server.ForwardDestinations.Add(b.URL)
+
+	ctr := samplers.Counter{Name: "foo", Tags: []string{}}
+	ctr.Sample(20.0, 1.0)
+	jsonCtr, err := ctr.Export()
+	require.NoError(t, err)
+	server.ProxyMetrics(context.Background(), []samplers.JSONMetric{jsonCtr}, "foo.com")
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, map[string]int{"a": 1, "b": 1}, received, "the metric goes to both destinations")
+	assert.ElementsMatch(t, []string{"veneur_replica:0", "veneur_replica:1"}, tags, "each replica is tagged")
+}
+
 func TestTimeout(t *testing.T) {
 	defer log.SetLevel(log.Level)
 	log.SetLevel(logrus.ErrorLevel)
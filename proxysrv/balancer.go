@@ -0,0 +1,199 @@
+package proxysrv
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"stathat.com/c/consistent"
+)
+
+// ReplicaTagKey is the key of the tag that marks which replica of a
+// metric a destination received, if metrics are replicated. Every
+// destination flushes its replica, and which destination gets which
+// replica changes when one of them fails, so queries should take the
+// maximum across replicas rather than select one: a query for
+// veneur_replica:0 loses the metrics whose first destination failed.
+const ReplicaTagKey = "veneur_replica"
+
+// Balancer picks the destinations of metrics on a consistent hash ring.
+//
+// By default, a metric goes to the destination that its key hashes to.
+// With a load factor, the Balancer uses consistent hashing with bounded
+// loads: it counts the metrics it sends to each destination, and a key
+// goes to the first destination that follows it on the ring and hasn't
+// been sent more than the load factor times the average number of
+// metrics yet. So a destination that hot keys hash to doesn't get the
+// keys that follow, and they spill over to the next destinations on
+// the ring. A key sticks to the destinations it was assigned until the
+// loads are reported with Loads, and keeps them after that unless
+// they're over the bound, so that it's aggregated in one place. Since
+// the loads are what this proxy observed, two proxies may send the same
+// key to different destinations while their loads differ.
+//
+// With a replication factor of n, each metric goes to the n destinations
+// that follow its key on the ring, so that it survives the failure of
+// n-1 of them. Each replica is tagged with ReplicaTag.
+type Balancer struct {
+	loadFactor float64
+	replicas   int
+
+	mtx sync.Mutex
+	// assigned are the destinations of the keys seen since the last
+	// call to Loads, with bounded loads, and previous are the ones
+	// before that.
+	assigned map[string][]string
+	previous map[string][]string
+	// sent is the number of metrics sent to each destination since
+	// the last call to Loads, and total is their sum.
+	sent    map[string]int64
+	total   int64
+	members []string
+}
+
+// NewBalancer returns a Balancer that bounds destination loads to
+// loadFactor times the average load, if loadFactor is at least 1, and
+// sends each metric to replicas destinations.
+func NewBalancer(loadFactor float64, replicas int) *Balancer {
+	if loadFactor < 1 {
+		loadFactor = 0
+	}
+	if replicas < 1 {
+		replicas = 1
+	}
+	return &Balancer{
+		loadFactor: loadFactor,
+		replicas:   replicas,
+		assigned:   map[string][]string{},
+		sent:       map[string]int64{},
+	}
+}
+
+// SetMembers tells the Balancer the members of the ring that it picks
+// destinations from. If they changed, keys are assigned anew.
+func (b *Balancer) SetMembers(members []string) {
+	sorted := make([]string, len(members))
+	copy(sorted, members)
+	sort.Strings(sorted)
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if equalStrings(sorted, b.members) {
+		return
+	}
+	b.members = sorted
+	b.assigned = map[string][]string{}
+	b.previous = nil
+}
+
+// Destinations returns the destinations that a metric with key should
+// be sent to, and counts it towards their load.
+func (b *Balancer) Destinations(ring *consistent.Consistent, key string) ([]string, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	var dests []string
+	if b.loadFactor == 0 {
+		var err error
+		dests, err = ring.GetN(key, b.replicas)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var ok bool
+		if dests, ok = b.assigned[key]; !ok {
+			var err error
+			dests, err = b.assign(ring, key)
+			if err != nil {
+				return nil, err
+			}
+			b.assigned[key] = dests
+		}
+	}
+	for _, dest := range dests {
+		b.sent[dest]++
+	}
+	b.total += int64(len(dests))
+	return dests, nil
+}
+
+// capacity is the load that a destination may have before it takes on
+// another key, out of n destinations.
+func (b *Balancer) capacity(n int) float64 {
+	return b.loadFactor * float64(b.total+int64(b.replicas)) / float64(n)
+}
+
+// assign picks the destinations of a key that hasn't been assigned
+// since the last call to Loads: the ones it had before, if they aren't
+// over capacity, or else the first destinations that follow the key on
+// the ring and aren't at capacity. If there aren't enough of those, it
+// fills up with the first ones that are.
+func (b *Balancer) assign(ring *consistent.Consistent, key string) ([]string, error) {
+	candidates, err := ring.GetN(key, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	capacity := b.capacity(len(candidates))
+	if prev, ok := b.previous[key]; ok {
+		keep := true
+		for _, dest := range prev {
+			if float64(b.sent[dest]) >= capacity || !strInSlice(dest, candidates) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			return prev, nil
+		}
+	}
+
+	dests := make([]string, 0, b.replicas)
+	var full []string
+	for _, c := range candidates {
+		if len(dests) == b.replicas {
+			break
+		}
+		if float64(b.sent[c]) < capacity {
+			dests = append(dests, c)
+		} else {
+			full = append(full, c)
+		}
+	}
+	for j := 0; len(dests) < b.replicas && j < len(full); j++ {
+		dests = append(dests, full[j])
+	}
+	return dests, nil
+}
+
+// ReplicaTag returns the tag that marks the copy of a metric that goes
+// to the nth of its destinations, or "" if metrics aren't replicated.
+func (b *Balancer) ReplicaTag(n int) string {
+	if b.replicas == 1 {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", ReplicaTagKey, n)
+}
+
+// Loads returns the number of metrics sent to each destination since the
+// last call, and starts counting them anew.
+func (b *Balancer) Loads() map[string]int64 {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	sent := b.sent
+	b.sent, b.total = map[string]int64{}, 0
+	b.previous, b.assigned = b.assigned, map[string][]string{}
+	return sent
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package proxysrv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"stathat.com/c/consistent"
+)
+
+func testRing(members ...string) *consistent.Consistent {
+	ring := consistent.New()
+	ring.Set(members)
+	return ring
+}
+
+func TestBalancerPlain(t *testing.T) {
+	ring := testRing("a:1", "b:1", "c:1")
+	b := NewBalancer(0, 1)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("metric.%d", i)
+		dests, err := b.Destinations(ring, key)
+		require.NoError(t, err)
+		expected, _ := ring.Get(key)
+		assert.Equal(t, []string{expected}, dests, "without a load factor, keys go where they hash to")
+	}
+}
+
+func TestBalancerBoundedLoads(t *testing.T) {
+	ring := testRing("a:1", "b:1", "c:1", "d:1")
+	b := NewBalancer(1.25, 1)
+	b.SetMembers(ring.Members())
+
+	// one hot metric and many cold ones:
+	hot, err := b.Destinations(ring, "hot")
+	require.NoError(t, err)
+	cold := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		dests, err := b.Destinations(ring, "hot")
+		require.NoError(t, err)
+		assert.Equal(t, hot, dests, "keys stick to their destination")
+		dests, err = b.Destinations(ring, fmt.Sprintf("metric.%d", i))
+		require.NoError(t, err)
+		cold[dests[0]]++
+	}
+	assert.True(t, cold[hot[0]] <= 1, "the hot destination gets %d cold metrics", cold[hot[0]])
+
+	loads := b.Loads()
+	var total int64
+	for _, load := range loads {
+		total += load
+	}
+	assert.Equal(t, int64(2001), total)
+	for dest, load := range loads {
+		if dest != hot[0] {
+			assert.True(t, float64(load) <= 1.25*float64(total)/4+1, "%s has a load of %d", dest, load)
+		}
+	}
+	assert.Empty(t, b.Loads(), "loads are reset when they're reported")
+
+	dests, err := b.Destinations(ring, "hot")
+	require.NoError(t, err)
+	assert.Equal(t, hot, dests, "keys keep their destination after the loads are reported")
+}
+
+func TestBalancerPlainOverloads(t *testing.T) {
+	// without a load factor, the cold metrics that hash to the hot
+	// destination still go there:
+	ring := testRing("a:1", "b:1", "c:1", "d:1")
+	b := NewBalancer(0, 1)
+	hot, err := b.Destinations(ring, "hot")
+	require.NoError(t, err)
+	cold := 0
+	for i := 0; i < 1000; i++ {
+		b.Destinations(ring, "hot")
+		dests, err := b.Destinations(ring, fmt.Sprintf("metric.%d", i))
+		require.NoError(t, err)
+		if dests[0] == hot[0] {
+			cold++
+		}
+	}
+	assert.True(t, cold > 100, "the hot destination gets %d cold metrics", cold)
+}
+
+func TestBalancerUnloaded(t *testing.T) {
+	// while the loads are even, keys go where they hash to:
+	ring := testRing("a:1", "b:1", "c:1")
+	for i := 0; i < 100; i++ {
+		b := NewBalancer(1.1, 1)
+		key := fmt.Sprintf("metric.%d", i)
+		dests, err := b.Destinations(ring, key)
+		require.NoError(t, err)
+		expected, _ := ring.Get(key)
+		assert.Equal(t, []string{expected}, dests, key)
+	}
+}
+
+func TestBalancerReplication(t *testing.T) {
+	ring := testRing("a:1", "b:1", "c:1")
+	for _, loadFactor := range []float64{0, 1.5} {
+		b := NewBalancer(loadFactor, 2)
+		for i := 0; i < 100; i++ {
+			dests, err := b.Destinations(ring, fmt.Sprintf("metric.%d", i))
+			require.NoError(t, err)
+			require.Len(t, dests, 2)
+			assert.NotEqual(t, dests[0], dests[1], "replicas go to different destinations")
+		}
+	}
+
+	b := NewBalancer(0, 5)
+	dests, err := b.Destinations(ring, "metric")
+	require.NoError(t, err)
+	assert.Len(t, dests, 3, "there can't be more replicas than destinations")
+
+	_, err = b.Destinations(consistent.New(), "metric")
+	assert.Error(t, err)
+}
+
+func TestBalancerMembersChange(t *testing.T) {
+	ring := testRing("a:1", "b:1")
+	b := NewBalancer(1.1, 1)
+	b.SetMembers(ring.Members())
+	first, err := b.Destinations(ring, "metric")
+	require.NoError(t, err)
+
+	ring.Remove(first[0])
+	b.SetMembers(ring.Members())
+	dests, err := b.Destinations(ring, "metric")
+	require.NoError(t, err)
+	assert.NotEqual(t, first, dests, "keys are assigned anew when the members change")
+}
+
+func TestBalancerReplicaTag(t *testing.T) {
+	assert.Equal(t, "", NewBalancer(0, 1).ReplicaTag(0), "metrics that aren't replicated aren't tagged")
+	b := NewBalancer(0, 2)
+	assert.Equal(t, "veneur_replica:0", b.ReplicaTag(0))
+	assert.Equal(t, "veneur_replica:1", b.ReplicaTag(1))
+}
@@ -15,6 +15,15 @@ func WithForwardTimeout(d time.Duration) Option {
 	}
 }
 
+// WithLoadFactor enables consistent hashing with bounded loads: no
+// destination gets more than factor times the average load. A factor of
+// 0 disables it.
+func WithLoadFactor(factor float64) Option {
+	return func(opts *options) {
+		opts.loadFactor = factor
+	}
+}
+
 // WithLog sets the logger entry used in the object.
 func WithLog(e *logrus.Entry) Option {
 	return func(opts *options) {
@@ -22,6 +31,14 @@ func WithLog(e *logrus.Entry) Option {
 	}
 }
 
+// WithReplicationFactor sets how many destinations each metric is
+// forwarded to.
+func WithReplicationFactor(n int) Option {
+	return func(opts *options) {
+		opts.replicas = n
+	}
+}
+
 // WithStatsInterval sets the time interval at which diagnostic metrics about
 // the server will be emitted.
 func WithStatsInterval(d time.Duration) Option {
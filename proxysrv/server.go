@@ -3,7 +3,9 @@
 //
 // The Server provided accepts a hash ring of destinations, and then listens
 // for metrics over gRPC.  It hashes each metric to a specific destination,
-// and forwards each metric to its appropriate destination Veneur.
+// and forwards each metric to its appropriate destination Veneur. A
+// Balancer can bound the load of each destination, and replicate metrics
+// to several destinations.
 package proxysrv
 
 import (
@@ -43,6 +45,7 @@ const (
 type Server struct {
 	*grpc.Server
 	destinations *consistent.Consistent
+	balancer     *Balancer
 	opts         *options
 	conns        *clientConnMap
 	updateMtx    sync.Mutex
@@ -60,6 +63,8 @@ type options struct {
 	forwardTimeout time.Duration
 	traceClient    *trace.Client
 	statsInterval  time.Duration
+	loadFactor     float64
+	replicas       int
 }
 
 // New creates a new Server with the provided destinations. The server returned
@@ -84,6 +89,7 @@ func New(destinations *consistent.Consistent, opts ...Option) (*Server, error) {
 		log.Out = ioutil.Discard
 		res.opts.log = logrus.NewEntry(log)
 	}
+	res.balancer = NewBalancer(res.opts.loadFactor, res.opts.replicas)
 
 	if err := res.SetDestinations(destinations); err != nil {
 		return nil, fmt.Errorf("failed to set the destinations: %v", err)
@@ -171,6 +177,7 @@ func (s *Server) SetDestinations(dests *consistent.Consistent) error {
 	}
 
 	s.destinations = dests
+	s.balancer.SetMembers(new)
 	return nil
 }
 
@@ -202,16 +209,24 @@ func (s *Server) sendMetrics(ctx context.Context, mlist *forwardrpc.MetricList)
 
 	dests := make(map[string][]*metricpb.Metric)
 	for _, metric := range metrics {
-		dest, err := s.destForMetric(metric)
+		metricDests, err := s.destsForMetric(metric)
 		if err != nil {
 			errs = append(errs, forwardError{err: err, cause: "no-destination",
 				msg: "failed to get a destination for a metric", numMetrics: 1})
-		} else {
+			continue
+		}
+		for i, dest := range metricDests {
 			// Lazily initialize keys in the map as necessary
 			if _, ok := dests[dest]; !ok {
 				dests[dest] = make([]*metricpb.Metric, 0, 1)
 			}
-			dests[dest] = append(dests[dest], metric)
+			replica := metric
+			if tag := s.balancer.ReplicaTag(i); tag != "" {
+				tagged := *metric
+				tagged.Tags = append(append(make([]string, 0, len(metric.Tags)+1), metric.Tags...), tag)
+				replica = &tagged
+			}
+			dests[dest] = append(dests[dest], replica)
 		}
 	}
 
@@ -268,16 +283,17 @@ func (s *Server) sendMetrics(ctx context.Context, mlist *forwardrpc.MetricList)
 	return res
 }
 
-// destForMetric returns a destination for the input metric.
-func (s *Server) destForMetric(m *metricpb.Metric) (string, error) {
+// destsForMetric returns the destinations for the input metric: one, or
+// as many as the replication factor.
+func (s *Server) destsForMetric(m *metricpb.Metric) ([]string, error) {
 	key := samplers.NewMetricKeyFromMetric(m)
-	dest, err := s.destinations.Get(key.String())
+	dests, err := s.balancer.Destinations(s.destinations, key.String())
 	if err != nil {
-		return "", fmt.Errorf("failed to hash the MetricKey '%s' to a "+
+		return nil, fmt.Errorf("failed to hash the MetricKey '%s' to a "+
 			"destination: %v", key.String(), err)
 	}
 
-	return dest, nil
+	return dests, nil
 }
 
 // forward sends a set of metrics to the destination address, and returns
@@ -305,8 +321,14 @@ func (s *Server) forward(ctx context.Context, dest string, ms []*metricpb.Metric
 
 // reportStats reports statistics about the server to the internal trace client
 func (s *Server) reportStats() {
-	_ = metrics.ReportOne(s.opts.traceClient,
-		ssf.Gauge("proxy.active_goroutines", float32(atomic.LoadInt64(s.activeProxyHandlers)), globalProtocolTags))
+	samples := []*ssf.SSFSample{
+		ssf.Gauge("proxy.active_goroutines", float32(atomic.LoadInt64(s.activeProxyHandlers)), globalProtocolTags),
+	}
+	for dest, load := range s.balancer.Loads() {
+		samples = append(samples, ssf.Gauge("proxy.destination_load", float32(load),
+			map[string]string{"destination": dest, "protocol": "grpc"}))
+	}
+	_ = metrics.ReportBatch(s.opts.traceClient, samples)
 }
 
 func strInSlice(s string, slice []string) bool {
@@ -62,6 +62,37 @@ func TestManyDestinations(t *testing.T) {
 	}
 }
 
+// Test that each metric goes to as many destinations as the replication
+// factor
+func TestReplication(t *testing.T) {
+	var actual []*metricpb.Metric
+	var mtx sync.Mutex
+	dests := createTestForwardServers(t, 3, func(ms []*metricpb.Metric) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		actual = append(actual, ms...)
+	})
+	defer stopTestForwardServers(dests)
+
+	ring := consistent.New()
+	ring.Set(addrsFromServers(dests))
+
+	expected := metrictest.RandomForwardMetrics(100)
+	server := newServer(t, ring, WithReplicationFactor(2), WithLoadFactor(1.25))
+	err := server.sendMetrics(context.Background(), &forwardrpc.MetricList{Metrics: expected})
+	assert.NoError(t, err, "sendMetrics shouldn't have failed")
+
+	var replicas []*metricpb.Metric
+	for i := 0; i < 2; i++ {
+		for _, m := range expected {
+			replica := *m
+			replica.Tags = append(append([]string{}, m.Tags...), fmt.Sprintf("veneur_replica:%d", i))
+			replicas = append(replicas, &replica)
+		}
+	}
+	assert.ElementsMatch(t, replicas, actual, "each replica is tagged")
+}
+
 func TestNoDestinations(t *testing.T) {
 	server := newServer(t, consistent.New())
 	err := server.sendMetrics(context.Background(),
@@ -0,0 +1,16 @@
+package veneur
+
+import "github.com/stripe/veneur/samplers"
+
+// relabelingIngester lets the metric extraction sink and the OTLP
+// receiver send metrics through the server's relabeling rules: Since
+// relabeling can change a metric's digest, it has to happen before the
+// metric is assigned to a worker.
+type relabelingIngester struct {
+	*Server
+}
+
+// IngestUDP relabels the metric and sends it to its worker.
+func (ri relabelingIngester) IngestUDP(metric samplers.UDPMetric) {
+	ri.ingestUDPMetric(metric)
+}
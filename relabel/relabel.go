@@ -0,0 +1,205 @@
+// Package relabel rewrites metrics according to an ordered list of
+// rules, before they are aggregated. Rules can rename metrics, add,
+// drop and rewrite tags, or drop metrics altogether.
+package relabel
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// Rule describes a rewrite. A rule applies to a metric if its name
+// matches MatchName and, for each key in MatchTags, the metric has a
+// tag with that key whose value matches the regular expression. Both
+// are optional, and regular expressions must match the entire name or
+// value.
+//
+// The actions of a rule that applies are carried out in this order:
+//
+//   - Drop discards the metric, and no further rules are applied.
+//   - Rename replaces the metric's name. It may refer to MatchName's
+//     capture groups, e.g. "$1".
+//   - DropTags removes the tags with the given keys.
+//   - MapTagValues rewrites the values of tags: for each tag key, it
+//     maps old values to new ones.
+//   - AddTags sets tags, replacing any existing tag with the same key.
+//     An empty value adds a tag with no value.
+type Rule struct {
+	AddTags      map[string]string            `yaml:"add_tags"`
+	Drop         bool                         `yaml:"drop"`
+	DropTags     []string                     `yaml:"drop_tags"`
+	MapTagValues map[string]map[string]string `yaml:"map_tag_values"`
+	MatchName    string                       `yaml:"match_name"`
+	MatchTags    map[string]string            `yaml:"match_tags"`
+	Rename       string                       `yaml:"rename"`
+}
+
+type rule struct {
+	Rule
+	name    *regexp.Regexp
+	tags    map[string]*regexp.Regexp
+	addTags []string
+}
+
+// A Relabeler applies rules to metrics. The nil Relabeler applies no
+// rules.
+type Relabeler struct {
+	rules []rule
+}
+
+// New compiles the rules into a Relabeler.
+func New(rules []Rule) (*Relabeler, error) {
+	r := &Relabeler{rules: make([]rule, 0, len(rules))}
+	for i, spec := range rules {
+		compiled := rule{Rule: spec, tags: map[string]*regexp.Regexp{}}
+		if spec.MatchName != "" {
+			re, err := compile(spec.MatchName)
+			if err != nil {
+				return nil, fmt.Errorf("relabel rule %d: invalid match_name: %v", i, err)
+			}
+			compiled.name = re
+		}
+		for key, expr := range spec.MatchTags {
+			re, err := compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("relabel rule %d: invalid match_tags pattern for %q: %v", i, key, err)
+			}
+			compiled.tags[key] = re
+		}
+		for key, value := range spec.AddTags {
+			if key == "" {
+				return nil, fmt.Errorf("relabel rule %d: add_tags has an empty key", i)
+			}
+			compiled.addTags = append(compiled.addTags, joinTag(key, value))
+		}
+		sort.Strings(compiled.addTags)
+		if !spec.Drop && spec.Rename == "" && len(spec.DropTags) == 0 &&
+			len(spec.MapTagValues) == 0 && len(spec.AddTags) == 0 {
+			return nil, fmt.Errorf("relabel rule %d has no actions", i)
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	return r, nil
+}
+
+// compile anchors a regular expression, so that it has to match the
+// whole string.
+func compile(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// Apply rewrites the metric in place according to the rules. It
+// returns false if the metric should be dropped.
+func (r *Relabeler) Apply(m *samplers.UDPMetric) bool {
+	if r == nil || len(r.rules) == 0 {
+		return true
+	}
+	name := m.Name
+	tags := m.Tags
+	changed := false
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if !rule.matches(name, tags) {
+			continue
+		}
+		if rule.Drop {
+			return false
+		}
+		if !changed {
+			// don't modify the caller's tags, they may be shared
+			// with other metrics from the same packet:
+			tags = append([]string(nil), tags...)
+			changed = true
+		}
+		if rule.Rename != "" {
+			if rule.name != nil {
+				name = rule.name.ReplaceAllString(name, rule.Rename)
+			} else {
+				name = rule.Rename
+			}
+		}
+		tags = rule.rewriteTags(tags)
+	}
+	if !changed {
+		return true
+	}
+
+	scope := m.Scope
+	relabeled := samplers.NewUDPMetric(name, m.Type, m.Value, tags)
+	if relabeled.Scope == samplers.MixedScope {
+		relabeled.Scope = scope
+	}
+	relabeled.SampleRate = m.SampleRate
+	relabeled.Timestamp = m.Timestamp
+	relabeled.Message = m.Message
+	relabeled.HostName = m.HostName
+	*m = relabeled
+	return true
+}
+
+func (r *rule) matches(name string, tags []string) bool {
+	if r.name != nil && !r.name.MatchString(name) {
+		return false
+	}
+	for key, re := range r.tags {
+		found := false
+		for _, tag := range tags {
+			k, v := splitTag(tag)
+			if k == key && re.MatchString(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *rule) rewriteTags(tags []string) []string {
+	out := tags[:0]
+	for _, tag := range tags {
+		key, value := splitTag(tag)
+		if r.dropsTag(key) {
+			continue
+		}
+		if mapping, ok := r.MapTagValues[key]; ok {
+			if newValue, ok := mapping[value]; ok {
+				tag = joinTag(key, newValue)
+			}
+		}
+		out = append(out, tag)
+	}
+	return append(out, r.addTags...)
+}
+
+// dropsTag returns true if tags with the given key are removed by the
+// rule, either because it drops them or because it sets a new value.
+func (r *rule) dropsTag(key string) bool {
+	for _, k := range r.DropTags {
+		if k == key {
+			return true
+		}
+	}
+	_, added := r.AddTags[key]
+	return added
+}
+
+func splitTag(tag string) (key, value string) {
+	if i := strings.IndexByte(tag, ':'); i >= 0 {
+		return tag[:i], tag[i+1:]
+	}
+	return tag, ""
+}
+
+func joinTag(key, value string) string {
+	if value == "" {
+		return key
+	}
+	return key + ":" + value
+}
@@ -0,0 +1,76 @@
+package relabel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestApply(t *testing.T) {
+	r, err := New([]Rule{
+		{
+			MatchName: `legacy\.(.*)`,
+			Rename:    "app.$1",
+		},
+		{
+			MatchName: `app\..*`,
+			MatchTags: map[string]string{"env": "stg|staging"},
+			MapTagValues: map[string]map[string]string{
+				"env": {"stg": "staging"},
+			},
+			DropTags: []string{"pod"},
+			AddTags:  map[string]string{"team": "platform", "relabeled": ""},
+		},
+		{
+			MatchTags: map[string]string{"debug": ".*"},
+			Drop:      true,
+		},
+	})
+	require.NoError(t, err)
+
+	m := samplers.NewUDPMetric("legacy.requests", "counter", 1.0, []string{"env:stg", "pod:abc", "team:web", "veneurlocalonly"})
+	m.SampleRate = 0.5
+	m.Timestamp = 1700000000
+	tags := m.Tags
+	require.True(t, r.Apply(&m))
+	expected := samplers.NewUDPMetric("app.requests", "counter", 1.0, []string{"env:staging", "relabeled", "team:platform"})
+	expected.Scope = samplers.LocalOnly
+	expected.SampleRate = 0.5
+	expected.Timestamp = 1700000000
+	assert.Equal(t, expected, m)
+	assert.Equal(t, []string{"env:stg", "pod:abc", "team:web"}, tags, "the original tags are left alone")
+
+	// only the first rule applies:
+	m = samplers.NewUDPMetric("legacy.requests", "counter", 1.0, []string{"env:prod", "pod:abc"})
+	require.True(t, r.Apply(&m))
+	assert.Equal(t, samplers.NewUDPMetric("app.requests", "counter", 1.0, []string{"env:prod", "pod:abc"}), m)
+
+	// no rule applies:
+	m = samplers.NewUDPMetric("other", "gauge", 1.0, []string{"env:stg"})
+	untouched := m
+	require.True(t, r.Apply(&m))
+	assert.Equal(t, untouched, m)
+
+	m = samplers.NewUDPMetric("other", "gauge", 1.0, []string{"debug"})
+	assert.False(t, r.Apply(&m))
+}
+
+func TestApplyNil(t *testing.T) {
+	var r *Relabeler
+	m := samplers.NewUDPMetric("a", "gauge", 1.0, nil)
+	assert.True(t, r.Apply(&m))
+}
+
+func TestNewErrors(t *testing.T) {
+	_, err := New([]Rule{{MatchName: "(", Drop: true}})
+	assert.Error(t, err)
+	_, err = New([]Rule{{MatchTags: map[string]string{"env": "["}, Drop: true}})
+	assert.Error(t, err)
+	_, err = New([]Rule{{AddTags: map[string]string{"": "x"}}})
+	assert.Error(t, err)
+	_, err = New([]Rule{{MatchName: "foo"}})
+	assert.Error(t, err, "a rule needs an action")
+}
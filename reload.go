@@ -0,0 +1,300 @@
+package veneur
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/routing"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+)
+
+// reloadableSettings are the config keys that a reload applies. Keys
+// that end in "_" stand for all keys that start with them.
+var reloadableSettings = []string{
+	"aggregates",
+	"datadog_api_hostname",
+	"datadog_api_key",
+	"datadog_flush_max_per_body",
+	"debug_flushed_metrics",
+	"influxdb_",
+	"kafka_broker",
+	"kafka_check_topic",
+	"kafka_event_topic",
+	"kafka_metric_",
+	"kafka_partitioner",
+	"kafka_retry_max",
+	"metric_routing_rules",
+	"metric_sinks",
+	"otlp_sink_address",
+	"otlp_sink_flush_max_per_body",
+	"percentiles",
+	"prometheus_remote_write_",
+	"signalfx_",
+	"tags",
+	"tags_exclude",
+}
+
+// spanSinkSettings are reloadable keys that span sinks use as well.
+// A reload only applies them to metric sinks; span sinks keep their
+// settings until veneur restarts. The tags that the span worker adds to
+// each span are reloaded, but the span sinks that add tags of their own
+// keep the old ones.
+var spanSinkSettings = []string{
+	"datadog_api_key",
+	"kafka_broker",
+	"kafka_metric_require_acks",
+	"kafka_partitioner",
+	"kafka_retry_max",
+	"tags",
+}
+
+// ReloadResult lists the settings that changed in a configuration
+// reload, by their config keys.
+type ReloadResult struct {
+	// Applied are the settings that took effect.
+	Applied []string `json:"applied"`
+	// RestartRequired are the settings that only take effect once
+	// veneur restarts.
+	RestartRequired []string `json:"restart_required"`
+}
+
+// matchesSetting returns true if key is one of the settings, or
+// starts with one of the settings that end in "_".
+func matchesSetting(key string, settings []string) bool {
+	for _, setting := range settings {
+		if key == setting || (strings.HasSuffix(setting, "_") && strings.HasPrefix(key, setting)) {
+			return true
+		}
+	}
+	return false
+}
+
+func configKey(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("yaml"), ",")[0]
+}
+
+// configValues returns the values of the given settings in conf, by
+// their config keys.
+func configValues(conf Config, settings ...string) map[string]interface{} {
+	v := reflect.ValueOf(conf)
+	values := map[string]interface{}{}
+	for i := 0; i < v.NumField(); i++ {
+		key := configKey(v.Type().Field(i))
+		if matchesSetting(key, settings) {
+			values[key] = v.Field(i).Interface()
+		}
+	}
+	return values
+}
+
+// diffConfig compares the running configuration with a new one. It
+// returns the configuration that the server runs with after a reload:
+// the new one, except for the settings that require a restart.
+func diffConfig(running, updated Config) (Config, ReloadResult) {
+	result := ReloadResult{}
+	merged := updated
+	rv, mv := reflect.ValueOf(running), reflect.ValueOf(&merged).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		if reflect.DeepEqual(rv.Field(i).Interface(), mv.Field(i).Interface()) {
+			continue
+		}
+		key := configKey(rv.Type().Field(i))
+		reloadable := matchesSetting(key, reloadableSettings)
+		if reloadable {
+			result.Applied = append(result.Applied, key)
+		} else {
+			mv.Field(i).Set(rv.Field(i))
+		}
+		if !reloadable || matchesSetting(key, spanSinkSettings) {
+			result.RestartRequired = append(result.RestartRequired, key)
+		}
+	}
+	return merged, result
+}
+
+// EnableConfigReload makes the server re-read its configuration from
+// path when it receives SIGHUP, or a POST request to /config/reload.
+func (s *Server) EnableConfigReload(path string) {
+	s.configFile = path
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sighup)
+		for {
+			select {
+			case <-sighup:
+				s.reloadConfigFile()
+			case <-s.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// reloadConfigFile reads the configuration file again and applies it.
+func (s *Server) reloadConfigFile() (ReloadResult, error) {
+	logger := log.WithField("file", s.configFile)
+	conf, err := ReadConfig(s.configFile)
+	if err != nil {
+		if _, ok := err.(*UnknownConfigKeys); !ok {
+			logger.WithError(err).Error("Could not read config file, not reloading")
+			return ReloadResult{}, err
+		}
+		logger.WithError(err).Warn("Config contains invalid or deprecated keys")
+	}
+	result, err := s.Reload(conf)
+	if err != nil {
+		logger.WithError(err).Error("Could not reload configuration")
+		return result, err
+	}
+	logger.WithFields(logrus.Fields{
+		"applied":          result.Applied,
+		"restart_required": result.RestartRequired,
+	}).Info("Reloaded configuration")
+	return result, nil
+}
+
+// Reload applies the settings of conf that can change while veneur
+// runs: tags, tags_exclude, percentiles, aggregates, routing rules and
+// the metric sinks. Metric sinks whose settings changed are
+// re-created, and sinks that conf doesn't have any more are removed.
+// The Prometheus scrape sink, span sinks and all other settings only
+// change when veneur restarts. Metrics keep being received and
+// aggregated during a reload, and nothing is flushed or dropped early.
+//
+// If the new metric sinks can't be created, Reload returns an error and
+// the server keeps running as before.
+func (s *Server) Reload(conf Config) (ReloadResult, error) {
+	s.reloadMtx.Lock()
+	defer s.reloadMtx.Unlock()
+
+	merged, result := diffConfig(s.config, conf)
+	if len(result.Applied) == 0 {
+		return result, nil
+	}
+
+	running := map[string]*metricSinkSpec{}
+	configured := map[sinks.MetricSink]bool{}
+	for i := range s.metricSinkSpecs {
+		running[s.metricSinkSpecs[i].id] = &s.metricSinkSpecs[i]
+		configured[s.metricSinkSpecs[i].sink] = true
+	}
+
+	// Keep the sinks whose settings are the same, and create the
+	// ones that are new or changed:
+	var specs, created []metricSinkSpec
+	for _, spec := range s.newMetricSinkSpecs(merged, log) {
+		prev, ok := running[spec.id]
+		switch {
+		case spec.restartOnly:
+			continue
+		case ok && reflect.DeepEqual(prev.settings, spec.settings):
+			spec.sink = prev.sink
+		default:
+			sink, err := spec.create()
+			if err != nil {
+				return ReloadResult{}, err
+			}
+			spec.sink = sink
+			created = append(created, spec)
+		}
+		specs = append(specs, spec)
+	}
+	for _, prev := range s.metricSinkSpecs {
+		if prev.restartOnly {
+			specs = append(specs, prev)
+		}
+	}
+
+	metricSinks := make([]sinks.MetricSink, 0, len(specs))
+	for _, spec := range specs {
+		metricSinks = append(metricSinks, spec.sink)
+	}
+	// Sinks that didn't come from the configuration stay:
+	for _, sink := range s.metricSinks {
+		if !configured[sink] {
+			metricSinks = append(metricSinks, sink)
+		}
+	}
+	if err := checkMetricSinkNames(metricSinks); err != nil {
+		return ReloadResult{}, err
+	}
+
+	sinkNames := make([]string, len(metricSinks))
+	for i, sink := range metricSinks {
+		sinkNames[i] = sink.Name()
+	}
+	routingRules := make([]routing.Rule, len(merged.MetricRoutingRules))
+	for i, rule := range merged.MetricRoutingRules {
+		routingRules[i] = routing.Rule(rule)
+	}
+	router, err := routing.New(routingRules, sinkNames)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+
+	var started []sinks.MetricSink
+	for _, spec := range created {
+		log.WithField("sink", spec.sink.Name()).Info("Starting metric sink")
+		if err := spec.sink.Start(s.TraceClient); err != nil {
+			// the sinks that this reload started already won't
+			// be used:
+			s.stopMetricSinks(started)
+			return ReloadResult{}, err
+		}
+		started = append(started, spec.sink)
+	}
+	setSinkExcludedTags(merged.TagsExclude, metricSinks)
+
+	kept := map[sinks.MetricSink]bool{}
+	for _, sink := range metricSinks {
+		kept[sink] = true
+	}
+	var removed []sinks.MetricSink
+	for _, prev := range s.metricSinkSpecs {
+		if !kept[prev.sink] {
+			log.WithField("sink", prev.sink.Name()).Info("Removed metric sink")
+			removed = append(removed, prev.sink)
+		}
+	}
+	defer s.stopMetricSinks(removed)
+
+	s.config = merged
+	s.metricSinkSpecs = specs
+	s.metricSinks = metricSinks
+	s.metricRouter = router
+	s.Tags = merged.Tags
+	s.TagsAsMap = samplers.ParseTagSliceToMap(merged.Tags)
+	if s.SpanWorker != nil {
+		s.SpanWorker.SetCommonTags(s.TagsAsMap)
+	}
+	s.HistogramPercentiles = merged.Percentiles
+	s.HistogramAggregates = histogramAggregates(merged.Aggregates)
+	return result, nil
+}
+
+// stopMetricSinks stops the metric sinks that implement sinks.Stopper
+// in the background, once they finished any flush that they're still
+// busy with. Each sink gets the sink flush timeout to stop.
+func (s *Server) stopMetricSinks(removed []sinks.MetricSink) {
+	for _, sink := range removed {
+		st, ok := sink.(sinks.Stopper)
+		if !ok {
+			continue
+		}
+		go func(sink sinks.MetricSink, st sinks.Stopper) {
+			s.busySinks.wait(sink)
+			ctx, cancel := context.WithTimeout(context.Background(), s.sinkFlushTimeout)
+			defer cancel()
+			if err := st.Stop(ctx); err != nil {
+				log.WithError(err).WithField("sink", sink.Name()).Warn("Error stopping metric sink")
+			}
+		}(sink, st)
+	}
+}
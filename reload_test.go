@@ -0,0 +1,305 @@
+package veneur
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/sinks/datadog"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// stoppableSink is a metric sink that records whether it was stopped.
+type stoppableSink struct {
+	name      string
+	failStart bool
+
+	mtx     sync.Mutex
+	stopped bool
+}
+
+var stoppableSinks = struct {
+	sync.Mutex
+	byName map[string]*stoppableSink
+}{byName: map[string]*stoppableSink{}}
+
+func init() {
+	sinks.RegisterMetricSink("test_stoppable", func(name string, config sinks.SinkConfig, deps sinks.Dependencies) (sinks.MetricSink, error) {
+		var conf struct {
+			FailStart bool `yaml:"fail_start"`
+		}
+		if err := config.Decode(&conf); err != nil {
+			return nil, err
+		}
+		sink := &stoppableSink{name: name, failStart: conf.FailStart}
+		stoppableSinks.Lock()
+		stoppableSinks.byName[name] = sink
+		stoppableSinks.Unlock()
+		return sink, nil
+	})
+}
+
+func (s *stoppableSink) Name() string { return s.name }
+
+func (s *stoppableSink) Start(*trace.Client) error {
+	if s.failStart {
+		return errors.New("can't start")
+	}
+	return nil
+}
+
+func (s *stoppableSink) Flush(context.Context, []samplers.InterMetric) error { return nil }
+
+func (s *stoppableSink) FlushOtherSamples(context.Context, []ssf.SSFSample) {}
+
+func (s *stoppableSink) Stop(context.Context) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.stopped = true
+	return nil
+}
+
+func (s *stoppableSink) isStopped() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.stopped
+}
+
+// waitStopped waits up to a second for the sink to be stopped.
+func (s *stoppableSink) waitStopped() bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if s.isStopped() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s.isStopped()
+}
+
+func stoppableSinkNamed(name string) *stoppableSink {
+	stoppableSinks.Lock()
+	defer stoppableSinks.Unlock()
+	return stoppableSinks.byName[name]
+}
+
+func TestDiffConfig(t *testing.T) {
+	running := globalConfig()
+	updated := globalConfig()
+	updated.Percentiles = []float64{.99}
+	updated.Interval = "1m"
+	updated.KafkaBroker = "kafka:9092"
+	updated.SignalfxAPIKey = "secret"
+
+	merged, result := diffConfig(running, updated)
+	assert.Equal(t, []string{"kafka_broker", "percentiles", "signalfx_api_key"}, result.Applied)
+	assert.Equal(t, []string{"interval", "kafka_broker"}, result.RestartRequired)
+	assert.Equal(t, running.Interval, merged.Interval, "settings that require a restart are not applied")
+	assert.Equal(t, updated.Percentiles, merged.Percentiles)
+	assert.Equal(t, "kafka:9092", merged.KafkaBroker)
+}
+
+func TestReload(t *testing.T) {
+	config := globalConfig()
+	config.DatadogAPIKey = "farts"
+	config.DatadogAPIHostname = "http://localhost:1"
+	ch := make(chan []samplers.InterMetric, 20)
+	sink, _ := NewChannelMetricSink(ch)
+	server := setupVeneurServer(t, config, nil, sink, nil, nil)
+	defer server.Shutdown()
+	require.Len(t, server.metricSinks, 2)
+	ddSink := server.metricSinks[0]
+
+	// nothing changed:
+	result, err := server.Reload(config)
+	require.NoError(t, err)
+	assert.Empty(t, result.Applied)
+	assert.Equal(t, ddSink, server.metricSinks[0])
+
+	updated := config
+	updated.Percentiles = []float64{.99}
+	updated.Aggregates = []string{"count"}
+	updated.NumWorkers = 2
+	require.NoError(t, yaml.Unmarshal([]byte(`
+metric_sinks:
+  - kind: datadog
+    name: datadog-eu
+    config:
+      api_hostname: "http://localhost:2"
+      api_key: "eu"
+metric_routing_rules:
+  - match_name_prefix: "eu."
+    sinks: ["datadog-eu"]
+`), &updated))
+	result, err = server.Reload(updated)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"aggregates", "metric_routing_rules", "metric_sinks", "percentiles"}, result.Applied)
+	assert.Equal(t, []string{"num_workers"}, result.RestartRequired)
+	assert.Equal(t, []float64{.99}, server.HistogramPercentiles)
+	assert.Equal(t, samplers.HistogramAggregates{Value: samplers.AggregatesLookup["count"], Count: 1}, server.HistogramAggregates)
+
+	names := []string{}
+	for _, sink := range server.metricSinks {
+		names = append(names, sink.Name())
+	}
+	assert.Equal(t, []string{"datadog", "datadog-eu", "channel"}, names, "sinks that don't come from the config are kept")
+	assert.Equal(t, ddSink, server.metricSinks[0], "unchanged sinks are kept")
+
+	// changing the credentials re-creates the sink, and dropping the
+	// named sink removes it:
+	updated.DatadogAPIKey = "new"
+	updated.MetricSinks = nil
+	updated.MetricRoutingRules = nil
+	result, err = server.Reload(updated)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"datadog_api_key", "metric_routing_rules", "metric_sinks"}, result.Applied)
+	require.Len(t, server.metricSinks, 2)
+	assert.NotEqual(t, ddSink, server.metricSinks[0])
+	assert.Equal(t, "new", server.metricSinks[0].(*datadog.DatadogMetricSink).APIKey)
+
+	// a broken config leaves everything as it was:
+	broken := updated
+	require.NoError(t, yaml.Unmarshal([]byte(`
+metric_routing_rules:
+  - sinks: ["nonexistent"]
+`), &broken))
+	sinksBefore := server.metricSinks
+	_, err = server.Reload(broken)
+	assert.Error(t, err)
+	assert.Equal(t, sinksBefore, server.metricSinks)
+}
+
+func TestReloadEndpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-reload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "veneur.yaml")
+
+	config := globalConfig()
+	bts, err := yaml.Marshal(config)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, bts, 0600))
+	conf, err := ReadConfig(path)
+	require.NoError(t, err)
+
+	server := setupVeneurServer(t, conf, nil, nil, nil, nil)
+	defer server.Shutdown()
+	handler := server.Handler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/config/reload", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, "reloading isn't enabled")
+
+	server.EnableConfigReload(path)
+	config.Tags = []string{"env:test"}
+	bts, err = yaml.Marshal(config)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, bts, 0600))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/config/reload", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	result := ReloadResult{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(t, ReloadResult{Applied: []string{"tags"}, RestartRequired: []string{"tags"}}, result)
+	assert.Equal(t, map[string]string{"env": "test"}, server.TagsAsMap)
+	assert.Equal(t, map[string]string{"env": "test"}, server.SpanWorker.commonTags.Load(), "spans get the new tags")
+}
+
+func TestReloadWhileStoppingSinks(t *testing.T) {
+	// a SIGHUP may arrive while veneur shuts down; run with -race:
+	config := globalConfig()
+	server := setupVeneurServer(t, config, nil, nil, nil, nil)
+	defer server.Shutdown()
+	updated := config
+	updated.Percentiles = []float64{.5}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := server.Reload(updated)
+		assert.NoError(t, err)
+	}()
+	server.stopSinks(context.Background())
+	<-done
+}
+
+func TestBusySinksByInstance(t *testing.T) {
+	// a reload replaced a busy sink with one of the same name:
+	bs := busySinks{}
+	old, _ := NewChannelMetricSink(make(chan []samplers.InterMetric))
+	replacement, _ := NewChannelMetricSink(make(chan []samplers.InterMetric))
+	require.True(t, bs.start("metrics", old))
+	assert.True(t, bs.start("metrics", replacement), "the replacement isn't busy")
+
+	waited := make(chan struct{})
+	go func() {
+		bs.wait(old)
+		close(waited)
+	}()
+	bs.done("metrics", replacement)
+	select {
+	case <-waited:
+		t.Fatal("waiting for the old sink returned while it's busy")
+	case <-time.After(50 * time.Millisecond):
+	}
+	bs.done("metrics", old)
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting for the old sink didn't return once it was done")
+	}
+}
+
+func TestReloadStopsSinks(t *testing.T) {
+	config := globalConfig()
+	require.NoError(t, yaml.Unmarshal([]byte(`
+metric_sinks:
+  - kind: test_stoppable
+    name: stopped-on-removal
+`), &config))
+	server := setupVeneurServer(t, config, nil, nil, nil, nil)
+	defer server.Shutdown()
+	removed := stoppableSinkNamed("stopped-on-removal")
+	require.NotNil(t, removed)
+
+	// a sink that fails to start stops the ones that the same reload
+	// started:
+	broken := config
+	broken.MetricSinks = nil
+	require.NoError(t, yaml.Unmarshal([]byte(`
+metric_sinks:
+  - kind: test_stoppable
+    name: started
+  - kind: test_stoppable
+    name: failing
+    config:
+      fail_start: true
+`), &broken))
+	_, err := server.Reload(broken)
+	assert.Error(t, err)
+	started := stoppableSinkNamed("started")
+	require.NotNil(t, started)
+	assert.True(t, started.waitStopped(), "the started sink should be stopped")
+	assert.False(t, removed.isStopped(), "the running sinks are kept")
+
+	// removing the sink from the config stops it:
+	updated := config
+	updated.MetricSinks = nil
+	_, err = server.Reload(updated)
+	require.NoError(t, err)
+	assert.True(t, removed.waitStopped(), "the removed sink should be stopped")
+}
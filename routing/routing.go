@@ -0,0 +1,162 @@
+// Package routing decides which metric sinks receive a metric,
+// according to rules from the configuration. It complements the
+// veneursinkonly:<sink> tags that clients can set on metrics: a metric
+// that has such tags is routed according to them, and the rules don't
+// apply to it.
+package routing
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// Rule describes where the metrics that it matches go. A rule matches a
+// metric if its name starts with MatchNamePrefix, its name matches the
+// MatchName regular expression, and, for each key in MatchTags, the
+// metric has a tag with that key whose value matches the regular
+// expression. All of them are optional, and regular expressions must
+// match the entire name or value.
+//
+// A matched metric goes to the sinks named in Sinks, or to all sinks if
+// Sinks is empty, except for the ones named in ExcludeSinks.
+type Rule struct {
+	ExcludeSinks    []string          `yaml:"exclude_sinks"`
+	MatchName       string            `yaml:"match_name"`
+	MatchNamePrefix string            `yaml:"match_name_prefix"`
+	MatchTags       map[string]string `yaml:"match_tags"`
+	Sinks           []string          `yaml:"sinks"`
+}
+
+type rule struct {
+	prefix string
+	name   *regexp.Regexp
+	tags   map[string]*regexp.Regexp
+	route  samplers.RouteInformation
+}
+
+// A Router applies routing rules to metrics. The nil Router doesn't
+// route metrics anywhere in particular.
+type Router struct {
+	rules []rule
+}
+
+// New compiles the rules into a Router. sinkNames are the names of the
+// metric sinks that are configured, which the rules may refer to.
+func New(rules []Rule, sinkNames []string) (*Router, error) {
+	known := map[string]bool{}
+	for _, name := range sinkNames {
+		known[name] = true
+	}
+	check := func(i int, field string, names []string) error {
+		for _, name := range names {
+			if !known[name] {
+				return fmt.Errorf("routing rule %d: %s refers to %q, which is not a configured metric sink", i, field, name)
+			}
+		}
+		return nil
+	}
+
+	r := &Router{rules: make([]rule, 0, len(rules))}
+	for i, spec := range rules {
+		if err := check(i, "sinks", spec.Sinks); err != nil {
+			return nil, err
+		}
+		if err := check(i, "exclude_sinks", spec.ExcludeSinks); err != nil {
+			return nil, err
+		}
+		if len(spec.Sinks) == 0 && len(spec.ExcludeSinks) == 0 {
+			return nil, fmt.Errorf("routing rule %d has neither sinks nor exclude_sinks", i)
+		}
+
+		compiled := rule{
+			prefix: spec.MatchNamePrefix,
+			tags:   map[string]*regexp.Regexp{},
+			route:  samplers.RouteInformation{},
+		}
+		if spec.MatchName != "" {
+			re, err := compile(spec.MatchName)
+			if err != nil {
+				return nil, fmt.Errorf("routing rule %d: invalid match_name: %v", i, err)
+			}
+			compiled.name = re
+		}
+		for key, expr := range spec.MatchTags {
+			re, err := compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("routing rule %d: invalid match_tags pattern for %q: %v", i, key, err)
+			}
+			compiled.tags[key] = re
+		}
+
+		targets := spec.Sinks
+		if len(targets) == 0 {
+			targets = sinkNames
+		}
+		for _, name := range targets {
+			compiled.route[name] = struct{}{}
+		}
+		for _, name := range spec.ExcludeSinks {
+			delete(compiled.route, name)
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	return r, nil
+}
+
+// compile anchors a regular expression, so that it has to match the
+// whole string.
+func compile(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// Route sets the Sinks of each metric that isn't routed by its tags
+// already, according to the first rule that matches it. Metrics that
+// no rule matches go to all sinks.
+//
+// The route information is shared between metrics, and must not be
+// modified.
+func (r *Router) Route(metrics []samplers.InterMetric) {
+	if r == nil || len(r.rules) == 0 {
+		return
+	}
+	for i := range metrics {
+		if metrics[i].Sinks != nil {
+			continue
+		}
+		for j := range r.rules {
+			if r.rules[j].matches(&metrics[i]) {
+				metrics[i].Sinks = r.rules[j].route
+				break
+			}
+		}
+	}
+}
+
+func (r *rule) matches(m *samplers.InterMetric) bool {
+	if !strings.HasPrefix(m.Name, r.prefix) {
+		return false
+	}
+	if r.name != nil && !r.name.MatchString(m.Name) {
+		return false
+	}
+	for key, re := range r.tags {
+		found := false
+		for _, tag := range m.Tags {
+			k, v := tag, ""
+			if i := strings.IndexByte(tag, ':'); i >= 0 {
+				k, v = tag[:i], tag[i+1:]
+			}
+			if k == key && re.MatchString(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestRoute(t *testing.T) {
+	r, err := New([]Rule{
+		{
+			MatchNamePrefix: "billing.",
+			MatchTags:       map[string]string{"env": "prod|production"},
+			Sinks:           []string{"datadog", "kafka"},
+		},
+		{
+			MatchName:    `.*\.debug\..*`,
+			ExcludeSinks: []string{"datadog"},
+		},
+	}, []string{"datadog", "signalfx", "kafka"})
+	require.NoError(t, err)
+
+	metrics := []samplers.InterMetric{
+		{Name: "billing.charges", Tags: []string{"env:prod"}},
+		{Name: "billing.charges", Tags: []string{"env:staging"}},
+		{Name: "api.debug.requests"},
+		{Name: "billing.debug.charges", Tags: []string{"env:production"}},
+		{Name: "api.requests", Sinks: samplers.RouteInformation{"signalfx": {}}},
+		{Name: "api.debug.requests", Sinks: samplers.RouteInformation{"datadog": {}}},
+	}
+	r.Route(metrics)
+
+	expected := []samplers.RouteInformation{
+		{"datadog": {}, "kafka": {}},
+		nil,
+		{"signalfx": {}, "kafka": {}},
+		{"datadog": {}, "kafka": {}},
+		{"signalfx": {}},
+		{"datadog": {}},
+	}
+	for i, m := range metrics {
+		assert.Equal(t, expected[i], m.Sinks, "metric %d", i)
+	}
+}
+
+func TestRouteNil(t *testing.T) {
+	var r *Router
+	metrics := []samplers.InterMetric{{Name: "a"}}
+	r.Route(metrics)
+	assert.Nil(t, metrics[0].Sinks)
+}
+
+func TestNewErrors(t *testing.T) {
+	sinks := []string{"datadog"}
+	_, err := New([]Rule{{Sinks: []string{"signalfx"}}}, sinks)
+	assert.Error(t, err, "unknown sink")
+	_, err = New([]Rule{{ExcludeSinks: []string{"signalfx"}}}, sinks)
+	assert.Error(t, err, "unknown excluded sink")
+	_, err = New([]Rule{{MatchNamePrefix: "a."}}, sinks)
+	assert.Error(t, err, "no sinks")
+	_, err = New([]Rule{{MatchName: "(", Sinks: sinks}}, sinks)
+	assert.Error(t, err)
+	_, err = New([]Rule{{MatchTags: map[string]string{"a": "["}, Sinks: sinks}}, sinks)
+	assert.Error(t, err)
+}
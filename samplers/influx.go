@@ -0,0 +1,186 @@
+package samplers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// InfluxPrecisions maps the values of the InfluxDB write API's
+// precision parameter to the duration of one timestamp unit.
+var InfluxPrecisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"n":  time.Nanosecond,
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// ParseInfluxLine converts a line of the InfluxDB line protocol, like
+// `measurement,tag1=a,tag2=b field1=1.5,field2=3i 1556813561098000000`,
+// into one gauge per numeric or boolean field, named
+// "measurement.field" and tagged with the line's tags. String fields
+// are ignored. The timestamp, if any, is interpreted in units of
+// precision.
+//
+// Empty lines and comments produce no metrics and no error.
+func ParseInfluxLine(line []byte, precision time.Duration) ([]UDPMetric, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' {
+		return nil, nil
+	}
+
+	keyEnd := influxIndex(line, 0, ' ', false)
+	if keyEnd < 0 {
+		return nil, fmt.Errorf("invalid influx line %q: no fields", line)
+	}
+	fieldsStart := keyEnd + 1
+	for fieldsStart < len(line) && line[fieldsStart] == ' ' {
+		fieldsStart++
+	}
+	fieldsEnd := influxIndex(line, fieldsStart, ' ', true)
+	if fieldsEnd < 0 {
+		fieldsEnd = len(line)
+	}
+
+	var timestamp int64
+	if rest := bytes.TrimSpace(line[fieldsEnd:]); len(rest) > 0 {
+		ts, err := strconv.ParseInt(string(rest), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid influx timestamp %q", rest)
+		}
+		timestamp = int64(time.Duration(ts) * precision / time.Second)
+	}
+
+	keyParts := influxSplit(line[:keyEnd], ',', false)
+	measurement := influxUnescape(keyParts[0])
+	if measurement == "" {
+		return nil, fmt.Errorf("invalid influx line %q: empty measurement", line)
+	}
+	tags := make([]string, 0, len(keyParts)-1)
+	for _, part := range keyParts[1:] {
+		eq := influxIndex(part, 0, '=', false)
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid influx tag %q", part)
+		}
+		tags = append(tags, influxUnescape(part[:eq])+":"+influxUnescape(part[eq+1:]))
+	}
+
+	fields := influxSplit(line[fieldsStart:fieldsEnd], ',', true)
+	metrics := make([]UDPMetric, 0, len(fields))
+	for _, field := range fields {
+		eq := influxIndex(field, 0, '=', false)
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid influx field %q", field)
+		}
+		value, ok, err := parseInfluxValue(field[eq+1:])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		m := NewUDPMetric(measurement+"."+influxUnescape(field[:eq]), "gauge", value, tags)
+		m.Timestamp = timestamp
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// parseInfluxValue parses a field value. It returns false for string
+// values, which veneur can't represent.
+func parseInfluxValue(v []byte) (float64, bool, error) {
+	if len(v) == 0 {
+		return 0, false, errors.New("empty influx field value")
+	}
+	switch string(v) {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	switch v[0] {
+	case '"':
+		if len(v) < 2 || v[len(v)-1] != '"' {
+			return 0, false, fmt.Errorf("unterminated influx string %q", v)
+		}
+		return 0, false, nil
+	}
+	switch v[len(v)-1] {
+	case 'i':
+		n, err := strconv.ParseInt(string(v[:len(v)-1]), 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid influx integer %q", v)
+		}
+		return float64(n), true, nil
+	case 'u':
+		n, err := strconv.ParseUint(string(v[:len(v)-1]), 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid influx unsigned integer %q", v)
+		}
+		return float64(n), true, nil
+	}
+	f, err := strconv.ParseFloat(string(v), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false, fmt.Errorf("invalid influx float %q", v)
+	}
+	return f, true, nil
+}
+
+// influxIndex returns the index of the first occurrence of sep in b at
+// or after start that isn't escaped with a backslash (or, if quotes is
+// true, inside a double-quoted string), or -1.
+func influxIndex(b []byte, start int, sep byte, quotes bool) int {
+	quoted := false
+	for i := start; i < len(b); i++ {
+		switch c := b[i]; {
+		case c == '\\':
+			i++
+		case quotes && c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			return i
+		}
+	}
+	return -1
+}
+
+// influxSplit splits b around the occurrences of sep that influxIndex
+// would find.
+func influxSplit(b []byte, sep byte, quotes bool) [][]byte {
+	var parts [][]byte
+	for {
+		i := influxIndex(b, 0, sep, quotes)
+		if i < 0 {
+			return append(parts, b)
+		}
+		parts = append(parts, b[:i])
+		b = b[i+1:]
+	}
+}
+
+// influxUnescape removes the backslashes that escape commas, spaces
+// and equals signs in measurements, tags and field keys.
+func influxUnescape(b []byte) string {
+	if bytes.IndexByte(b, '\\') < 0 {
+		return string(b)
+	}
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] == '\\' && i+1 < len(b) {
+			switch b[i+1] {
+			case ',', ' ', '=', '\\':
+				i++
+			}
+		}
+		out = append(out, b[i])
+	}
+	return string(out)
+}
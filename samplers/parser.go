@@ -273,6 +273,10 @@ func ParseMetricSSF(metric *ssf.SSFSample) (UDPMetric, error) {
 		ret.Scope = GlobalOnly
 	}
 	ret.SampleRate = metric.SampleRate
+	// SSF timestamps are in nanoseconds:
+	if metric.Timestamp > 0 {
+		ret.Timestamp = metric.Timestamp / int64(time.Second)
+	}
 	tempTags := make([]string, 0, len(metric.Tags))
 	for key, value := range metric.Tags {
 		if key == "veneurlocalonly" {
@@ -293,10 +297,74 @@ func ParseMetricSSF(metric *ssf.SSFSample) (UDPMetric, error) {
 	return ret, nil
 }
 
+// NewUDPMetric constructs a UDPMetric from a name, type, value and
+// tags that were decoded from some other wire format. Like
+// ParseMetric, it sorts the tags, honors the veneurlocalonly and
+// veneurglobalonly tags, and computes the metric's digest.
+func NewUDPMetric(name, metricType string, value interface{}, tags []string) UDPMetric {
+	ret := UDPMetric{
+		MetricKey: MetricKey{
+			Name: name,
+			Type: metricType,
+		},
+		Value:      value,
+		SampleRate: 1.0,
+	}
+	ret.Tags = make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, "veneurlocalonly") {
+			ret.Scope = LocalOnly
+			continue
+		}
+		if strings.HasPrefix(tag, "veneurglobalonly") {
+			ret.Scope = GlobalOnly
+			continue
+		}
+		ret.Tags = append(ret.Tags, tag)
+	}
+	sort.Strings(ret.Tags)
+	ret.JoinedTags = strings.Join(ret.Tags, ",")
+
+	h := fnv1a.Init32
+	h = fnv1a.AddString32(h, ret.Name)
+	h = fnv1a.AddString32(h, ret.Type)
+	h = fnv1a.AddString32(h, ret.JoinedTags)
+	ret.Digest = h
+	return ret
+}
+
+// ContainerIDTag is the tag that holds the container ID that DogStatsD
+// clients send in the "c:" section of a packet to identify where a
+// metric originated.
+const ContainerIDTag = "container_id"
+
 // ParseMetric converts the incoming packet from Datadog DogStatsD
 // Datagram format in to a Metric. http://docs.datadoghq.com/guides/dogstatsd/#datagram-format
+//
+// ParseMetric only handles packets with a single value; use
+// ParseMetrics for packets that may carry several.
 func ParseMetric(packet []byte) (*UDPMetric, error) {
-	ret := &UDPMetric{
+	metrics, err := ParseMetrics(packet)
+	if err != nil {
+		return nil, err
+	}
+	if len(metrics) != 1 {
+		return nil, fmt.Errorf("Invalid metric packet, expected 1 value but found %d", len(metrics))
+	}
+	return &metrics[0], nil
+}
+
+// ParseMetrics converts the incoming packet from Datadog DogStatsD
+// Datagram format in to one metric per value in the packet: besides
+// the usual "name:value|type" packets, DogStatsD clients may send
+// several values of the same metric at once, as in "name:1:2:3|d".
+// The values of sets are never split up.
+//
+// In addition to sample rates and tags, the packet may carry a
+// "|T<unix timestamp>" section, which sets the metrics' Timestamp, and
+// a "|c:<container ID>" section, which adds a ContainerIDTag tag.
+func ParseMetrics(packet []byte) ([]UDPMetric, error) {
+	ret := UDPMetric{
 		SampleRate: 1.0,
 	}
 	pipeSplitter := NewSplitBytes(packet, '|')
@@ -345,32 +413,38 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 	// Add the type to the digest
 	h = fnv1a.AddString32(h, ret.Type)
 
-	// Now convert the metric's value
+	// Now convert the metric's values
+	var values []interface{}
 	if ret.Type == "set" {
-		ret.Value = string(valueChunk)
+		values = []interface{}{string(valueChunk)}
 	} else {
-		v, err := strconv.ParseFloat(string(valueChunk), 64)
-		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
-			return nil, fmt.Errorf("Invalid number for metric value: %s", valueChunk)
+		valueSplitter := NewSplitBytes(valueChunk, ':')
+		for valueSplitter.Next() {
+			v, err := strconv.ParseFloat(string(valueSplitter.Chunk()), 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, fmt.Errorf("Invalid number for metric value: %s", valueSplitter.Chunk())
+			}
+			values = append(values, v)
 		}
-		ret.Value = v
 	}
 
 	// each of these sections can only appear once in the packet
 	foundSampleRate := false
+	foundTimestamp := false
+	containerID := ""
 	for pipeSplitter.Next() {
 		if len(pipeSplitter.Chunk()) == 0 {
 			// avoid panicking on malformed packets that have too many pipes
 			// (eg "foo:1|g|" or "foo:1|c||@0.1")
 			return nil, errors.New("Invalid metric packet, empty string after/between pipes")
 		}
-		switch pipeSplitter.Chunk()[0] {
-		case '@':
+		switch chunk := pipeSplitter.Chunk(); {
+		case chunk[0] == '@':
 			if foundSampleRate {
 				return nil, errors.New("Invalid metric packet, multiple sample rates specified")
 			}
 			// sample rate!
-			sr := string(pipeSplitter.Chunk()[1:])
+			sr := string(chunk[1:])
 			sampleRate, err := strconv.ParseFloat(sr, 32)
 			if err != nil {
 				return nil, fmt.Errorf("Invalid float for sample rate: %s", sr)
@@ -381,7 +455,7 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 			ret.SampleRate = float32(sampleRate)
 			foundSampleRate = true
 
-		case '#':
+		case chunk[0] == '#':
 			// tags!
 			if ret.Tags != nil {
 				return nil, errors.New("Invalid metric packet, multiple tag sections specified")
@@ -389,8 +463,7 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 			// should we be filtering known key tags from here?
 			// in order to prevent extremely high cardinality in the global stats?
 			// see worker.go line 273
-			tags := strings.Split(string(pipeSplitter.Chunk()[1:]), ",")
-			sort.Strings(tags)
+			tags := strings.Split(string(chunk[1:]), ",")
 			for i, tag := range tags {
 				// we use this tag as an escape hatch for metrics that always
 				// want to be host-local
@@ -407,19 +480,49 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 				}
 			}
 			ret.Tags = tags
-			// we specifically need the sorted version here so that hashing over
-			// tags behaves deterministically
-			ret.JoinedTags = strings.Join(tags, ",")
-			h = fnv1a.AddString32(h, ret.JoinedTags)
+
+		case chunk[0] == 'T':
+			// a client-side timestamp, in seconds
+			if foundTimestamp {
+				return nil, errors.New("Invalid metric packet, multiple timestamps specified")
+			}
+			ts, err := strconv.ParseInt(string(chunk[1:]), 10, 64)
+			if err != nil || ts <= 0 {
+				return nil, fmt.Errorf("Invalid timestamp: %s", chunk[1:])
+			}
+			ret.Timestamp = ts
+			foundTimestamp = true
+
+		case len(chunk) > 2 && chunk[0] == 'c' && chunk[1] == ':':
+			// the ID of the container the metric came from
+			if containerID != "" {
+				return nil, errors.New("Invalid metric packet, multiple container IDs specified")
+			}
+			containerID = string(chunk[2:])
 
 		default:
-			return nil, fmt.Errorf("Invalid metric packet, contains unknown section %q", pipeSplitter.Chunk())
+			return nil, fmt.Errorf("Invalid metric packet, contains unknown section %q", chunk)
 		}
 	}
 
+	if containerID != "" {
+		ret.Tags = append(ret.Tags, ContainerIDTag+":"+containerID)
+	}
+	if ret.Tags != nil {
+		// we specifically need the sorted version here so that hashing over
+		// tags behaves deterministically
+		sort.Strings(ret.Tags)
+		ret.JoinedTags = strings.Join(ret.Tags, ",")
+		h = fnv1a.AddString32(h, ret.JoinedTags)
+	}
 	ret.Digest = h
 
-	return ret, nil
+	metrics := make([]UDPMetric, len(values))
+	for i, v := range values {
+		metrics[i] = ret
+		metrics[i].Value = v
+	}
+	return metrics, nil
 }
 
 // ParseEvent parses a DogStatsD event packet and returns an SSF sample or an
@@ -54,12 +54,27 @@ type InterMetric struct {
 	Message   string
 	HostName  string
 
+	// Histogram is set on the metrics that a histogram or timer
+	// flushes into, and says which of its values the metric holds.
+	Histogram *HistogramPart
+
 	// Sinks, if non-nil, indicates which metric sinks a metric
 	// should be inserted into. If nil, that means the metric is
 	// meant to go to every sink.
 	Sinks RouteInformation
 }
 
+// HistogramPart identifies one of the values that veneur generates
+// when flushing a histogram or timer.
+type HistogramPart struct {
+	// Aggregate is the aggregate that the metric holds, or zero if
+	// it holds a percentile.
+	Aggregate Aggregate
+	// Percentile is the percentile (between 0 and 1) that the
+	// metric holds, if Aggregate is zero.
+	Percentile float64
+}
+
 type Aggregate int
 
 const (
@@ -543,6 +558,7 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 			Value:     val,
 			Tags:      tags,
 			Type:      GaugeMetric,
+			Histogram: &HistogramPart{Aggregate: AggregateMax},
 			Sinks:     sinks,
 		})
 	}
@@ -559,6 +575,7 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 			Value:     val,
 			Tags:      tags,
 			Type:      GaugeMetric,
+			Histogram: &HistogramPart{Aggregate: AggregateMin},
 			Sinks:     sinks,
 		})
 	}
@@ -576,6 +593,7 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 			Value:     val,
 			Tags:      tags,
 			Type:      GaugeMetric,
+			Histogram: &HistogramPart{Aggregate: AggregateSum},
 			Sinks:     sinks,
 		})
 	}
@@ -595,6 +613,7 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 			Value:     val,
 			Tags:      tags,
 			Type:      GaugeMetric,
+			Histogram: &HistogramPart{Aggregate: AggregateAverage},
 			Sinks:     sinks,
 		})
 	}
@@ -615,6 +634,7 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 			Value:     val,
 			Tags:      tags,
 			Type:      CounterMetric,
+			Histogram: &HistogramPart{Aggregate: AggregateCount},
 			Sinks:     sinks,
 		})
 	}
@@ -630,6 +650,7 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 				Value:     float64(h.Value.Quantile(0.5)),
 				Tags:      tags,
 				Type:      GaugeMetric,
+				Histogram: &HistogramPart{Aggregate: AggregateMedian},
 				Sinks:     sinks,
 			},
 		)
@@ -650,6 +671,7 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 			Value:     val,
 			Tags:      tags,
 			Type:      GaugeMetric,
+			Histogram: &HistogramPart{Aggregate: AggregateHarmonicMean},
 			Sinks:     sinks,
 		})
 	}
@@ -666,6 +688,7 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 				Value:     float64(h.Value.Quantile(p)),
 				Tags:      tags,
 				Type:      GaugeMetric,
+				Histogram: &HistogramPart{Percentile: p},
 				Sinks:     sinks,
 			},
 		)
@@ -342,6 +342,7 @@ func TestHisto(t *testing.T) {
 	assert.Len(t, m2.Tags, 1, "Tag count")
 	assert.Equal(t, "a:b", m2.Tags[0], "First tag")
 	assert.Equal(t, float64(25), m2.Value, "Value")
+	assert.Equal(t, &HistogramPart{Aggregate: AggregateMax}, m2.Histogram, "Histogram part")
 
 	// the min
 	m3 := metrics[1]
@@ -399,6 +400,7 @@ func TestHisto(t *testing.T) {
 	assert.Len(t, m7.Tags, 1, "Tag count")
 	assert.Equal(t, "a:b", m7.Tags[0], "First tag")
 	assert.Equal(t, float64(23.75), m7.Value, "Value")
+	assert.Equal(t, &HistogramPart{Percentile: 0.90}, m7.Histogram, "Histogram part")
 }
 
 func TestHistoAvgOnly(t *testing.T) {
@@ -35,24 +35,34 @@ import (
 
 	"github.com/pkg/profile"
 
+	"github.com/stripe/veneur/graphite"
 	vhttp "github.com/stripe/veneur/http"
 	"github.com/stripe/veneur/importsrv"
+	"github.com/stripe/veneur/otlp"
 	"github.com/stripe/veneur/plugins"
 	localfilep "github.com/stripe/veneur/plugins/localfile"
 	s3p "github.com/stripe/veneur/plugins/s3"
 	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/relabel"
+	"github.com/stripe/veneur/routing"
 	"github.com/stripe/veneur/samplers"
 	"github.com/stripe/veneur/scopedstatsd"
 	"github.com/stripe/veneur/sinks"
 	"github.com/stripe/veneur/sinks/datadog"
 	"github.com/stripe/veneur/sinks/debug"
 	"github.com/stripe/veneur/sinks/falconer"
+	"github.com/stripe/veneur/sinks/influxdb"
+	jaegersink "github.com/stripe/veneur/sinks/jaeger"
 	"github.com/stripe/veneur/sinks/kafka"
 	"github.com/stripe/veneur/sinks/lightstep"
+	otlpsink "github.com/stripe/veneur/sinks/otlp"
+	"github.com/stripe/veneur/sinks/prometheus"
+	"github.com/stripe/veneur/sinks/retry"
 	"github.com/stripe/veneur/sinks/signalfx"
 	"github.com/stripe/veneur/sinks/splunk"
 	"github.com/stripe/veneur/sinks/ssfmetrics"
 	"github.com/stripe/veneur/sinks/xray"
+	"github.com/stripe/veneur/sinks/zipkin"
 	"github.com/stripe/veneur/ssf"
 	"github.com/stripe/veneur/trace"
 	"github.com/stripe/veneur/trace/metrics"
@@ -113,6 +123,14 @@ type Server struct {
 	tlsConfig      *tls.Config
 	tcpReadTimeout time.Duration
 
+	graphiteParser *graphite.Parser
+
+	cardinalityLimiter *cardinalityLimiter
+
+	relabeler      *relabel.Relabeler
+	metricRouter   *routing.Router
+	relabelDropped int64
+
 	// closed when the server is shutting down gracefully
 	shutdown chan struct{}
 
@@ -128,6 +146,21 @@ type Server struct {
 	spanSinks   []sinks.SpanSink
 	metricSinks []sinks.MetricSink
 
+	// metricSinkSpecs are the metric sinks from the configuration,
+	// and derivedMetrics is the processor that the signalfx sink
+	// reports derived metrics to.
+	metricSinkSpecs []metricSinkSpec
+	derivedMetrics  samplers.DerivedMetricsProcessor
+	debugSinkMtx    sync.Mutex
+
+	// config is the configuration that the server runs with, and
+	// configFile the file that it's reloaded from, if reloading is
+	// enabled. reloadMtx protects the settings that a reload
+	// changes while they're in use.
+	config     Config
+	configFile string
+	reloadMtx  sync.RWMutex
+
 	TraceClient *trace.Client
 
 	ssfInternalMetrics sync.Map
@@ -139,8 +172,46 @@ type Server struct {
 	// gRPC forward clients
 	grpcForwardConn *grpc.ClientConn
 
+	// OTLP receivers
+	otlpGRPCAddress string
+	otlpHTTPAddress string
+	otlpServer      *otlp.Server
+
 	stuckIntervals int
 	lastFlushUnix  int64
+
+	// shutdownTimeout is how long the final flush and stopping the
+	// sinks may take when the server shuts down.
+	shutdownTimeout time.Duration
+
+	// sinkFlushTimeout is how long each sink may take to flush, and
+	// busySinks are the sinks whose flushes are still running.
+	sinkFlushTimeout time.Duration
+	busySinks        busySinks
+
+	// sinkMultiples are the intervals of the sinks and plugins that
+	// don't flush every interval, as multiples of the interval, and
+	// slowFlushes aggregate the metrics for them.
+	sinkMultiples map[string]int
+	slowFlushes   []*slowFlush
+
+	// sinkRetry is how calls to the sinks are retried, and when
+	// their circuit breakers open.
+	sinkRetry retry.Policy
+
+	// spools persist the metrics that sinks fail to flush, if
+	// sink_spool_directory is set.
+	spools *sinkSpools
+
+	// stateFile is where the workers' metrics are saved on shutdown,
+	// and restored from on startup.
+	stateFile string
+
+	// listeners are the sockets that the server listens on, and
+	// hotRestartSocket is where it hands them to a new veneur.
+	listeners        listenerSet
+	hotRestartSocket string
+	shutdownOnce     sync.Once
 }
 
 // ssfServiceSpanMetrics refer to the span metrics that will
@@ -251,6 +322,14 @@ func scopesFromConfig(conf Config) (scopedstatsd.MetricScopes, error) {
 	return ms, nil
 }
 
+func histogramAggregates(names []string) samplers.HistogramAggregates {
+	aggregates := samplers.HistogramAggregates{Count: len(names)}
+	for _, agg := range names {
+		aggregates.Value += samplers.AggregatesLookup[agg]
+	}
+	return aggregates
+}
+
 // NewFromConfig creates a new veneur server from a configuration
 // specification and sets up the passed logger according to the
 // configuration.
@@ -266,11 +345,7 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 
 	ret.TagsAsMap = mappedTags
 	ret.HistogramPercentiles = conf.Percentiles
-	ret.HistogramAggregates.Value = 0
-	for _, agg := range conf.Aggregates {
-		ret.HistogramAggregates.Value += samplers.AggregatesLookup[agg]
-	}
-	ret.HistogramAggregates.Count = len(conf.Aggregates)
+	ret.HistogramAggregates = histogramAggregates(conf.Aggregates)
 
 	var err error
 	ret.interval, err = conf.ParseInterval()
@@ -278,7 +353,69 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 		return ret, err
 	}
 
+	var timestampLateness time.Duration
+	if conf.TimestampLateness != "" {
+		timestampLateness, err = time.ParseDuration(conf.TimestampLateness)
+		if err != nil {
+			return ret, err
+		}
+	}
+
+	ret.shutdownTimeout = ret.interval
+	if conf.ShutdownTimeout != "" {
+		ret.shutdownTimeout, err = time.ParseDuration(conf.ShutdownTimeout)
+		if err != nil {
+			return ret, err
+		}
+	}
+
+	ret.sinkFlushTimeout = ret.interval
+	if conf.SinkFlushTimeout != "" {
+		ret.sinkFlushTimeout, err = time.ParseDuration(conf.SinkFlushTimeout)
+		if err != nil {
+			return ret, err
+		}
+	}
+
+	ret.sinkRetry, err = sinkRetryPolicy(conf, ret.interval)
+	if err != nil {
+		return ret, err
+	}
+
+	ret.sinkMultiples, err = parseSinkIntervals(conf.SinkIntervals, ret.interval)
+	if err != nil {
+		return ret, err
+	}
+	ret.slowFlushes = newSlowFlushes(ret.sinkMultiples)
+
+	if conf.SinkSpoolDirectory != "" {
+		var spoolTTL time.Duration
+		if conf.SinkSpoolTTL != "" {
+			spoolTTL, err = time.ParseDuration(conf.SinkSpoolTTL)
+			if err != nil {
+				return ret, err
+			}
+		}
+		ret.spools, err = newSinkSpools(conf.SinkSpoolDirectory, int64(conf.SinkSpoolMaxBytes), spoolTTL)
+		if err != nil {
+			return ret, err
+		}
+	}
+
 	ret.stuckIntervals = conf.FlushWatchdogMissedFlushes
+	ret.stateFile = conf.AggregationStateFile
+
+	if conf.HotRestartSocket != "" && !hotRestartSupported {
+		return ret, errors.New("hot_restart_socket is only supported on Linux")
+	}
+	ret.hotRestartSocket = conf.HotRestartSocket
+
+	if conf.CardinalityLimit > 0 {
+		ret.cardinalityLimiter, err = newCardinalityLimiter(conf.CardinalityLimit, conf.CardinalityLimitAction)
+		if err != nil {
+			return ret, err
+		}
+	}
 
 	transport := &http.Transport{
 		IdleConnTimeout: ret.interval * 2, // If we're idle more than one interval something is up
@@ -376,6 +513,9 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 	// Use the pre-allocated Workers slice to know how many to start.
 	for i := range ret.Workers {
 		ret.Workers[i] = NewWorker(i+1, ret.TraceClient, log, ret.Statsd)
+		ret.Workers[i].interval = ret.interval
+		ret.Workers[i].lateness = timestampLateness
+		ret.Workers[i].limiter = ret.cardinalityLimiter
 		// do not close over loop index
 		go func(w *Worker) {
 			defer func() {
@@ -389,10 +529,7 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 
 	// Set up a span sink that extracts metrics from SSF spans and
 	// reports them via the metric workers:
-	processors := make([]ssfmetrics.Processor, len(ret.Workers))
-	for i, w := range ret.Workers {
-		processors[i] = w
-	}
+	processors := []ssfmetrics.Processor{relabelingIngester{ret}}
 	metricSink, err := ssfmetrics.NewMetricExtractionSink(processors, conf.IndicatorSpanTimerName, conf.ObjectiveSpanTimerName, ret.TraceClient, log)
 	if err != nil {
 		return ret, err
@@ -406,6 +543,20 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 		}
 		ret.StatsdListenAddrs = append(ret.StatsdListenAddrs, addr)
 	}
+
+	ret.graphiteParser, err = graphite.NewParser(conf.GraphiteTemplates)
+	if err != nil {
+		return ret, err
+	}
+
+	relabelRules := make([]relabel.Rule, len(conf.MetricRelabelRules))
+	for i, rule := range conf.MetricRelabelRules {
+		relabelRules[i] = relabel.Rule(rule)
+	}
+	ret.relabeler, err = relabel.New(relabelRules)
+	if err != nil {
+		return ret, err
+	}
 	for _, addrStr := range conf.SsfListenAddresses {
 		addr, err := protocol.ResolveAddr(addrStr)
 		if err != nil {
@@ -457,30 +608,19 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 		}
 	}
 
-	if conf.SignalfxAPIKey != "" {
-		tracedHTTP := *ret.HTTPClient
-		tracedHTTP.Transport = vhttp.NewTraceRoundTripper(tracedHTTP.Transport, ret.TraceClient, "signalfx")
-
-		fallback := signalfx.NewClient(conf.SignalfxEndpointBase, conf.SignalfxAPIKey, &tracedHTTP)
-		byTagClients := map[string]signalfx.DPClient{}
-		for _, perTag := range conf.SignalfxPerTagAPIKeys {
-			byTagClients[perTag.Name] = signalfx.NewClient(conf.SignalfxEndpointBase, perTag.APIKey, &tracedHTTP)
-		}
-		sfxSink, err := signalfx.NewSignalFxSink(conf.SignalfxHostnameTag, conf.Hostname, ret.TagsAsMap, log, fallback, conf.SignalfxVaryKeyBy, byTagClients, conf.SignalfxMetricNamePrefixDrops, conf.SignalfxMetricTagPrefixDrops, metricSink, conf.SignalfxFlushMaxPerBody)
+	ret.derivedMetrics = metricSink
+	ret.config = conf
+	ret.metricSinkSpecs = ret.newMetricSinkSpecs(conf, logger)
+	for i := range ret.metricSinkSpecs {
+		spec := &ret.metricSinkSpecs[i]
+		spec.sink, err = spec.create()
 		if err != nil {
 			return ret, err
 		}
-		ret.metricSinks = append(ret.metricSinks, sfxSink)
+		ret.metricSinks = append(ret.metricSinks, spec.sink)
 	}
-	if conf.DatadogAPIKey != "" && conf.DatadogAPIHostname != "" {
-		ddSink, err := datadog.NewDatadogMetricSink(
-			ret.interval.Seconds(), conf.DatadogFlushMaxPerBody, conf.Hostname, ret.Tags,
-			conf.DatadogAPIHostname, conf.DatadogAPIKey, ret.HTTPClient, log,
-		)
-		if err != nil {
-			return ret, err
-		}
-		ret.metricSinks = append(ret.metricSinks, ddSink)
+	if err := checkMetricSinkNames(ret.metricSinks); err != nil {
+		return ret, err
 	}
 
 	// Configure tracing sinks
@@ -591,33 +731,55 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 			logger.Info("Configured Falconer trace sink")
 		}
 
-		// Set up as many span workers as we need:
-		ret.SpanWorkerGoroutines = 1
-		if conf.NumSpanWorkers > 0 {
-			ret.SpanWorkerGoroutines = conf.NumSpanWorkers
+		if conf.OtlpSinkAddress != "" {
+			otlpSink, err := otlpsink.NewOTLPSpanSink(
+				context.Background(), conf.OtlpSinkAddress, conf.Hostname,
+				ret.TagsAsMap, conf.OtlpSinkSpanBufferSize,
+				conf.OtlpSinkFlushMaxPerBody, log, grpc.WithInsecure(),
+			)
+			if err != nil {
+				return ret, err
+			}
+
+			ret.spanSinks = append(ret.spanSinks, otlpSink)
+			logger.Info("Configured OTLP span sink")
 		}
-	}
 
-	if conf.KafkaBroker != "" {
-		if conf.KafkaMetricTopic != "" || conf.KafkaCheckTopic != "" || conf.KafkaEventTopic != "" {
-			kSink, err := kafka.NewKafkaMetricSink(
-				log, ret.TraceClient, conf.KafkaBroker, conf.KafkaCheckTopic, conf.KafkaEventTopic,
-				conf.KafkaMetricTopic, conf.KafkaMetricRequireAcks,
-				conf.KafkaPartitioner, conf.KafkaRetryMax,
-				conf.KafkaMetricBufferBytes, conf.KafkaMetricBufferMessages,
-				conf.KafkaMetricBufferFrequency,
+		if conf.ZipkinAddress != "" {
+			zipkinSink, err := zipkin.NewZipkinSpanSink(
+				conf.ZipkinAddress, ret.TagsAsMap, conf.ZipkinSpanBufferSize,
+				conf.ZipkinFlushMaxPerBody, ret.HTTPClient, log,
 			)
 			if err != nil {
 				return ret, err
 			}
 
-			ret.metricSinks = append(ret.metricSinks, kSink)
+			ret.spanSinks = append(ret.spanSinks, zipkinSink)
+			logger.Info("Configured Zipkin span sink")
+		}
 
-			logger.Info("Configured Kafka metric sink")
-		} else {
-			logger.Warn("Kafka metric sink skipped due to missing metric, check and event topic")
+		if conf.JaegerAddress != "" {
+			jaegerSink, err := jaegersink.NewJaegerSpanSink(
+				conf.JaegerAddress, conf.Hostname, ret.TagsAsMap,
+				conf.JaegerSpanBufferSize, conf.JaegerFlushMaxPerBody,
+				ret.HTTPClient, log,
+			)
+			if err != nil {
+				return ret, err
+			}
+
+			ret.spanSinks = append(ret.spanSinks, jaegerSink)
+			logger.Info("Configured Jaeger span sink")
 		}
 
+		// Set up as many span workers as we need:
+		ret.SpanWorkerGoroutines = 1
+		if conf.NumSpanWorkers > 0 {
+			ret.SpanWorkerGoroutines = conf.NumSpanWorkers
+		}
+	}
+
+	if conf.KafkaBroker != "" {
 		if conf.KafkaSpanTopic != "" {
 			sink, err := kafka.NewKafkaSpanSink(log, ret.TraceClient, conf.KafkaBroker, conf.KafkaSpanTopic,
 				conf.KafkaPartitioner, conf.KafkaMetricRequireAcks, conf.KafkaRetryMax,
@@ -636,21 +798,62 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 		}
 	}
 
-	{
-		mtx := sync.Mutex{}
-		if conf.DebugFlushedMetrics {
-			ret.metricSinks = append(ret.metricSinks, debug.NewDebugMetricSink(&mtx, log))
+	// Configure the named span sinks from span_sinks, which may have
+	// several instances of the same kind:
+	deps := ret.sinkDependencies(conf)
+	spanSinkRetry := map[string]sinkRetryConfig{}
+	for _, sc := range conf.SpanSinks {
+		for _, existing := range ret.spanSinks {
+			if existing.Name() == sc.Name {
+				return ret, fmt.Errorf("span sink name %q is used more than once", sc.Name)
+			}
 		}
-		if conf.DebugIngestedSpans {
-			blackhole := debug.NewDebugSpanSink(&mtx, log)
-			ret.spanSinks = append(ret.spanSinks, blackhole)
-			logger.WithField("name", blackhole.Name()).Info("Starting logger debug sink")
+		sink, err := sinks.NewSpanSink(sc.Kind, sc.Name, sinks.SinkConfig(sc.Config), deps)
+		if err != nil {
+			return ret, err
+		}
+		ret.spanSinks = append(ret.spanSinks, sink)
+		spanSinkRetry[sc.Name] = sinkRetryConfig(sc.Retry)
+		logger.WithFields(logrus.Fields{"kind": sc.Kind, "name": sc.Name}).Info("Configured span sink")
+	}
+
+	if conf.DebugIngestedSpans {
+		blackhole := debug.NewDebugSpanSink(&ret.debugSinkMtx, log)
+		ret.spanSinks = append(ret.spanSinks, blackhole)
+		logger.WithField("name", blackhole.Name()).Info("Starting logger debug sink")
+	}
+
+	for i, sink := range ret.spanSinks {
+		// spans that are turned into metrics don't leave veneur:
+		if sink == metricSink {
+			continue
+		}
+		policy, err := sinkRetryOverride(ret.sinkRetry, spanSinkRetry[sink.Name()])
+		if err != nil {
+			return ret, fmt.Errorf("span sink %q: %v", sink.Name(), err)
+		}
+		if policy.Enabled() {
+			ret.spanSinks[i] = retry.NewSpanSink(sink, policy)
 		}
 	}
 
 	// After all sinks are initialized, set the list of tags to exclude
 	setSinkExcludedTags(conf.TagsExclude, ret.metricSinks)
 
+	// and set up the routing rules that refer to them:
+	sinkNames := make([]string, len(ret.metricSinks))
+	for i, sink := range ret.metricSinks {
+		sinkNames[i] = sink.Name()
+	}
+	routingRules := make([]routing.Rule, len(conf.MetricRoutingRules))
+	for i, rule := range conf.MetricRoutingRules {
+		routingRules[i] = routing.Rule(rule)
+	}
+	ret.metricRouter, err = routing.New(routingRules, sinkNames)
+	if err != nil {
+		return ret, err
+	}
+
 	var svc s3iface.S3API
 	awsID := conf.AwsAccessKeyID
 	awsSecret := conf.AwsSecretAccessKey
@@ -696,6 +899,7 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 		ret.registerPlugin(localFilePlugin)
 		logger.Info(fmt.Sprintf("Local file logging to %s", conf.FlushFile))
 	}
+	ret.checkSinkIntervals()
 
 	// closed in Shutdown; Same approach and http.Shutdown
 	ret.shutdown = make(chan struct{})
@@ -724,11 +928,335 @@ func NewFromConfig(logger *logrus.Logger, conf Config) (*Server, error) {
 			importsrv.WithTraceClient(ret.TraceClient))
 	}
 
+	// Setup the OTLP receivers if they were configured
+	ret.otlpGRPCAddress = conf.OtlpGrpcAddress
+	ret.otlpHTTPAddress = conf.OtlpHTTPAddress
+	if ret.otlpGRPCAddress != "" || ret.otlpHTTPAddress != "" {
+		ret.otlpServer = otlp.New([]otlp.MetricIngester{relabelingIngester{ret}},
+			otlp.WithTraceClient(ret.TraceClient),
+			otlp.WithLogger(logger),
+			otlp.WithSpanIngester(otlpSpanIngester{ret}))
+	}
+
 	logger.WithField("config", conf).Debug("Initialized server")
 
 	return ret, err
 }
 
+// sinkDependencies returns what the sinks from metric_sinks and
+// span_sinks need from the server.
+func (s *Server) sinkDependencies(conf Config) sinks.Dependencies {
+	return sinks.Dependencies{
+		Hostname:    conf.Hostname,
+		Tags:        conf.Tags,
+		TagsAsMap:   samplers.ParseTagSliceToMap(conf.Tags),
+		Interval:    s.interval,
+		HTTPClient:  s.HTTPClient,
+		TraceClient: s.TraceClient,
+		Log:         log,
+	}
+}
+
+// A metricSinkSpec is a metric sink that the configuration asks for.
+// Specs let a configuration reload tell which sinks it has to create,
+// keep or remove.
+type metricSinkSpec struct {
+	// id identifies the sink across reloads: the name of the sink
+	// for legacy sink settings, or its entry in metric_sinks.
+	id string
+	// settings are the configuration values that the sink is
+	// created from. The sink is only re-created if they change.
+	settings interface{}
+	// restartOnly sinks can't be replaced while veneur runs,
+	// e.g. because they listen on a port.
+	restartOnly bool
+	// retry overrides the retry policy for the sink, if it comes
+	// from metric_sinks.
+	retry  sinkRetryConfig
+	create func() (sinks.MetricSink, error)
+
+	// sink is the sink once it's created.
+	sink sinks.MetricSink
+}
+
+// newMetricSinkSpecs returns the specs of the metric sinks that conf
+// configures, in the order in which they are flushed.
+func (s *Server) newMetricSinkSpecs(conf Config, logger *logrus.Logger) []metricSinkSpec {
+	tags := conf.Tags
+	tagsAsMap := samplers.ParseTagSliceToMap(tags)
+	settings := func(keys ...string) interface{} {
+		return []interface{}{configValues(conf, keys...), tags}
+	}
+	var specs []metricSinkSpec
+
+	if conf.SignalfxAPIKey != "" {
+		specs = append(specs, metricSinkSpec{
+			id:       "signalfx",
+			settings: settings("signalfx_"),
+			create: func() (sinks.MetricSink, error) {
+				tracedHTTP := *s.HTTPClient
+				tracedHTTP.Transport = vhttp.NewTraceRoundTripper(tracedHTTP.Transport, s.TraceClient, "signalfx")
+
+				fallback := signalfx.NewClient(conf.SignalfxEndpointBase, conf.SignalfxAPIKey, &tracedHTTP)
+				byTagClients := map[string]signalfx.DPClient{}
+				for _, perTag := range conf.SignalfxPerTagAPIKeys {
+					byTagClients[perTag.Name] = signalfx.NewClient(conf.SignalfxEndpointBase, perTag.APIKey, &tracedHTTP)
+				}
+				return signalfx.NewSignalFxSink(conf.SignalfxHostnameTag, conf.Hostname, tagsAsMap, log, fallback, conf.SignalfxVaryKeyBy, byTagClients, conf.SignalfxMetricNamePrefixDrops, conf.SignalfxMetricTagPrefixDrops, s.derivedMetrics, conf.SignalfxFlushMaxPerBody)
+			},
+		})
+	}
+	if conf.DatadogAPIKey != "" && conf.DatadogAPIHostname != "" {
+		specs = append(specs, metricSinkSpec{
+			id:       "datadog",
+			settings: settings("datadog_api_hostname", "datadog_api_key", "datadog_flush_max_per_body"),
+			create: func() (sinks.MetricSink, error) {
+				return datadog.NewDatadogMetricSink(
+					s.sinkInterval("datadog").Seconds(), conf.DatadogFlushMaxPerBody, conf.Hostname, tags,
+					conf.DatadogAPIHostname, conf.DatadogAPIKey, s.HTTPClient, log,
+				)
+			},
+		})
+	}
+	if conf.PrometheusScrapeEnabled || conf.PrometheusScrapeAddress != "" {
+		specs = append(specs, metricSinkSpec{
+			id:          "prometheus",
+			settings:    settings("prometheus_scrape_"),
+			restartOnly: true,
+			create: func() (sinks.MetricSink, error) {
+				promSink, err := prometheus.NewPrometheusMetricSink(conf.PrometheusScrapeAddress, conf.PrometheusScrapeExpireIntervals, tags, log)
+				if err != nil {
+					return nil, err
+				}
+				logger.Info("Configured Prometheus metric sink")
+				return promSink, nil
+			},
+		})
+	}
+
+	if conf.PrometheusRemoteWriteAddress != "" {
+		specs = append(specs, metricSinkSpec{
+			id:       "prometheus_remote_write",
+			settings: settings("prometheus_remote_write_"),
+			create: func() (sinks.MetricSink, error) {
+				rwSink, err := prometheus.NewRemoteWriteMetricSink(
+					conf.PrometheusRemoteWriteAddress, conf.PrometheusRemoteWriteFlushMaxPerBody,
+					tags, s.HTTPClient, log,
+				)
+				if err != nil {
+					return nil, err
+				}
+				logger.Info("Configured Prometheus remote_write metric sink")
+				return rwSink, nil
+			},
+		})
+	}
+
+	if conf.OtlpSinkAddress != "" {
+		specs = append(specs, metricSinkSpec{
+			id:       "otlp",
+			settings: settings("otlp_sink_address", "otlp_sink_flush_max_per_body"),
+			create: func() (sinks.MetricSink, error) {
+				otlpSink, err := otlpsink.NewOTLPMetricSink(
+					context.Background(), conf.OtlpSinkAddress, s.sinkInterval("otlp"),
+					conf.Hostname, tags, conf.OtlpSinkFlushMaxPerBody, log,
+					grpc.WithInsecure(),
+				)
+				if err != nil {
+					return nil, err
+				}
+				logger.Info("Configured OTLP metric sink")
+				return otlpSink, nil
+			},
+		})
+	}
+
+	if conf.InfluxdbAddress != "" {
+		specs = append(specs, metricSinkSpec{
+			id:       "influxdb",
+			settings: settings("influxdb_"),
+			create: func() (sinks.MetricSink, error) {
+				var influxSink *influxdb.InfluxDBMetricSink
+				var err error
+				if conf.InfluxdbOrg != "" || conf.InfluxdbBucket != "" {
+					influxSink, err = influxdb.NewInfluxDBV2MetricSink(
+						conf.InfluxdbAddress, conf.InfluxdbOrg, conf.InfluxdbBucket,
+						conf.InfluxdbToken, conf.InfluxdbFlushMaxPerBody, conf.Hostname,
+						tags, s.HTTPClient, log,
+					)
+				} else {
+					influxSink, err = influxdb.NewInfluxDBV1MetricSink(
+						conf.InfluxdbAddress, conf.InfluxdbDatabase, conf.InfluxdbRetentionPolicy,
+						conf.InfluxdbUsername, conf.InfluxdbPassword, conf.InfluxdbFlushMaxPerBody,
+						conf.Hostname, tags, s.HTTPClient, log,
+					)
+				}
+				if err != nil {
+					return nil, err
+				}
+				logger.Info("Configured InfluxDB metric sink")
+				return influxSink, nil
+			},
+		})
+	}
+
+	if conf.KafkaBroker != "" {
+		if conf.KafkaMetricTopic != "" || conf.KafkaCheckTopic != "" || conf.KafkaEventTopic != "" {
+			specs = append(specs, metricSinkSpec{
+				id:       "kafka",
+				settings: settings("kafka_broker", "kafka_check_topic", "kafka_event_topic", "kafka_metric_", "kafka_partitioner", "kafka_retry_max"),
+				create: func() (sinks.MetricSink, error) {
+					kSink, err := kafka.NewKafkaMetricSink(
+						log, s.TraceClient, conf.KafkaBroker, conf.KafkaCheckTopic, conf.KafkaEventTopic,
+						conf.KafkaMetricTopic, conf.KafkaMetricRequireAcks,
+						conf.KafkaPartitioner, conf.KafkaRetryMax,
+						conf.KafkaMetricBufferBytes, conf.KafkaMetricBufferMessages,
+						conf.KafkaMetricBufferFrequency,
+					)
+					if err != nil {
+						return nil, err
+					}
+					logger.Info("Configured Kafka metric sink")
+					return kSink, nil
+				},
+			})
+		} else {
+			logger.Warn("Kafka metric sink skipped due to missing metric, check and event topic")
+		}
+	}
+
+	// The named sinks from metric_sinks may have several instances
+	// of the same kind:
+	deps := s.sinkDependencies(conf)
+	for _, sc := range conf.MetricSinks {
+		sc := sc
+		specs = append(specs, metricSinkSpec{
+			id:       "metric_sinks:" + sc.Name,
+			settings: []interface{}{sc, tags},
+			retry:    sinkRetryConfig(sc.Retry),
+			create: func() (sinks.MetricSink, error) {
+				deps := deps
+				deps.Interval = s.sinkInterval(sc.Name)
+				sink, err := sinks.NewMetricSink(sc.Kind, sc.Name, sinks.SinkConfig(sc.Config), deps)
+				if err != nil {
+					return nil, err
+				}
+				logger.WithFields(logrus.Fields{"kind": sc.Kind, "name": sc.Name}).Info("Configured metric sink")
+				return sink, nil
+			},
+		})
+	}
+
+	if conf.DebugFlushedMetrics {
+		specs = append(specs, metricSinkSpec{
+			id:       "debug",
+			settings: settings("debug_flushed_metrics"),
+			create: func() (sinks.MetricSink, error) {
+				return debug.NewDebugMetricSink(&s.debugSinkMtx, log), nil
+			},
+		})
+	}
+
+	for i := range specs {
+		id, create, rc := specs[i].id, specs[i].create, specs[i].retry
+		specs[i].create = func() (sinks.MetricSink, error) {
+			policy, err := sinkRetryOverride(s.sinkRetry, rc)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", id, err)
+			}
+			sink, err := create()
+			if err != nil || !policy.Enabled() {
+				return sink, err
+			}
+			return retry.NewMetricSink(sink, policy), nil
+		}
+	}
+	return specs
+}
+
+// sinkRetryConfig is the retry block of an entry in metric_sinks or
+// span_sinks, which overrides the sink_retry_* and sink_breaker_*
+// settings for that sink.
+type sinkRetryConfig struct {
+	AttemptTimeout   string `yaml:"attempt_timeout"`
+	BreakerCooldown  string `yaml:"breaker_cooldown"`
+	BreakerThreshold int    `yaml:"breaker_threshold"`
+	InitialBackoff   string `yaml:"initial_backoff"`
+	MaxAttempts      int    `yaml:"max_attempts"`
+	MaxBackoff       string `yaml:"max_backoff"`
+}
+
+// sinkRetryPolicy returns the retry policy and circuit breaker settings
+// that conf sets for all sinks. Backoffs and the breaker cooldown
+// default to the interval.
+func sinkRetryPolicy(conf Config, interval time.Duration) (retry.Policy, error) {
+	policy := retry.Policy{
+		MaxAttempts:      conf.SinkRetryMaxAttempts,
+		InitialBackoff:   time.Second,
+		MaxBackoff:       interval,
+		BreakerThreshold: conf.SinkBreakerThreshold,
+		BreakerCooldown:  interval,
+	}
+	err := parseRetryDurations(&policy, sinkRetryConfig{
+		AttemptTimeout:  conf.SinkRetryAttemptTimeout,
+		BreakerCooldown: conf.SinkBreakerCooldown,
+		InitialBackoff:  conf.SinkRetryInitialBackoff,
+		MaxBackoff:      conf.SinkRetryMaxBackoff,
+	})
+	return policy, err
+}
+
+// sinkRetryOverride returns policy with the settings that a sink's retry
+// block sets. Settings that the block leaves out, or sets to zero, keep
+// their value from policy.
+func sinkRetryOverride(policy retry.Policy, rc sinkRetryConfig) (retry.Policy, error) {
+	if rc.MaxAttempts != 0 {
+		policy.MaxAttempts = rc.MaxAttempts
+	}
+	if rc.BreakerThreshold != 0 {
+		policy.BreakerThreshold = rc.BreakerThreshold
+	}
+	err := parseRetryDurations(&policy, rc)
+	return policy, err
+}
+
+// parseRetryDurations sets the durations of policy that rc sets.
+func parseRetryDurations(policy *retry.Policy, rc sinkRetryConfig) error {
+	durations := []struct {
+		value string
+		into  *time.Duration
+	}{
+		{rc.InitialBackoff, &policy.InitialBackoff},
+		{rc.MaxBackoff, &policy.MaxBackoff},
+		{rc.AttemptTimeout, &policy.AttemptTimeout},
+		{rc.BreakerCooldown, &policy.BreakerCooldown},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		var err error
+		*d.into, err = time.ParseDuration(d.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMetricSinkNames returns an error if two metric sinks have the
+// same name.
+func checkMetricSinkNames(metricSinks []sinks.MetricSink) error {
+	seen := map[string]bool{}
+	for _, sink := range metricSinks {
+		if seen[sink.Name()] {
+			return fmt.Errorf("metric sink name %q is used more than once", sink.Name())
+		}
+		seen[sink.Name()] = true
+	}
+	return nil
+}
+
 // Start spins up the Server to do actual work, firing off goroutines for
 // various workers and utilities.
 func (s *Server) Start() {
@@ -777,13 +1305,29 @@ func (s *Server) Start() {
 		}
 	}
 
-	for _, sink := range s.metricSinks {
+	for _, sink := range s.getMetricSinks() {
 		logrus.WithField("sink", sink.Name()).Info("Starting metric sink")
 		if err := sink.Start(s.TraceClient); err != nil {
 			logrus.WithError(err).WithField("sink", sink).Fatal("Error starting metric sink")
 		}
 	}
 
+	// Take over the listeners of the veneur that we replace, if it's
+	// still running:
+	var handoff *net.UnixConn
+	if s.hotRestartSocket != "" {
+		handoff = s.takeOverListeners()
+	}
+
+	// Pick up the interval where the previous server left off. After a
+	// hot restart, the state is only there once the old veneur shut
+	// down:
+	if s.stateFile != "" && handoff == nil {
+		if err := s.restoreState(time.Now()); err != nil {
+			log.WithError(err).Error("Could not restore aggregation state")
+		}
+	}
+
 	// Read Metrics Forever!
 	concreteAddrs := make([]net.Addr, 0, len(s.StatsdListenAddrs))
 	for _, addr := range s.StatsdListenAddrs {
@@ -802,6 +1346,15 @@ func (s *Server) Start() {
 		logrus.Info("Tracing sockets are not configured - not reading trace socket")
 	}
 
+	// Read OTLP Forever!
+	if s.otlpServer != nil {
+		s.startOTLP()
+	}
+
+	if s.hotRestartSocket != "" {
+		go s.serveHotRestart(handoff)
+	}
+
 	// Initialize a gRPC connection for forwarding
 	if s.forwardUseGRPC {
 		var err error
@@ -935,7 +1488,7 @@ func (s *Server) HandleMetricPacket(packet []byte) error {
 		}
 		s.Workers[svcheck.Digest%uint32(len(s.Workers))].PacketChan <- *svcheck
 	} else {
-		metric, err := samplers.ParseMetric(packet)
+		parsed, err := samplers.ParseMetrics(packet)
 		if err != nil {
 			log.WithFields(logrus.Fields{
 				logrus.ErrorKey: err,
@@ -944,11 +1497,23 @@ func (s *Server) HandleMetricPacket(packet []byte) error {
 			samples.Add(ssf.Count("packet.error_total", 1, map[string]string{"packet_type": "metric", "reason": "parse"}))
 			return err
 		}
-		s.Workers[metric.Digest%uint32(len(s.Workers))].PacketChan <- *metric
+		for _, metric := range parsed {
+			s.ingestUDPMetric(metric)
+		}
 	}
 	return nil
 }
 
+// ingestUDPMetric applies the relabeling rules to a metric, and sends
+// the result to the worker responsible for it.
+func (s *Server) ingestUDPMetric(metric samplers.UDPMetric) {
+	if !s.relabeler.Apply(&metric) {
+		atomic.AddInt64(&s.relabelDropped, 1)
+		return
+	}
+	s.Workers[metric.Digest%uint32(len(s.Workers))].IngestUDP(metric)
+}
+
 // HandleTracePacket accepts an incoming packet as bytes and sends it to the
 // appropriate worker.
 func (s *Server) HandleTracePacket(packet []byte) {
@@ -1027,14 +1592,30 @@ func (s *Server) handleSSF(span *ssf.SSFSpan, ssfFormat string) {
 	s.SpanChan <- span
 }
 
+// otlpSpanIngester passes the spans that the OTLP receiver converted
+// to SSF on to the span workers.
+type otlpSpanIngester struct {
+	s *Server
+}
+
+func (o otlpSpanIngester) IngestSpan(span *ssf.SSFSpan) {
+	o.s.handleSSF(span, "otlp")
+}
+
 // ReadMetricSocket listens for available packets to handle.
 func (s *Server) ReadMetricSocket(serverConn net.PacketConn, packetPool *sync.Pool) {
 	for {
 		buf := packetPool.Get().([]byte)
 		n, _, err := serverConn.ReadFrom(buf)
 		if err != nil {
-			log.WithError(err).Error("Error reading from UDP metrics socket")
-			continue
+			select {
+			case <-s.shutdown:
+				log.WithError(err).Info("Ignoring ReadFrom error while shutting down")
+				return
+			default:
+				log.WithError(err).Error("Error reading from UDP metrics socket")
+				continue
+			}
 		}
 		s.processMetricPacket(n, buf, packetPool)
 	}
@@ -1306,7 +1887,12 @@ func (s *Server) HTTPServe() {
 			profileStopOnce.Do(prf.Stop)
 		}()
 	}
-	httpSocket := bind.Socket(s.HTTPAddr)
+	httpSocket, err := s.listeners.listen(listenerKey("http", "tcp", s.HTTPAddr), func() (net.Listener, error) {
+		return bind.Socket(s.HTTPAddr), nil
+	})
+	if err != nil {
+		log.WithError(err).WithField("address", s.HTTPAddr).Fatal("Could not take over the HTTP listener")
+	}
 	graceful.Timeout(10 * time.Second)
 	graceful.PreHook(func() {
 
@@ -1319,7 +1905,12 @@ func (s *Server) HTTPServe() {
 
 	// Ensure that the server responds to SIGUSR2 even
 	// when *not* running under einhorn.
-	graceful.AddSignal(syscall.SIGUSR2, syscall.SIGHUP)
+	// SIGHUP reloads the configuration instead, if that's enabled.
+	if s.configFile == "" {
+		graceful.AddSignal(syscall.SIGUSR2, syscall.SIGHUP)
+	} else {
+		graceful.AddSignal(syscall.SIGUSR2)
+	}
 	graceful.HandleSignals()
 	gracefulSocket := graceful.WrapListener(httpSocket)
 	log.WithField("address", s.HTTPAddr).Info("HTTP server listening")
@@ -1347,7 +1938,14 @@ func (s *Server) HTTPServe() {
 func (s *Server) gRPCServe() {
 	entry := log.WithFields(logrus.Fields{"address": s.grpcListenAddress})
 	entry.Info("Starting gRPC server")
-	if err := s.grpcServer.Serve(s.grpcListenAddress); err != nil {
+	ln, err := s.listeners.listen(listenerKey("grpc", "tcp", s.grpcListenAddress), func() (net.Listener, error) {
+		return net.Listen("tcp", s.grpcListenAddress)
+	})
+	if err != nil {
+		entry.WithError(err).Error("Could not listen for gRPC")
+		return
+	}
+	if err := s.grpcServer.Server.Serve(ln); err != nil {
 		entry.WithError(err).Error("gRPC server was not shut down cleanly")
 	}
 
@@ -1376,14 +1974,91 @@ func (s *Server) gRPCStop() {
 	}
 }
 
+// startOTLP binds the configured OTLP/gRPC and OTLP/HTTP listeners
+// and serves them in the background.
+func (s *Server) startOTLP() {
+	serve := func(protocol, addr string, serve func(net.Listener) error) {
+		entry := log.WithFields(logrus.Fields{"address": addr, "protocol": protocol})
+		ln, err := s.listeners.listen(listenerKey("otlp_"+protocol, "tcp", addr), func() (net.Listener, error) {
+			return net.Listen("tcp", addr)
+		})
+		if err != nil {
+			entry.WithError(err).Fatal("Could not listen for OTLP")
+		}
+		entry = entry.WithField("address", ln.Addr())
+		entry.Info("Listening for OTLP")
+		go func() {
+			defer func() {
+				ConsumePanic(s.Sentry, s.TraceClient, s.Hostname, recover())
+			}()
+			if err := serve(ln); err != nil {
+				entry.WithError(err).Error("OTLP server was not shut down cleanly")
+			}
+		}()
+	}
+	if s.otlpGRPCAddress != "" {
+		serve("grpc", s.otlpGRPCAddress, s.otlpServer.ServeGRPC)
+	}
+	if s.otlpHTTPAddress != "" {
+		serve("http", s.otlpHTTPAddress, s.otlpServer.ServeHTTPListener)
+	}
+}
+
 // Shutdown signals the server to shut down after closing all
-// current connections.
+// current connections. Only the first call shuts the server down; later
+// ones wait for it to finish.
 func (s *Server) Shutdown() {
-	// TODO(aditya) shut down workers and socket readers
+	s.shutdownOnce.Do(s.shutdownGracefully)
+}
+
+// ShuttingDown returns a channel that's closed once the server starts
+// shutting down.
+func (s *Server) ShuttingDown() <-chan struct{} {
+	return s.shutdown
+}
+
+// shutdownGracefully shuts the server down in order: it stops receiving
+// data, lets the workers process what they received already, and
+// flushes everything one last time, or saves it to the state file if
+// there is one. Then it stops the sinks and plugins, so that they can
+// send what they buffered. The final flush and stopping the sinks take
+// at most shutdown_timeout.
+func (s *Server) shutdownGracefully() {
 	log.Info("Shutting down server gracefully")
 	close(s.shutdown)
+	s.listeners.closePacketConns()
 	graceful.Shutdown()
 	s.gRPCStop()
+	if s.otlpServer != nil {
+		s.otlpServer.Stop(10 * time.Second)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	s.drainQueues(ctx)
+
+	if s.stateFile != "" {
+		if err := s.saveState(); err != nil {
+			log.WithError(err).Error("Could not save aggregation state")
+		}
+	}
+
+	// Let the veneur that took over the listeners know that it can
+	// pick up from here:
+	if conn := s.listeners.handoffConn(); conn != nil {
+		if _, err := conn.Write([]byte(handoffDone)); err != nil {
+			log.WithError(err).Error("Could not tell the new veneur that we shut down")
+		}
+		conn.Close()
+	}
+
+	// A server that never started has nothing to flush:
+	if s.SpanWorker != nil {
+		log.Info("Flushing before shutting down")
+		background := s.flush(ctx)
+		waitUntilDone(ctx, background, "Timed out waiting for the final flush")
+		s.stopSinks(ctx)
+	}
 
 	// Close the gRPC connection for forwarding
 	if s.grpcForwardConn != nil {
@@ -1391,6 +2066,88 @@ func (s *Server) Shutdown() {
 	}
 }
 
+// drainQueues waits until the workers have processed the metrics and
+// spans that are queued up for them, or until ctx is done.
+func (s *Server) drainQueues(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !s.queuesEmpty() {
+		select {
+		case <-ctx.Done():
+			log.WithError(ctx.Err()).Warn("Timed out processing the queued metrics and spans")
+			return
+		case <-ticker.C:
+		}
+	}
+	// the workers may still be processing what they took last:
+	for _, w := range s.Workers {
+		w.waitIdle(ctx)
+	}
+}
+
+func (s *Server) queuesEmpty() bool {
+	if len(s.SpanChan) > 0 {
+		return false
+	}
+	for _, w := range s.Workers {
+		if len(w.PacketChan) > 0 || len(w.ImportChan) > 0 || len(w.ImportMetricChan) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// stopSinks calls Stop on all the sinks and plugins that implement
+// sinks.Stopper, and waits for them until ctx is done.
+func (s *Server) stopSinks(ctx context.Context) {
+	type stoppable interface {
+		Name() string
+		sinks.Stopper
+	}
+	var stoppables []stoppable
+	for _, sink := range s.spanSinks {
+		if st, ok := sink.(stoppable); ok {
+			stoppables = append(stoppables, st)
+		}
+	}
+	for _, sink := range s.getMetricSinks() {
+		if st, ok := sink.(stoppable); ok {
+			stoppables = append(stoppables, st)
+		}
+	}
+	for _, p := range s.getPlugins() {
+		if st, ok := p.(stoppable); ok {
+			stoppables = append(stoppables, st)
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, st := range stoppables {
+		wg.Add(1)
+		go func(st stoppable) {
+			defer wg.Done()
+			if err := st.Stop(ctx); err != nil {
+				log.WithError(err).WithField("sink", st.Name()).Warn("Error stopping sink")
+			}
+		}(st)
+	}
+	waitUntilDone(ctx, wg, "Timed out stopping the sinks")
+}
+
+// waitUntilDone waits for wg, and logs msg if ctx is done first.
+func waitUntilDone(ctx context.Context, wg *sync.WaitGroup, msg string) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.WithError(ctx.Err()).Warn(msg)
+	}
+}
+
 // IsLocal indicates whether veneur is running as a local instance
 // (forwarding non-local data to a global veneur instance) or is running as a global
 // instance (sending all data directly to the final destination).
@@ -1412,6 +2169,16 @@ func (s *Server) registerPlugin(p plugins.Plugin) {
 	s.plugins = append(s.plugins, p)
 }
 
+// getMetricSinks returns the metric sinks, which a configuration reload
+// may replace.
+func (s *Server) getMetricSinks() []sinks.MetricSink {
+	s.reloadMtx.RLock()
+	defer s.reloadMtx.RUnlock()
+	metricSinks := make([]sinks.MetricSink, len(s.metricSinks))
+	copy(metricSinks, s.metricSinks)
+	return metricSinks
+}
+
 func (s *Server) getPlugins() []plugins.Plugin {
 	s.pluginMtx.Lock()
 	plugins := make([]plugins.Plugin, len(s.plugins))
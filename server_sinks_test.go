@@ -14,8 +14,12 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
 	"github.com/stripe/veneur/sinks/datadog"
 	"github.com/stripe/veneur/sinks/lightstep"
+	"github.com/stripe/veneur/sinks/retry"
+	"gopkg.in/yaml.v2"
 )
 
 func TestFlushTracesBySink(t *testing.T) {
@@ -162,3 +166,118 @@ func TestNewDatadogMetricSinkConfig(t *testing.T) {
 	// Verify that the values got set	assert.Equal(t, "apikey", sink.APIKey)
 	assert.Equal(t, "http://api", sink.DDHostname)
 }
+
+func TestSinkRetryConfig(t *testing.T) {
+	config := Config{
+		DatadogAPIKey:          "apikey",
+		DatadogAPIHostname:     "http://api",
+		DatadogTraceAPIAddress: "http://trace",
+		SsfListenAddresses:     []string{"udp://127.0.0.1:99"},
+		SinkRetryMaxAttempts:   3,
+		SinkBreakerThreshold:   5,
+		SinkBreakerCooldown:    "1m",
+
+		// required or NewFromConfig fails
+		Interval:     "10s",
+		StatsAddress: "localhost:62251",
+	}
+	server, err := NewFromConfig(logrus.New(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, retry.Policy{
+		MaxAttempts:      3,
+		InitialBackoff:   time.Second,
+		MaxBackoff:       10 * time.Second,
+		BreakerThreshold: 5,
+		BreakerCooldown:  time.Minute,
+	}, server.sinkRetry)
+
+	sink := server.metricSinks[0].(*retry.MetricSink)
+	assert.Equal(t, "datadog", sink.Name())
+	assert.IsType(t, &datadog.DatadogMetricSink{}, sink.Sink())
+	for _, spanSink := range server.spanSinks {
+		if spanSink.Name() == "datadog" {
+			assert.IsType(t, &retry.SpanSink{}, spanSink)
+		}
+	}
+}
+
+func TestSinkRetryOverrides(t *testing.T) {
+	config := Config{
+		DatadogAPIKey:          "apikey",
+		DatadogAPIHostname:     "http://api",
+		DatadogTraceAPIAddress: "http://trace",
+		SsfListenAddresses:     []string{"udp://127.0.0.1:99"},
+		SinkRetryMaxAttempts:   3,
+
+		// required or NewFromConfig fails
+		Interval:     "10s",
+		StatsAddress: "localhost:62251",
+	}
+	require.NoError(t, yaml.Unmarshal([]byte(`
+metric_sinks:
+  - kind: datadog
+    name: datadog-eu
+    config:
+      api_hostname: "http://api.eu"
+      api_key: "eu"
+    retry:
+      max_attempts: 1
+span_sinks:
+  - kind: datadog
+    name: datadog-traces
+    config:
+      trace_api_address: "http://trace"
+    retry:
+      breaker_threshold: 2
+      breaker_cooldown: "5s"
+`), &config))
+	server, err := NewFromConfig(logrus.New(), config)
+	require.NoError(t, err)
+
+	require.Len(t, server.metricSinks, 2)
+	assert.IsType(t, &retry.MetricSink{}, server.metricSinks[0])
+	assert.Equal(t, "datadog-eu", server.metricSinks[1].Name())
+	assert.IsType(t, &datadog.DatadogMetricSink{}, server.metricSinks[1], "a sink without retries isn't wrapped")
+	for _, spanSink := range server.spanSinks {
+		if spanSink.Name() == "datadog-traces" {
+			assert.IsType(t, &retry.SpanSink{}, spanSink)
+		}
+	}
+
+	policy, err := sinkRetryOverride(server.sinkRetry, sinkRetryConfig{BreakerThreshold: 2, BreakerCooldown: "5s"})
+	require.NoError(t, err)
+	assert.Equal(t, retry.Policy{
+		MaxAttempts:      3,
+		InitialBackoff:   time.Second,
+		MaxBackoff:       10 * time.Second,
+		BreakerThreshold: 2,
+		BreakerCooldown:  5 * time.Second,
+	}, policy)
+
+	config.MetricSinks[0].Retry.MaxBackoff = "soon"
+	_, err = NewFromConfig(logrus.New(), config)
+	assert.Error(t, err)
+}
+
+func TestSinkRetryKeepsPrometheusHandler(t *testing.T) {
+	config := localConfig()
+	config.PrometheusScrapeEnabled = true
+	config.SinkRetryMaxAttempts = 3
+	server := setupVeneurServer(t, config, nil, nil, nil, nil)
+	defer server.Shutdown()
+	require.IsType(t, &retry.MetricSink{}, server.metricSinks[0])
+
+	server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+		MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "gauge"},
+		Value:      1.0,
+		SampleRate: 1.0,
+	})
+	server.Flush(context.Background())
+
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "a_b_c")
+}
@@ -6,6 +6,8 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -18,6 +20,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -34,6 +37,7 @@ import (
 	"github.com/stripe/veneur/trace"
 	"github.com/stripe/veneur/trace/metrics"
 	"github.com/zenazn/goji/graceful"
+	"gopkg.in/yaml.v2"
 )
 
 const ε = .00002
@@ -199,6 +203,27 @@ func (c *channelMetricSink) FlushOtherSamples(ctx context.Context, events []ssf.
 	return
 }
 
+// channelSpanSink writes any ingested spans to its `spansChannel`, so
+// tests can inspect them.
+type channelSpanSink struct {
+	spansChannel chan *ssf.SSFSpan
+}
+
+func (c *channelSpanSink) Name() string {
+	return "channel"
+}
+
+func (c *channelSpanSink) Start(*trace.Client) error {
+	return nil
+}
+
+func (c *channelSpanSink) Ingest(span *ssf.SSFSpan) error {
+	c.spansChannel <- span
+	return nil
+}
+
+func (c *channelSpanSink) Flush() {}
+
 // fixture sets up a mock Datadog API server and Veneur
 type fixture struct {
 	api             *httptest.Server
@@ -578,6 +603,289 @@ func TestUDPMetrics(t *testing.T) {
 	assert.Equal(t, "foo.bar", metrics[0].Name, "worker processed the metric")
 }
 
+func TestGraphiteMetrics(t *testing.T) {
+	config := localConfig()
+	config.NumWorkers = 1
+	config.Interval = "60s"
+	config.StatsdListenAddresses = []string{
+		"graphite://127.0.0.1:0",
+		"graphite+udp://127.0.0.1:0",
+		"graphite+pickle://127.0.0.1:0",
+	}
+	config.GraphiteTemplates = []string{"servers.* .host.measurement*"}
+	ch := make(chan []samplers.InterMetric, 20)
+	sink, _ := NewChannelMetricSink(ch)
+	f := newFixture(t, config, sink, nil)
+	defer f.Close()
+
+	tcp := connectToAddress(t, "tcp", f.server.StatsdListenAddrs[0].String(), 20*time.Millisecond)
+	defer tcp.Close()
+	udp := connectToAddress(t, "udp", f.server.StatsdListenAddrs[1].String(), 20*time.Millisecond)
+	defer udp.Close()
+	pickle := connectToAddress(t, "tcp", f.server.StatsdListenAddrs[2].String(), 20*time.Millisecond)
+	defer pickle.Close()
+
+	tcp.Write([]byte("servers.web01.cpu 1 -1\nnot a valid line\nservers.web01.mem 2 -1\n"))
+	udp.Write([]byte("servers.web02.cpu 3 -1"))
+	// pickle.dumps([('servers.web03.cpu', (-1, 4))], protocol=2):
+	payload := []byte("\x80\x02]q\x00X\x11\x00\x00\x00servers.web03.cpuq\x01J\xff\xff\xff\xffK\x04\x86q\x02\x86q\x03a.")
+	frame := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	pickle.Write(append(frame, payload...))
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	keepFlushing(ctx, f.server)
+
+	var received []samplers.InterMetric
+	for len(received) < 4 {
+		select {
+		case metrics := <-ch:
+			received = append(received, metrics...)
+		case <-ctx.Done():
+			t.Fatalf("only received %d metrics", len(received))
+		}
+	}
+
+	values := map[string]float64{}
+	for _, m := range received {
+		assert.Equal(t, samplers.GaugeMetric, m.Type)
+		values[m.Name+"|"+strings.Join(m.Tags, ",")] = m.Value
+	}
+	assert.Equal(t, map[string]float64{
+		"cpu|host:web01": 1,
+		"mem|host:web01": 2,
+		"cpu|host:web02": 3,
+		"cpu|host:web03": 4,
+	}, values)
+}
+
+func TestInfluxMetrics(t *testing.T) {
+	config := localConfig()
+	config.NumWorkers = 1
+	config.Interval = "60s"
+	config.StatsdListenAddresses = []string{"influx://127.0.0.1:0", "influx+udp://127.0.0.1:0"}
+	ch := make(chan []samplers.InterMetric, 20)
+	sink, _ := NewChannelMetricSink(ch)
+	f := newFixture(t, config, sink, nil)
+	defer f.Close()
+
+	tcp := connectToAddress(t, "tcp", f.server.StatsdListenAddrs[0].String(), 20*time.Millisecond)
+	defer tcp.Close()
+	udp := connectToAddress(t, "udp", f.server.StatsdListenAddrs[1].String(), 20*time.Millisecond)
+	defer udp.Close()
+
+	tcp.Write([]byte("cpu,host=web01 usage=1,idle=2\nnot line protocol\n"))
+	udp.Write([]byte("cpu,host=web02 usage=3"))
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	keepFlushing(ctx, f.server)
+
+	values := map[string]float64{}
+	for len(values) < 3 {
+		select {
+		case metrics := <-ch:
+			for _, m := range metrics {
+				assert.Equal(t, samplers.GaugeMetric, m.Type)
+				values[m.Name+"|"+strings.Join(m.Tags, ",")] = m.Value
+			}
+		case <-ctx.Done():
+			t.Fatalf("only received %v", values)
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		"cpu.usage|host:web01": 1,
+		"cpu.idle|host:web01":  2,
+		"cpu.usage|host:web02": 3,
+	}, values)
+}
+
+func TestRelabeledMetrics(t *testing.T) {
+	config := localConfig()
+	config.NumWorkers = 4
+	config.Interval = "60s"
+	require.NoError(t, yaml.Unmarshal([]byte(`
+metric_relabel_rules:
+  - match_name: "legacy\\.(.*)"
+    rename: "$1"
+    drop_tags: ["pod"]
+  - match_name: "noise"
+    drop: true
+`), &config))
+	ch := make(chan []samplers.InterMetric, 20)
+	sink, _ := NewChannelMetricSink(ch)
+	server := setupVeneurServer(t, config, nil, sink, nil, nil)
+	defer server.Shutdown()
+
+	// the two counters only differ in the tag that's dropped, so
+	// they end up in the same worker and are aggregated together:
+	for _, packet := range []string{"legacy.requests:1|c|#pod:a", "legacy.requests:2|c|#pod:b", "noise:1|c"} {
+		require.NoError(t, server.HandleMetricPacket([]byte(packet)))
+	}
+	for processed := int64(0); processed < 2; {
+		time.Sleep(time.Millisecond)
+		processed = 0
+		for _, w := range server.Workers {
+			processed += w.MetricsProcessedCount()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	keepFlushing(ctx, server)
+
+	select {
+	case metrics := <-ch:
+		require.Len(t, metrics, 1)
+		assert.Equal(t, "requests", metrics[0].Name)
+		assert.Empty(t, metrics[0].Tags)
+		assert.Equal(t, float64(3), metrics[0].Value)
+	case <-ctx.Done():
+		t.Fatal("no metrics were flushed")
+	}
+}
+
+func TestNamedMetricSinks(t *testing.T) {
+	config := localConfig()
+	require.NoError(t, yaml.Unmarshal([]byte(`
+metric_sinks:
+  - kind: datadog
+    name: datadog-us
+    config:
+      api_hostname: "http://localhost:1"
+      api_key: "us"
+  - kind: datadog
+    name: datadog-eu
+    config:
+      api_hostname: "http://localhost:2"
+      api_key: "eu"
+metric_routing_rules:
+  - match_name_prefix: "eu."
+    sinks: ["datadog-eu"]
+`), &config))
+	server, err := NewFromConfig(logrus.New(), config)
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, sink := range server.metricSinks {
+		names = append(names, sink.Name())
+	}
+	assert.Equal(t, []string{"datadog-us", "datadog-eu"}, names)
+
+	config.MetricSinks[1].Name = "datadog-us"
+	_, err = NewFromConfig(logrus.New(), config)
+	assert.Error(t, err, "sink names must be unique")
+
+	config.MetricSinks[1].Name = "datadog-eu"
+	config.MetricSinks[1].Kind = "nonexistent"
+	_, err = NewFromConfig(logrus.New(), config)
+	assert.Error(t, err, "unknown sink kind")
+}
+
+// stoppingMetricSink is a channelMetricSink that takes stopDelay to
+// stop, and closes stopped once it did.
+type stoppingMetricSink struct {
+	*channelMetricSink
+	stopDelay time.Duration
+	stopped   chan struct{}
+}
+
+func (s *stoppingMetricSink) Stop(ctx context.Context) error {
+	select {
+	case <-time.After(s.stopDelay):
+		close(s.stopped)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestShutdownFlushes(t *testing.T) {
+	config := globalConfig()
+	config.Interval = "10s"
+	config.ShutdownTimeout = "5s"
+	ch := make(chan []samplers.InterMetric, 20)
+	cs, _ := NewChannelMetricSink(ch)
+	sink := &stoppingMetricSink{channelMetricSink: cs, stopped: make(chan struct{})}
+	server := setupVeneurServer(t, config, nil, sink, nil, nil)
+
+	// a metric that's still queued up for a worker is flushed too:
+	server.Workers[0].PacketChan <- samplers.UDPMetric{
+		MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "counter"},
+		Value:      3.0,
+		SampleRate: 1.0,
+	}
+	server.Shutdown()
+
+	select {
+	case metrics := <-ch:
+		require.Len(t, metrics, 1)
+		assert.Equal(t, "a.b.c", metrics[0].Name)
+		assert.Equal(t, 3.0, metrics[0].Value)
+	default:
+		t.Fatal("the metrics were not flushed on shutdown")
+	}
+	select {
+	case <-sink.stopped:
+	default:
+		t.Fatal("the sink was not stopped")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	config := globalConfig()
+	config.Interval = "10s"
+	config.ShutdownTimeout = "100ms"
+	cs, _ := NewChannelMetricSink(make(chan []samplers.InterMetric, 20))
+	sink := &stoppingMetricSink{channelMetricSink: cs, stopDelay: time.Minute, stopped: make(chan struct{})}
+	server := setupVeneurServer(t, config, nil, sink, nil, nil)
+
+	start := time.Now()
+	server.Shutdown()
+	assert.True(t, time.Since(start) < 10*time.Second, "shutting down took %v", time.Since(start))
+	select {
+	case <-sink.stopped:
+		t.Fatal("the sink should still be stopping")
+	default:
+	}
+}
+
+func TestJaegerSpans(t *testing.T) {
+	config := localConfig()
+	config.SsfListenAddresses = []string{"jaeger+udp://127.0.0.1:0"}
+	ch := make(chan *ssf.SSFSpan, 20)
+	f := newFixture(t, config, nil, &channelSpanSink{spansChannel: ch})
+	defer f.Close()
+
+	// An emitBatch call with one span of the "checkout" service, as
+	// sent by Jaeger clients.
+	packet, err := hex.DecodeString("82810109656d697442617463681c1c1808636865636b6f757400191c160a260c2806636861726765368080cef2be8faa051614000000")
+	require.NoError(t, err)
+	udp := connectToAddress(t, "udp", f.server.SSFListenAddrs[0].String(), 20*time.Millisecond)
+	defer udp.Close()
+	_, err = udp.Write(packet)
+	require.NoError(t, err)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case span := <-ch:
+			if span.Service != "checkout" {
+				continue
+			}
+			assert.Equal(t, int64(5), span.TraceId)
+			assert.Equal(t, int64(6), span.Id)
+			assert.Equal(t, "charge", span.Name)
+			assert.Equal(t, int64(1500000000000000000), span.StartTimestamp)
+			assert.Equal(t, int64(1500000000000010000), span.EndTimestamp)
+			return
+		case <-timeout:
+			t.Fatal("timed out waiting for the jaeger span")
+		}
+	}
+}
+
 func TestUnixSocketMetrics(t *testing.T) {
 	ctx := context.TODO()
 	tdir, err := ioutil.TempDir("", "unixmetrics_statsd")
@@ -1477,28 +1785,49 @@ func TestWatchdog(t *testing.T) {
 	config.Interval = "10ms"
 	config.FlushWatchdogMissedFlushes = 10
 
-	sink := blockingSink{make(chan struct{})}
-
-	f := newFixture(t, config, sink, nil)
+	f := newFixture(t, config, nil, nil)
 	defer f.Close()
 
-	// ingesting this metric will cause the blocking sink to block
-	// in Flush:
-	f.server.Workers[0].ProcessMetric(&samplers.UDPMetric{
-		MetricKey: samplers.MetricKey{
-			Name: "a.b.c",
-			Type: "histogram",
-		},
-		Value:      20.0,
-		Digest:     12345,
-		SampleRate: 1.0,
-		Scope:      samplers.LocalOnly,
-	})
+	// a configuration reload that never finishes keeps the flushes
+	// from starting:
+	f.server.reloadMtx.Lock()
+	defer f.server.reloadMtx.Unlock()
 
 	assert.Panics(t, func() {
 		f.server.FlushWatchdog()
 	}, "watchdog should have triggered")
-	close(sink.ch)
+}
+
+func TestSlowSinkFlushSkipped(t *testing.T) {
+	config := globalConfig()
+	config.Interval = "10s"
+	config.SinkFlushTimeout = "50ms"
+
+	slow := blockingSink{make(chan struct{})}
+	server := setupVeneurServer(t, config, nil, slow, nil, nil)
+	defer server.Shutdown()
+	defer close(slow.ch)
+	ch := make(chan []samplers.InterMetric, 20)
+	sink, _ := NewChannelMetricSink(ch)
+	server.metricSinks = append(server.metricSinks, sink)
+
+	for i := 0; i < 2; i++ {
+		server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "counter"},
+			Value:      1.0,
+			SampleRate: 1.0,
+		})
+		start := time.Now()
+		server.Flush(context.Background())
+		assert.True(t, time.Since(start) < 5*time.Second, "the flush doesn't wait for the slow sink")
+		select {
+		case metrics := <-ch:
+			assert.Len(t, metrics, 1, "the other sinks are flushed")
+		default:
+			t.Fatal("the other sink was not flushed")
+		}
+	}
+	assert.False(t, server.busySinks.start("metrics", slow), "the slow sink is still busy with its first flush")
 }
 
 func BenchmarkHandleTracePacket(b *testing.B) {
@@ -0,0 +1,100 @@
+package sinks
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Batch is a batch of items that FlushBatches failed to flush.
+type Batch struct {
+	// Start and End are the bounds of the batch's items.
+	Start, End int
+	// Permanent is true if the batch failed with a permanent error.
+	Permanent bool
+}
+
+// BatchError is the error that FlushBatches returns when some of the
+// batches fail.
+type BatchError struct {
+	Err error
+	// Failed are the batches that failed.
+	Failed []Batch
+}
+
+func (e *BatchError) Error() string {
+	return e.Err.Error()
+}
+
+// Permanent returns true if all the batches that failed did so with a
+// permanent error.
+func (e *BatchError) Permanent() bool {
+	for _, b := range e.Failed {
+		if !b.Permanent {
+			return false
+		}
+	}
+	return true
+}
+
+// Retryable returns true if item i is in a batch that failed, but not
+// permanently, so that it may succeed if it's flushed again.
+func (e *BatchError) Retryable(i int) bool {
+	for _, b := range e.Failed {
+		if i >= b.Start && i < b.End {
+			return !b.Permanent
+		}
+	}
+	return false
+}
+
+// FlushBatches breaks n items up into batches of approximately equal
+// size, such that each batch has at most maxPerBatch items (or into a
+// single batch, if maxPerBatch is zero), and calls flush with the
+// bounds of each batch in parallel. It returns the number of items in
+// the batches that failed and, if any did, a *BatchError that says
+// which. Sinks pass it to NewFlushError, so that only the metrics in
+// those batches are retried or spooled.
+func FlushBatches(n, maxPerBatch int, flush func(start, end int) error) (int, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	workers := 1
+	if maxPerBatch > 0 {
+		workers = ((n - 1) / maxPerBatch) + 1
+	}
+	batchSize := ((n - 1) / workers) + 1
+
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	var firstErr error
+	var failed []Batch
+	dropped := 0
+	for start := 0; start < n; start += batchSize {
+		end := start + batchSize
+		if end > n {
+			end = n
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			if err := flush(start, end); err != nil {
+				mtx.Lock()
+				defer mtx.Unlock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				failed = append(failed, Batch{Start: start, End: end, Permanent: IsPermanent(err)})
+				dropped += end - start
+			}
+		}(start, end)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return dropped, &BatchError{
+			Err:    fmt.Errorf("%d of %d batches failed, e.g.: %v", len(failed), workers, firstErr),
+			Failed: failed,
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,65 @@
+package sinks
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlushBatches(t *testing.T) {
+	var mtx sync.Mutex
+	var batches [][2]int
+	dropped, err := FlushBatches(5, 2, func(start, end int) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		batches = append(batches, [2]int{start, end})
+		if start == 0 {
+			return errors.New("backend is down")
+		}
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "backend is down")
+	assert.False(t, IsPermanent(err))
+	assert.Equal(t, 2, dropped)
+	batchErr, ok := err.(*BatchError)
+	require.True(t, ok)
+	assert.Equal(t, []Batch{{Start: 0, End: 2}}, batchErr.Failed)
+	assert.True(t, batchErr.Retryable(1))
+	assert.False(t, batchErr.Retryable(2))
+
+	sort.Slice(batches, func(i, j int) bool { return batches[i][0] < batches[j][0] })
+	assert.Equal(t, [][2]int{{0, 2}, {2, 4}, {4, 5}}, batches)
+}
+
+func TestFlushBatchesUnlimited(t *testing.T) {
+	calls := 0
+	dropped, err := FlushBatches(7, 0, func(start, end int) error {
+		calls++
+		assert.Equal(t, 0, start)
+		assert.Equal(t, 7, end)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, dropped)
+	assert.Equal(t, 1, calls)
+}
+
+func TestFlushBatchesPermanent(t *testing.T) {
+	_, err := FlushBatches(4, 2, func(start, end int) error {
+		return Permanent(errors.New("bad request"))
+	})
+	assert.True(t, IsPermanent(err), "the error is permanent if all batches failed permanently")
+
+	_, err = FlushBatches(4, 2, func(start, end int) error {
+		if start == 0 {
+			return Permanent(errors.New("bad request"))
+		}
+		return errors.New("backend is down")
+	})
+	assert.False(t, IsPermanent(err))
+}
@@ -32,6 +32,7 @@ const datadogSpanType = "web"
 const datadogSpanBufferSize = 1 << 14
 
 type DatadogMetricSink struct {
+	name            string
 	HTTPClient      *http.Client
 	APIKey          string
 	DDHostname      string
@@ -95,7 +96,10 @@ func NewDatadogMetricSink(interval float64, flushMaxPerBody int, hostname string
 
 // Name returns the name of this sink.
 func (dd *DatadogMetricSink) Name() string {
-	return "datadog"
+	if dd.name == "" {
+		return "datadog"
+	}
+	return dd.name
 }
 
 // Start sets the sink up.
@@ -104,18 +108,20 @@ func (dd *DatadogMetricSink) Start(cl *trace.Client) error {
 	return nil
 }
 
-// Flush sends metrics to Datadog
+// Flush sends metrics to Datadog. If some of the batches of metrics
+// fail, it returns a *sinks.FlushError with the metrics in those
+// batches. Service checks that fail to post are only logged.
 func (dd *DatadogMetricSink) Flush(ctx context.Context, interMetrics []samplers.InterMetric) error {
 	span, _ := trace.StartSpanFromContext(ctx, "")
 	defer span.ClientFinish(dd.traceClient)
 
-	ddmetrics, checks := dd.finalizeMetrics(interMetrics)
+	ddmetrics, checks, items := dd.finalizeMetrics(interMetrics)
 
 	if len(checks) != 0 {
 		// this endpoint is not documented to take an array... but it does
 		// another curious constraint of this endpoint is that it does not
 		// support "Content-Encoding: deflate"
-		err := vhttp.PostHelper(context.TODO(), dd.HTTPClient, dd.traceClient, http.MethodPost, fmt.Sprintf("%s/api/v1/check_run?api_key=%s", dd.DDHostname, dd.APIKey), checks, "flush_checks", false, map[string]string{"sink": "datadog"}, dd.log)
+		err := vhttp.PostHelper(context.TODO(), dd.HTTPClient, dd.traceClient, http.MethodPost, fmt.Sprintf("%s/api/v1/check_run?api_key=%s", dd.DDHostname, dd.APIKey), checks, "flush_checks", false, map[string]string{"sink": dd.Name()}, dd.log)
 		if err == nil {
 			dd.log.WithField("checks", len(checks)).Info("Completed flushing service checks to Datadog")
 		} else {
@@ -125,30 +131,19 @@ func (dd *DatadogMetricSink) Flush(ctx context.Context, interMetrics []samplers.
 		}
 	}
 
-	// break the metrics into chunks of approximately equal size, such that
-	// each chunk is less than the limit
-	// we compute the chunks using rounding-up integer division
-	workers := ((len(ddmetrics) - 1) / dd.flushMaxPerBody) + 1
-	chunkSize := ((len(ddmetrics) - 1) / workers) + 1
-	dd.log.WithField("workers", workers).Debug("Worker count chosen")
-	dd.log.WithField("chunkSize", chunkSize).Debug("Chunk size chosen")
-	var wg sync.WaitGroup
 	flushStart := time.Now()
-	for i := 0; i < workers; i++ {
-		chunk := ddmetrics[i*chunkSize:]
-		if i < workers-1 {
-			// trim to chunk size unless this is the last one
-			chunk = chunk[:chunkSize]
-		}
-		wg.Add(1)
-		go dd.flushPart(span.Attach(ctx), chunk, &wg)
-	}
-	wg.Wait()
+	countDropped, err := sinks.FlushBatches(len(ddmetrics), dd.flushMaxPerBody, func(start, end int) error {
+		return dd.flushPart(span.Attach(ctx), ddmetrics[start:end])
+	})
 	tags := map[string]string{"sink": dd.Name()}
 	span.Add(
 		ssf.Timing(sinks.MetricKeyMetricFlushDuration, time.Since(flushStart), time.Nanosecond, tags),
-		ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(len(ddmetrics)), tags),
+		ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(len(ddmetrics)-countDropped), tags),
 	)
+	if err != nil {
+		span.Add(ssf.Count(sinks.MetricKeyTotalMetricsDropped, float32(countDropped), tags))
+		return sinks.NewFlushError(err, interMetrics, items)
+	}
 	dd.log.WithField("metrics", len(ddmetrics)).Info("Completed flush to Datadog")
 	return nil
 }
@@ -231,7 +226,7 @@ func (dd *DatadogMetricSink) FlushOtherSamples(ctx context.Context, samples []ss
 			"events": {
 				"api": events,
 			},
-		}, "flush_events", true, map[string]string{"sink": "datadog"}, dd.log)
+		}, "flush_events", true, map[string]string{"sink": dd.Name()}, dd.log)
 
 		if err == nil {
 			dd.log.WithField("events", len(events)).Info("Completed flushing events to Datadog")
@@ -249,11 +244,16 @@ func (dd *DatadogMetricSink) SetExcludedTags(excludes []string) {
 	dd.excludedTags = excludes
 }
 
-func (dd *DatadogMetricSink) finalizeMetrics(metrics []samplers.InterMetric) ([]DDMetric, []DDServiceCheck) {
+// finalizeMetrics converts metrics to Datadog metrics and service
+// checks. items[i] is the index of the Datadog metric that metrics[i]
+// became, or -1 if it didn't become one.
+func (dd *DatadogMetricSink) finalizeMetrics(metrics []samplers.InterMetric) ([]DDMetric, []DDServiceCheck, []int) {
 	ddMetrics := make([]DDMetric, 0, len(metrics))
 	checks := []DDServiceCheck{}
+	items := make([]int, len(metrics))
 
-	for _, m := range metrics {
+	for i, m := range metrics {
+		items[i] = -1
 		if !sinks.IsAcceptableMetric(m, dd) {
 			continue
 		}
@@ -345,17 +345,17 @@ func (dd *DatadogMetricSink) finalizeMetrics(metrics []samplers.InterMetric) ([]
 			Hostname:   hostname,
 			DeviceName: devicename,
 		}
+		items[i] = len(ddMetrics)
 		ddMetrics = append(ddMetrics, ddMetric)
 	}
 
-	return ddMetrics, checks
+	return ddMetrics, checks, items
 }
 
-func (dd *DatadogMetricSink) flushPart(ctx context.Context, metricSlice []DDMetric, wg *sync.WaitGroup) {
-	defer wg.Done()
-	vhttp.PostHelper(ctx, dd.HTTPClient, dd.traceClient, http.MethodPost, fmt.Sprintf("%s/api/v1/series?api_key=%s", dd.DDHostname, dd.APIKey), map[string][]DDMetric{
+func (dd *DatadogMetricSink) flushPart(ctx context.Context, metricSlice []DDMetric) error {
+	return vhttp.PostHelper(ctx, dd.HTTPClient, dd.traceClient, http.MethodPost, fmt.Sprintf("%s/api/v1/series?api_key=%s", dd.DDHostname, dd.APIKey), map[string][]DDMetric{
 		"series": metricSlice,
-	}, "flush", true, map[string]string{"sink": "datadog"}, dd.log)
+	}, "flush", true, map[string]string{"sink": dd.Name()}, dd.log)
 }
 
 // DatadogTraceSpan represents a trace span as JSON for the
@@ -377,6 +377,7 @@ type DatadogTraceSpan struct {
 
 // DatadogSpanSink is a sink for sending spans to a Datadog trace agent.
 type DatadogSpanSink struct {
+	name         string
 	HTTPClient   *http.Client
 	buffer       *ring.Ring
 	bufferSize   int
@@ -404,7 +405,10 @@ func NewDatadogSpanSink(address string, bufferSize int, httpClient *http.Client,
 
 // Name returns the name of this sink.
 func (dd *DatadogSpanSink) Name() string {
-	return "datadog"
+	if dd.name == "" {
+		return "datadog"
+	}
+	return dd.name
 }
 
 // Start performs final adjustments on the sink.
@@ -542,7 +546,7 @@ func (dd *DatadogSpanSink) Flush() {
 		// another curious constraint of this endpoint is that it does not
 		// support "Content-Encoding: deflate"
 
-		err := vhttp.PostHelper(context.TODO(), dd.HTTPClient, dd.traceClient, http.MethodPut, fmt.Sprintf("%s/v0.3/traces", dd.traceAddress), finalTraces, "flush_traces", false, map[string]string{"sink": "datadog"}, dd.log)
+		err := vhttp.PostHelper(context.TODO(), dd.HTTPClient, dd.traceClient, http.MethodPut, fmt.Sprintf("%s/v0.3/traces", dd.traceAddress), finalTraces, "flush_traces", false, map[string]string{"sink": dd.Name()}, dd.log)
 		if err == nil {
 			dd.log.WithField("traces", len(finalTraces)).Info("Completed flushing traces to Datadog")
 		} else {
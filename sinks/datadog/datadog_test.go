@@ -16,6 +16,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/stripe/veneur/protocol/dogstatsd"
 	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
 	"github.com/stripe/veneur/ssf"
 )
 
@@ -46,7 +47,7 @@ func TestDatadogRate(t *testing.T) {
 		Tags:      []string{"gorch:frobble", "x:e"},
 		Type:      samplers.CounterMetric,
 	}}
-	ddMetrics, serviceChecks := ddSink.finalizeMetrics(metrics)
+	ddMetrics, serviceChecks, _ := ddSink.finalizeMetrics(metrics)
 	assert.Empty(t, serviceChecks, "No service check metrics are reported")
 	assert.Equal(t, "rate", ddMetrics[0].MetricType, "Metric type should be rate")
 	assert.Equal(t, float64(1.0), ddMetrics[0].Value[0][1], "Metric rate wasnt computed correctly")
@@ -67,7 +68,7 @@ func TestServerTags(t *testing.T) {
 		Type:      samplers.CounterMetric,
 	}}
 
-	ddMetrics, serviceChecks := ddSink.finalizeMetrics(metrics)
+	ddMetrics, serviceChecks, _ := ddSink.finalizeMetrics(metrics)
 	assert.Empty(t, serviceChecks, "No service check metrics are reported")
 	assert.Equal(t, "somehostname", ddMetrics[0].Hostname, "Metric hostname uses argument")
 	assert.Contains(t, ddMetrics[0].Tags, "a:b", "Tags should contain server tags")
@@ -87,7 +88,7 @@ func TestHostMagicTag(t *testing.T) {
 		Type:      samplers.CounterMetric,
 	}}
 
-	ddMetrics, serviceChecks := ddSink.finalizeMetrics(metrics)
+	ddMetrics, serviceChecks, _ := ddSink.finalizeMetrics(metrics)
 	assert.Empty(t, serviceChecks, "No service check metrics are reported")
 	assert.Equal(t, "abc123", ddMetrics[0].Hostname, "Metric hostname should be from tag")
 	assert.NotContains(t, ddMetrics[0].Tags, "host:abc123", "Host tag should be removed")
@@ -108,7 +109,7 @@ func TestDeviceMagicTag(t *testing.T) {
 		Type:      samplers.CounterMetric,
 	}}
 
-	ddMetrics, serviceChecks := ddSink.finalizeMetrics(metrics)
+	ddMetrics, serviceChecks, _ := ddSink.finalizeMetrics(metrics)
 	assert.Empty(t, serviceChecks, "No service check metrics are reported")
 	assert.Equal(t, "abc123", ddMetrics[0].DeviceName, "Metric devicename should be from tag")
 	assert.NotContains(t, ddMetrics[0].Tags, "device:abc123", "Host tag should be removed")
@@ -437,7 +438,7 @@ func TestDataDogSetExcludeTags(t *testing.T) {
 		Type: samplers.CounterMetric,
 	}}
 
-	ddMetrics, serviceChecks := ddSink.finalizeMetrics(interMetrics)
+	ddMetrics, serviceChecks, _ := ddSink.finalizeMetrics(interMetrics)
 
 	assert.Empty(t, serviceChecks, "No service check metrics are reported")
 	assert.Equal(t, 1, len(ddMetrics))
@@ -450,3 +451,29 @@ func TestDataDogSetExcludeTags(t *testing.T) {
 	assert.Equal(t, "baz:quz", tags[1], "Incorrect baz tag in second position")
 	assert.Equal(t, "novalue", tags[2], "Incorrect novalue tag in third position")
 }
+
+func TestNewMetricSinkFromConfig(t *testing.T) {
+	deps := sinks.Dependencies{Hostname: "host", Interval: 10 * time.Second, Log: logrus.New()}
+	sink, err := sinks.NewMetricSink("datadog", "datadog-eu", sinks.SinkConfig{
+		"api_hostname": "https://api.datadoghq.eu",
+		"api_key":      "secret",
+	}, deps)
+	require.NoError(t, err)
+	assert.Equal(t, "datadog-eu", sink.Name())
+	ddSink := sink.(*DatadogMetricSink)
+	assert.Equal(t, "https://api.datadoghq.eu", ddSink.DDHostname)
+	assert.Equal(t, 25000, ddSink.flushMaxPerBody)
+
+	_, err = sinks.NewMetricSink("datadog", "datadog-eu", sinks.SinkConfig{
+		"api_hostname": "https://api.datadoghq.eu",
+		"api_key":      "secret",
+		"apikey":       "typo",
+	}, deps)
+	assert.Error(t, err, "unknown keys are an error")
+
+	_, err = sinks.NewMetricSink("datadog", "datadog-eu", sinks.SinkConfig{}, deps)
+	assert.Error(t, err, "the API key and hostname are required")
+
+	_, err = sinks.NewMetricSink("datadog", "", sinks.SinkConfig{}, deps)
+	assert.Error(t, err, "a name is required")
+}
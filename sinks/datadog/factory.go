@@ -0,0 +1,61 @@
+package datadog
+
+import (
+	"errors"
+
+	"github.com/stripe/veneur/sinks"
+)
+
+func init() {
+	sinks.RegisterMetricSink("datadog", newMetricSinkFromConfig)
+	sinks.RegisterSpanSink("datadog", newSpanSinkFromConfig)
+}
+
+// MetricSinkConfig is the configuration of a datadog entry in
+// metric_sinks.
+type MetricSinkConfig struct {
+	APIHostname     string `yaml:"api_hostname"`
+	APIKey          string `yaml:"api_key"`
+	FlushMaxPerBody int    `yaml:"flush_max_per_body"`
+}
+
+// SpanSinkConfig is the configuration of a datadog entry in span_sinks.
+type SpanSinkConfig struct {
+	SpanBufferSize  int    `yaml:"span_buffer_size"`
+	TraceAPIAddress string `yaml:"trace_api_address"`
+}
+
+func newMetricSinkFromConfig(name string, config sinks.SinkConfig, deps sinks.Dependencies) (sinks.MetricSink, error) {
+	conf := MetricSinkConfig{FlushMaxPerBody: 25000}
+	if err := config.Decode(&conf); err != nil {
+		return nil, err
+	}
+	if conf.APIKey == "" || conf.APIHostname == "" {
+		return nil, errors.New("api_key and api_hostname are required")
+	}
+	sink, err := NewDatadogMetricSink(
+		deps.Interval.Seconds(), conf.FlushMaxPerBody, deps.Hostname, deps.Tags,
+		conf.APIHostname, conf.APIKey, deps.HTTPClient, deps.Log,
+	)
+	if err != nil {
+		return nil, err
+	}
+	sink.name = name
+	return sink, nil
+}
+
+func newSpanSinkFromConfig(name string, config sinks.SinkConfig, deps sinks.Dependencies) (sinks.SpanSink, error) {
+	conf := SpanSinkConfig{}
+	if err := config.Decode(&conf); err != nil {
+		return nil, err
+	}
+	if conf.TraceAPIAddress == "" {
+		return nil, errors.New("trace_api_address is required")
+	}
+	sink, err := NewDatadogSpanSink(conf.TraceAPIAddress, conf.SpanBufferSize, deps.HTTPClient, deps.Log)
+	if err != nil {
+		return nil, err
+	}
+	sink.name = name
+	return sink, nil
+}
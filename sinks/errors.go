@@ -0,0 +1,91 @@
+package sinks
+
+import (
+	"github.com/stripe/veneur/samplers"
+)
+
+// PermanentError is an error that trying the same call again won't fix,
+// e.g. because the backend rejected the payload as invalid. Sinks return
+// it from Flush so that the flush isn't retried or spooled.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Permanent returns true.
+func (e *PermanentError) Permanent() bool {
+	return true
+}
+
+// Permanent marks err as permanent. It returns nil if err is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent returns true if err was marked as permanent, or is a
+// *BatchError or *FlushError whose failures all were.
+func IsPermanent(err error) bool {
+	p, ok := err.(interface {
+		Permanent() bool
+	})
+	return ok && p.Permanent()
+}
+
+// FlushError is an error from a MetricSink's Flush that only some of the
+// metrics failed to flush with. Callers that retry or spool the flush
+// should do so with the Failed metrics only, so that the metrics that
+// were flushed aren't sent twice.
+type FlushError struct {
+	Err error
+	// Failed are the metrics that failed to flush, and may succeed if
+	// they're flushed again.
+	Failed []samplers.InterMetric
+}
+
+func (e *FlushError) Error() string {
+	return e.Err.Error()
+}
+
+// Permanent returns true if no metrics may succeed if they're flushed
+// again.
+func (e *FlushError) Permanent() bool {
+	return len(e.Failed) == 0
+}
+
+// NewFlushError converts an error from FlushBatches into a *FlushError
+// that holds the metrics in the batches that failed, unless they failed
+// permanently. items[i] is the index of the batched item that metrics[i]
+// was flushed in, or -1 if it wasn't flushed. Other errors are returned
+// as they are.
+func NewFlushError(err error, metrics []samplers.InterMetric, items []int) error {
+	batchErr, ok := err.(*BatchError)
+	if !ok {
+		return err
+	}
+	var failed []samplers.InterMetric
+	for i, item := range items {
+		if item >= 0 && batchErr.Retryable(item) {
+			failed = append(failed, metrics[i])
+		}
+	}
+	return &FlushError{Err: err, Failed: failed}
+}
+
+// FailedMetrics returns the metrics that a Flush of metrics that
+// returned err may flush if it's called again: the Failed metrics of a
+// *FlushError, none if err is permanent, or else all of them.
+func FailedMetrics(err error, metrics []samplers.InterMetric) []samplers.InterMetric {
+	if flushErr, ok := err.(*FlushError); ok {
+		return flushErr.Failed
+	}
+	if IsPermanent(err) {
+		return nil
+	}
+	return metrics
+}
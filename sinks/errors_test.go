@@ -0,0 +1,32 @@
+package sinks
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestFailedMetrics(t *testing.T) {
+	metrics := []samplers.InterMetric{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}
+	_, err := FlushBatches(3, 1, func(start, end int) error {
+		switch start {
+		case 0:
+			return errors.New("backend is down")
+		case 1:
+			return Permanent(errors.New("bad request"))
+		}
+		return nil
+	})
+	// "b" wasn't flushed, "c" and "d" went into the same item:
+	err = NewFlushError(err, metrics, []int{0, -1, 1, 1})
+	assert.False(t, IsPermanent(err))
+	assert.Equal(t, []samplers.InterMetric{{Name: "a"}}, FailedMetrics(err, metrics),
+		"only the metrics in batches that didn't fail permanently are flushed again")
+
+	err = errors.New("backend is down")
+	assert.Equal(t, metrics, FailedMetrics(err, metrics))
+	assert.Empty(t, FailedMetrics(Permanent(err), metrics))
+	assert.True(t, IsPermanent(NewFlushError(&BatchError{Err: err, Failed: []Batch{{Start: 0, End: 1, Permanent: true}}}, metrics, []int{0})))
+}
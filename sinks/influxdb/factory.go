@@ -0,0 +1,54 @@
+package influxdb
+
+import (
+	"errors"
+
+	"github.com/stripe/veneur/sinks"
+)
+
+func init() {
+	sinks.RegisterMetricSink("influxdb", newMetricSinkFromConfig)
+}
+
+// MetricSinkConfig is the configuration of an influxdb entry in
+// metric_sinks. Setting org or bucket writes to the InfluxDB 2.x API,
+// otherwise to the 1.x API.
+type MetricSinkConfig struct {
+	Address         string `yaml:"address"`
+	Bucket          string `yaml:"bucket"`
+	Database        string `yaml:"database"`
+	FlushMaxPerBody int    `yaml:"flush_max_per_body"`
+	Org             string `yaml:"org"`
+	Password        string `yaml:"password"`
+	RetentionPolicy string `yaml:"retention_policy"`
+	Token           string `yaml:"token"`
+	Username        string `yaml:"username"`
+}
+
+func newMetricSinkFromConfig(name string, config sinks.SinkConfig, deps sinks.Dependencies) (sinks.MetricSink, error) {
+	conf := MetricSinkConfig{FlushMaxPerBody: 5000}
+	if err := config.Decode(&conf); err != nil {
+		return nil, err
+	}
+	if conf.Address == "" {
+		return nil, errors.New("address is required")
+	}
+	var sink *InfluxDBMetricSink
+	var err error
+	if conf.Org != "" || conf.Bucket != "" {
+		sink, err = NewInfluxDBV2MetricSink(
+			conf.Address, conf.Org, conf.Bucket, conf.Token, conf.FlushMaxPerBody,
+			deps.Hostname, deps.Tags, deps.HTTPClient, deps.Log,
+		)
+	} else {
+		sink, err = NewInfluxDBV1MetricSink(
+			conf.Address, conf.Database, conf.RetentionPolicy, conf.Username, conf.Password,
+			conf.FlushMaxPerBody, deps.Hostname, deps.Tags, deps.HTTPClient, deps.Log,
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sink.name = name
+	return sink, nil
+}
@@ -0,0 +1,298 @@
+package influxdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// TypeTag is the tag that holds the type (counter, gauge or status) of
+// the veneur metric that a point was written for.
+const TypeTag = "metric_type"
+
+// InfluxDBMetricSink is a MetricSink that writes metrics to InfluxDB
+// in the line protocol.
+type InfluxDBMetricSink struct {
+	name            string
+	writeURL        string
+	authHeader      string
+	flushMaxPerBody int
+	hostname        string
+	commonTags      []string
+	excludedTags    map[string]struct{}
+	httpClient      *http.Client
+	log             *logrus.Logger
+	traceClient     *trace.Client
+}
+
+var _ sinks.MetricSink = &InfluxDBMetricSink{}
+
+// NewInfluxDBV1MetricSink creates a sink that writes to the /write
+// endpoint of the InfluxDB 1.x server at address, in batches of at
+// most flushMaxPerBody points. The retention policy and credentials
+// are optional.
+func NewInfluxDBV1MetricSink(address, database, retentionPolicy, username, password string, flushMaxPerBody int, hostname string, commonTags []string, httpClient *http.Client, log *logrus.Logger) (*InfluxDBMetricSink, error) {
+	if database == "" {
+		return nil, fmt.Errorf("an InfluxDB database is required")
+	}
+	params := url.Values{"db": {database}, "precision": {"s"}}
+	if retentionPolicy != "" {
+		params.Set("rp", retentionPolicy)
+	}
+	if username != "" {
+		params.Set("u", username)
+		params.Set("p", password)
+	}
+	return newInfluxDBMetricSink(address, "/write", params, "", flushMaxPerBody, hostname, commonTags, httpClient, log)
+}
+
+// NewInfluxDBV2MetricSink creates a sink that writes to the
+// /api/v2/write endpoint of the InfluxDB 2.x server at address, in
+// batches of at most flushMaxPerBody points.
+func NewInfluxDBV2MetricSink(address, org, bucket, token string, flushMaxPerBody int, hostname string, commonTags []string, httpClient *http.Client, log *logrus.Logger) (*InfluxDBMetricSink, error) {
+	if org == "" || bucket == "" {
+		return nil, fmt.Errorf("an InfluxDB organization and bucket are required")
+	}
+	params := url.Values{"org": {org}, "bucket": {bucket}, "precision": {"s"}}
+	auth := ""
+	if token != "" {
+		auth = "Token " + token
+	}
+	return newInfluxDBMetricSink(address, "/api/v2/write", params, auth, flushMaxPerBody, hostname, commonTags, httpClient, log)
+}
+
+func newInfluxDBMetricSink(address, path string, params url.Values, authHeader string, flushMaxPerBody int, hostname string, commonTags []string, httpClient *http.Client, log *logrus.Logger) (*InfluxDBMetricSink, error) {
+	if flushMaxPerBody <= 0 {
+		return nil, fmt.Errorf("InfluxDB batch size must be positive, not %d", flushMaxPerBody)
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = params.Encode()
+	return &InfluxDBMetricSink{
+		writeURL:        u.String(),
+		authHeader:      authHeader,
+		flushMaxPerBody: flushMaxPerBody,
+		hostname:        hostname,
+		commonTags:      commonTags,
+		httpClient:      httpClient,
+		log:             log,
+	}, nil
+}
+
+// Name returns the name of this sink.
+func (s *InfluxDBMetricSink) Name() string {
+	if s.name == "" {
+		return "influxdb"
+	}
+	return s.name
+}
+
+// Start sets the sink up.
+func (s *InfluxDBMetricSink) Start(cl *trace.Client) error {
+	s.traceClient = cl
+	return nil
+}
+
+// SetExcludedTags sets the excluded tag names. Any tags with the
+// provided key (name) will be excluded.
+func (s *InfluxDBMetricSink) SetExcludedTags(excludes []string) {
+	tagsSet := map[string]struct{}{}
+	for _, tag := range excludes {
+		tagsSet[tag] = struct{}{}
+	}
+	s.excludedTags = tagsSet
+}
+
+// Flush converts the metrics into lines of line protocol and writes
+// them to InfluxDB, in parallel batches. If any batch fails, it returns
+// a *sinks.FlushError with the metrics in the batches that failed.
+func (s *InfluxDBMetricSink) Flush(ctx context.Context, interMetrics []samplers.InterMetric) error {
+	span, _ := trace.StartSpanFromContext(ctx, "")
+	defer span.ClientFinish(s.traceClient)
+
+	lines, items, countSkipped := s.finalizeMetrics(interMetrics)
+	if len(lines) == 0 {
+		return nil
+	}
+
+	flushStart := time.Now()
+	countDropped, err := sinks.FlushBatches(len(lines), s.flushMaxPerBody, func(start, end int) error {
+		err := s.flushPart(span.Attach(ctx), lines[start:end])
+		if err != nil {
+			s.log.WithError(err).WithField("points", end-start).
+				Warn("Error writing to InfluxDB")
+		}
+		return err
+	})
+
+	tags := map[string]string{"sink": s.Name()}
+	span.Add(
+		ssf.Timing(sinks.MetricKeyMetricFlushDuration, time.Since(flushStart), time.Nanosecond, tags),
+		ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(len(lines)-countDropped), tags),
+		ssf.Count(sinks.MetricKeyTotalMetricsSkipped, float32(countSkipped), tags),
+	)
+	if err != nil {
+		span.Add(ssf.Count(sinks.MetricKeyTotalMetricsDropped, float32(countDropped), tags))
+		return sinks.NewFlushError(err, interMetrics, items)
+	}
+	s.log.WithField("points", len(lines)).Info("Completed flush to InfluxDB")
+	return nil
+}
+
+// FlushOtherSamples is a no-op: InfluxDB has no notion of events or
+// service checks.
+func (s *InfluxDBMetricSink) FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample) {}
+
+// finalizeMetrics renders each metric as a line of line protocol: the
+// metric's name is the measurement, its tags (along with the sink's
+// common tags, its host and its type) are the line's tags, and its
+// value is the "value" field. Status checks carry their message in the
+// "message" field as well. items[i] is the index of the line that
+// interMetrics[i] became, or -1 if it was skipped.
+func (s *InfluxDBMetricSink) finalizeMetrics(interMetrics []samplers.InterMetric) ([][]byte, []int, int) {
+	lines := make([][]byte, 0, len(interMetrics))
+	items := make([]int, len(interMetrics))
+	countSkipped := 0
+	for i, m := range interMetrics {
+		items[i] = -1
+		if !sinks.IsAcceptableMetric(m, s) {
+			countSkipped++
+			continue
+		}
+
+		tags := map[string]string{}
+		addTags := func(list []string, excluded map[string]struct{}) {
+			for _, tag := range list {
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+					// InfluxDB doesn't allow tags without a value
+					continue
+				}
+				if _, ok := excluded[kv[0]]; ok {
+					continue
+				}
+				tags[kv[0]] = kv[1]
+			}
+		}
+		addTags(s.commonTags, nil)
+		if host := m.HostName; host != "" {
+			tags["host"] = host
+		} else if s.hostname != "" {
+			tags["host"] = s.hostname
+		}
+		addTags(m.Tags, s.excludedTags)
+		tags[TypeTag] = metricType(m.Type)
+
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var buf bytes.Buffer
+		buf.WriteString(escape(m.Name, measurementEscaper))
+		for _, k := range keys {
+			buf.WriteByte(',')
+			buf.WriteString(escape(k, tagEscaper))
+			buf.WriteByte('=')
+			buf.WriteString(escape(tags[k], tagEscaper))
+		}
+		buf.WriteString(" value=")
+		buf.WriteString(strconv.FormatFloat(m.Value, 'g', -1, 64))
+		if m.Type == samplers.StatusMetric && m.Message != "" {
+			buf.WriteString(`,message="`)
+			buf.WriteString(stringFieldEscaper.Replace(m.Message))
+			buf.WriteByte('"')
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(m.Timestamp, 10))
+		items[i] = len(lines)
+		lines = append(lines, buf.Bytes())
+	}
+	return lines, items, countSkipped
+}
+
+func metricType(t samplers.MetricType) string {
+	switch t {
+	case samplers.CounterMetric:
+		return "counter"
+	case samplers.StatusMetric:
+		return "status"
+	}
+	return "gauge"
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	stringFieldEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	newlineRemover     = strings.NewReplacer("\n", " ", "\r", " ")
+)
+
+// escape escapes a measurement, tag key or tag value. Newlines can't
+// be escaped in those, so they're replaced with spaces.
+func escape(s string, escaper *strings.Replacer) string {
+	return escaper.Replace(newlineRemover.Replace(s))
+}
+
+// flushPart writes a single gzipped batch of lines.
+func (s *InfluxDBMetricSink) flushPart(ctx context.Context, lines [][]byte) error {
+	span, ctx := trace.StartSpanFromContext(ctx, "")
+	defer span.ClientFinish(s.traceClient)
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	for _, line := range lines {
+		gz.Write(line)
+		gz.Write([]byte{'\n'})
+	}
+	if err := gz.Close(); err != nil {
+		span.Error(err)
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.writeURL, &body)
+	if err != nil {
+		span.Error(err)
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.authHeader != "" {
+		req.Header.Set("Authorization", s.authHeader)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		span.Error(err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("InfluxDB returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	span.Error(err)
+	return err
+}
@@ -0,0 +1,160 @@
+package influxdb
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+)
+
+type writeRequest struct {
+	path  string
+	query map[string][]string
+	auth  string
+	lines []string
+}
+
+func newTestServer(t *testing.T, status int) (*httptest.Server, func() []writeRequest) {
+	var mtx sync.Mutex
+	var reqs []writeRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(gz)
+		require.NoError(t, err)
+
+		mtx.Lock()
+		reqs = append(reqs, writeRequest{
+			path:  r.URL.Path,
+			query: r.URL.Query(),
+			auth:  r.Header.Get("Authorization"),
+			lines: strings.Split(strings.TrimSuffix(string(body), "\n"), "\n"),
+		})
+		mtx.Unlock()
+		w.WriteHeader(status)
+	}))
+	return srv, func() []writeRequest {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return reqs
+	}
+}
+
+func TestFlushV1(t *testing.T) {
+	srv, requests := newTestServer(t, http.StatusNoContent)
+	defer srv.Close()
+
+	sink, err := NewInfluxDBV1MetricSink(srv.URL, "veneur", "autogen", "user", "pass", 2, "box", []string{"env:test"}, srv.Client(), logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+	sink.SetExcludedTags([]string{"secret"})
+
+	metrics := []samplers.InterMetric{
+		{Name: "a.counter", Timestamp: 1500000000, Value: 3, Tags: []string{"foo:bar baz", "secret:x", "bare"}, Type: samplers.CounterMetric},
+		{Name: "a gauge,with=commas", Timestamp: 1500000000, Value: 1.5, Type: samplers.GaugeMetric, HostName: "other"},
+		{Name: "a.check", Timestamp: 1500000000, Value: 2, Type: samplers.StatusMetric, Message: `it's "bad"`},
+		{Name: "a.skipped", Timestamp: 1500000000, Value: 1, Type: samplers.GaugeMetric, Sinks: samplers.RouteInformation{"datadog": struct{}{}}},
+	}
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+
+	reqs := requests()
+	require.Len(t, reqs, 2)
+	var lines []string
+	for _, req := range reqs {
+		assert.Equal(t, "/write", req.path)
+		assert.Equal(t, map[string][]string{
+			"db": {"veneur"}, "rp": {"autogen"}, "u": {"user"}, "p": {"pass"}, "precision": {"s"},
+		}, req.query)
+		assert.Empty(t, req.auth)
+		lines = append(lines, req.lines...)
+	}
+	sort.Strings(lines)
+	assert.Equal(t, []string{
+		`a.check,env=test,host=box,metric_type=status value=2,message="it's \"bad\"" 1500000000`,
+		`a.counter,env=test,foo=bar\ baz,host=box,metric_type=counter value=3 1500000000`,
+		`a\ gauge\,with=commas,env=test,host=other,metric_type=gauge value=1.5 1500000000`,
+	}, lines)
+}
+
+func TestFlushV2(t *testing.T) {
+	srv, requests := newTestServer(t, http.StatusNoContent)
+	defer srv.Close()
+
+	sink, err := NewInfluxDBV2MetricSink(srv.URL+"/", "stripe", "metrics", "secret-token", 100, "", nil, srv.Client(), logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+
+	require.NoError(t, sink.Flush(context.Background(), []samplers.InterMetric{
+		{Name: "a.gauge", Timestamp: 1500000000, Value: 1, Type: samplers.GaugeMetric},
+	}))
+	reqs := requests()
+	require.Len(t, reqs, 1)
+	assert.Equal(t, "/api/v2/write", reqs[0].path)
+	assert.Equal(t, map[string][]string{
+		"org": {"stripe"}, "bucket": {"metrics"}, "precision": {"s"},
+	}, reqs[0].query)
+	assert.Equal(t, "Token secret-token", reqs[0].auth)
+	assert.Equal(t, []string{"a.gauge,metric_type=gauge value=1 1500000000"}, reqs[0].lines)
+}
+
+func TestFlushError(t *testing.T) {
+	srv, requests := newTestServer(t, http.StatusBadRequest)
+	defer srv.Close()
+
+	sink, err := NewInfluxDBV1MetricSink(srv.URL, "veneur", "", "", "", 100, "", nil, srv.Client(), logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+	err = sink.Flush(context.Background(), []samplers.InterMetric{
+		{Name: "a.gauge", Timestamp: 1500000000, Value: 1, Type: samplers.GaugeMetric},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "400 Bad Request")
+	assert.Len(t, requests(), 1)
+}
+
+func TestNewSinkErrors(t *testing.T) {
+	_, err := NewInfluxDBV1MetricSink("http://localhost:8086", "", "", "", "", 100, "", nil, nil, logrus.New())
+	assert.Error(t, err)
+	_, err = NewInfluxDBV2MetricSink("http://localhost:8086", "org", "", "", 100, "", nil, nil, logrus.New())
+	assert.Error(t, err)
+	_, err = NewInfluxDBV1MetricSink("http://localhost:8086", "db", "", "", "", 0, "", nil, nil, logrus.New())
+	assert.Error(t, err)
+}
+
+func TestNewMetricSinkFromConfig(t *testing.T) {
+	deps := sinks.Dependencies{Hostname: "host", Log: logrus.New()}
+	sink, err := sinks.NewMetricSink("influxdb", "influx-v2", sinks.SinkConfig{
+		"address": "http://influx:8086",
+		"org":     "stripe",
+		"bucket":  "veneur",
+		"token":   "secret",
+	}, deps)
+	require.NoError(t, err)
+	assert.Equal(t, "influx-v2", sink.Name())
+	v2 := sink.(*InfluxDBMetricSink)
+	assert.Equal(t, "http://influx:8086/api/v2/write?bucket=veneur&org=stripe&precision=s", v2.writeURL)
+	assert.Equal(t, "Token secret", v2.authHeader)
+	assert.Equal(t, 5000, v2.flushMaxPerBody)
+
+	sink, err = sinks.NewMetricSink("influxdb", "influx-v1", sinks.SinkConfig{
+		"address":  "http://influx:8086",
+		"database": "veneur",
+	}, deps)
+	require.NoError(t, err)
+	assert.Equal(t, "http://influx:8086/write?db=veneur&precision=s", sink.(*InfluxDBMetricSink).writeURL)
+
+	_, err = sinks.NewMetricSink("influxdb", "influx-v1", sinks.SinkConfig{"address": "http://influx:8086"}, deps)
+	assert.Error(t, err, "a database or a bucket is required")
+}
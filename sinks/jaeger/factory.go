@@ -0,0 +1,37 @@
+package jaeger
+
+import (
+	"errors"
+
+	"github.com/stripe/veneur/sinks"
+)
+
+func init() {
+	sinks.RegisterSpanSink("jaeger", newSpanSinkFromConfig)
+}
+
+// SpanSinkConfig is the configuration of a jaeger entry in span_sinks.
+type SpanSinkConfig struct {
+	Address         string `yaml:"address"`
+	FlushMaxPerBody int    `yaml:"flush_max_per_body"`
+	SpanBufferSize  int    `yaml:"span_buffer_size"`
+}
+
+func newSpanSinkFromConfig(name string, config sinks.SinkConfig, deps sinks.Dependencies) (sinks.SpanSink, error) {
+	conf := SpanSinkConfig{FlushMaxPerBody: 1000, SpanBufferSize: 16384}
+	if err := config.Decode(&conf); err != nil {
+		return nil, err
+	}
+	if conf.Address == "" {
+		return nil, errors.New("address is required")
+	}
+	sink, err := NewJaegerSpanSink(
+		conf.Address, deps.Hostname, deps.TagsAsMap, conf.SpanBufferSize,
+		conf.FlushMaxPerBody, deps.HTTPClient, deps.Log,
+	)
+	if err != nil {
+		return nil, err
+	}
+	sink.name = name
+	return sink, nil
+}
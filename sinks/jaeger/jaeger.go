@@ -0,0 +1,203 @@
+package jaeger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/stripe/veneur/jaeger"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+// JaegerSpanSink is a SpanSink that buffers spans and posts them to a
+// Jaeger collector's /api/traces endpoint, in the Thrift binary
+// protocol, on every flush.
+type JaegerSpanSink struct {
+	name            string
+	tracesURL       string
+	hostname        string
+	commonTags      map[string]string
+	bufferSize      int
+	flushMaxPerBody int
+	httpClient      *http.Client
+	traceClient     *trace.Client
+	log             *logrus.Logger
+
+	mtx     sync.Mutex
+	buffer  []*ssf.SSFSpan
+	dropped int64
+}
+
+var _ sinks.SpanSink = &JaegerSpanSink{}
+
+// NewJaegerSpanSink creates a sink that holds on to at most bufferSize
+// spans between flushes, and posts them to the Jaeger collector at
+// address (e.g. http://jaeger-collector:14268) in batches of at most
+// flushMaxPerBody spans. The hostname and common tags become tags of
+// the process that emitted the spans.
+func NewJaegerSpanSink(address string, hostname string, commonTags map[string]string, bufferSize, flushMaxPerBody int, httpClient *http.Client, log *logrus.Logger) (*JaegerSpanSink, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/traces"
+	return &JaegerSpanSink{
+		tracesURL:       u.String(),
+		hostname:        hostname,
+		commonTags:      commonTags,
+		bufferSize:      bufferSize,
+		flushMaxPerBody: flushMaxPerBody,
+		httpClient:      httpClient,
+		log:             log,
+	}, nil
+}
+
+// Name returns the name of this sink.
+func (j *JaegerSpanSink) Name() string {
+	if j.name == "" {
+		return "jaeger"
+	}
+	return j.name
+}
+
+// Start sets the sink up.
+func (j *JaegerSpanSink) Start(cl *trace.Client) error {
+	j.traceClient = cl
+	return nil
+}
+
+// Ingest buffers a span until the next flush. If the buffer is full,
+// the span is dropped.
+func (j *JaegerSpanSink) Ingest(span *ssf.SSFSpan) error {
+	if err := protocol.ValidateTrace(span); err != nil {
+		return err
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if len(j.buffer) >= j.bufferSize {
+		j.dropped++
+		return nil
+	}
+	j.buffer = append(j.buffer, span)
+	return nil
+}
+
+// Flush posts the buffered spans to the collector. Since a Jaeger
+// batch describes a single process, spans are grouped by service, and
+// each service's spans are posted in one or more batches.
+func (j *JaegerSpanSink) Flush() {
+	j.mtx.Lock()
+	spans := j.buffer
+	dropped := j.dropped
+	j.buffer = make([]*ssf.SSFSpan, 0, len(spans))
+	j.dropped = 0
+	j.mtx.Unlock()
+
+	flushStart := time.Now()
+	flushed := 0
+
+	byService := map[string][]jaeger.Span{}
+	for _, span := range spans {
+		byService[span.Service] = append(byService[span.Service], jaeger.FromSSF(span))
+	}
+	services := make([]string, 0, len(byService))
+	for service := range byService {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	for _, service := range services {
+		spans := byService[service]
+		batchSize := j.flushMaxPerBody
+		if batchSize <= 0 {
+			batchSize = len(spans)
+		}
+		for len(spans) > 0 {
+			n := batchSize
+			if n > len(spans) {
+				n = len(spans)
+			}
+			batch := &jaeger.Batch{Process: j.process(service), Spans: spans[:n]}
+			spans = spans[n:]
+			if err := j.post(batch); err != nil {
+				dropped += int64(len(batch.Spans))
+				j.log.WithError(err).WithField("spans", len(batch.Spans)).
+					Warn("Error posting spans to Jaeger collector")
+				continue
+			}
+			flushed += len(batch.Spans)
+		}
+	}
+
+	tags := map[string]string{"sink": j.Name()}
+	metrics.ReportBatch(j.traceClient, []*ssf.SSFSample{
+		ssf.Timing(sinks.MetricKeySpanFlushDuration, time.Since(flushStart), time.Nanosecond, tags),
+		ssf.Count(sinks.MetricKeyTotalSpansFlushed, float32(flushed), tags),
+		ssf.Count(sinks.MetricKeyTotalSpansDropped, float32(dropped), tags),
+	})
+	j.log.WithFields(logrus.Fields{
+		"flushed_spans": flushed,
+		"dropped_spans": dropped,
+	}).Debug("Completed flush to Jaeger")
+}
+
+// process describes a service, with the host and the sink's common
+// tags.
+func (j *JaegerSpanSink) process(service string) jaeger.Process {
+	keys := make([]string, 0, len(j.commonTags))
+	for k := range j.commonTags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	p := jaeger.Process{ServiceName: service}
+	if j.hostname != "" {
+		p.Tags = append(p.Tags, jaeger.Tag{Key: "hostname", VType: jaeger.TagTypeString, VStr: j.hostname})
+	}
+	for _, k := range keys {
+		p.Tags = append(p.Tags, jaeger.Tag{Key: k, VType: jaeger.TagTypeString, VStr: j.commonTags[k]})
+	}
+	return p
+}
+
+func (j *JaegerSpanSink) post(batch *jaeger.Batch) error {
+	span, ctx := trace.StartSpanFromContext(context.Background(), "")
+	defer span.ClientFinish(j.traceClient)
+
+	req, err := http.NewRequest(http.MethodPost, j.tracesURL, bytes.NewReader(batch.Encode()))
+	if err != nil {
+		span.Error(err)
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-thrift")
+
+	resp, err := j.httpClient.Do(req)
+	if err != nil {
+		span.Error(err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("Jaeger collector returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	span.Error(err)
+	return err
+}
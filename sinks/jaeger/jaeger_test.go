@@ -0,0 +1,93 @@
+package jaeger
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stripe/veneur/jaeger"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+)
+
+func testSpan(service string, id int64) *ssf.SSFSpan {
+	return &ssf.SSFSpan{
+		TraceId:        1,
+		Id:             id,
+		Name:           "request",
+		Service:        service,
+		StartTimestamp: 1500000000000000000,
+		EndTimestamp:   1500000000002000000,
+		Tags:           map[string]string{"env": "prod"},
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var bodies [][]byte
+	status := http.StatusAccepted
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/traces", r.URL.Path)
+		assert.Equal(t, "application/x-thrift", r.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, body)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	sink, err := NewJaegerSpanSink(srv.URL, "box", map[string]string{"region": "us"}, 3, 2, srv.Client(), logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+
+	require.NoError(t, sink.Ingest(testSpan("web", 1)))
+	require.NoError(t, sink.Ingest(testSpan("api", 2)))
+	require.NoError(t, sink.Ingest(testSpan("api", 3)))
+	require.NoError(t, sink.Ingest(testSpan("api", 4))) // dropped
+	assert.Error(t, sink.Ingest(&ssf.SSFSpan{}))
+	sink.Flush()
+
+	process := func(service string) jaeger.Process {
+		return jaeger.Process{ServiceName: service, Tags: []jaeger.Tag{
+			{Key: "hostname", VType: jaeger.TagTypeString, VStr: "box"},
+			{Key: "region", VType: jaeger.TagTypeString, VStr: "us"},
+		}}
+	}
+	expected := [][]byte{
+		(&jaeger.Batch{Process: process("api"), Spans: []jaeger.Span{
+			jaeger.FromSSF(testSpan("api", 2)), jaeger.FromSSF(testSpan("api", 3)),
+		}}).Encode(),
+		(&jaeger.Batch{Process: process("web"), Spans: []jaeger.Span{
+			jaeger.FromSSF(testSpan("web", 1)),
+		}}).Encode(),
+	}
+	assert.Equal(t, expected, bodies)
+
+	// the buffer is emptied, even if the collector fails:
+	status = http.StatusServiceUnavailable
+	require.NoError(t, sink.Ingest(testSpan("web", 5)))
+	sink.Flush()
+	sink.Flush()
+	assert.Len(t, bodies, 3)
+}
+
+func TestNewSpanSinkFromConfig(t *testing.T) {
+	deps := sinks.Dependencies{Hostname: "host", Log: logrus.New()}
+	sink, err := sinks.NewSpanSink("jaeger", "jaeger-eu", sinks.SinkConfig{
+		"address":            "http://jaeger-eu:14268",
+		"flush_max_per_body": 10,
+	}, deps)
+	require.NoError(t, err)
+	assert.Equal(t, "jaeger-eu", sink.Name())
+	jSink := sink.(*JaegerSpanSink)
+	assert.Equal(t, "http://jaeger-eu:14268/api/traces", jSink.tracesURL)
+	assert.Equal(t, 10, jSink.flushMaxPerBody)
+	assert.Equal(t, "host", jSink.hostname)
+
+	_, err = sinks.NewSpanSink("jaeger", "jaeger-eu", sinks.SinkConfig{}, deps)
+	assert.Error(t, err, "the address is required")
+}
@@ -0,0 +1,77 @@
+package kafka
+
+import (
+	"github.com/stripe/veneur/sinks"
+)
+
+func init() {
+	sinks.RegisterMetricSink("kafka", newMetricSinkFromConfig)
+	sinks.RegisterSpanSink("kafka", newSpanSinkFromConfig)
+}
+
+// MetricSinkConfig is the configuration of a kafka entry in
+// metric_sinks.
+type MetricSinkConfig struct {
+	Broker                string `yaml:"broker"`
+	CheckTopic            string `yaml:"check_topic"`
+	EventTopic            string `yaml:"event_topic"`
+	MetricBufferBytes     int    `yaml:"metric_buffer_bytes"`
+	MetricBufferFrequency string `yaml:"metric_buffer_frequency"`
+	MetricBufferMessages  int    `yaml:"metric_buffer_messages"`
+	MetricRequireAcks     string `yaml:"metric_require_acks"`
+	MetricTopic           string `yaml:"metric_topic"`
+	Partitioner           string `yaml:"partitioner"`
+	RetryMax              int    `yaml:"retry_max"`
+}
+
+// SpanSinkConfig is the configuration of a kafka entry in span_sinks.
+type SpanSinkConfig struct {
+	Broker                  string `yaml:"broker"`
+	Partitioner             string `yaml:"partitioner"`
+	RequireAcks             string `yaml:"require_acks"`
+	RetryMax                int    `yaml:"retry_max"`
+	SpanBufferBytes         int    `yaml:"span_buffer_bytes"`
+	SpanBufferFrequency     string `yaml:"span_buffer_frequency"`
+	SpanBufferMessages      int    `yaml:"span_buffer_messages"`
+	SpanSampleRatePercent   int    `yaml:"span_sample_rate_percent"`
+	SpanSampleTag           string `yaml:"span_sample_tag"`
+	SpanSerializationFormat string `yaml:"span_serialization_format"`
+	SpanTopic               string `yaml:"span_topic"`
+}
+
+func newMetricSinkFromConfig(name string, config sinks.SinkConfig, deps sinks.Dependencies) (sinks.MetricSink, error) {
+	conf := MetricSinkConfig{}
+	if err := config.Decode(&conf); err != nil {
+		return nil, err
+	}
+	sink, err := NewKafkaMetricSink(
+		deps.Log, deps.TraceClient, conf.Broker, conf.CheckTopic, conf.EventTopic,
+		conf.MetricTopic, conf.MetricRequireAcks, conf.Partitioner, conf.RetryMax,
+		conf.MetricBufferBytes, conf.MetricBufferMessages, conf.MetricBufferFrequency,
+	)
+	if err != nil {
+		return nil, err
+	}
+	sink.name = name
+	sink.logger = sink.logger.WithField("name", name)
+	return sink, nil
+}
+
+func newSpanSinkFromConfig(name string, config sinks.SinkConfig, deps sinks.Dependencies) (sinks.SpanSink, error) {
+	conf := SpanSinkConfig{SpanSampleRatePercent: 100}
+	if err := config.Decode(&conf); err != nil {
+		return nil, err
+	}
+	sink, err := NewKafkaSpanSink(
+		deps.Log, deps.TraceClient, conf.Broker, conf.SpanTopic, conf.Partitioner,
+		conf.RequireAcks, conf.RetryMax, conf.SpanBufferBytes, conf.SpanBufferMessages,
+		conf.SpanBufferFrequency, conf.SpanSerializationFormat, conf.SpanSampleTag,
+		conf.SpanSampleRatePercent,
+	)
+	if err != nil {
+		return nil, err
+	}
+	sink.name = name
+	sink.logger = sink.logger.WithField("name", name)
+	return sink, nil
+}
@@ -34,8 +34,11 @@ var IngestTimeoutError = errors.New("Timed out writing to Kafka producer")
 
 var _ sinks.MetricSink = &KafkaMetricSink{}
 var _ sinks.SpanSink = &KafkaSpanSink{}
+var _ sinks.Stopper = &KafkaMetricSink{}
+var _ sinks.Stopper = &KafkaSpanSink{}
 
 type KafkaMetricSink struct {
+	name        string
 	logger      *logrus.Entry
 	producer    sarama.AsyncProducer
 	checkTopic  string
@@ -47,6 +50,7 @@ type KafkaMetricSink struct {
 }
 
 type KafkaSpanSink struct {
+	name            string
 	logger          *logrus.Entry
 	producer        sarama.AsyncProducer
 	topic           string
@@ -96,6 +100,7 @@ func NewKafkaMetricSink(logger *logrus.Logger, cl *trace.Client, brokers string,
 	}).Info("Created Kafka metric sink")
 
 	return &KafkaMetricSink{
+		name:        "kafka",
 		logger:      ll,
 		checkTopic:  checkTopic,
 		eventTopic:  eventTopic,
@@ -172,7 +177,7 @@ func newConfiguredProducer(logger *logrus.Entry, brokerString string, config *sa
 
 // Name returns the name of this sink.
 func (k *KafkaMetricSink) Name() string {
-	return "kafka"
+	return k.name
 }
 
 // Start performs final adjustments on the sink.
@@ -224,6 +229,29 @@ func (k *KafkaMetricSink) FlushOtherSamples(ctx context.Context, samples []ssf.S
 	// TODO
 }
 
+// Stop sends the messages that the producer buffered, and closes it.
+func (k *KafkaMetricSink) Stop(ctx context.Context) error {
+	return closeProducer(ctx, k.producer)
+}
+
+// closeProducer closes an async producer, which sends its buffered
+// messages first, and waits for it until ctx is done.
+func closeProducer(ctx context.Context, producer sarama.AsyncProducer) error {
+	if producer == nil {
+		return nil
+	}
+	closed := make(chan error, 1)
+	go func() {
+		closed <- producer.Close()
+	}()
+	select {
+	case err := <-closed:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // NewKafkaSpanSink creates a new Kafka Plugin.
 func NewKafkaSpanSink(logger *logrus.Logger, cl *trace.Client, brokers string, topic string, partitioner string, ackRequirement string, retries int, bufferBytes int, bufferMessages int, bufferDuration string, serializationFormat string, sampleTag string, sampleRatePercentage int) (*KafkaSpanSink, error) {
 	if logger == nil {
@@ -275,6 +303,7 @@ func NewKafkaSpanSink(logger *logrus.Logger, cl *trace.Client, brokers string, t
 	}).Info("Started Kafka span sink")
 
 	return &KafkaSpanSink{
+		name:            "kafka",
 		logger:          ll,
 		topic:           topic,
 		brokers:         brokers,
@@ -287,7 +316,7 @@ func NewKafkaSpanSink(logger *logrus.Logger, cl *trace.Client, brokers string, t
 
 // Name returns the name of this sink.
 func (k *KafkaSpanSink) Name() string {
-	return "kafka"
+	return k.name
 }
 
 // Start performs final adjustments on the sink.
@@ -396,3 +425,8 @@ func (k *KafkaSpanSink) Flush() {
 	metrics.ReportOne(k.traceClient, ssf.Count(sinks.MetricKeyTotalSpansFlushed, float32(atomic.LoadInt64(&k.spansFlushed)), map[string]string{"sink": k.Name()}))
 	atomic.SwapInt64(&k.spansFlushed, 0)
 }
+
+// Stop sends the spans that the producer buffered, and closes it.
+func (k *KafkaSpanSink) Stop(ctx context.Context) error {
+	return closeProducer(ctx, k.producer)
+}
@@ -0,0 +1,67 @@
+package otlp
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc"
+
+	"github.com/stripe/veneur/sinks"
+)
+
+func init() {
+	sinks.RegisterMetricSink("otlp", newMetricSinkFromConfig)
+	sinks.RegisterSpanSink("otlp", newSpanSinkFromConfig)
+}
+
+// MetricSinkConfig is the configuration of an otlp entry in
+// metric_sinks.
+type MetricSinkConfig struct {
+	Address         string `yaml:"address"`
+	FlushMaxPerBody int    `yaml:"flush_max_per_body"`
+}
+
+// SpanSinkConfig is the configuration of an otlp entry in span_sinks.
+type SpanSinkConfig struct {
+	Address         string `yaml:"address"`
+	FlushMaxPerBody int    `yaml:"flush_max_per_body"`
+	SpanBufferSize  int    `yaml:"span_buffer_size"`
+}
+
+func newMetricSinkFromConfig(name string, config sinks.SinkConfig, deps sinks.Dependencies) (sinks.MetricSink, error) {
+	conf := MetricSinkConfig{FlushMaxPerBody: 1000}
+	if err := config.Decode(&conf); err != nil {
+		return nil, err
+	}
+	if conf.Address == "" {
+		return nil, errors.New("address is required")
+	}
+	sink, err := NewOTLPMetricSink(
+		context.Background(), conf.Address, deps.Interval, deps.Hostname,
+		deps.Tags, conf.FlushMaxPerBody, deps.Log, grpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	sink.name = name
+	return sink, nil
+}
+
+func newSpanSinkFromConfig(name string, config sinks.SinkConfig, deps sinks.Dependencies) (sinks.SpanSink, error) {
+	conf := SpanSinkConfig{FlushMaxPerBody: 1000, SpanBufferSize: 16384}
+	if err := config.Decode(&conf); err != nil {
+		return nil, err
+	}
+	if conf.Address == "" {
+		return nil, errors.New("address is required")
+	}
+	sink, err := NewOTLPSpanSink(
+		context.Background(), conf.Address, deps.Hostname, deps.TagsAsMap,
+		conf.SpanBufferSize, conf.FlushMaxPerBody, deps.Log, grpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	sink.name = name
+	return sink, nil
+}
@@ -0,0 +1,250 @@
+// Package otlp contains a MetricSink and a SpanSink that export to any
+// collector that speaks the OpenTelemetry protocol (OTLP) over gRPC.
+package otlp
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	"github.com/stripe/veneur/otlp/otlppb"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// OTLPMetricSink is a MetricSink that exports metrics to an OTLP/gRPC
+// collector.
+type OTLPMetricSink struct {
+	name            string
+	target          string
+	hostname        string
+	commonTags      []string
+	flushMaxPerBody int
+	excludedTags    map[string]struct{}
+	interval        time.Duration
+	conn            *grpc.ClientConn
+	client          otlppb.MetricsServiceClient
+	traceClient     *trace.Client
+	log             *logrus.Logger
+}
+
+var _ sinks.MetricSink = &OTLPMetricSink{}
+
+// NewOTLPMetricSink creates a sink that sends each flush to the OTLP
+// collector at target, in requests of at most flushMaxPerBody data
+// points. The interval is the flush interval of the server, which
+// determines the start time of the delta sums that counters are sent
+// as.
+func NewOTLPMetricSink(ctx context.Context, target string, interval time.Duration, hostname string, commonTags []string, flushMaxPerBody int, log *logrus.Logger, opts ...grpc.DialOption) (*OTLPMetricSink, error) {
+	conn, err := grpc.DialContext(ctx, target, opts...)
+	if err != nil {
+		log.WithError(err).WithField("target", target).Error("Error establishing connection to OTLP collector")
+		return nil, err
+	}
+	return &OTLPMetricSink{
+		target:          target,
+		hostname:        hostname,
+		commonTags:      commonTags,
+		flushMaxPerBody: flushMaxPerBody,
+		interval:        interval,
+		conn:            conn,
+		client:          otlppb.NewMetricsServiceClient(conn),
+		log:             log,
+	}, nil
+}
+
+// Name returns the name of this sink.
+func (o *OTLPMetricSink) Name() string {
+	if o.name == "" {
+		return "otlp"
+	}
+	return o.name
+}
+
+// Start sets the sink up.
+func (o *OTLPMetricSink) Start(cl *trace.Client) error {
+	o.traceClient = cl
+	return nil
+}
+
+// SetExcludedTags sets the excluded tag names. Any tags with the
+// provided key (name) will be excluded.
+func (o *OTLPMetricSink) SetExcludedTags(excludes []string) {
+	tagsSet := map[string]struct{}{}
+	for _, tag := range excludes {
+		tagsSet[tag] = struct{}{}
+	}
+	o.excludedTags = tagsSet
+}
+
+// Flush converts the metrics to OTLP and exports them, in parallel
+// batches. If any batch fails, it returns a *sinks.FlushError with the
+// metrics in the batches that failed.
+func (o *OTLPMetricSink) Flush(ctx context.Context, interMetrics []samplers.InterMetric) error {
+	span, _ := trace.StartSpanFromContext(ctx, "")
+	defer span.ClientFinish(o.traceClient)
+
+	metrics, items, countSkipped := o.finalizeMetrics(interMetrics)
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	flushStart := time.Now()
+	countDropped, err := sinks.FlushBatches(len(metrics), o.flushMaxPerBody, func(start, end int) error {
+		err := o.flushPart(span.Attach(ctx), metrics[start:end])
+		if err != nil {
+			o.log.WithError(err).WithField("metrics", end-start).
+				Warn("Error exporting metrics to OTLP collector")
+		}
+		return err
+	})
+
+	tags := map[string]string{"sink": o.Name()}
+	span.Add(
+		ssf.Timing(sinks.MetricKeyMetricFlushDuration, time.Since(flushStart), time.Nanosecond, tags),
+		ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(len(metrics)-countDropped), tags),
+		ssf.Count(sinks.MetricKeyTotalMetricsSkipped, float32(countSkipped), tags),
+	)
+	if err != nil {
+		span.Add(ssf.Count(sinks.MetricKeyTotalMetricsDropped, float32(countDropped), tags))
+		return sinks.NewFlushError(err, interMetrics, items)
+	}
+	o.log.WithField("metrics", len(metrics)).Info("Completed flush to OTLP collector")
+	return nil
+}
+
+// FlushOtherSamples is a no-op: OTLP metrics have no notion of events
+// or service checks.
+func (o *OTLPMetricSink) FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample) {}
+
+func (o *OTLPMetricSink) flushPart(ctx context.Context, metrics []*otlppb.Metric) error {
+	span, ctx := trace.StartSpanFromContext(ctx, "")
+	defer span.ClientFinish(o.traceClient)
+
+	resource := &otlppb.Resource{
+		Attributes: tagAttributes(o.commonTags, nil),
+	}
+	if o.hostname != "" {
+		resource.Attributes = append(resource.Attributes, otlppb.StringAttribute("host.name", o.hostname))
+	}
+	req := &otlppb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*otlppb.ResourceMetrics{{
+			Resource: resource,
+			ScopeMetrics: []*otlppb.ScopeMetrics{{
+				Scope:   &otlppb.InstrumentationScope{Name: "veneur"},
+				Metrics: metrics,
+			}},
+		}},
+	}
+	resp, err := o.client.Export(ctx, req)
+	if err != nil {
+		span.Error(err)
+		return err
+	}
+	if ps := resp.PartialSuccess; ps != nil && ps.RejectedDataPoints > 0 {
+		o.log.WithFields(logrus.Fields{
+			"rejected":      ps.RejectedDataPoints,
+			logrus.ErrorKey: ps.ErrorMessage,
+		}).Warn("OTLP collector rejected some data points")
+	}
+	return nil
+}
+
+// summaryKey identifies the summary that a histogram-derived value
+// belongs to.
+type summaryKey struct {
+	name string
+	tags string
+}
+
+// finalizeMetrics converts InterMetrics into OTLP metrics: counters
+// become delta sums, gauges and status checks become gauges, and the
+// percentiles, min, max, median, count and sum that veneur generates
+// for a histogram or timer are gathered up into a single summary.
+// items[i] is the index of the OTLP metric that interMetrics[i] went
+// into, or -1 if it was skipped.
+func (o *OTLPMetricSink) finalizeMetrics(interMetrics []samplers.InterMetric) ([]*otlppb.Metric, []int, int) {
+	metrics := make([]*otlppb.Metric, 0, len(interMetrics))
+	summaries := map[summaryKey]int{}
+	items := make([]int, len(interMetrics))
+	countSkipped := 0
+	for i, m := range interMetrics {
+		items[i] = -1
+		if !sinks.IsAcceptableMetric(m, o) {
+			countSkipped++
+			continue
+		}
+		end := uint64(m.Timestamp) * uint64(time.Second)
+		dp := &otlppb.NumberDataPoint{
+			TimeUnixNano: end,
+			AsDouble:     proto.Float64(m.Value),
+			Attributes:   tagAttributes(m.Tags, o.excludedTags),
+		}
+		if m.HostName != "" && m.HostName != o.hostname {
+			dp.Attributes = append(dp.Attributes, otlppb.StringAttribute("host.name", m.HostName))
+		}
+
+		if base, kind, quantile := sinks.SummaryPart(m); kind != "" {
+			key := summaryKey{name: base, tags: strings.Join(m.Tags, ",")}
+			item, ok := summaries[key]
+			if !ok {
+				item = len(metrics)
+				summaries[key] = item
+				metrics = append(metrics, &otlppb.Metric{
+					Name: base,
+					Summary: &otlppb.Summary{DataPoints: []*otlppb.SummaryDataPoint{{
+						StartTimeUnixNano: end - uint64(o.interval),
+						TimeUnixNano:      end,
+						Attributes:        dp.Attributes,
+					}}},
+				})
+			}
+			items[i] = item
+			sdp := metrics[item].Summary.DataPoints[0]
+			switch kind {
+			case sinks.SummaryCount:
+				sdp.Count = uint64(m.Value)
+			case sinks.SummarySum:
+				sdp.Sum = m.Value
+			default:
+				sdp.QuantileValues = append(sdp.QuantileValues, &otlppb.SummaryDataPoint_ValueAtQuantile{
+					Quantile: quantile,
+					Value:    m.Value,
+				})
+			}
+			continue
+		}
+
+		metric := &otlppb.Metric{Name: m.Name}
+		switch m.Type {
+		case samplers.CounterMetric:
+			dp.StartTimeUnixNano = end - uint64(o.interval)
+			metric.Sum = &otlppb.Sum{
+				AggregationTemporality: otlppb.AggregationTemporalityDelta,
+				IsMonotonic:            true,
+				DataPoints:             []*otlppb.NumberDataPoint{dp},
+			}
+		default:
+			metric.Gauge = &otlppb.Gauge{DataPoints: []*otlppb.NumberDataPoint{dp}}
+		}
+		items[i] = len(metrics)
+		metrics = append(metrics, metric)
+	}
+	return metrics, items, countSkipped
+}
+
+// tagAttributes converts veneur tags into OTLP attributes, skipping
+// excluded tags and veneursinkonly.
+func tagAttributes(tags []string, excluded map[string]struct{}) []*otlppb.KeyValue {
+	attrs := make([]*otlppb.KeyValue, 0, len(tags))
+	sinks.EachTag(tags, excluded, func(key, value string) {
+		attrs = append(attrs, otlppb.StringAttribute(key, value))
+	})
+	return attrs
+}
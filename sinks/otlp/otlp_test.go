@@ -0,0 +1,235 @@
+package otlp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/stripe/veneur/otlp/otlppb"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+)
+
+type testCollector struct {
+	mtx     sync.Mutex
+	metrics []*otlppb.ExportMetricsServiceRequest
+	traces  []*otlppb.ExportTraceServiceRequest
+	// err, if set, fails every metrics export.
+	err error
+}
+
+func (c *testCollector) Export(ctx context.Context, req *otlppb.ExportMetricsServiceRequest) (*otlppb.ExportMetricsServiceResponse, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.metrics = append(c.metrics, req)
+	return &otlppb.ExportMetricsServiceResponse{}, nil
+}
+
+type testTraceCollector struct {
+	*testCollector
+}
+
+func (c testTraceCollector) Export(ctx context.Context, req *otlppb.ExportTraceServiceRequest) (*otlppb.ExportTraceServiceResponse, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.traces = append(c.traces, req)
+	return &otlppb.ExportTraceServiceResponse{}, nil
+}
+
+func newTestCollector(t *testing.T) (*testCollector, string, func()) {
+	collector := &testCollector{}
+	srv := grpc.NewServer()
+	otlppb.RegisterMetricsServiceServer(srv, collector)
+	otlppb.RegisterTraceServiceServer(srv, testTraceCollector{collector})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	return collector, ln.Addr().String(), srv.Stop
+}
+
+func TestMetricSinkFlush(t *testing.T) {
+	collector, addr, stop := newTestCollector(t)
+	defer stop()
+
+	sink, err := NewOTLPMetricSink(context.Background(), addr, 10*time.Second, "box", []string{"env:test"}, 2, logrus.New(), grpc.WithInsecure())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+	sink.SetExcludedTags([]string{"secret"})
+
+	now := time.Now().Unix()
+	metrics := []samplers.InterMetric{
+		{Name: "a.counter", Timestamp: now, Value: 3, Tags: []string{"foo:bar", "secret:x"}, Type: samplers.CounterMetric},
+		{Name: "a.gauge", Timestamp: now, Value: 1.5, Type: samplers.GaugeMetric},
+		{Name: "a.timer.50percentile", Timestamp: now, Value: 4, Tags: []string{"foo:bar"}, Type: samplers.GaugeMetric, Histogram: &samplers.HistogramPart{Percentile: 0.5}},
+		{Name: "a.timer.max", Timestamp: now, Value: 9, Tags: []string{"foo:bar"}, Type: samplers.GaugeMetric, Histogram: &samplers.HistogramPart{Aggregate: samplers.AggregateMax}},
+		{Name: "a.timer.count", Timestamp: now, Value: 6, Tags: []string{"foo:bar"}, Type: samplers.CounterMetric, Histogram: &samplers.HistogramPart{Aggregate: samplers.AggregateCount}},
+		{Name: "a.timer.sum", Timestamp: now, Value: 30, Tags: []string{"foo:bar"}, Type: samplers.GaugeMetric, Histogram: &samplers.HistogramPart{Aggregate: samplers.AggregateSum}},
+		{Name: "a.timer.avg", Timestamp: now, Value: 5, Tags: []string{"foo:bar"}, Type: samplers.GaugeMetric, Histogram: &samplers.HistogramPart{Aggregate: samplers.AggregateAverage}},
+		{Name: "queue.max", Timestamp: now, Value: 2, Type: samplers.GaugeMetric},
+		{Name: "a.skipped", Timestamp: now, Value: 1, Type: samplers.GaugeMetric, Sinks: samplers.RouteInformation{"datadog": struct{}{}}},
+	}
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+
+	collector.mtx.Lock()
+	defer collector.mtx.Unlock()
+	// 5 metrics, in chunks of at most 2:
+	require.Len(t, collector.metrics, 3)
+	byName := map[string]*otlppb.Metric{}
+	for _, req := range collector.metrics {
+		require.Len(t, req.ResourceMetrics, 1)
+		rm := req.ResourceMetrics[0]
+		assert.Equal(t, []*otlppb.KeyValue{
+			otlppb.StringAttribute("env", "test"),
+			otlppb.StringAttribute("host.name", "box"),
+		}, rm.Resource.Attributes)
+		for _, m := range rm.ScopeMetrics[0].Metrics {
+			byName[m.Name] = m
+		}
+	}
+	require.Len(t, byName, 5)
+
+	counter := byName["a.counter"].Sum
+	require.NotNil(t, counter)
+	assert.Equal(t, otlppb.AggregationTemporalityDelta, counter.AggregationTemporality)
+	assert.True(t, counter.IsMonotonic)
+	assert.Equal(t, float64(3), counter.DataPoints[0].Value())
+	assert.Equal(t, uint64(10*time.Second), counter.DataPoints[0].TimeUnixNano-counter.DataPoints[0].StartTimeUnixNano)
+	assert.Equal(t, []*otlppb.KeyValue{otlppb.StringAttribute("foo", "bar")}, counter.DataPoints[0].Attributes)
+
+	gauge := byName["a.gauge"].Gauge
+	require.NotNil(t, gauge)
+	assert.Equal(t, 1.5, gauge.DataPoints[0].Value())
+
+	summary := byName["a.timer"].Summary
+	require.NotNil(t, summary)
+	dp := summary.DataPoints[0]
+	assert.Equal(t, uint64(6), dp.Count)
+	assert.Equal(t, float64(30), dp.Sum)
+	assert.Equal(t, []*otlppb.SummaryDataPoint_ValueAtQuantile{
+		{Quantile: 0.5, Value: 4},
+		{Quantile: 1, Value: 9},
+	}, dp.QuantileValues)
+
+	require.NotNil(t, byName["a.timer.avg"].Gauge)
+	require.NotNil(t, byName["queue.max"].Gauge)
+}
+
+func TestMetricSinkFlushError(t *testing.T) {
+	collector, addr, stop := newTestCollector(t)
+	defer stop()
+	collector.err = errors.New("collector is down")
+
+	sink, err := NewOTLPMetricSink(context.Background(), addr, 10*time.Second, "box", nil, 0, logrus.New(), grpc.WithInsecure())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+
+	metrics := []samplers.InterMetric{{Name: "a.gauge", Timestamp: time.Now().Unix(), Value: 1, Type: samplers.GaugeMetric}}
+	assert.Error(t, sink.Flush(context.Background(), metrics))
+}
+
+func TestSpanSinkFlush(t *testing.T) {
+	collector, addr, stop := newTestCollector(t)
+	defer stop()
+
+	sink, err := NewOTLPSpanSink(context.Background(), addr, "box", map[string]string{"env": "test"}, 3, 2, logrus.New(), grpc.WithInsecure())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+
+	start := time.Now()
+	span := func(id int64, service string) *ssf.SSFSpan {
+		return &ssf.SSFSpan{
+			TraceId:        1,
+			Id:             id,
+			StartTimestamp: start.UnixNano(),
+			EndTimestamp:   start.Add(time.Second).UnixNano(),
+			Service:        service,
+			Name:           "op",
+			Tags:           map[string]string{},
+		}
+	}
+	fromOTLP := span(2, "frontend")
+	fromOTLP.ParentId = 1
+	fromOTLP.Error = true
+	fromOTLP.Indicator = true
+	fromOTLP.Tags = map[string]string{
+		traceIDTag:       "ffeeddccbbaa99880000000000000001",
+		spanKindTag:      "server",
+		statusMessageTag: "oops",
+		"http.method":    "GET",
+	}
+
+	require.NoError(t, sink.Ingest(span(1, "backend")))
+	require.NoError(t, sink.Ingest(fromOTLP))
+	require.NoError(t, sink.Ingest(span(3, "backend")))
+	// the buffer is full:
+	require.NoError(t, sink.Ingest(span(4, "backend")))
+	assert.Error(t, sink.Ingest(&ssf.SSFSpan{}))
+	sink.Flush()
+
+	collector.mtx.Lock()
+	defer collector.mtx.Unlock()
+	require.Len(t, collector.traces, 2)
+
+	first := collector.traces[0]
+	require.Len(t, first.ResourceSpans, 2)
+	assert.Equal(t, []*otlppb.KeyValue{
+		otlppb.StringAttribute("service.name", "backend"),
+		otlppb.StringAttribute("host.name", "box"),
+		otlppb.StringAttribute("env", "test"),
+	}, first.ResourceSpans[0].Resource.Attributes)
+
+	plain := first.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, plain.TraceId)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 1}, plain.SpanId)
+	assert.Empty(t, plain.ParentSpanId)
+	assert.Equal(t, otlppb.StatusCodeUnset, plain.Status.Code)
+
+	converted := first.ResourceSpans[1].ScopeSpans[0].Spans[0]
+	assert.Equal(t, []byte{0xff, 0xee, 0xdd, 0xcc, 0xbb, 0xaa, 0x99, 0x88, 0, 0, 0, 0, 0, 0, 0, 1}, converted.TraceId)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 1}, converted.ParentSpanId)
+	assert.Equal(t, otlppb.SpanKindServer, converted.Kind)
+	assert.Equal(t, &otlppb.Status{Code: otlppb.StatusCodeError, Message: "oops"}, converted.Status)
+	assert.Equal(t, uint64(start.UnixNano()), converted.StartTimeUnixNano)
+	assert.Equal(t, []*otlppb.KeyValue{
+		otlppb.StringAttribute("http.method", "GET"),
+		otlppb.StringAttribute("indicator", "true"),
+	}, converted.Attributes)
+
+	second := collector.traces[1]
+	require.Len(t, second.ResourceSpans, 1)
+	assert.Len(t, second.ResourceSpans[0].ScopeSpans[0].Spans, 1)
+}
+
+func TestNewSinksFromConfig(t *testing.T) {
+	deps := sinks.Dependencies{Hostname: "host", Interval: 10 * time.Second, Log: logrus.New()}
+	metricSink, err := sinks.NewMetricSink("otlp", "collector-eu", sinks.SinkConfig{
+		"address": "collector-eu:4317",
+	}, deps)
+	require.NoError(t, err)
+	assert.Equal(t, "collector-eu", metricSink.Name())
+	assert.Equal(t, 10*time.Second, metricSink.(*OTLPMetricSink).interval)
+
+	spanSink, err := sinks.NewSpanSink("otlp", "collector-eu", sinks.SinkConfig{
+		"address":          "collector-eu:4317",
+		"span_buffer_size": 10,
+	}, deps)
+	require.NoError(t, err)
+	assert.Equal(t, "collector-eu", spanSink.Name())
+	assert.Equal(t, 10, spanSink.(*OTLPSpanSink).bufferSize)
+	assert.Equal(t, 1000, spanSink.(*OTLPSpanSink).flushMaxPerBody)
+
+	_, err = sinks.NewSpanSink("otlp", "collector-eu", sinks.SinkConfig{}, deps)
+	assert.Error(t, err, "the address is required")
+}
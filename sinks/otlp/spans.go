@@ -0,0 +1,273 @@
+package otlp
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	"github.com/stripe/veneur/otlp/otlppb"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+const (
+	// traceIDTag is the span tag that the OTLP receiver keeps the
+	// full 128-bit trace ID of a span in.
+	traceIDTag = "otlp.trace_id"
+
+	spanKindTag      = "span.kind"
+	statusMessageTag = "status.message"
+)
+
+var spanKinds = map[string]otlppb.SpanKind{
+	"internal": otlppb.SpanKindInternal,
+	"server":   otlppb.SpanKindServer,
+	"client":   otlppb.SpanKindClient,
+	"producer": otlppb.SpanKindProducer,
+	"consumer": otlppb.SpanKindConsumer,
+}
+
+// OTLPSpanSink is a SpanSink that buffers spans and exports them to an
+// OTLP/gRPC collector on every flush.
+type OTLPSpanSink struct {
+	name            string
+	target          string
+	hostname        string
+	commonTags      map[string]string
+	flushMaxPerBody int
+	bufferSize      int
+	conn            *grpc.ClientConn
+	client          otlppb.TraceServiceClient
+	traceClient     *trace.Client
+	log             *logrus.Logger
+
+	mtx     sync.Mutex
+	buffer  []*ssf.SSFSpan
+	dropped int64
+}
+
+var _ sinks.SpanSink = &OTLPSpanSink{}
+
+// NewOTLPSpanSink creates a sink that holds on to at most bufferSize
+// spans between flushes, and sends them to the OTLP collector at
+// target in requests of at most flushMaxPerBody spans.
+func NewOTLPSpanSink(ctx context.Context, target string, hostname string, commonTags map[string]string, bufferSize, flushMaxPerBody int, log *logrus.Logger, opts ...grpc.DialOption) (*OTLPSpanSink, error) {
+	conn, err := grpc.DialContext(ctx, target, opts...)
+	if err != nil {
+		log.WithError(err).WithField("target", target).Error("Error establishing connection to OTLP collector")
+		return nil, err
+	}
+	return &OTLPSpanSink{
+		target:          target,
+		hostname:        hostname,
+		commonTags:      commonTags,
+		bufferSize:      bufferSize,
+		flushMaxPerBody: flushMaxPerBody,
+		conn:            conn,
+		client:          otlppb.NewTraceServiceClient(conn),
+		log:             log,
+	}, nil
+}
+
+// Name returns the name of this sink.
+func (o *OTLPSpanSink) Name() string {
+	if o.name == "" {
+		return "otlp"
+	}
+	return o.name
+}
+
+// Start sets the sink up.
+func (o *OTLPSpanSink) Start(cl *trace.Client) error {
+	o.traceClient = cl
+	return nil
+}
+
+// Ingest buffers a span until the next flush. If the buffer is full,
+// the span is dropped.
+func (o *OTLPSpanSink) Ingest(span *ssf.SSFSpan) error {
+	if err := protocol.ValidateTrace(span); err != nil {
+		return err
+	}
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	if len(o.buffer) >= o.bufferSize {
+		o.dropped++
+		return nil
+	}
+	o.buffer = append(o.buffer, span)
+	return nil
+}
+
+// Flush exports the buffered spans, grouped by service.
+func (o *OTLPSpanSink) Flush() {
+	o.mtx.Lock()
+	spans := o.buffer
+	dropped := o.dropped
+	o.buffer = make([]*ssf.SSFSpan, 0, len(spans))
+	o.dropped = 0
+	o.mtx.Unlock()
+
+	flushStart := time.Now()
+	flushed := 0
+	batchSize := o.flushMaxPerBody
+	if batchSize <= 0 {
+		batchSize = len(spans)
+	}
+	for len(spans) > 0 {
+		n := batchSize
+		if n > len(spans) {
+			n = len(spans)
+		}
+		batch := spans[:n]
+		spans = spans[n:]
+		if err := o.flushPart(batch); err != nil {
+			dropped += int64(len(batch))
+			o.log.WithError(err).WithField("spans", len(batch)).
+				Warn("Error exporting spans to OTLP collector")
+			continue
+		}
+		flushed += len(batch)
+	}
+
+	tags := map[string]string{"sink": o.Name()}
+	metrics.ReportBatch(o.traceClient, []*ssf.SSFSample{
+		ssf.Timing(sinks.MetricKeySpanFlushDuration, time.Since(flushStart), time.Nanosecond, tags),
+		ssf.Count(sinks.MetricKeyTotalSpansFlushed, float32(flushed), tags),
+		ssf.Count(sinks.MetricKeyTotalSpansDropped, float32(dropped), tags),
+	})
+	o.log.WithFields(logrus.Fields{
+		"flushed_spans": flushed,
+		"dropped_spans": dropped,
+	}).Debug("Completed flush to OTLP collector")
+}
+
+func (o *OTLPSpanSink) flushPart(spans []*ssf.SSFSpan) error {
+	byService := map[string][]*otlppb.Span{}
+	for _, span := range spans {
+		byService[span.Service] = append(byService[span.Service], o.convertSpan(span))
+	}
+	services := make([]string, 0, len(byService))
+	for service := range byService {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	req := &otlppb.ExportTraceServiceRequest{}
+	for _, service := range services {
+		req.ResourceSpans = append(req.ResourceSpans, &otlppb.ResourceSpans{
+			Resource: &otlppb.Resource{Attributes: o.resourceAttributes(service)},
+			ScopeSpans: []*otlppb.ScopeSpans{{
+				Scope: &otlppb.InstrumentationScope{Name: "veneur"},
+				Spans: byService[service],
+			}},
+		})
+	}
+
+	resp, err := o.client.Export(context.Background(), req)
+	if err != nil {
+		return err
+	}
+	if ps := resp.PartialSuccess; ps != nil && ps.RejectedSpans > 0 {
+		o.log.WithFields(logrus.Fields{
+			"rejected":      ps.RejectedSpans,
+			logrus.ErrorKey: ps.ErrorMessage,
+		}).Warn("OTLP collector rejected some spans")
+	}
+	return nil
+}
+
+// resourceAttributes returns the attributes of the resource that
+// describes a service: its name, the host and the sink's common tags.
+func (o *OTLPSpanSink) resourceAttributes(service string) []*otlppb.KeyValue {
+	keys := make([]string, 0, len(o.commonTags))
+	for k := range o.commonTags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]*otlppb.KeyValue, 0, len(keys)+2)
+	attrs = append(attrs, otlppb.StringAttribute("service.name", service))
+	if o.hostname != "" {
+		attrs = append(attrs, otlppb.StringAttribute("host.name", o.hostname))
+	}
+	for _, k := range keys {
+		attrs = append(attrs, otlppb.StringAttribute(k, o.commonTags[k]))
+	}
+	return attrs
+}
+
+// convertSpan turns an SSF span into an OTLP span. It is the inverse
+// of the conversion that the OTLP receiver does: if the span came in
+// over OTLP, its original 128-bit trace ID is restored from the tag
+// the receiver kept it in; otherwise, the SSF trace ID makes up the
+// lower 64 bits.
+func (o *OTLPSpanSink) convertSpan(span *ssf.SSFSpan) *otlppb.Span {
+	ret := &otlppb.Span{
+		TraceId:           traceID(span),
+		SpanId:            idBytes(span.Id),
+		Name:              span.Name,
+		Kind:              otlppb.SpanKindUnspecified,
+		StartTimeUnixNano: uint64(span.StartTimestamp),
+		EndTimeUnixNano:   uint64(span.EndTimestamp),
+		Attributes:        make([]*otlppb.KeyValue, 0, len(span.Tags)+1),
+	}
+	if span.ParentId != 0 {
+		ret.ParentSpanId = idBytes(span.ParentId)
+	}
+
+	status := &otlppb.Status{Code: otlppb.StatusCodeUnset}
+	if span.Error {
+		status.Code = otlppb.StatusCodeError
+	}
+	keys := make([]string, 0, len(span.Tags))
+	for k := range span.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := span.Tags[k]
+		switch k {
+		case traceIDTag:
+			continue
+		case spanKindTag:
+			if kind, ok := spanKinds[v]; ok {
+				ret.Kind = kind
+				continue
+			}
+		case statusMessageTag:
+			status.Message = v
+			continue
+		}
+		ret.Attributes = append(ret.Attributes, otlppb.StringAttribute(k, v))
+	}
+	if span.Indicator {
+		ret.Attributes = append(ret.Attributes, otlppb.StringAttribute("indicator", "true"))
+	}
+	ret.Status = status
+	return ret
+}
+
+// traceID returns the 16-byte OTLP trace ID of an SSF span.
+func traceID(span *ssf.SSFSpan) []byte {
+	if full, err := hex.DecodeString(span.Tags[traceIDTag]); err == nil && len(full) == 16 &&
+		int64(binary.BigEndian.Uint64(full[8:]))&(1<<63-1) == span.TraceId {
+		return full
+	}
+	return append(make([]byte, 8), idBytes(span.TraceId)...)
+}
+
+func idBytes(id int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
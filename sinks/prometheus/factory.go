@@ -0,0 +1,34 @@
+package prometheus
+
+import (
+	"errors"
+
+	"github.com/stripe/veneur/sinks"
+)
+
+func init() {
+	sinks.RegisterMetricSink("prometheus_remote_write", newRemoteWriteMetricSinkFromConfig)
+}
+
+// RemoteWriteMetricSinkConfig is the configuration of a
+// prometheus_remote_write entry in metric_sinks.
+type RemoteWriteMetricSinkConfig struct {
+	Address         string `yaml:"address"`
+	FlushMaxPerBody int    `yaml:"flush_max_per_body"`
+}
+
+func newRemoteWriteMetricSinkFromConfig(name string, config sinks.SinkConfig, deps sinks.Dependencies) (sinks.MetricSink, error) {
+	conf := RemoteWriteMetricSinkConfig{FlushMaxPerBody: 5000}
+	if err := config.Decode(&conf); err != nil {
+		return nil, err
+	}
+	if conf.Address == "" {
+		return nil, errors.New("address is required")
+	}
+	sink, err := NewRemoteWriteMetricSink(conf.Address, conf.FlushMaxPerBody, deps.Tags, deps.HTTPClient, deps.Log)
+	if err != nil {
+		return nil, err
+	}
+	sink.name = name
+	return sink, nil
+}
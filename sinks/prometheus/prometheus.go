@@ -0,0 +1,408 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// MetricsPath is the HTTP path under which the sink serves the
+// exposition format.
+const MetricsPath = "/metrics"
+
+// seriesKey identifies a single time series in a metric family.
+type seriesKey struct {
+	family string
+	labels string
+}
+
+// counterSeries is a counter that accumulates over the lifetime of
+// the sink, as prometheus expects of its counters.
+type counterSeries struct {
+	labels []*dto.LabelPair
+	value  float64
+	// updated is the number of the flush that last updated the
+	// series.
+	updated uint64
+}
+
+// summarySeries holds the pieces of a histogram or timer: the
+// quantiles reflect the latest flush, whereas count and sum are
+// cumulative.
+type summarySeries struct {
+	labels    []*dto.LabelPair
+	count     float64
+	sum       float64
+	quantiles map[float64]float64
+	updated   uint64
+}
+
+// PrometheusMetricSink is a MetricSink that holds on to the metrics
+// of the most recent flush and serves them in the prometheus text
+// exposition format.
+type PrometheusMetricSink struct {
+	address      string
+	commonTags   []string
+	log          *logrus.Logger
+	traceClient  *trace.Client
+	excludedTags map[string]struct{}
+	// expireAfter is the number of flushes after which series that
+	// haven't been updated are no longer exposed.
+	expireAfter uint64
+
+	mtx       sync.RWMutex
+	flushes   uint64
+	counters  map[seriesKey]*counterSeries
+	summaries map[seriesKey]*summarySeries
+	families  []*dto.MetricFamily
+}
+
+var _ sinks.MetricSink = &PrometheusMetricSink{}
+
+// NewPrometheusMetricSink creates a new sink that exposes metrics for
+// scraping. If address is non-empty, the sink listens on that address
+// on its own; otherwise it is expected to be mounted on veneur's HTTP
+// server. Counters and summaries that none of the last expireAfter
+// flushes updated are dropped; if expireAfter is zero, they are kept
+// forever.
+func NewPrometheusMetricSink(address string, expireAfter int, commonTags []string, log *logrus.Logger) (*PrometheusMetricSink, error) {
+	if expireAfter < 0 {
+		return nil, fmt.Errorf("the number of flushes after which series expire must not be negative, got %d", expireAfter)
+	}
+	return &PrometheusMetricSink{
+		address:     address,
+		commonTags:  commonTags,
+		log:         log,
+		expireAfter: uint64(expireAfter),
+		counters:    map[seriesKey]*counterSeries{},
+		summaries:   map[seriesKey]*summarySeries{},
+	}, nil
+}
+
+// Name returns the name of this sink.
+func (p *PrometheusMetricSink) Name() string {
+	return "prometheus"
+}
+
+// Start sets the sink up, and starts listening for scrapes on the
+// configured address, if any.
+func (p *PrometheusMetricSink) Start(cl *trace.Client) error {
+	p.traceClient = cl
+	if p.address == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", p.address)
+	if err != nil {
+		return fmt.Errorf("could not listen for prometheus scrapes on %q: %v", p.address, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, p)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			p.log.WithError(err).Error("Prometheus scrape listener shut down")
+		}
+	}()
+	p.log.WithField("address", ln.Addr()).Info("Serving prometheus scrapes")
+	return nil
+}
+
+// HandlerPath returns the path under which veneur's own HTTP server
+// should serve this sink's metrics. If the sink listens on its own
+// address, it returns the empty string.
+func (p *PrometheusMetricSink) HandlerPath() string {
+	if p.address != "" {
+		return ""
+	}
+	return MetricsPath
+}
+
+// ServeHTTP renders the metric families of the latest flush in the
+// format negotiated with the scraper.
+func (p *PrometheusMetricSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	format := expfmt.Negotiate(r.Header)
+	w.Header().Set("Content-Type", string(format))
+	enc := expfmt.NewEncoder(w, format)
+
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	for _, fam := range p.families {
+		if err := enc.Encode(fam); err != nil {
+			p.log.WithError(err).Warn("Could not encode prometheus metric family")
+			return
+		}
+	}
+}
+
+// SetExcludedTags sets the excluded tag names. Any tags with the
+// provided key (name) will be excluded.
+func (p *PrometheusMetricSink) SetExcludedTags(excludes []string) {
+	tagsSet := map[string]struct{}{}
+	for _, tag := range excludes {
+		tagsSet[tag] = struct{}{}
+	}
+	p.excludedTags = tagsSet
+}
+
+// Flush replaces the set of exposed metrics with the ones passed in,
+// accumulating counters into their running totals.
+func (p *PrometheusMetricSink) Flush(ctx context.Context, interMetrics []samplers.InterMetric) error {
+	span, _ := trace.StartSpanFromContext(ctx, "")
+	defer span.ClientFinish(p.traceClient)
+
+	flushStart := time.Now()
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.flushes++
+	for _, s := range p.summaries {
+		s.quantiles = map[float64]float64{}
+	}
+	gauges := map[seriesKey]*counterSeries{}
+	types := map[string]dto.MetricType{}
+	for key := range p.counters {
+		types[key.family] = dto.MetricType_COUNTER
+	}
+	for key := range p.summaries {
+		types[key.family] = dto.MetricType_SUMMARY
+	}
+
+	countSkipped := 0
+	countFlushed := 0
+	for _, m := range interMetrics {
+		if !sinks.IsAcceptableMetric(m, p) {
+			countSkipped++
+			continue
+		}
+		labels, labelKey := p.labels(m.Tags)
+
+		family, kind, quantile := sinks.SummaryPart(m)
+		var typ dto.MetricType
+		switch {
+		case kind != "":
+			family = SanitizeMetricName(family)
+			typ = dto.MetricType_SUMMARY
+		case m.Type == samplers.CounterMetric:
+			family = SanitizeMetricName(m.Name) + "_total"
+			typ = dto.MetricType_COUNTER
+		default:
+			family = SanitizeMetricName(m.Name)
+			typ = dto.MetricType_GAUGE
+		}
+		if existing, ok := types[family]; ok && existing != typ {
+			// prometheus can't represent a family with
+			// mixed types, so the first type seen wins:
+			countSkipped++
+			continue
+		}
+		types[family] = typ
+		key := seriesKey{family: family, labels: labelKey}
+
+		switch typ {
+		case dto.MetricType_COUNTER:
+			c, ok := p.counters[key]
+			if !ok {
+				c = &counterSeries{labels: labels}
+				p.counters[key] = c
+			}
+			c.value += m.Value
+			c.updated = p.flushes
+		case dto.MetricType_GAUGE:
+			gauges[key] = &counterSeries{labels: labels, value: m.Value}
+		case dto.MetricType_SUMMARY:
+			s, ok := p.summaries[key]
+			if !ok {
+				s = &summarySeries{labels: labels, quantiles: map[float64]float64{}}
+				p.summaries[key] = s
+			}
+			s.updated = p.flushes
+			switch kind {
+			case sinks.SummaryCount:
+				s.count += m.Value
+			case sinks.SummarySum:
+				s.sum += m.Value
+			default:
+				s.quantiles[quantile] = m.Value
+			}
+		}
+		countFlushed++
+	}
+	p.expire()
+	p.families = p.render(gauges)
+
+	tags := map[string]string{"sink": p.Name()}
+	span.Add(
+		ssf.Timing(sinks.MetricKeyMetricFlushDuration, time.Since(flushStart), time.Nanosecond, tags),
+		ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(countFlushed), tags),
+		ssf.Count(sinks.MetricKeyTotalMetricsSkipped, float32(countSkipped), tags),
+	)
+	p.log.WithField("metrics", countFlushed).Debug("Completed flush to prometheus exposition")
+	return nil
+}
+
+// FlushOtherSamples is a no-op: prometheus has no notion of events
+// or service checks.
+func (p *PrometheusMetricSink) FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample) {}
+
+// expire forgets the counters and summaries that haven't been updated
+// in the last expireAfter flushes.
+func (p *PrometheusMetricSink) expire() {
+	if p.expireAfter == 0 {
+		return
+	}
+	for key, c := range p.counters {
+		if p.flushes-c.updated >= p.expireAfter {
+			delete(p.counters, key)
+		}
+	}
+	for key, s := range p.summaries {
+		if p.flushes-s.updated >= p.expireAfter {
+			delete(p.summaries, key)
+		}
+	}
+}
+
+// render converts the current state of the sink into metric families,
+// sorted by name so that scrapes are deterministic.
+func (p *PrometheusMetricSink) render(gauges map[seriesKey]*counterSeries) []*dto.MetricFamily {
+	byName := map[string]*dto.MetricFamily{}
+	family := func(name string, typ dto.MetricType) *dto.MetricFamily {
+		fam, ok := byName[name]
+		if !ok {
+			fam = &dto.MetricFamily{Name: proto.String(name), Type: typ.Enum()}
+			byName[name] = fam
+		}
+		return fam
+	}
+
+	for key, c := range p.counters {
+		fam := family(key.family, dto.MetricType_COUNTER)
+		fam.Metric = append(fam.Metric, &dto.Metric{
+			Label:   c.labels,
+			Counter: &dto.Counter{Value: proto.Float64(c.value)},
+		})
+	}
+	for key, g := range gauges {
+		fam := family(key.family, dto.MetricType_GAUGE)
+		fam.Metric = append(fam.Metric, &dto.Metric{
+			Label: g.labels,
+			Gauge: &dto.Gauge{Value: proto.Float64(g.value)},
+		})
+	}
+	for key, s := range p.summaries {
+		quantiles := make([]*dto.Quantile, 0, len(s.quantiles))
+		for q, v := range s.quantiles {
+			quantiles = append(quantiles, &dto.Quantile{Quantile: proto.Float64(q), Value: proto.Float64(v)})
+		}
+		sort.Slice(quantiles, func(i, j int) bool {
+			return quantiles[i].GetQuantile() < quantiles[j].GetQuantile()
+		})
+		fam := family(key.family, dto.MetricType_SUMMARY)
+		fam.Metric = append(fam.Metric, &dto.Metric{
+			Label: s.labels,
+			Summary: &dto.Summary{
+				SampleCount: proto.Uint64(uint64(s.count)),
+				SampleSum:   proto.Float64(s.sum),
+				Quantile:    quantiles,
+			},
+		})
+	}
+
+	families := make([]*dto.MetricFamily, 0, len(byName))
+	for _, fam := range byName {
+		sort.Slice(fam.Metric, func(i, j int) bool {
+			return labelString(fam.Metric[i].Label) < labelString(fam.Metric[j].Label)
+		})
+		families = append(families, fam)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].GetName() < families[j].GetName()
+	})
+	return families
+}
+
+// labels converts veneur tags (and the sink's common tags) into a
+// sorted list of prometheus label pairs and a string uniquely
+// identifying that label set.
+func (p *PrometheusMetricSink) labels(tags []string) ([]*dto.LabelPair, string) {
+	values := tagLabels(p.commonTags, tags, p.excludedTags)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	labels := make([]*dto.LabelPair, 0, len(names))
+	for _, name := range names {
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(values[name])})
+	}
+	return labels, labelString(labels)
+}
+
+// tagLabels maps veneur tags to prometheus label values, keyed by
+// the sanitized label name. Tags in tags take precedence over
+// commonTags; excluded tags and veneursinkonly are dropped.
+func tagLabels(commonTags, tags []string, excluded map[string]struct{}) map[string]string {
+	values := map[string]string{}
+	add := func(key, value string) {
+		values[SanitizeLabelName(key)] = value
+	}
+	sinks.EachTag(commonTags, excluded, add)
+	sinks.EachTag(tags, excluded, add)
+	return values
+}
+
+func labelString(labels []*dto.LabelPair) string {
+	parts := make([]string, 0, len(labels))
+	for _, l := range labels {
+		parts = append(parts, l.GetName()+"="+strconv.Quote(l.GetValue()))
+	}
+	return strings.Join(parts, ",")
+}
+
+// SanitizeMetricName converts a veneur metric name into one that is
+// valid for prometheus, replacing any disallowed characters (like
+// veneur's customary dots) with underscores.
+func SanitizeMetricName(name string) string {
+	return sanitize(name, true)
+}
+
+// SanitizeLabelName converts a veneur tag key into a valid prometheus
+// label name.
+func SanitizeLabelName(name string) string {
+	return sanitize(name, false)
+}
+
+func sanitize(name string, allowColon bool) string {
+	if name == "" {
+		return "_"
+	}
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		case c >= '0' && c <= '9':
+		case c == ':' && allowColon:
+		default:
+			b[i] = '_'
+		}
+	}
+	if name[0] >= '0' && name[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
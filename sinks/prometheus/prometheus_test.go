@@ -0,0 +1,152 @@
+package prometheus
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+)
+
+func scrape(t *testing.T, sink *PrometheusMetricSink) string {
+	srv := httptest.NewServer(sink)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + MetricsPath)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestPrometheusFlushTypes(t *testing.T) {
+	sink, err := NewPrometheusMetricSink("", 0, []string{"env:test"}, logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+
+	metrics := []samplers.InterMetric{
+		{Name: "a.counter", Value: 2, Tags: []string{"foo:bar"}, Type: samplers.CounterMetric},
+		{Name: "a.gauge", Value: 10, Tags: []string{"foo:bar"}, Type: samplers.GaugeMetric},
+		{Name: "a.timer.50percentile", Value: 5, Type: samplers.GaugeMetric, Histogram: &samplers.HistogramPart{Percentile: 0.5}},
+		{Name: "a.timer.99percentile", Value: 9, Type: samplers.GaugeMetric, Histogram: &samplers.HistogramPart{Percentile: 0.99}},
+		{Name: "a.timer.max", Value: 10, Type: samplers.GaugeMetric, Histogram: &samplers.HistogramPart{Aggregate: samplers.AggregateMax}},
+		{Name: "a.timer.count", Value: 4, Type: samplers.CounterMetric, Histogram: &samplers.HistogramPart{Aggregate: samplers.AggregateCount}},
+		{Name: "a.timer.sum", Value: 20, Type: samplers.GaugeMetric, Histogram: &samplers.HistogramPart{Aggregate: samplers.AggregateSum}},
+	}
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+
+	body := scrape(t, sink)
+	assert.Contains(t, body, "# TYPE a_counter_total counter\n")
+	assert.Contains(t, body, `a_counter_total{env="test",foo="bar"} 4`)
+	assert.Contains(t, body, "# TYPE a_gauge gauge\n")
+	assert.Contains(t, body, `a_gauge{env="test",foo="bar"} 10`)
+	assert.Contains(t, body, "# TYPE a_timer summary\n")
+	assert.Contains(t, body, `a_timer{env="test",quantile="0.5"} 5`)
+	assert.Contains(t, body, `a_timer{env="test",quantile="0.99"} 9`)
+	assert.Contains(t, body, `a_timer{env="test",quantile="1"} 10`)
+	assert.Contains(t, body, `a_timer_sum{env="test"} 40`)
+	assert.Contains(t, body, `a_timer_count{env="test"} 8`)
+}
+
+func TestPrometheusPlainMetricsWithSummaryNames(t *testing.T) {
+	sink, err := NewPrometheusMetricSink("", 0, nil, logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+
+	require.NoError(t, sink.Flush(context.Background(), []samplers.InterMetric{
+		{Name: "http.requests.count", Value: 3, Type: samplers.CounterMetric},
+		{Name: "queue.max", Value: 7, Type: samplers.GaugeMetric},
+	}))
+
+	body := scrape(t, sink)
+	assert.Contains(t, body, "# TYPE http_requests_count_total counter\n")
+	assert.Contains(t, body, "http_requests_count_total 3")
+	assert.Contains(t, body, "# TYPE queue_max gauge\n")
+	assert.Contains(t, body, "queue_max 7")
+	assert.NotContains(t, body, "summary")
+}
+
+func TestPrometheusExpireSeries(t *testing.T) {
+	sink, err := NewPrometheusMetricSink("", 2, nil, logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+
+	require.NoError(t, sink.Flush(context.Background(), []samplers.InterMetric{
+		{Name: "old.counter", Value: 1, Type: samplers.CounterMetric},
+		{Name: "a.timer.count", Value: 1, Type: samplers.CounterMetric, Histogram: &samplers.HistogramPart{Aggregate: samplers.AggregateCount}},
+	}))
+	live := []samplers.InterMetric{{Name: "live.counter", Value: 1, Type: samplers.CounterMetric}}
+	require.NoError(t, sink.Flush(context.Background(), live))
+
+	body := scrape(t, sink)
+	assert.Contains(t, body, "old_counter_total 1")
+	assert.Contains(t, body, "a_timer_count 1")
+
+	require.NoError(t, sink.Flush(context.Background(), live))
+	body = scrape(t, sink)
+	assert.NotContains(t, body, "old_counter")
+	assert.NotContains(t, body, "a_timer")
+	assert.Contains(t, body, "live_counter_total 2")
+}
+
+func TestPrometheusGaugesOnlyFromLatestFlush(t *testing.T) {
+	sink, err := NewPrometheusMetricSink("", 0, nil, logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+
+	require.NoError(t, sink.Flush(context.Background(), []samplers.InterMetric{
+		{Name: "old.gauge", Value: 1, Type: samplers.GaugeMetric},
+	}))
+	require.NoError(t, sink.Flush(context.Background(), []samplers.InterMetric{
+		{Name: "new.gauge", Value: 1, Type: samplers.GaugeMetric},
+	}))
+
+	body := scrape(t, sink)
+	assert.NotContains(t, body, "old_gauge")
+	assert.Contains(t, body, "new_gauge 1")
+}
+
+func TestPrometheusFlushRouting(t *testing.T) {
+	sink, err := NewPrometheusMetricSink("", 0, nil, logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+	sink.SetExcludedTags([]string{"nonce"})
+
+	require.NoError(t, sink.Flush(context.Background(), []samplers.InterMetric{
+		{Name: "any", Value: 1, Tags: []string{"nonce:abc"}, Type: samplers.GaugeMetric},
+		{
+			Name:  "prom",
+			Value: 1,
+			Tags:  []string{"veneursinkonly:prometheus"},
+			Type:  samplers.GaugeMetric,
+			Sinks: samplers.RouteInformation{"prometheus": struct{}{}},
+		},
+		{
+			Name:  "not.us",
+			Value: 1,
+			Tags:  []string{"veneursinkonly:datadog"},
+			Type:  samplers.GaugeMetric,
+			Sinks: samplers.RouteInformation{"datadog": struct{}{}},
+		},
+	}))
+
+	body := scrape(t, sink)
+	assert.Contains(t, body, "any 1\n")
+	assert.Contains(t, body, "prom 1\n")
+	assert.NotContains(t, body, "not_us")
+}
+
+func TestSanitizeNames(t *testing.T) {
+	assert.Equal(t, "a_b_c", SanitizeMetricName("a.b.c"))
+	assert.Equal(t, "a:b_c", SanitizeMetricName("a:b-c"))
+	assert.Equal(t, "_1xx", SanitizeMetricName("1xx"))
+	assert.Equal(t, "a_b", SanitizeLabelName("a:b"))
+	assert.Equal(t, "_", SanitizeLabelName(""))
+}
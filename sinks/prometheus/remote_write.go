@@ -0,0 +1,317 @@
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+const (
+	// remoteWriteMaxRetries is the number of times a batch is
+	// re-sent after a retryable failure.
+	remoteWriteMaxRetries = 3
+
+	// remoteWriteInitialBackoff is the delay before the first
+	// retry; it doubles with each subsequent attempt.
+	remoteWriteInitialBackoff = 250 * time.Millisecond
+)
+
+// RemoteWriteMetricSink is a MetricSink that pushes metrics to an
+// endpoint that speaks prometheus' remote_write protocol, such as
+// Cortex, Thanos receive or Mimir.
+type RemoteWriteMetricSink struct {
+	name            string
+	url             string
+	flushMaxPerBody int
+	commonTags      []string
+	excludedTags    map[string]struct{}
+	httpClient      *http.Client
+	log             *logrus.Logger
+	traceClient     *trace.Client
+	backoff         time.Duration
+
+	mtx      sync.Mutex
+	counters map[seriesKey]float64
+}
+
+var _ sinks.MetricSink = &RemoteWriteMetricSink{}
+
+// NewRemoteWriteMetricSink creates a new sink that sends each flush
+// to the remote_write URL given, in batches of at most
+// flushMaxPerBody time series.
+func NewRemoteWriteMetricSink(url string, flushMaxPerBody int, commonTags []string, httpClient *http.Client, log *logrus.Logger) (*RemoteWriteMetricSink, error) {
+	if flushMaxPerBody <= 0 {
+		return nil, fmt.Errorf("prometheus remote_write batch size must be positive, not %d", flushMaxPerBody)
+	}
+	return &RemoteWriteMetricSink{
+		url:             url,
+		flushMaxPerBody: flushMaxPerBody,
+		commonTags:      commonTags,
+		httpClient:      httpClient,
+		log:             log,
+		backoff:         remoteWriteInitialBackoff,
+		counters:        map[seriesKey]float64{},
+	}, nil
+}
+
+// Name returns the name of this sink.
+func (rw *RemoteWriteMetricSink) Name() string {
+	if rw.name == "" {
+		return "prometheus_remote_write"
+	}
+	return rw.name
+}
+
+// Start sets the sink up.
+func (rw *RemoteWriteMetricSink) Start(cl *trace.Client) error {
+	rw.traceClient = cl
+	return nil
+}
+
+// SetExcludedTags sets the excluded tag names. Any tags with the
+// provided key (name) will be excluded.
+func (rw *RemoteWriteMetricSink) SetExcludedTags(excludes []string) {
+	tagsSet := map[string]struct{}{}
+	for _, tag := range excludes {
+		tagsSet[tag] = struct{}{}
+	}
+	rw.excludedTags = tagsSet
+}
+
+// Flush converts the metrics into time series and sends them to the
+// remote_write endpoint, in parallel batches. If any batch fails, it
+// returns a *sinks.FlushError with the metrics in the batches that
+// failed, and the running totals of their counters aren't advanced, so
+// that flushing them again sends the same values. Batches that the
+// endpoint rejects as invalid fail permanently, and aren't in the
+// error's metrics.
+func (rw *RemoteWriteMetricSink) Flush(ctx context.Context, interMetrics []samplers.InterMetric) error {
+	span, _ := trace.StartSpanFromContext(ctx, "")
+	defer span.ClientFinish(rw.traceClient)
+
+	series, items, deltas, countSkipped := rw.finalizeMetrics(interMetrics)
+	if len(series) == 0 {
+		return nil
+	}
+
+	flushStart := time.Now()
+	countDropped, err := sinks.FlushBatches(len(series), rw.flushMaxPerBody, func(start, end int) error {
+		err := rw.flushPart(span.Attach(ctx), series[start:end])
+		if err != nil {
+			rw.log.WithError(err).WithField("series", end-start).
+				Warn("Error flushing to prometheus remote_write")
+		}
+		return err
+	})
+
+	tags := map[string]string{"sink": rw.Name()}
+	span.Add(
+		ssf.Timing(sinks.MetricKeyMetricFlushDuration, time.Since(flushStart), time.Nanosecond, tags),
+		ssf.Count(sinks.MetricKeyTotalMetricsFlushed, float32(len(series)-countDropped), tags),
+		ssf.Count(sinks.MetricKeyTotalMetricsSkipped, float32(countSkipped), tags),
+	)
+	batchErr, _ := err.(*sinks.BatchError)
+	rw.mtx.Lock()
+	for i, d := range deltas {
+		if batchErr == nil || !batchErr.Retryable(i) {
+			rw.counters[d.key] += d.delta
+		}
+	}
+	rw.mtx.Unlock()
+	if err != nil {
+		span.Add(ssf.Count(sinks.MetricKeyTotalMetricsDropped, float32(countDropped), tags))
+		return sinks.NewFlushError(err, interMetrics, items)
+	}
+	rw.log.WithField("series", len(series)).Info("Completed flush to prometheus remote_write")
+	return nil
+}
+
+// FlushOtherSamples is a no-op: prometheus has no notion of events
+// or service checks.
+func (rw *RemoteWriteMetricSink) FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample) {}
+
+// finalizeMetrics converts InterMetrics into remote_write time
+// series, following the same conventions as the scrape sink:
+// counters (including the counts of histograms) become cumulative
+// "_total" series, and histogram quantiles get a "quantile" label.
+// items[i] is the index of the series that interMetrics[i] became, or
+// -1 if it was skipped. It also returns how much each cumulative series
+// grew, by the series' index, for Flush to add to the running totals
+// once the series are sent.
+func (rw *RemoteWriteMetricSink) finalizeMetrics(interMetrics []samplers.InterMetric) ([]*TimeSeries, []int, map[int]seriesDelta, int) {
+	rw.mtx.Lock()
+	defer rw.mtx.Unlock()
+
+	series := make([]*TimeSeries, 0, len(interMetrics))
+	items := make([]int, len(interMetrics))
+	deltas := map[int]seriesDelta{}
+	pending := map[seriesKey]float64{}
+	countSkipped := 0
+	for i, m := range interMetrics {
+		items[i] = -1
+		if !sinks.IsAcceptableMetric(m, rw) {
+			countSkipped++
+			continue
+		}
+		values := tagLabels(rw.commonTags, m.Tags, rw.excludedTags)
+
+		name := SanitizeMetricName(m.Name)
+		cumulative := false
+		family, kind, quantile := sinks.SummaryPart(m)
+		switch {
+		case kind == sinks.SummaryQuantile:
+			name = SanitizeMetricName(family)
+			values["quantile"] = strconv.FormatFloat(quantile, 'g', -1, 64)
+		case kind != "":
+			name = SanitizeMetricName(family) + "_" + kind
+			cumulative = true
+		case m.Type == samplers.CounterMetric:
+			name += "_total"
+			cumulative = true
+		}
+		values["__name__"] = name
+
+		labels := make([]*Label, 0, len(values))
+		for k, v := range values {
+			labels = append(labels, &Label{Name: k, Value: v})
+		}
+		sort.Slice(labels, func(i, j int) bool {
+			return labels[i].Name < labels[j].Name
+		})
+
+		value := m.Value
+		if cumulative {
+			key := seriesKey{family: name, labels: remoteLabelString(labels)}
+			pending[key] += m.Value
+			value = rw.counters[key] + pending[key]
+			deltas[len(series)] = seriesDelta{key: key, delta: m.Value}
+		}
+		items[i] = len(series)
+		series = append(series, &TimeSeries{
+			Labels:  labels,
+			Samples: []*Sample{{Value: value, Timestamp: m.Timestamp * 1000}},
+		})
+	}
+	return series, items, deltas, countSkipped
+}
+
+// seriesDelta is how much a cumulative series grew in a flush.
+type seriesDelta struct {
+	key   seriesKey
+	delta float64
+}
+
+// flushPart sends a single batch of time series, retrying with
+// exponential backoff when the endpoint is unavailable or asks us to
+// slow down. If the endpoint says how long to wait with a Retry-After
+// header, that's how long it waits instead.
+func (rw *RemoteWriteMetricSink) flushPart(ctx context.Context, series []*TimeSeries) error {
+	span, ctx := trace.StartSpanFromContext(ctx, "")
+	defer span.ClientFinish(rw.traceClient)
+
+	raw, err := proto.Marshal(&WriteRequest{Timeseries: series})
+	if err != nil {
+		span.Error(err)
+		return sinks.Permanent(err)
+	}
+	body := snappy.Encode(nil, raw)
+
+	backoff := rw.backoff
+	for attempt := 0; ; attempt++ {
+		retry, wait, err := rw.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retry {
+			span.Error(err)
+			return sinks.Permanent(err)
+		}
+		if attempt >= remoteWriteMaxRetries {
+			span.Error(err)
+			return err
+		}
+		if wait <= 0 {
+			wait = backoff
+		}
+		rw.log.WithError(err).WithField("attempt", attempt+1).
+			Debug("Retrying prometheus remote_write")
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			span.Error(ctx.Err())
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// post sends one remote_write request. It returns whether a failed
+// request should be retried, and how long the endpoint asked to wait
+// before that, if it did.
+func (rw *RemoteWriteMetricSink) post(ctx context.Context, body []byte) (bool, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodPost, rw.url, bytes.NewReader(body))
+	if err != nil {
+		return false, 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := rw.httpClient.Do(req)
+	if err != nil {
+		// network errors are usually transient:
+		return true, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, 0, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("remote_write endpoint returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	retry := resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, retryAfter(resp.Header.Get("Retry-After"), time.Now()), err
+}
+
+// retryAfter returns how long a Retry-After header value, in seconds or
+// as an HTTP date, asks to wait from now. It returns 0 if the value is
+// empty or invalid.
+func retryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+func remoteLabelString(labels []*Label) string {
+	var buf bytes.Buffer
+	for _, l := range labels {
+		fmt.Fprintf(&buf, "%s=%q,", l.Name, l.Value)
+	}
+	return buf.String()
+}
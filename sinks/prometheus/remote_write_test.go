@@ -0,0 +1,280 @@
+package prometheus
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+)
+
+type remoteWriteReceiver struct {
+	mtx      sync.Mutex
+	requests []*WriteRequest
+}
+
+func (rr *remoteWriteReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Encoding") != "snappy" {
+		http.Error(w, "not snappy", http.StatusBadRequest)
+		return
+	}
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	raw, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &WriteRequest{}
+	if err := proto.Unmarshal(raw, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rr.mtx.Lock()
+	rr.requests = append(rr.requests, req)
+	rr.mtx.Unlock()
+}
+
+func (rr *remoteWriteReceiver) series() map[string]*TimeSeries {
+	rr.mtx.Lock()
+	defer rr.mtx.Unlock()
+	series := map[string]*TimeSeries{}
+	for _, req := range rr.requests {
+		for _, ts := range req.Timeseries {
+			series[remoteLabelString(ts.Labels)] = ts
+		}
+	}
+	return series
+}
+
+func TestRemoteWriteFlush(t *testing.T) {
+	rcv := &remoteWriteReceiver{}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	sink, err := NewRemoteWriteMetricSink(srv.URL, 100, []string{"env:test"}, srv.Client(), logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+
+	metrics := []samplers.InterMetric{
+		{Name: "a.b.counter", Timestamp: 1476119058, Value: 2, Tags: []string{"foo:bar", "baz.quz:1"}, Type: samplers.CounterMetric},
+		{Name: "a.b.gauge", Timestamp: 1476119058, Value: 5, Type: samplers.GaugeMetric},
+		{Name: "a.b.timer.99percentile", Timestamp: 1476119058, Value: 30, Type: samplers.GaugeMetric, Histogram: &samplers.HistogramPart{Percentile: 0.99}},
+	}
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+	require.NoError(t, sink.Flush(context.Background(), metrics[:1]))
+
+	rcv.mtx.Lock()
+	assert.Len(t, rcv.requests, 2)
+	rcv.mtx.Unlock()
+
+	series := rcv.series()
+	counter, ok := series[`__name__="a_b_counter_total",baz_quz="1",env="test",foo="bar",`]
+	require.True(t, ok, "series: %v", series)
+	require.Len(t, counter.Samples, 1)
+	assert.Equal(t, float64(4), counter.Samples[0].Value, "counters should be cumulative")
+	assert.Equal(t, int64(1476119058000), counter.Samples[0].Timestamp)
+
+	gauge, ok := series[`__name__="a_b_gauge",env="test",`]
+	require.True(t, ok, "series: %v", series)
+	assert.Equal(t, float64(5), gauge.Samples[0].Value)
+
+	quantile, ok := series[`__name__="a_b_timer",env="test",quantile="0.99",`]
+	require.True(t, ok, "series: %v", series)
+	assert.Equal(t, float64(30), quantile.Samples[0].Value)
+}
+
+func TestRemoteWriteBatches(t *testing.T) {
+	rcv := &remoteWriteReceiver{}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	sink, err := NewRemoteWriteMetricSink(srv.URL, 2, nil, srv.Client(), logrus.New())
+	require.NoError(t, err)
+
+	metrics := []samplers.InterMetric{
+		{Name: "a", Value: 1, Type: samplers.GaugeMetric},
+		{Name: "b", Value: 1, Type: samplers.GaugeMetric},
+		{Name: "c", Value: 1, Type: samplers.GaugeMetric},
+		{Name: "d", Value: 1, Type: samplers.GaugeMetric},
+		{Name: "e", Value: 1, Type: samplers.GaugeMetric},
+	}
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+
+	rcv.mtx.Lock()
+	defer rcv.mtx.Unlock()
+	require.Len(t, rcv.requests, 3)
+	for _, req := range rcv.requests {
+		assert.True(t, len(req.Timeseries) <= 2)
+	}
+}
+
+func TestRemoteWriteFailedFlushReturnsError(t *testing.T) {
+	rcv := &remoteWriteReceiver{}
+	var fail int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rcv.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	sink, err := NewRemoteWriteMetricSink(srv.URL, 100, nil, srv.Client(), logrus.New())
+	require.NoError(t, err)
+	sink.backoff = time.Millisecond
+
+	metrics := []samplers.InterMetric{{Name: "a", Value: 2, Type: samplers.CounterMetric}}
+	err = sink.Flush(context.Background(), metrics)
+	assert.Error(t, err)
+	assert.False(t, sinks.IsPermanent(err), "an unavailable endpoint may come back")
+
+	// flushing the same metrics again, e.g. from the spool, must not
+	// count them twice:
+	atomic.StoreInt32(&fail, 0)
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+
+	rcv.mtx.Lock()
+	defer rcv.mtx.Unlock()
+	require.Len(t, rcv.requests, 1)
+	require.Len(t, rcv.requests[0].Timeseries, 1)
+	assert.Equal(t, float64(2), rcv.requests[0].Timeseries[0].Samples[0].Value)
+}
+
+func TestRemoteWritePartialFlush(t *testing.T) {
+	rcv := &remoteWriteReceiver{}
+	var fail int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, _ := ioutil.ReadAll(r.Body)
+		raw, _ := snappy.Decode(nil, compressed)
+		req := &WriteRequest{}
+		require.NoError(t, proto.Unmarshal(raw, req))
+		for _, l := range req.Timeseries[0].Labels {
+			if l.Name == "__name__" && l.Value == "b_total" && atomic.LoadInt32(&fail) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		rcv.mtx.Lock()
+		rcv.requests = append(rcv.requests, req)
+		rcv.mtx.Unlock()
+	}))
+	defer srv.Close()
+
+	sink, err := NewRemoteWriteMetricSink(srv.URL, 1, nil, srv.Client(), logrus.New())
+	require.NoError(t, err)
+	sink.backoff = time.Millisecond
+
+	metrics := []samplers.InterMetric{
+		{Name: "a", Value: 2, Type: samplers.CounterMetric},
+		{Name: "b", Value: 3, Type: samplers.CounterMetric},
+	}
+	err = sink.Flush(context.Background(), metrics)
+	require.Error(t, err)
+	failed := sinks.FailedMetrics(err, metrics)
+	require.Len(t, failed, 1, "only the batch that failed is flushed again")
+	assert.Equal(t, "b", failed[0].Name)
+
+	atomic.StoreInt32(&fail, 0)
+	require.NoError(t, sink.Flush(context.Background(), failed))
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+	values := map[string][]float64{}
+	rcv.mtx.Lock()
+	defer rcv.mtx.Unlock()
+	for _, req := range rcv.requests {
+		for _, ts := range req.Timeseries {
+			for _, l := range ts.Labels {
+				if l.Name == "__name__" {
+					values[l.Value] = append(values[l.Value], ts.Samples[0].Value)
+				}
+			}
+		}
+	}
+	assert.Equal(t, map[string][]float64{
+		"a_total": {2, 4},
+		"b_total": {3, 6},
+	}, values, "the counters of the batches that succeeded advance")
+}
+
+func TestRemoteWriteRetries(t *testing.T) {
+	rcv := &remoteWriteReceiver{}
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			rcv.ServeHTTP(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	sink, err := NewRemoteWriteMetricSink(srv.URL, 100, nil, srv.Client(), logrus.New())
+	require.NoError(t, err)
+	sink.backoff = time.Millisecond
+
+	metrics := []samplers.InterMetric{{Name: "a", Value: 1, Type: samplers.GaugeMetric}}
+	require.NoError(t, sink.Flush(context.Background(), metrics))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls), "5xx and 429 responses are retried")
+	assert.Len(t, rcv.series(), 1)
+}
+
+func TestRemoteWriteBadRequestIsPermanent(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	sink, err := NewRemoteWriteMetricSink(srv.URL, 100, nil, srv.Client(), logrus.New())
+	require.NoError(t, err)
+	sink.backoff = time.Millisecond
+
+	err = sink.Flush(context.Background(), []samplers.InterMetric{{Name: "a", Value: 1, Type: samplers.GaugeMetric}})
+	require.Error(t, err)
+	assert.True(t, sinks.IsPermanent(err), "the flush can't succeed if it's retried")
+	assert.Contains(t, err.Error(), "out of order sample")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "4xx responses aren't retried")
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Duration(0), retryAfter("", now))
+	assert.Equal(t, 3*time.Second, retryAfter("3", now))
+	assert.Equal(t, 10*time.Second, retryAfter(now.Add(10*time.Second).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), retryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), retryAfter("soon", now))
+}
+
+func TestNewRemoteWriteMetricSinkFromConfig(t *testing.T) {
+	deps := sinks.Dependencies{Hostname: "host", Interval: 10 * time.Second, Log: logrus.New()}
+	sink, err := sinks.NewMetricSink("prometheus_remote_write", "cortex-eu", sinks.SinkConfig{
+		"address": "http://cortex-eu/api/v1/push",
+	}, deps)
+	require.NoError(t, err)
+	assert.Equal(t, "cortex-eu", sink.Name())
+	rwSink := sink.(*RemoteWriteMetricSink)
+	assert.Equal(t, "http://cortex-eu/api/v1/push", rwSink.url)
+	assert.Equal(t, 5000, rwSink.flushMaxPerBody)
+
+	_, err = sinks.NewMetricSink("prometheus_remote_write", "cortex-eu", sinks.SinkConfig{}, deps)
+	assert.Error(t, err, "the address is required")
+}
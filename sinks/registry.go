@@ -0,0 +1,145 @@
+package sinks
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/stripe/veneur/trace"
+)
+
+// Dependencies are the parts of a veneur server that sinks created from
+// the configuration may use.
+type Dependencies struct {
+	// Hostname is the name of the host that veneur runs on.
+	Hostname string
+	// Tags are the tags that veneur adds to everything, as
+	// "key:value" strings, and TagsAsMap are the same tags as a map.
+	Tags      []string
+	TagsAsMap map[string]string
+	// Interval is how often the sink flushes: the flush interval, or
+	// the sink's own interval from sink_intervals.
+	Interval   time.Duration
+	HTTPClient *http.Client
+	// TraceClient is the client that veneur reports its own
+	// metrics and spans to.
+	TraceClient *trace.Client
+	Log         *logrus.Logger
+}
+
+// SinkConfig is the kind-specific configuration block of a sink.
+type SinkConfig map[string]interface{}
+
+// Decode unmarshals the configuration into a kind's configuration
+// struct, using the struct's yaml tags. Keys that the struct doesn't
+// have are an error.
+func (c SinkConfig) Decode(into interface{}) error {
+	bts, err := yaml.Marshal(map[string]interface{}(c))
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(bts, into)
+}
+
+// MetricSinkFactory creates a metric sink with the given name from its
+// configuration block.
+type MetricSinkFactory func(name string, config SinkConfig, deps Dependencies) (MetricSink, error)
+
+// SpanSinkFactory creates a span sink with the given name from its
+// configuration block.
+type SpanSinkFactory func(name string, config SinkConfig, deps Dependencies) (SpanSink, error)
+
+var (
+	registryMtx         sync.RWMutex
+	metricSinkFactories = map[string]MetricSinkFactory{}
+	spanSinkFactories   = map[string]SpanSinkFactory{}
+)
+
+// RegisterMetricSink makes a kind of metric sink available to the
+// metric_sinks configuration. Sink packages call it from their init
+// functions. It panics if the kind is registered twice.
+func RegisterMetricSink(kind string, factory MetricSinkFactory) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	if _, dup := metricSinkFactories[kind]; dup {
+		panic("sinks: RegisterMetricSink called twice for kind " + kind)
+	}
+	metricSinkFactories[kind] = factory
+}
+
+// RegisterSpanSink makes a kind of span sink available to the
+// span_sinks configuration. Sink packages call it from their init
+// functions. It panics if the kind is registered twice.
+func RegisterSpanSink(kind string, factory SpanSinkFactory) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	if _, dup := spanSinkFactories[kind]; dup {
+		panic("sinks: RegisterSpanSink called twice for kind " + kind)
+	}
+	spanSinkFactories[kind] = factory
+}
+
+// NewMetricSink creates a metric sink of a registered kind.
+func NewMetricSink(kind, name string, config SinkConfig, deps Dependencies) (MetricSink, error) {
+	registryMtx.RLock()
+	factory, ok := metricSinkFactories[kind]
+	registryMtx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown metric sink kind %q, must be one of %v", kind, MetricSinkKinds())
+	}
+	if name == "" {
+		return nil, fmt.Errorf("metric sink of kind %q needs a name", kind)
+	}
+	sink, err := factory(name, config, deps)
+	if err != nil {
+		return nil, fmt.Errorf("metric sink %q: %v", name, err)
+	}
+	return sink, nil
+}
+
+// NewSpanSink creates a span sink of a registered kind.
+func NewSpanSink(kind, name string, config SinkConfig, deps Dependencies) (SpanSink, error) {
+	registryMtx.RLock()
+	factory, ok := spanSinkFactories[kind]
+	registryMtx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown span sink kind %q, must be one of %v", kind, SpanSinkKinds())
+	}
+	if name == "" {
+		return nil, fmt.Errorf("span sink of kind %q needs a name", kind)
+	}
+	sink, err := factory(name, config, deps)
+	if err != nil {
+		return nil, fmt.Errorf("span sink %q: %v", name, err)
+	}
+	return sink, nil
+}
+
+// MetricSinkKinds returns the registered kinds of metric sinks, sorted.
+func MetricSinkKinds() []string {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	kinds := make([]string, 0, len(metricSinkFactories))
+	for kind := range metricSinkFactories {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// SpanSinkKinds returns the registered kinds of span sinks, sorted.
+func SpanSinkKinds() []string {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	kinds := make([]string, 0, len(spanSinkFactories))
+	for kind := range spanSinkFactories {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
@@ -0,0 +1,438 @@
+// Package retry wraps metric and span sinks with retries and a circuit
+// breaker, so that sinks don't each have to handle a failing backend.
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
+)
+
+// MetricKeyBreakerState is the state of a sink's circuit breaker, as a
+// gauge: 0 if it's closed, 1 if it's half-open and 2 if it's open.
+// Tagged with `sink:sink.Name()`.
+const MetricKeyBreakerState = "sink.breaker_state"
+
+// MetricKeyRetries counts the attempts that are retries of a failed
+// flush or ingest. Tagged with `sink:sink.Name()`.
+const MetricKeyRetries = "sink.retries_total"
+
+// MetricKeyBreakerRejected counts the flushes and ingests that were
+// rejected because the sink's circuit breaker is open. Tagged with
+// `sink:sink.Name()`.
+const MetricKeyBreakerRejected = "sink.breaker_rejected_total"
+
+// ErrBreakerOpen is returned instead of calling a sink whose circuit
+// breaker is open.
+var ErrBreakerOpen = errors.New("circuit breaker is open")
+
+// Policy configures how a sink's calls are retried, and when its
+// circuit breaker opens.
+type Policy struct {
+	// MaxAttempts is how often a call is attempted at most,
+	// including the first attempt.
+	MaxAttempts int
+	// InitialBackoff is how long to wait before the first retry. The
+	// wait doubles with every retry, up to MaxBackoff, and is
+	// randomly shortened by up to half.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// AttemptTimeout limits each attempt to flush metrics, if set.
+	AttemptTimeout time.Duration
+
+	// BreakerThreshold is the number of consecutive failed attempts
+	// that open the circuit breaker. With a threshold of 0, there is
+	// no breaker.
+	BreakerThreshold int
+	// BreakerCooldown is how long the breaker stays open before it
+	// lets one attempt through to check if the backend recovered.
+	BreakerCooldown time.Duration
+
+	// IsRetryable returns false for errors that retrying can't fix.
+	// They're returned right away, and don't count against the
+	// breaker. Defaults to Retryable.
+	IsRetryable func(error) bool
+}
+
+// Retryable returns false for invalid spans and permanent errors (see
+// sinks.IsPermanent), and true for any other error.
+func Retryable(err error) bool {
+	if _, invalid := err.(*protocol.InvalidTrace); invalid {
+		return false
+	}
+	return !sinks.IsPermanent(err)
+}
+
+// retryable returns true if err is worth retrying.
+func (p Policy) retryable(err error) bool {
+	if p.IsRetryable != nil {
+		return p.IsRetryable(err)
+	}
+	return Retryable(err)
+}
+
+// Enabled returns true if the policy retries calls or has a circuit
+// breaker.
+func (p Policy) Enabled() bool {
+	return p.MaxAttempts > 1 || p.BreakerThreshold > 0
+}
+
+// backoff returns how long to wait before retry number n, counting
+// from 0.
+func (p Policy) backoff(n int) time.Duration {
+	d := p.InitialBackoff
+	for i := 0; i < n && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all calls through.
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen lets one call through, to check if the backend
+	// recovered.
+	BreakerHalfOpen
+	// BreakerOpen rejects all calls.
+	BreakerOpen
+)
+
+// breaker is a circuit breaker. The zero value has no threshold, and
+// never opens.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mtx      sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// trial is true while the attempt that a half-open breaker let
+	// through is running.
+	trial bool
+}
+
+func newBreaker(p Policy) *breaker {
+	return &breaker{threshold: p.BreakerThreshold, cooldown: p.BreakerCooldown, now: time.Now}
+}
+
+// allow returns true if a call may go ahead.
+func (b *breaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.trial = true
+		return true
+	case BreakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of a call that it
+// allowed.
+func (b *breaker) record(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if err == nil {
+		b.state = BreakerClosed
+		b.failures = 0
+		b.trial = false
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = b.now()
+		b.trial = false
+	}
+}
+
+// abandon lets another call through a half-open breaker, if the call
+// that it allowed says nothing about the backend.
+func (b *breaker) abandon() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.trial = false
+}
+
+func (b *breaker) current() BreakerState {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.state
+}
+
+// caller makes calls to a sink according to a policy.
+type caller struct {
+	policy  Policy
+	breaker *breaker
+
+	mtx      sync.Mutex
+	retries  int64
+	rejected int64
+}
+
+func newCaller(p Policy) *caller {
+	return &caller{policy: p, breaker: newBreaker(p)}
+}
+
+// do calls attempt until it succeeds, the policy's attempts are used up,
+// ctx is done, or the breaker rejects the call. Errors that the policy
+// doesn't retry are returned right away and don't count against the
+// breaker.
+func (c *caller) do(ctx context.Context, attempt func(context.Context) error) error {
+	var err error
+	for n := 0; ; n++ {
+		if !c.breaker.allow() {
+			c.count(0, 1)
+			if err == nil {
+				err = ErrBreakerOpen
+			}
+			return err
+		}
+		if n > 0 {
+			c.count(1, 0)
+		}
+
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if c.policy.AttemptTimeout > 0 {
+			actx, cancel = context.WithTimeout(ctx, c.policy.AttemptTimeout)
+		}
+		err = attempt(actx)
+		cancel()
+		if err != nil && !c.policy.retryable(err) {
+			c.breaker.abandon()
+			return err
+		}
+		c.breaker.record(err)
+		if err == nil || n+1 >= c.policy.MaxAttempts {
+			return err
+		}
+
+		select {
+		case <-time.After(c.policy.backoff(n)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (c *caller) count(retries, rejected int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.retries += retries
+	c.rejected += rejected
+}
+
+// report sends the breaker state, and the retries and rejections since
+// the last report, to the trace client.
+func (c *caller) report(cl *trace.Client, name string) {
+	c.mtx.Lock()
+	retries, rejected := c.retries, c.rejected
+	c.retries, c.rejected = 0, 0
+	c.mtx.Unlock()
+
+	tags := map[string]string{"sink": name}
+	metrics.ReportBatch(cl, []*ssf.SSFSample{
+		ssf.Gauge(MetricKeyBreakerState, float32(c.breaker.current()), tags),
+		ssf.Count(MetricKeyRetries, float32(retries), tags),
+		ssf.Count(MetricKeyBreakerRejected, float32(rejected), tags),
+	})
+}
+
+// MetricSink retries the flushes of a metric sink, and stops flushing to
+// it while its circuit breaker is open. If the sink reports which of
+// the metrics failed with a *sinks.FlushError, only those are flushed
+// again. Otherwise, the whole flush is retried, so such sinks must be
+// safe to flush the same metrics to twice.
+type MetricSink struct {
+	sink        sinks.MetricSink
+	caller      *caller
+	traceClient *trace.Client
+}
+
+var _ sinks.MetricSink = &MetricSink{}
+var _ sinks.Stopper = &MetricSink{}
+var _ http.Handler = &MetricSink{}
+
+// NewMetricSink wraps sink with the retries and the circuit breaker of
+// policy.
+func NewMetricSink(sink sinks.MetricSink, policy Policy) *MetricSink {
+	return &MetricSink{sink: sink, caller: newCaller(policy)}
+}
+
+// Sink returns the wrapped sink.
+func (s *MetricSink) Sink() sinks.MetricSink {
+	return s.sink
+}
+
+// Name returns the name of the wrapped sink.
+func (s *MetricSink) Name() string {
+	return s.sink.Name()
+}
+
+// Start starts the wrapped sink.
+func (s *MetricSink) Start(cl *trace.Client) error {
+	s.traceClient = cl
+	return s.sink.Start(cl)
+}
+
+// Flush flushes metrics to the wrapped sink, and retries the metrics
+// that failed. It returns the error of the last attempt, or
+// ErrBreakerOpen if the sink wasn't called at all. If some of the
+// metrics were flushed by then, the error is a *sinks.FlushError with
+// the ones that weren't.
+func (s *MetricSink) Flush(ctx context.Context, metrics []samplers.InterMetric) error {
+	pending := metrics
+	err := s.caller.do(ctx, func(ctx context.Context) error {
+		err := s.sink.Flush(ctx, pending)
+		if failed := sinks.FailedMetrics(err, pending); len(failed) > 0 {
+			pending = failed
+		}
+		return err
+	})
+	s.caller.report(s.traceClient, s.Name())
+	if _, ok := err.(*sinks.FlushError); !ok && err != nil && !sinks.IsPermanent(err) && len(pending) < len(metrics) {
+		err = &sinks.FlushError{Err: err, Failed: pending}
+	}
+	return err
+}
+
+// FlushOtherSamples passes the samples to the wrapped sink, unless its
+// circuit breaker is open. It's not retried, since the sink doesn't
+// report errors.
+func (s *MetricSink) FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample) {
+	if s.caller.breaker.current() == BreakerOpen {
+		return
+	}
+	s.sink.FlushOtherSamples(ctx, samples)
+}
+
+// SetExcludedTags passes the excluded tags to the wrapped sink, if it
+// excludes tags.
+func (s *MetricSink) SetExcludedTags(excludes []string) {
+	if es, ok := s.sink.(interface{ SetExcludedTags([]string) }); ok {
+		es.SetExcludedTags(excludes)
+	}
+}
+
+// Stop stops the wrapped sink, if it's a sinks.Stopper.
+func (s *MetricSink) Stop(ctx context.Context) error {
+	if st, ok := s.sink.(sinks.Stopper); ok {
+		return st.Stop(ctx)
+	}
+	return nil
+}
+
+// HandlerPath returns the path under which the wrapped sink serves its
+// metrics over HTTP, or "" if it doesn't.
+func (s *MetricSink) HandlerPath() string {
+	if hs, ok := s.sink.(interface{ HandlerPath() string }); ok {
+		return hs.HandlerPath()
+	}
+	return ""
+}
+
+// ServeHTTP passes the request to the wrapped sink, if it's an
+// http.Handler.
+func (s *MetricSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h, ok := s.sink.(http.Handler); ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// SpanSink drops spans while the circuit breaker of a span sink is
+// open. Ingests aren't retried, since that would hold up the span
+// worker that ingests the span; the policy only configures the
+// breaker.
+type SpanSink struct {
+	sink        sinks.SpanSink
+	caller      *caller
+	traceClient *trace.Client
+}
+
+var _ sinks.SpanSink = &SpanSink{}
+var _ sinks.Stopper = &SpanSink{}
+
+// NewSpanSink wraps sink with the circuit breaker of policy.
+func NewSpanSink(sink sinks.SpanSink, policy Policy) *SpanSink {
+	policy.MaxAttempts = 1
+	policy.AttemptTimeout = 0
+	return &SpanSink{sink: sink, caller: newCaller(policy)}
+}
+
+// Sink returns the wrapped sink.
+func (s *SpanSink) Sink() sinks.SpanSink {
+	return s.sink
+}
+
+// Name returns the name of the wrapped sink.
+func (s *SpanSink) Name() string {
+	return s.sink.Name()
+}
+
+// Start starts the wrapped sink.
+func (s *SpanSink) Start(cl *trace.Client) error {
+	s.traceClient = cl
+	return s.sink.Start(cl)
+}
+
+// Ingest passes span to the wrapped sink, unless its circuit breaker is
+// open.
+func (s *SpanSink) Ingest(span *ssf.SSFSpan) error {
+	return s.caller.do(context.Background(), func(context.Context) error {
+		return s.sink.Ingest(span)
+	})
+}
+
+// Flush flushes the wrapped sink, and reports the state of its circuit
+// breaker.
+func (s *SpanSink) Flush() {
+	s.sink.Flush()
+	s.caller.report(s.traceClient, s.Name())
+}
+
+// Stop stops the wrapped sink, if it's a sinks.Stopper.
+func (s *SpanSink) Stop(ctx context.Context) error {
+	if st, ok := s.sink.(sinks.Stopper); ok {
+		return st.Stop(ctx)
+	}
+	return nil
+}
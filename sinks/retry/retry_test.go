@@ -0,0 +1,303 @@
+package retry
+
+import (
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/sinks/datadog"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+)
+
+// testSink fails the first failures calls to Flush and Ingest, and
+// blocks in Flush until the context is done if block is set.
+type testSink struct {
+	failures int32
+	calls    int32
+	block    bool
+	err      error
+}
+
+func (s *testSink) Name() string                 { return "test" }
+func (s *testSink) Start(cl *trace.Client) error { return nil }
+
+func (s *testSink) call(ctx context.Context) error {
+	n := atomic.AddInt32(&s.calls, 1)
+	if s.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if n <= atomic.LoadInt32(&s.failures) {
+		if s.err != nil {
+			return s.err
+		}
+		return errors.New("backend unavailable")
+	}
+	return nil
+}
+
+func (s *testSink) Flush(ctx context.Context, metrics []samplers.InterMetric) error {
+	return s.call(ctx)
+}
+
+func (s *testSink) FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample) {}
+
+func (s *testSink) SetExcludedTags([]string) {
+	atomic.StoreInt32(&s.calls, -1)
+}
+
+// testSpanSink is a testSink that takes spans.
+type testSpanSink struct {
+	*testSink
+}
+
+func (s testSpanSink) Ingest(span *ssf.SSFSpan) error {
+	return s.call(context.Background())
+}
+
+func (s testSpanSink) Flush() {}
+
+func TestMetricSinkRetries(t *testing.T) {
+	inner := &testSink{failures: 2}
+	sink := NewMetricSink(inner, Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	assert.NoError(t, sink.Flush(context.Background(), nil))
+	assert.Equal(t, int32(3), inner.calls)
+
+	inner = &testSink{failures: 5}
+	sink = NewMetricSink(inner, Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	assert.Error(t, sink.Flush(context.Background(), nil))
+	assert.Equal(t, int32(3), inner.calls, "gives up after MaxAttempts")
+
+	sink.SetExcludedTags(nil)
+	assert.Equal(t, int32(-1), inner.calls, "optional methods are passed on")
+}
+
+func TestMetricSinkPermanentError(t *testing.T) {
+	inner := &testSink{failures: 5, err: sinks.Permanent(errors.New("bad request"))}
+	sink := NewMetricSink(inner, Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond, BreakerThreshold: 1})
+	assert.True(t, sinks.IsPermanent(sink.Flush(context.Background(), nil)))
+	assert.Equal(t, int32(1), inner.calls, "permanent errors aren't retried")
+	assert.Equal(t, BreakerClosed, sink.caller.breaker.current())
+}
+
+func TestMetricSinkAttemptTimeout(t *testing.T) {
+	inner := &testSink{block: true}
+	sink := NewMetricSink(inner, Policy{MaxAttempts: 2, AttemptTimeout: 10 * time.Millisecond})
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, sink.Flush(context.Background(), nil))
+	assert.Equal(t, int32(2), inner.calls)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+// partialSink fails to flush the metrics named "b" the first failures
+// times, and records the metrics it's asked to flush.
+type partialSink struct {
+	*testSink
+	flushed [][]string
+}
+
+func (s *partialSink) Flush(ctx context.Context, metrics []samplers.InterMetric) error {
+	var names []string
+	var failed []samplers.InterMetric
+	for _, m := range metrics {
+		names = append(names, m.Name)
+		if m.Name == "b" && atomic.LoadInt32(&s.calls) < s.failures {
+			failed = append(failed, m)
+		}
+	}
+	s.flushed = append(s.flushed, names)
+	atomic.AddInt32(&s.calls, 1)
+	if len(failed) > 0 {
+		return &sinks.FlushError{Err: errors.New("backend unavailable"), Failed: failed}
+	}
+	return nil
+}
+
+func TestMetricSinkRetriesFailedMetrics(t *testing.T) {
+	metrics := []samplers.InterMetric{{Name: "a"}, {Name: "b"}}
+	inner := &partialSink{testSink: &testSink{failures: 1}}
+	sink := NewMetricSink(inner, Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	assert.NoError(t, sink.Flush(context.Background(), metrics))
+	assert.Equal(t, [][]string{{"a", "b"}, {"b"}}, inner.flushed, "only the metrics that failed are retried")
+
+	inner = &partialSink{testSink: &testSink{failures: 5}}
+	sink = NewMetricSink(inner, Policy{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+	err := sink.Flush(context.Background(), metrics)
+	assert.Equal(t, []samplers.InterMetric{{Name: "b"}}, sinks.FailedMetrics(err, metrics))
+}
+
+func TestMetricSinkPartialFlushThenError(t *testing.T) {
+	metrics := []samplers.InterMetric{{Name: "a"}, {Name: "b"}}
+	calls := 0
+	inner := &funcSink{testSink: &testSink{}, flush: func(metrics []samplers.InterMetric) error {
+		calls++
+		if calls == 1 {
+			return &sinks.FlushError{Err: errors.New("backend unavailable"), Failed: metrics[1:]}
+		}
+		return errors.New("backend unavailable")
+	}}
+	sink := NewMetricSink(inner, Policy{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+	err := sink.Flush(context.Background(), metrics)
+	assert.Equal(t, []samplers.InterMetric{{Name: "b"}}, sinks.FailedMetrics(err, metrics),
+		"the metrics that were flushed by an earlier attempt aren't reported as failed")
+}
+
+// funcSink is a testSink that flushes with flush.
+type funcSink struct {
+	*testSink
+	flush func([]samplers.InterMetric) error
+}
+
+func (s *funcSink) Flush(ctx context.Context, metrics []samplers.InterMetric) error {
+	return s.flush(metrics)
+}
+
+func TestDatadogChecksArentRetried(t *testing.T) {
+	var mtx sync.Mutex
+	checks, series := 0, map[string]int{}
+	var failed int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/api/v1/check_run") {
+			checks++
+			return
+		}
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "deflate" {
+			body, _ = zlib.NewReader(r.Body)
+		}
+		payload := map[string][]datadog.DDMetric{}
+		require.NoError(t, json.NewDecoder(body).Decode(&payload))
+		for _, m := range payload["series"] {
+			if m.Name == "b" && atomic.CompareAndSwapInt32(&failed, 0, 1) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		for _, m := range payload["series"] {
+			series[m.Name]++
+		}
+	}))
+	defer srv.Close()
+
+	dd, err := datadog.NewDatadogMetricSink(10, 1, "host", nil, srv.URL, "key", srv.Client(), logrus.New())
+	require.NoError(t, err)
+	sink := NewMetricSink(dd, Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	require.NoError(t, sink.Flush(context.Background(), []samplers.InterMetric{
+		{Name: "check", Type: samplers.StatusMetric},
+		{Name: "a", Type: samplers.GaugeMetric},
+		{Name: "b", Type: samplers.GaugeMetric},
+	}))
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, 1, checks, "service checks are posted once")
+	assert.Equal(t, map[string]int{"a": 1, "b": 1}, series, "each batch is posted until it succeeds")
+}
+
+func TestPolicyIsRetryable(t *testing.T) {
+	notFound := errors.New("404 not found")
+	inner := &testSink{failures: 5, err: notFound}
+	sink := NewMetricSink(inner, Policy{
+		MaxAttempts:      3,
+		InitialBackoff:   time.Millisecond,
+		BreakerThreshold: 1,
+		IsRetryable:      func(err error) bool { return err != notFound },
+	})
+	assert.Equal(t, notFound, sink.Flush(context.Background(), nil))
+	assert.Equal(t, int32(1), inner.calls, "errors that aren't retryable use up no attempts")
+	assert.Equal(t, BreakerClosed, sink.caller.breaker.current(), "or trip the breaker")
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	inner := &testSink{failures: 2}
+	sink := NewMetricSink(inner, Policy{MaxAttempts: 1, BreakerThreshold: 2, BreakerCooldown: time.Minute})
+	sink.caller.breaker.now = func() time.Time { return now }
+
+	assert.Error(t, sink.Flush(context.Background(), nil))
+	assert.Equal(t, BreakerClosed, sink.caller.breaker.current())
+	assert.Error(t, sink.Flush(context.Background(), nil))
+	assert.Equal(t, BreakerOpen, sink.caller.breaker.current())
+
+	assert.Equal(t, ErrBreakerOpen, sink.Flush(context.Background(), nil))
+	assert.Equal(t, int32(2), inner.calls, "an open breaker doesn't call the sink")
+
+	// after the cooldown, one attempt is let through, and opens the
+	// breaker again when it fails:
+	now = now.Add(time.Minute)
+	assert.True(t, sink.caller.breaker.allow())
+	assert.Equal(t, BreakerHalfOpen, sink.caller.breaker.current())
+	assert.False(t, sink.caller.breaker.allow(), "only one trial at a time")
+	sink.caller.breaker.record(errors.New("still down"))
+	assert.Equal(t, BreakerOpen, sink.caller.breaker.current())
+
+	now = now.Add(time.Minute)
+	require.NoError(t, sink.Flush(context.Background(), nil))
+	assert.Equal(t, BreakerClosed, sink.caller.breaker.current())
+}
+
+func TestSpanSinkInvalidTrace(t *testing.T) {
+	inner := &testSink{failures: 1, err: &protocol.InvalidTrace{}}
+	sink := NewSpanSink(testSpanSink{inner}, Policy{MaxAttempts: 3, BreakerThreshold: 1})
+	assert.Error(t, sink.Ingest(&ssf.SSFSpan{}))
+	assert.Equal(t, int32(1), inner.calls, "invalid spans aren't retried")
+	assert.Equal(t, BreakerClosed, sink.caller.breaker.current())
+	assert.NoError(t, sink.Ingest(&ssf.SSFSpan{}))
+}
+
+func TestSpanSinkIngestIsNotRetried(t *testing.T) {
+	inner := &testSink{failures: 1}
+	sink := NewSpanSink(testSpanSink{inner}, Policy{MaxAttempts: 3, InitialBackoff: time.Hour, BreakerThreshold: 1, BreakerCooldown: time.Hour})
+	assert.Error(t, sink.Ingest(&ssf.SSFSpan{}))
+	assert.Equal(t, int32(1), inner.calls)
+	assert.Equal(t, ErrBreakerOpen, sink.Ingest(&ssf.SSFSpan{}))
+	assert.Equal(t, int32(1), inner.calls, "the breaker still applies")
+}
+
+// handlerSink is a testSink that serves its metrics over HTTP.
+type handlerSink struct {
+	*testSink
+}
+
+func (s handlerSink) HandlerPath() string { return "/metrics" }
+
+func (s handlerSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("metrics"))
+}
+
+func TestMetricSinkHandler(t *testing.T) {
+	sink := NewMetricSink(handlerSink{&testSink{}}, Policy{MaxAttempts: 3})
+	assert.Equal(t, "/metrics", sink.HandlerPath())
+	rec := httptest.NewRecorder()
+	sink.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, "metrics", rec.Body.String())
+
+	sink = NewMetricSink(&testSink{}, Policy{MaxAttempts: 3})
+	assert.Equal(t, "", sink.HandlerPath(), "sinks that don't serve HTTP have no path")
+}
+
+func TestBackoff(t *testing.T) {
+	p := Policy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for n, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		d := p.backoff(n)
+		assert.True(t, d >= max/2 && d <= max, "retry %d waits %v", n, d)
+	}
+	assert.Equal(t, time.Duration(0), Policy{}.backoff(3))
+}
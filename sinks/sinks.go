@@ -23,6 +23,12 @@ const MetricKeyTotalMetricsFlushed = "sink.metrics_flushed_total"
 // skipped, not applicable to this MetricSink.
 const MetricKeyTotalMetricsSkipped = "sink.metrics_skipped_total"
 
+// MetricKeyTotalMetricsDropped tracks the number of metrics that the sink is
+// aware it has dropped, e.g. because they could not be delivered. It should be
+// emitted as a counter by a MetricSink if possible. Tagged with
+// `sink:sink.Name()`.
+const MetricKeyTotalMetricsDropped = "sink.metrics_dropped_total"
+
 // EventReportedCount number of events processed by a sink. Tagged with
 // `sink:sink.Name()`.
 const EventReportedCount = "sink.events_reported_total"
@@ -46,6 +52,14 @@ type MetricSink interface {
 	FlushOtherSamples(ctx context.Context, samples []ssf.SSFSample)
 }
 
+// Stopper is implemented by sinks (and plugins) that do work in the
+// background, such as sending buffered data asynchronously. When veneur
+// shuts down, it calls Stop after the final flush, and gives the sink
+// until the context is done to send what it still has.
+type Stopper interface {
+	Stop(ctx context.Context) error
+}
+
 // IsAcceptableMetric returns true if a metric is meant to be ingested
 // by a given sink.
 func IsAcceptableMetric(metric samplers.InterMetric, sink MetricSink) bool {
@@ -34,7 +34,7 @@ type TestableSplunkSpanSink interface {
 
 	// Stop shuts down the sink's submission workers by finishing
 	// each worker's last submission HTTP request.
-	Stop()
+	Stop(ctx context.Context) error
 
 	// Sync instructs all submission workers to finish submitting
 	// their current request and start a new one. It returns when
@@ -68,6 +68,9 @@ type splunkSpanSink struct {
 	connLifetimeJitter time.Duration
 	rand               *mrand.Rand
 
+	// requests tracks the HEC requests that are in flight.
+	requests sync.WaitGroup
+
 	// these fields are for testing only:
 
 	// sync holds one channel per submission worker.
@@ -79,6 +82,7 @@ type splunkSpanSink struct {
 }
 
 var _ sinks.SpanSink = &splunkSpanSink{}
+var _ sinks.Stopper = &splunkSpanSink{}
 var _ TestableSplunkSpanSink = &splunkSpanSink{}
 
 // NewSplunkSpanSink constructs a new splunk span sink from the server
@@ -163,9 +167,24 @@ func (sss *splunkSpanSink) Start(cl *trace.Client) error {
 	return nil
 }
 
-func (sss *splunkSpanSink) Stop() {
-	for _, signal := range sss.sync {
-		close(signal)
+// Stop submits the batch that each worker has collected so far, shuts
+// the workers down, and waits for the submissions to finish until ctx
+// is done.
+func (sss *splunkSpanSink) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sss.Sync()
+		for _, signal := range sss.sync {
+			close(signal)
+		}
+		sss.requests.Wait()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -214,7 +233,11 @@ func (sss *splunkSpanSink) setupHTTPRequest(ctx context.Context) (context.Cancel
 
 	// At this point, we have a workable HTTP connection;
 	// open it in the background:
-	go sss.makeHTTPRequest(req, cancel)
+	sss.requests.Add(1)
+	go func() {
+		defer sss.requests.Done()
+		sss.makeHTTPRequest(req, cancel)
+	}()
 	return cancel, hecReq, w, nil
 }
 
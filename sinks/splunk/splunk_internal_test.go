@@ -1,6 +1,7 @@
 package splunk
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
@@ -35,7 +36,7 @@ func TestWorkerCount(t *testing.T) {
 			sink, err := NewSplunkSpanSink(ts.URL, "00000000-0000-0000-0000-000000000000",
 				"test-host", "", logger, time.Duration(0), time.Duration(0), 100, nWorkers, 10, 10*time.Millisecond, 0)
 			sss := sink.(*splunkSpanSink)
-			defer sss.Stop()
+			defer sss.Stop(context.Background())
 			require.NoError(t, err)
 
 			// this number should correspond to the input:
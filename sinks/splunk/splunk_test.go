@@ -1,6 +1,7 @@
 package splunk_test
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"io/ioutil"
@@ -141,7 +142,7 @@ func TestSpanIngestBatch(t *testing.T) {
 		assert.Equal(t, true, output.Indicator)
 		assert.Equal(t, true, output.Error)
 	}
-	sink.Stop()
+	sink.Stop(context.Background())
 }
 
 func TestTimeout(t *testing.T) {
@@ -201,7 +202,7 @@ readMetrics:
 	}
 	require.NotNil(t, found, "Expected a timeout metric to be reported")
 	assert.Equal(t, found.Tags["cause"], "submission_timeout")
-	sink.Stop()
+	sink.Stop(context.Background())
 }
 
 const benchmarkCapacity = 100
@@ -249,7 +250,7 @@ func BenchmarkBatchIngest(b *testing.B) {
 		require.NoError(b, err)
 	}
 	b.StopTimer()
-	sink.Stop()
+	sink.Stop(context.Background())
 }
 
 func TestSampling(t *testing.T) {
@@ -293,7 +294,7 @@ func TestSampling(t *testing.T) {
 	sink.Sync()
 
 	// Ensure nothing sends into the channel anymore:
-	sink.Stop()
+	sink.Stop(context.Background())
 
 	// check how many events we got:
 	events := 0
@@ -361,7 +362,7 @@ func TestSamplingIndicators(t *testing.T) {
 	sink.Sync()
 
 	// Ensure nothing sends into the channel anymore:
-	sink.Stop()
+	sink.Stop(context.Background())
 
 	// check how many events we got:
 	events := 0
@@ -434,7 +435,7 @@ func TestClosedIngestionEndpoint(t *testing.T) {
 		}
 	}
 	sink.Sync()
-	sink.Stop()
+	sink.Stop(context.Background())
 	events := 0
 	for range ch {
 		events++
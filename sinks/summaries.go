@@ -0,0 +1,73 @@
+package sinks
+
+import (
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// The kinds of summary values that SummaryPart reports.
+const (
+	SummaryCount    = "count"
+	SummarySum      = "sum"
+	SummaryQuantile = "quantile"
+)
+
+// SummaryPart determines whether an InterMetric is one of the values
+// that veneur generates when flushing a histogram or timer, for sinks
+// that gather those values up into a summary. If so, it returns the
+// name of the histogram and one of SummaryCount, SummarySum or
+// SummaryQuantile (with the quantile it represents). Otherwise,
+// including for the average and harmonic mean, it returns an empty
+// kind.
+//
+// Only the Histogram field of the metric decides this, so that
+// counters and gauges whose names happen to end in ".count" or ".max"
+// keep their own series.
+func SummaryPart(m samplers.InterMetric) (base, kind string, quantile float64) {
+	if m.Histogram == nil {
+		return "", "", 0
+	}
+	dot := strings.LastIndexByte(m.Name, '.')
+	if dot <= 0 {
+		return "", "", 0
+	}
+	base = m.Name[:dot]
+
+	switch m.Histogram.Aggregate {
+	case samplers.AggregateCount:
+		return base, SummaryCount, 0
+	case samplers.AggregateSum:
+		return base, SummarySum, 0
+	case samplers.AggregateMin:
+		return base, SummaryQuantile, 0
+	case samplers.AggregateMax:
+		return base, SummaryQuantile, 1
+	case samplers.AggregateMedian:
+		return base, SummaryQuantile, 0.5
+	case 0:
+		return base, SummaryQuantile, m.Histogram.Percentile
+	}
+	return "", "", 0
+}
+
+// EachTag calls fn with the key and the value of each of veneur's
+// "key:value" tags, in order. Tags without a value have an empty value.
+// Tags without a key, veneursinkonly tags and tags whose key is
+// excluded are skipped.
+func EachTag(tags []string, excluded map[string]struct{}, fn func(key, value string)) {
+	for _, tag := range tags {
+		kv := strings.SplitN(tag, ":", 2)
+		if kv[0] == "" || kv[0] == "veneursinkonly" {
+			continue
+		}
+		if _, ok := excluded[kv[0]]; ok {
+			continue
+		}
+		if len(kv) == 1 {
+			fn(kv[0], "")
+		} else {
+			fn(kv[0], kv[1])
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package sinks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestSummaryPart(t *testing.T) {
+	tests := []struct {
+		metric   samplers.InterMetric
+		base     string
+		kind     string
+		quantile float64
+	}{
+		{samplers.InterMetric{Name: "a.timer.count", Type: samplers.CounterMetric, Histogram: &samplers.HistogramPart{Aggregate: samplers.AggregateCount}}, "a.timer", SummaryCount, 0},
+		{samplers.InterMetric{Name: "a.timer.sum", Histogram: &samplers.HistogramPart{Aggregate: samplers.AggregateSum}}, "a.timer", SummarySum, 0},
+		{samplers.InterMetric{Name: "a.timer.max", Histogram: &samplers.HistogramPart{Aggregate: samplers.AggregateMax}}, "a.timer", SummaryQuantile, 1},
+		{samplers.InterMetric{Name: "a.timer.999percentile", Histogram: &samplers.HistogramPart{Percentile: 0.999}}, "a.timer", SummaryQuantile, 0.999},
+		{samplers.InterMetric{Name: "a.timer.avg", Histogram: &samplers.HistogramPart{Aggregate: samplers.AggregateAverage}}, "", "", 0},
+		// plain metrics that only look like histogram values:
+		{samplers.InterMetric{Name: "http.requests.count", Type: samplers.CounterMetric}, "", "", 0},
+		{samplers.InterMetric{Name: "queue.max", Type: samplers.GaugeMetric}, "", "", 0},
+	}
+	for _, test := range tests {
+		base, kind, quantile := SummaryPart(test.metric)
+		assert.Equal(t, test.base, base, test.metric.Name)
+		assert.Equal(t, test.kind, kind, test.metric.Name)
+		assert.Equal(t, test.quantile, quantile, test.metric.Name)
+	}
+}
+
+func TestEachTag(t *testing.T) {
+	var got []string
+	EachTag([]string{"a:b", "c", ":d", "veneursinkonly:datadog", "secret:x", "e:f:g"}, map[string]struct{}{"secret": {}}, func(key, value string) {
+		got = append(got, key+"="+value)
+	})
+	assert.Equal(t, []string{"a=b", "c=", "e=f:g"}, got)
+}
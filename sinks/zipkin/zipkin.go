@@ -0,0 +1,147 @@
+package zipkin
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	vhttp "github.com/stripe/veneur/http"
+	"github.com/stripe/veneur/protocol"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace"
+	"github.com/stripe/veneur/trace/metrics"
+	zipkinmodel "github.com/stripe/veneur/zipkin"
+)
+
+// ZipkinSpanSink is a SpanSink that buffers spans and posts them to a
+// Zipkin collector's /api/v2/spans endpoint on every flush.
+type ZipkinSpanSink struct {
+	name            string
+	spansURL        string
+	commonTags      map[string]string
+	bufferSize      int
+	flushMaxPerBody int
+	httpClient      *http.Client
+	traceClient     *trace.Client
+	log             *logrus.Logger
+
+	mtx     sync.Mutex
+	buffer  []*ssf.SSFSpan
+	dropped int64
+}
+
+var _ sinks.SpanSink = &ZipkinSpanSink{}
+
+// NewZipkinSpanSink creates a sink that holds on to at most bufferSize
+// spans between flushes, and posts them to the Zipkin collector at
+// address (e.g. http://zipkin:9411) in requests of at most
+// flushMaxPerBody spans. The common tags are added to every span that
+// doesn't already have them.
+func NewZipkinSpanSink(address string, commonTags map[string]string, bufferSize, flushMaxPerBody int, httpClient *http.Client, log *logrus.Logger) (*ZipkinSpanSink, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/spans"
+	return &ZipkinSpanSink{
+		spansURL:        u.String(),
+		commonTags:      commonTags,
+		bufferSize:      bufferSize,
+		flushMaxPerBody: flushMaxPerBody,
+		httpClient:      httpClient,
+		log:             log,
+	}, nil
+}
+
+// Name returns the name of this sink.
+func (z *ZipkinSpanSink) Name() string {
+	if z.name == "" {
+		return "zipkin"
+	}
+	return z.name
+}
+
+// Start sets the sink up.
+func (z *ZipkinSpanSink) Start(cl *trace.Client) error {
+	z.traceClient = cl
+	return nil
+}
+
+// Ingest buffers a span until the next flush. If the buffer is full,
+// the span is dropped.
+func (z *ZipkinSpanSink) Ingest(span *ssf.SSFSpan) error {
+	if err := protocol.ValidateTrace(span); err != nil {
+		return err
+	}
+	z.mtx.Lock()
+	defer z.mtx.Unlock()
+	if len(z.buffer) >= z.bufferSize {
+		z.dropped++
+		return nil
+	}
+	z.buffer = append(z.buffer, span)
+	return nil
+}
+
+// Flush converts the buffered spans to Zipkin's JSON format and posts
+// them to the collector.
+func (z *ZipkinSpanSink) Flush() {
+	z.mtx.Lock()
+	spans := z.buffer
+	dropped := z.dropped
+	z.buffer = make([]*ssf.SSFSpan, 0, len(spans))
+	z.dropped = 0
+	z.mtx.Unlock()
+
+	flushStart := time.Now()
+	flushed := 0
+	batchSize := z.flushMaxPerBody
+	if batchSize <= 0 {
+		batchSize = len(spans)
+	}
+	for len(spans) > 0 {
+		n := batchSize
+		if n > len(spans) {
+			n = len(spans)
+		}
+		batch := make([]zipkinmodel.Span, 0, n)
+		for _, span := range spans[:n] {
+			batch = append(batch, z.convertSpan(span))
+		}
+		spans = spans[n:]
+
+		err := vhttp.PostHelper(context.Background(), z.httpClient, z.traceClient, http.MethodPost, z.spansURL, batch, "flush_spans", false, map[string]string{"sink": z.Name()}, z.log)
+		if err != nil {
+			dropped += int64(len(batch))
+			continue
+		}
+		flushed += len(batch)
+	}
+
+	tags := map[string]string{"sink": z.Name()}
+	metrics.ReportBatch(z.traceClient, []*ssf.SSFSample{
+		ssf.Timing(sinks.MetricKeySpanFlushDuration, time.Since(flushStart), time.Nanosecond, tags),
+		ssf.Count(sinks.MetricKeyTotalSpansFlushed, float32(flushed), tags),
+		ssf.Count(sinks.MetricKeyTotalSpansDropped, float32(dropped), tags),
+	})
+	z.log.WithFields(logrus.Fields{
+		"flushed_spans": flushed,
+		"dropped_spans": dropped,
+	}).Debug("Completed flush to Zipkin")
+}
+
+func (z *ZipkinSpanSink) convertSpan(span *ssf.SSFSpan) zipkinmodel.Span {
+	ret := zipkinmodel.FromSSF(span)
+	for k, v := range z.commonTags {
+		if _, ok := ret.Tags[k]; !ok {
+			ret.Tags[k] = v
+		}
+	}
+	return ret
+}
@@ -0,0 +1,93 @@
+package zipkin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/ssf"
+	zipkinmodel "github.com/stripe/veneur/zipkin"
+)
+
+func testSpan(id int64) *ssf.SSFSpan {
+	return &ssf.SSFSpan{
+		TraceId:        1,
+		Id:             id,
+		Name:           "request",
+		Service:        "api",
+		StartTimestamp: 1500000000000000000,
+		EndTimestamp:   1500000000002000000,
+		Tags:           map[string]string{"env": "prod"},
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var mtx sync.Mutex
+	var batches [][]zipkinmodel.Span
+	status := http.StatusAccepted
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/zipkin/api/v2/spans", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var batch []zipkinmodel.Span
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+		mtx.Lock()
+		batches = append(batches, batch)
+		w.WriteHeader(status)
+		mtx.Unlock()
+	}))
+	defer srv.Close()
+
+	sink, err := NewZipkinSpanSink(srv.URL+"/zipkin/", map[string]string{"env": "dev", "region": "us"}, 3, 2, srv.Client(), logrus.New())
+	require.NoError(t, err)
+	require.NoError(t, sink.Start(nil))
+
+	for i := int64(1); i <= 4; i++ {
+		require.NoError(t, sink.Ingest(testSpan(i)))
+	}
+	assert.Error(t, sink.Ingest(&ssf.SSFSpan{}))
+	sink.Flush()
+
+	// the fourth span didn't fit in the buffer:
+	require.Len(t, batches, 2)
+	assert.Len(t, batches[0], 2)
+	assert.Len(t, batches[1], 1)
+	assert.Equal(t, zipkinmodel.Span{
+		TraceID:       "0000000000000001",
+		ID:            "0000000000000001",
+		Name:          "request",
+		Timestamp:     1500000000000000,
+		Duration:      2000,
+		LocalEndpoint: &zipkinmodel.Endpoint{ServiceName: "api"},
+		Tags:          map[string]string{"env": "prod", "region": "us"},
+	}, batches[0][0])
+
+	// the buffer is emptied, even if the collector fails:
+	status = http.StatusInternalServerError
+	require.NoError(t, sink.Ingest(testSpan(5)))
+	sink.Flush()
+	sink.Flush()
+	assert.Len(t, batches, 3)
+}
+
+func TestNewSpanSinkFromConfig(t *testing.T) {
+	deps := sinks.Dependencies{TagsAsMap: map[string]string{"env": "prod"}, Log: logrus.New()}
+	sink, err := sinks.NewSpanSink("zipkin", "zipkin-eu", sinks.SinkConfig{
+		"address": "http://zipkin-eu:9411",
+	}, deps)
+	require.NoError(t, err)
+	assert.Equal(t, "zipkin-eu", sink.Name())
+	zSink := sink.(*ZipkinSpanSink)
+	assert.Equal(t, "http://zipkin-eu:9411/api/v2/spans", zSink.spansURL)
+	assert.Equal(t, 16384, zSink.bufferSize)
+	assert.Equal(t, map[string]string{"env": "prod"}, zSink.commonTags)
+
+	_, err = sinks.NewSpanSink("zipkin", "zipkin-eu", sinks.SinkConfig{}, deps)
+	assert.Error(t, err, "the address is required")
+}
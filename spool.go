@@ -0,0 +1,401 @@
+package veneur
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+)
+
+const (
+	// defaultSpoolMaxBytes and defaultSpoolTTL apply if the
+	// configuration doesn't set sink_spool_max_bytes and
+	// sink_spool_ttl.
+	defaultSpoolMaxBytes = 100 << 20
+	defaultSpoolTTL      = time.Hour
+
+	// spoolReplayBatch is how many spooled payloads a sink retries
+	// at most in one flush, so that catching up on a long outage
+	// doesn't hold up the flush.
+	spoolReplayBatch = 10
+
+	spoolFileSuffix = ".json"
+)
+
+// sinkSpools are the on-disk spools of the metric sinks. Each sink gets
+// its own spool, in a directory named after the sink.
+type sinkSpools struct {
+	dir      string
+	maxBytes int64
+	ttl      time.Duration
+
+	mtx    sync.Mutex
+	spools map[string]*sinkSpool
+}
+
+func newSinkSpools(dir string, maxBytes int64, ttl time.Duration) (*sinkSpools, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultSpoolMaxBytes
+	}
+	if ttl <= 0 {
+		ttl = defaultSpoolTTL
+	}
+	return &sinkSpools{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		spools:   map[string]*sinkSpool{},
+	}, nil
+}
+
+// get returns the spool of the named sink, opening it on first use.
+// Payloads that a previous veneur left in the spool are picked up. Sink
+// names that aren't a single path element are an error, so that a
+// spool never ends up outside of the spool directory.
+func (ss *sinkSpools) get(name string) (*sinkSpool, error) {
+	if name == "" || strings.Contains(name, "..") || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("sink name %q can't be used as a spool directory", name)
+	}
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	if spool, ok := ss.spools[name]; ok {
+		return spool, nil
+	}
+	spool, err := openSinkSpool(filepath.Join(ss.dir, name), ss.maxBytes, ss.ttl)
+	if err != nil {
+		return nil, err
+	}
+	ss.spools[name] = spool
+	return spool, nil
+}
+
+// spoolEntry is a payload in a spool, stored in its own file.
+type spoolEntry struct {
+	path    string
+	created time.Time
+	size    int64
+}
+
+// sinkSpool persists the metrics that a sink failed to flush, so that
+// they can be flushed again later. Payloads older than the TTL are
+// discarded, and so are the oldest payloads if the spool grows beyond
+// its size cap.
+type sinkSpool struct {
+	dir      string
+	maxBytes int64
+	ttl      time.Duration
+
+	mtx     sync.Mutex
+	entries []spoolEntry
+	bytes   int64
+	seq     int
+	// dropped counts the payloads that were discarded without being
+	// flushed since the last call to stats, by reason.
+	dropped map[string]int64
+}
+
+// openSinkSpool opens the spool in dir, creating the directory if it
+// doesn't exist.
+func openSinkSpool(dir string, maxBytes int64, ttl time.Duration) (*sinkSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	spool := &sinkSpool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		dropped:  map[string]int64{},
+	}
+	for _, fi := range files {
+		path := filepath.Join(dir, fi.Name())
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), spoolFileSuffix) {
+			if strings.HasSuffix(fi.Name(), ".tmp") {
+				// left over from a write that didn't finish:
+				os.Remove(path)
+			}
+			continue
+		}
+		nanos, err := strconv.ParseInt(strings.SplitN(fi.Name(), "-", 2)[0], 10, 64)
+		if err != nil {
+			log.WithError(err).WithField("file", path).Warn("Ignoring unknown file in sink spool")
+			continue
+		}
+		spool.entries = append(spool.entries, spoolEntry{
+			path:    path,
+			created: time.Unix(0, nanos),
+			size:    fi.Size(),
+		})
+		spool.bytes += fi.Size()
+	}
+	sort.Slice(spool.entries, func(i, j int) bool {
+		return spool.entries[i].path < spool.entries[j].path
+	})
+	if len(spool.entries) > 0 {
+		log.WithFields(logrus.Fields{
+			"dir":      dir,
+			"payloads": len(spool.entries),
+		}).Info("Found spooled payloads from an earlier run")
+	}
+	return spool, nil
+}
+
+// add persists metrics that a sink failed to flush.
+func (sp *sinkSpool) add(metrics []samplers.InterMetric, now time.Time) error {
+	bts, err := encodeSpooled(metrics)
+	if err != nil {
+		return err
+	}
+
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	sp.seq++
+	path := filepath.Join(sp.dir, fmt.Sprintf("%019d-%d%s", now.UnixNano(), sp.seq, spoolFileSuffix))
+	if err := writeSpoolFile(path, bts); err != nil {
+		return err
+	}
+	sp.entries = append(sp.entries, spoolEntry{path: path, created: now, size: int64(len(bts))})
+	sp.bytes += int64(len(bts))
+
+	// make room by discarding the oldest payloads, but always keep
+	// the newest one:
+	for sp.bytes > sp.maxBytes && len(sp.entries) > 1 {
+		sp.removeOldest("size")
+	}
+	return nil
+}
+
+// replay flushes the oldest spooled payloads to sink, and removes the
+// ones that were flushed. It stops at the first payload that fails to
+// flush, or after spoolReplayBatch payloads. Expired payloads are
+// discarded, and so are payloads that the sink rejects with a permanent
+// error.
+func (sp *sinkSpool) replay(ctx context.Context, sink sinks.MetricSink, now time.Time) error {
+	for replayed := 0; replayed < spoolReplayBatch; {
+		entry, ok := sp.oldest(now)
+		if !ok {
+			return nil
+		}
+		bts, err := ioutil.ReadFile(entry.path)
+		if err != nil {
+			log.WithError(err).WithField("file", entry.path).Warn("Could not read spooled payload")
+			sp.remove(entry, "unreadable")
+			continue
+		}
+		metrics, err := decodeSpooled(bts)
+		if err != nil {
+			log.WithError(err).WithField("file", entry.path).Warn("Could not decode spooled payload")
+			sp.remove(entry, "unreadable")
+			continue
+		}
+		// the spool isn't locked while the sink flushes, so that
+		// failed flushes can be spooled meanwhile:
+		if err := sink.Flush(ctx, metrics); err != nil {
+			failed := sinks.FailedMetrics(err, metrics)
+			if len(failed) == 0 {
+				log.WithError(err).WithField("file", entry.path).Warn("Sink rejected spooled payload")
+				sp.remove(entry, "rejected")
+				continue
+			}
+			if len(failed) < len(metrics) {
+				// keep only the metrics that failed, so that the
+				// ones that were flushed aren't sent again:
+				if err := sp.rewrite(entry, failed); err != nil {
+					log.WithError(err).WithField("file", entry.path).Warn("Could not rewrite spooled payload")
+				}
+			}
+			return err
+		}
+		sp.remove(entry, "")
+		replayed++
+	}
+	return nil
+}
+
+// oldest returns the oldest payload that hasn't expired, and discards
+// the ones that have.
+func (sp *sinkSpool) oldest(now time.Time) (spoolEntry, bool) {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	for len(sp.entries) > 0 {
+		if now.Sub(sp.entries[0].created) <= sp.ttl {
+			return sp.entries[0], true
+		}
+		sp.removeOldest("expired")
+	}
+	return spoolEntry{}, false
+}
+
+// remove deletes a payload, unless it's gone already.
+func (sp *sinkSpool) remove(entry spoolEntry, reason string) {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	for i, e := range sp.entries {
+		if e.path == entry.path {
+			sp.removeAt(i, reason)
+			return
+		}
+	}
+}
+
+// rewrite replaces the metrics of a payload, unless it's gone already.
+func (sp *sinkSpool) rewrite(entry spoolEntry, metrics []samplers.InterMetric) error {
+	bts, err := encodeSpooled(metrics)
+	if err != nil {
+		return err
+	}
+
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	for i, e := range sp.entries {
+		if e.path != entry.path {
+			continue
+		}
+		if err := writeSpoolFile(e.path, bts); err != nil {
+			return err
+		}
+		sp.bytes += int64(len(bts)) - e.size
+		sp.entries[i].size = int64(len(bts))
+		return nil
+	}
+	return nil
+}
+
+// writeSpoolFile writes a payload to a temporary file first, so that
+// the spool never holds a partial one.
+func writeSpoolFile(path string, bts []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bts, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// spooledMetric is the form that metrics are spooled in. It's the
+// InterMetric's JSON, except that the value may be NaN or ±Inf, which
+// aggregates such as the average of an empty histogram can be and JSON
+// numbers can't.
+type spooledMetric struct {
+	samplers.InterMetric
+	Value spooledValue
+}
+
+// spooledValue is a float64 that's encoded as a JSON number if it's
+// finite, and as "NaN", "+Inf" or "-Inf" otherwise.
+type spooledValue float64
+
+func (v spooledValue) MarshalJSON() ([]byte, error) {
+	f := float64(v)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return json.Marshal(strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	return json.Marshal(f)
+}
+
+func (v *spooledValue) UnmarshalJSON(bts []byte) error {
+	var f float64
+	if len(bts) > 0 && bts[0] == '"' {
+		var s string
+		if err := json.Unmarshal(bts, &s); err != nil {
+			return err
+		}
+		var err error
+		if f, err = strconv.ParseFloat(s, 64); err != nil {
+			return err
+		}
+	} else if err := json.Unmarshal(bts, &f); err != nil {
+		return err
+	}
+	*v = spooledValue(f)
+	return nil
+}
+
+// encodeSpooled encodes metrics as a spooled payload.
+func encodeSpooled(metrics []samplers.InterMetric) ([]byte, error) {
+	spooled := make([]spooledMetric, len(metrics))
+	for i, m := range metrics {
+		spooled[i] = spooledMetric{InterMetric: m, Value: spooledValue(m.Value)}
+	}
+	return json.Marshal(spooled)
+}
+
+// decodeSpooled decodes a spooled payload.
+func decodeSpooled(bts []byte) ([]samplers.InterMetric, error) {
+	var spooled []spooledMetric
+	if err := json.Unmarshal(bts, &spooled); err != nil {
+		return nil, err
+	}
+	metrics := make([]samplers.InterMetric, len(spooled))
+	for i, m := range spooled {
+		metrics[i] = m.InterMetric
+		metrics[i].Value = float64(m.Value)
+	}
+	return metrics, nil
+}
+
+// removeOldest deletes the oldest payload.
+func (sp *sinkSpool) removeOldest(reason string) {
+	sp.removeAt(0, reason)
+}
+
+// removeAt deletes the payload at index i. If reason isn't empty, the
+// payload is counted as dropped for that reason.
+func (sp *sinkSpool) removeAt(i int, reason string) {
+	entry := sp.entries[i]
+	sp.entries = append(sp.entries[:i:i], sp.entries[i+1:]...)
+	sp.bytes -= entry.size
+	if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("file", entry.path).Warn("Could not remove spooled payload")
+	}
+	if reason != "" {
+		sp.dropped[reason]++
+	}
+}
+
+// spoolStats describe a spool at one point in time.
+type spoolStats struct {
+	depth   int
+	bytes   int64
+	age     time.Duration
+	dropped map[string]int64
+}
+
+// stats returns the number of spooled payloads, their size, the age of
+// the oldest one, and the payloads dropped since the last call.
+func (sp *sinkSpool) stats(now time.Time) spoolStats {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	st := spoolStats{
+		depth:   len(sp.entries),
+		bytes:   sp.bytes,
+		dropped: sp.dropped,
+	}
+	if len(sp.entries) > 0 {
+		st.age = now.Sub(sp.entries[0].created)
+	}
+	sp.dropped = map[string]int64{}
+	return st
+}
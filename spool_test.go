@@ -0,0 +1,393 @@
+package veneur
+
+import (
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/sinks"
+	"github.com/stripe/veneur/sinks/datadog"
+)
+
+// flakyMetricSink fails to flush while failing is set, with err if it
+// is set.
+type flakyMetricSink struct {
+	*channelMetricSink
+	failing int32
+	err     error
+}
+
+func (s *flakyMetricSink) Flush(ctx context.Context, metrics []samplers.InterMetric) error {
+	if atomic.LoadInt32(&s.failing) != 0 {
+		if s.err != nil {
+			return s.err
+		}
+		return errors.New("backend unavailable")
+	}
+	return s.channelMetricSink.Flush(ctx, metrics)
+}
+
+func TestSinkSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	spool, err := openSinkSpool(dir, 1<<20, time.Hour)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		metrics := []samplers.InterMetric{{Name: "a.b.c", Value: float64(i), Type: samplers.CounterMetric}}
+		require.NoError(t, spool.add(metrics, now.Add(time.Duration(i-3)*time.Minute)))
+	}
+
+	// the spool picks up where it left off:
+	spool, err = openSinkSpool(dir, 1<<20, time.Hour)
+	require.NoError(t, err)
+	st := spool.stats(now)
+	assert.Equal(t, 3, st.depth)
+	assert.Equal(t, 3*time.Minute, st.age)
+
+	ch := make(chan []samplers.InterMetric, 10)
+	cms, _ := NewChannelMetricSink(ch)
+	sink := &flakyMetricSink{channelMetricSink: cms, failing: 1}
+	assert.Error(t, spool.replay(context.Background(), sink, now))
+	assert.Equal(t, 3, spool.stats(now).depth, "payloads that fail again stay in the spool")
+
+	atomic.StoreInt32(&sink.failing, 0)
+	require.NoError(t, spool.replay(context.Background(), sink, now))
+	for i := 0; i < 3; i++ {
+		metrics := <-ch
+		require.Len(t, metrics, 1)
+		assert.Equal(t, float64(i), metrics[0].Value, "payloads are replayed oldest first")
+	}
+	assert.Equal(t, 0, spool.stats(now).depth)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+// partialMetricSink fails to flush the metrics named failName, and
+// flushes the rest.
+type partialMetricSink struct {
+	*channelMetricSink
+	failName string
+}
+
+func (s *partialMetricSink) Flush(ctx context.Context, metrics []samplers.InterMetric) error {
+	var flushed, failed []samplers.InterMetric
+	for _, m := range metrics {
+		if m.Name == s.failName {
+			failed = append(failed, m)
+		} else {
+			flushed = append(flushed, m)
+		}
+	}
+	if len(flushed) > 0 {
+		s.channelMetricSink.Flush(ctx, flushed)
+	}
+	if len(failed) > 0 {
+		return &sinks.FlushError{Err: errors.New("backend unavailable"), Failed: failed}
+	}
+	return nil
+}
+
+func TestSinkSpoolPartialReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	spool, err := openSinkSpool(dir, 1<<20, time.Hour)
+	require.NoError(t, err)
+	metrics := []samplers.InterMetric{
+		{Name: "a", Value: 1, Type: samplers.CounterMetric},
+		{Name: "b", Value: 2, Type: samplers.CounterMetric},
+	}
+	require.NoError(t, spool.add(metrics, now))
+
+	ch := make(chan []samplers.InterMetric, 10)
+	cms, _ := NewChannelMetricSink(ch)
+	sink := &partialMetricSink{channelMetricSink: cms, failName: "b"}
+	assert.Error(t, spool.replay(context.Background(), sink, now))
+	require.Len(t, ch, 1)
+	assert.Equal(t, "a", (<-ch)[0].Name)
+	assert.Equal(t, 1, spool.stats(now).depth)
+
+	sink.failName = ""
+	require.NoError(t, spool.replay(context.Background(), sink, now))
+	replayed := <-ch
+	require.Len(t, replayed, 1, "the metrics that were flushed aren't replayed again")
+	assert.Equal(t, "b", replayed[0].Name)
+	assert.Equal(t, 0, spool.stats(now).depth)
+}
+
+func TestSinkSpoolNonFiniteValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	spool, err := openSinkSpool(dir, 1<<20, time.Hour)
+	require.NoError(t, err)
+	metrics := []samplers.InterMetric{
+		{Name: "a.avg", Value: math.NaN(), Type: samplers.GaugeMetric},
+		{Name: "a.max", Value: math.Inf(-1), Type: samplers.GaugeMetric, Tags: []string{"x:y"}},
+		{Name: "a.min", Value: math.Inf(1), Type: samplers.GaugeMetric},
+		{Name: "a.count", Value: 2.5, Type: samplers.CounterMetric},
+	}
+	require.NoError(t, spool.add(metrics, now))
+
+	ch := make(chan []samplers.InterMetric, 10)
+	cms, _ := NewChannelMetricSink(ch)
+	require.NoError(t, spool.replay(context.Background(), cms, now))
+	replayed := <-ch
+	require.Len(t, replayed, 4)
+	assert.True(t, math.IsNaN(replayed[0].Value))
+	assert.Equal(t, math.Inf(-1), replayed[1].Value)
+	assert.Equal(t, []string{"x:y"}, replayed[1].Tags)
+	assert.Equal(t, math.Inf(1), replayed[2].Value)
+	assert.Equal(t, 2.5, replayed[3].Value)
+}
+
+func TestSinkSpoolRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	spool, err := openSinkSpool(dir, 1<<20, time.Hour)
+	require.NoError(t, err)
+	metrics := []samplers.InterMetric{{Name: "a.b.c", Value: 1, Type: samplers.CounterMetric}}
+	require.NoError(t, spool.add(metrics, now))
+
+	ch := make(chan []samplers.InterMetric, 10)
+	cms, _ := NewChannelMetricSink(ch)
+	sink := &flakyMetricSink{channelMetricSink: cms, failing: 1, err: sinks.Permanent(errors.New("bad request"))}
+	require.NoError(t, spool.replay(context.Background(), sink, now))
+	st := spool.stats(now)
+	assert.Equal(t, 0, st.depth, "rejected payloads aren't kept")
+	assert.Equal(t, map[string]int64{"rejected": 1}, st.dropped)
+}
+
+func TestSinkSpoolNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spools, err := newSinkSpools(filepath.Join(dir, "spools"), 0, 0)
+	require.NoError(t, err)
+	_, err = spools.get("datadog-eu")
+	assert.NoError(t, err)
+	for _, name := range []string{"", "..", "../outside", "a/b", `a\b`} {
+		_, err := spools.get(name)
+		assert.Error(t, err, name)
+	}
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1, "nothing is created outside of the spool directory")
+}
+
+func TestSinkSpoolLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	metrics := []samplers.InterMetric{{Name: "a.b.c", Value: 1.0, Type: samplers.CounterMetric}}
+	spool, err := openSinkSpool(dir, 1<<20, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, spool.add(metrics, now.Add(-2*time.Minute)))
+	require.NoError(t, spool.add(metrics, now))
+
+	ch := make(chan []samplers.InterMetric, 10)
+	sink, _ := NewChannelMetricSink(ch)
+	require.NoError(t, spool.replay(context.Background(), sink, now))
+	assert.Len(t, ch, 1, "expired payloads are discarded")
+	st := spool.stats(now)
+	assert.Equal(t, 0, st.depth)
+	assert.Equal(t, map[string]int64{"expired": 1}, st.dropped)
+
+	spool.maxBytes = 1
+	require.NoError(t, spool.add(metrics, now))
+	require.NoError(t, spool.add(metrics, now))
+	st = spool.stats(now)
+	assert.Equal(t, 1, st.depth, "the newest payload is kept")
+	assert.Equal(t, map[string]int64{"size": 1}, st.dropped)
+}
+
+func TestFlushSpoolsFailedMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := globalConfig()
+	config.SinkSpoolDirectory = dir
+	ch := make(chan []samplers.InterMetric, 10)
+	cms, _ := NewChannelMetricSink(ch)
+	sink := &flakyMetricSink{channelMetricSink: cms, failing: 1}
+	server := setupVeneurServer(t, config, nil, sink, nil, nil)
+	defer server.Shutdown()
+
+	counter := func(value float64) {
+		server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "counter"},
+			Value:      value,
+			SampleRate: 1.0,
+		})
+	}
+	counter(3.0)
+	server.Flush(context.Background())
+	assert.Empty(t, ch)
+	files, err := ioutil.ReadDir(filepath.Join(dir, "channel"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1, "the failed flush is spooled")
+
+	atomic.StoreInt32(&sink.failing, 0)
+	counter(5.0)
+	server.Flush(context.Background())
+	var values []float64
+	for len(ch) > 0 {
+		for _, m := range <-ch {
+			values = append(values, m.Value)
+		}
+	}
+	assert.Equal(t, []float64{5.0, 3.0}, values, "the spooled metrics are flushed after the current ones")
+}
+
+func TestFlushDoesNotSpoolRejectedMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := globalConfig()
+	config.SinkSpoolDirectory = dir
+	ch := make(chan []samplers.InterMetric, 10)
+	cms, _ := NewChannelMetricSink(ch)
+	sink := &flakyMetricSink{channelMetricSink: cms, failing: 1, err: sinks.Permanent(errors.New("bad request"))}
+	server := setupVeneurServer(t, config, nil, sink, nil, nil)
+	defer server.Shutdown()
+
+	server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+		MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "counter"},
+		Value:      3.0,
+		SampleRate: 1.0,
+	})
+	server.Flush(context.Background())
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "channel"))
+	assert.Empty(t, files, "rejected flushes aren't spooled")
+}
+
+func TestFlushSpoolsOnlyFailedMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := globalConfig()
+	config.SinkSpoolDirectory = dir
+	ch := make(chan []samplers.InterMetric, 10)
+	cms, _ := NewChannelMetricSink(ch)
+	sink := &partialMetricSink{channelMetricSink: cms, failName: "b"}
+	server := setupVeneurServer(t, config, nil, sink, nil, nil)
+	defer server.Shutdown()
+
+	for _, name := range []string{"a", "b"} {
+		server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: name, Type: "counter"},
+			Value:      1.0,
+			SampleRate: 1.0,
+		})
+	}
+	server.Flush(context.Background())
+	spool, err := server.spools.get("channel")
+	require.NoError(t, err)
+	require.Equal(t, 1, spool.stats(time.Now()).depth)
+	bts, err := ioutil.ReadFile(spool.entries[0].path)
+	require.NoError(t, err)
+	spooled, err := decodeSpooled(bts)
+	require.NoError(t, err)
+	require.Len(t, spooled, 1, "the metrics that were flushed aren't spooled")
+	assert.Equal(t, "b", spooled[0].Name)
+}
+
+func TestFlushSpoolsFailedDatadogMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var failing int32 = 1
+	series := make(chan []datadog.DDMetric, 10)
+	dd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/series" {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if atomic.LoadInt32(&failing) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		zr, err := zlib.NewReader(r.Body)
+		if !assert.NoError(t, err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var body struct {
+			Series []datadog.DDMetric `json:"series"`
+		}
+		if !assert.NoError(t, json.NewDecoder(zr).Decode(&body)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		series <- body.Series
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer dd.Close()
+
+	config := globalConfig()
+	config.DatadogAPIKey = "farts"
+	config.DatadogAPIHostname = dd.URL
+	config.SinkSpoolDirectory = dir
+	server := setupVeneurServer(t, config, nil, nil, nil, nil)
+	defer server.Shutdown()
+
+	counter := func(value float64) {
+		server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "counter"},
+			Value:      value,
+			SampleRate: 1.0,
+		})
+	}
+	counter(3.0)
+	server.Flush(context.Background())
+	files, err := ioutil.ReadDir(filepath.Join(dir, "datadog"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1, "the batch that Datadog rejected is spooled")
+
+	atomic.StoreInt32(&failing, 0)
+	counter(5.0)
+	server.Flush(context.Background())
+	var values []float64
+	for len(series) > 0 {
+		for _, m := range <-series {
+			if m.Name == "a.b.c" {
+				values = append(values, m.Value[0][1])
+			}
+		}
+	}
+	assert.Len(t, values, 2, "the spooled batch is replayed once Datadog recovers")
+	files, err = ioutil.ReadDir(filepath.Join(dir, "datadog"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
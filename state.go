@@ -0,0 +1,408 @@
+package veneur
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/segmentio/fasthash/fnv1a"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/veneur/forwardrpc"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/samplers/metricpb"
+	"github.com/stripe/veneur/trace"
+)
+
+// savedState is the aggregation state that a server saves to its
+// aggregation_state_file when it shuts down, so that the next server
+// can pick up the interval where it left off.
+type savedState struct {
+	// SavedAt is when the state was saved, in unix nanoseconds.
+	SavedAt  int64
+	Interval time.Duration
+	// Workers are the metrics of each worker.
+	Workers []savedMetrics
+	// Buckets are the buckets of timestamped metrics of each worker,
+	// by the unix timestamp of their interval's end.
+	Buckets []map[int64]savedMetrics
+}
+
+// savedMetrics are the metrics of a worker, or of one of its buckets.
+type savedMetrics struct {
+	// Metrics is a marshaled forwardrpc.MetricList.
+	Metrics []byte
+	// Locals are the local values of the histograms and timers in
+	// Metrics, by their index in the list, since a metricpb.Metric
+	// only holds the t-digest.
+	Locals map[int]histoLocals
+	// StatusChecks have no metricpb.Metric form, so they're saved on
+	// their own.
+	StatusChecks []savedStatusCheck
+}
+
+// histoLocals are the values of a samplers.Histo that only count the
+// samples that this veneur received.
+type histoLocals struct {
+	Weight        float64
+	Min           float64
+	Max           float64
+	Sum           float64
+	ReciprocalSum float64
+}
+
+// savedStatusCheck is a status check with the last value it took.
+type savedStatusCheck struct {
+	Name     string
+	Tags     []string
+	Value    float64
+	Message  string
+	HostName string
+}
+
+// ExportState converts all the metrics that can be restored into
+// another WorkerMetrics to metricpb.Metrics. Status checks aren't
+// exported, and histograms and timers are exported without their local
+// values; saveState saves both.
+func (wm WorkerMetrics) ExportState(cl *trace.Client) []*metricpb.Metric {
+	var metrics []*metricpb.Metric
+	for _, counter := range wm.counters {
+		metrics = wm.appendExportedMetric(metrics, counter, metricpb.Type_Counter, cl, samplers.MixedScope)
+	}
+	for _, counter := range wm.globalCounters {
+		metrics = wm.appendExportedMetric(metrics, counter, metricpb.Type_Counter, cl, samplers.GlobalOnly)
+	}
+	for _, gauge := range wm.gauges {
+		metrics = wm.appendExportedMetric(metrics, gauge, metricpb.Type_Gauge, cl, samplers.MixedScope)
+	}
+	for _, gauge := range wm.globalGauges {
+		metrics = wm.appendExportedMetric(metrics, gauge, metricpb.Type_Gauge, cl, samplers.GlobalOnly)
+	}
+	for _, histo := range wm.histograms {
+		metrics = wm.appendExportedMetric(metrics, histo, metricpb.Type_Histogram, cl, samplers.MixedScope)
+	}
+	for _, histo := range wm.globalHistograms {
+		metrics = wm.appendExportedMetric(metrics, histo, metricpb.Type_Histogram, cl, samplers.GlobalOnly)
+	}
+	for _, histo := range wm.localHistograms {
+		metrics = wm.appendExportedMetric(metrics, histo, metricpb.Type_Histogram, cl, samplers.LocalOnly)
+	}
+	for _, set := range wm.sets {
+		metrics = wm.appendExportedMetric(metrics, set, metricpb.Type_Set, cl, samplers.MixedScope)
+	}
+	for _, set := range wm.localSets {
+		metrics = wm.appendExportedMetric(metrics, set, metricpb.Type_Set, cl, samplers.LocalOnly)
+	}
+	for _, timer := range wm.timers {
+		metrics = wm.appendExportedMetric(metrics, timer, metricpb.Type_Timer, cl, samplers.MixedScope)
+	}
+	for _, timer := range wm.globalTimers {
+		metrics = wm.appendExportedMetric(metrics, timer, metricpb.Type_Timer, cl, samplers.GlobalOnly)
+	}
+	for _, timer := range wm.localTimers {
+		metrics = wm.appendExportedMetric(metrics, timer, metricpb.Type_Timer, cl, samplers.LocalOnly)
+	}
+	return metrics
+}
+
+// saveState converts the metrics to savedMetrics, and returns them
+// with the number of series they hold.
+func (wm WorkerMetrics) saveState(cl *trace.Client) (savedMetrics, int, error) {
+	list := forwardrpc.MetricList{Metrics: wm.ExportState(cl)}
+	saved := savedMetrics{Locals: map[int]histoLocals{}}
+	for i, m := range list.Metrics {
+		if m.GetHistogram() == nil {
+			continue
+		}
+		scope := samplers.ScopeFromPB(m.Scope)
+		h := wm.histos(m.Type, scope)[samplers.NewMetricKeyFromMetric(m)]
+		if h == nil {
+			continue
+		}
+		saved.Locals[i] = histoLocals{
+			Weight:        h.LocalWeight,
+			Min:           h.LocalMin,
+			Max:           h.LocalMax,
+			Sum:           h.LocalSum,
+			ReciprocalSum: h.LocalReciprocalSum,
+		}
+	}
+	for _, check := range wm.localStatusChecks {
+		saved.StatusChecks = append(saved.StatusChecks, savedStatusCheck{
+			Name:     check.Name,
+			Tags:     check.Tags,
+			Value:    check.Value,
+			Message:  check.Message,
+			HostName: check.HostName,
+		})
+	}
+	bts, err := list.Marshal()
+	if err != nil {
+		return savedMetrics{}, 0, err
+	}
+	saved.Metrics = bts
+	return saved, len(list.Metrics) + len(saved.StatusChecks), nil
+}
+
+// histos returns the histograms, or the timers if mType is a timer, of
+// the given scope.
+func (wm WorkerMetrics) histos(mType metricpb.Type, scope samplers.MetricScope) map[samplers.MetricKey]*samplers.Histo {
+	if mType == metricpb.Type_Timer {
+		switch scope {
+		case samplers.GlobalOnly:
+			return wm.globalTimers
+		case samplers.LocalOnly:
+			return wm.localTimers
+		}
+		return wm.timers
+	}
+	switch scope {
+	case samplers.GlobalOnly:
+		return wm.globalHistograms
+	case samplers.LocalOnly:
+		return wm.localHistograms
+	}
+	return wm.histograms
+}
+
+// exportState removes the worker's metrics and its buckets of
+// timestamped metrics, and returns them as savedMetrics with the number
+// of series they hold. The buckets are keyed by the unix timestamp of
+// their interval's end.
+func (w *Worker) exportState() (savedMetrics, map[int64]savedMetrics, int, error) {
+	w.mutex.Lock()
+	wm, buckets := w.wm, w.buckets
+	w.wm, w.buckets = NewWorkerMetrics(), nil
+	w.mutex.Unlock()
+
+	saved, total, err := wm.saveState(w.traceClient)
+	if err != nil {
+		return savedMetrics{}, nil, 0, err
+	}
+	savedBuckets := make(map[int64]savedMetrics, len(buckets))
+	for end, bucket := range buckets {
+		s, n, err := bucket.saveState(w.traceClient)
+		if err != nil {
+			return savedMetrics{}, nil, 0, err
+		}
+		savedBuckets[end] = s
+		total += n
+	}
+	return saved, savedBuckets, total, nil
+}
+
+// RestoreMetric merges a metric that was exported with ExportState
+// into the worker's metrics, in the same scope that it was exported
+// from.
+func (w *Worker) RestoreMetric(other *metricpb.Metric) error {
+	return w.restoreMetric(0, other, nil)
+}
+
+// restoreMetric is like RestoreMetric, but merges the metric into the
+// bucket of timestamped metrics of the interval that ends at end, unless
+// end is 0, and restores the local values of a histogram or timer too
+// if locals isn't nil.
+func (w *Worker) restoreMetric(end int64, other *metricpb.Metric, locals *histoLocals) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	wm := w.wm
+	if end != 0 {
+		wm = w.bucket(end)
+	}
+
+	scope := samplers.ScopeFromPB(other.Scope)
+	key, ok := w.upsert(wm, samplers.NewMetricKeyFromMetric(other), scope, other.Tags)
+	if !ok {
+		return nil
+	}
+
+	switch v := other.GetValue().(type) {
+	case *metricpb.Metric_Counter:
+		if scope == samplers.GlobalOnly {
+			wm.globalCounters[key].Merge(v.Counter)
+		} else {
+			wm.counters[key].Merge(v.Counter)
+		}
+	case *metricpb.Metric_Gauge:
+		if scope == samplers.GlobalOnly {
+			wm.globalGauges[key].Merge(v.Gauge)
+		} else {
+			wm.gauges[key].Merge(v.Gauge)
+		}
+	case *metricpb.Metric_Set:
+		if scope == samplers.LocalOnly {
+			return wm.localSets[key].Merge(v.Set)
+		}
+		return wm.sets[key].Merge(v.Set)
+	case *metricpb.Metric_Histogram:
+		h := wm.histos(other.Type, scope)[key]
+		h.Merge(v.Histogram)
+		if locals != nil {
+			h.LocalWeight += locals.Weight
+			h.LocalMin = math.Min(h.LocalMin, locals.Min)
+			h.LocalMax = math.Max(h.LocalMax, locals.Max)
+			h.LocalSum += locals.Sum
+			h.LocalReciprocalSum += locals.ReciprocalSum
+		}
+	default:
+		return fmt.Errorf("can't restore a metric with value %T", v)
+	}
+	return nil
+}
+
+// restoreStatusCheck restores a status check that was saved with
+// saveState into the worker's metrics, or into the bucket of the
+// interval that ends at end unless end is 0.
+func (w *Worker) restoreStatusCheck(end int64, check savedStatusCheck) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	wm := w.wm
+	if end != 0 {
+		wm = w.bucket(end)
+	}
+	mk := samplers.MetricKey{
+		Name:       check.Name,
+		Type:       statusTypeName,
+		JoinedTags: strings.Join(check.Tags, ","),
+	}
+	key, _ := w.upsert(wm, mk, samplers.LocalOnly, check.Tags)
+	wm.localStatusChecks[key].Sample(check.Value, 1.0, check.Message, check.HostName)
+}
+
+// saveState writes the workers' metrics to the state file.
+func (s *Server) saveState() error {
+	state := savedState{
+		SavedAt:  time.Now().UnixNano(),
+		Interval: s.interval,
+		Workers:  make([]savedMetrics, len(s.Workers)),
+		Buckets:  make([]map[int64]savedMetrics, len(s.Workers)),
+	}
+	total := 0
+	for i, w := range s.Workers {
+		saved, buckets, n, err := w.exportState()
+		if err != nil {
+			return err
+		}
+		state.Workers[i], state.Buckets[i] = saved, buckets
+		total += n
+	}
+
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(state); err != nil {
+		return err
+	}
+	// Write the state to a temporary file first, so that the
+	// next server never reads a partial one:
+	tmp := s.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.stateFile); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		"file":    s.stateFile,
+		"metrics": total,
+	}).Info("Saved aggregation state")
+	return nil
+}
+
+// restoreState reads the state file that a previous server saved, and
+// merges its metrics into the workers if they're from the current
+// interval. The file is removed either way, so that it's only restored
+// once.
+func (s *Server) restoreState(now time.Time) error {
+	bts, err := ioutil.ReadFile(s.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(s.stateFile); err != nil {
+		return err
+	}
+
+	state := savedState{}
+	if err := gob.NewDecoder(bytes.NewReader(bts)).Decode(&state); err != nil {
+		return fmt.Errorf("could not decode %s: %v", s.stateFile, err)
+	}
+	savedAt := time.Unix(0, state.SavedAt)
+	logger := log.WithFields(logrus.Fields{
+		"file":     s.stateFile,
+		"saved_at": savedAt,
+	})
+	if !s.sameInterval(state.Interval, savedAt, now) {
+		logger.Info("Discarding aggregation state from an earlier interval")
+		return nil
+	}
+
+	total := 0
+	// With the same number of workers, a series goes back to the
+	// worker that aggregated it. Otherwise, it goes where an imported
+	// metric would:
+	worker := func(i int, mk samplers.MetricKey) *Worker {
+		if len(state.Workers) == len(s.Workers) {
+			return s.Workers[i]
+		}
+		h := fnv1a.Init32
+		h = fnv1a.AddString32(h, mk.Name)
+		h = fnv1a.AddString32(h, mk.Type)
+		h = fnv1a.AddString32(h, mk.JoinedTags)
+		return s.Workers[h%uint32(len(s.Workers))]
+	}
+	restore := func(i int, end int64, saved savedMetrics) error {
+		list := forwardrpc.MetricList{}
+		if err := list.Unmarshal(saved.Metrics); err != nil {
+			return fmt.Errorf("could not decode %s: %v", s.stateFile, err)
+		}
+		for j, m := range list.Metrics {
+			var locals *histoLocals
+			if l, ok := saved.Locals[j]; ok {
+				locals = &l
+			}
+			w := worker(i, samplers.NewMetricKeyFromMetric(m))
+			if err := w.restoreMetric(end, m, locals); err != nil {
+				logger.WithError(err).WithField("name", m.Name).Warn("Could not restore a metric")
+				continue
+			}
+			total++
+		}
+		for _, check := range saved.StatusChecks {
+			mk := samplers.MetricKey{Name: check.Name, Type: statusTypeName, JoinedTags: strings.Join(check.Tags, ",")}
+			worker(i, mk).restoreStatusCheck(end, check)
+			total++
+		}
+		return nil
+	}
+	for i, saved := range state.Workers {
+		if err := restore(i, 0, saved); err != nil {
+			return err
+		}
+	}
+	for i, buckets := range state.Buckets {
+		for end, saved := range buckets {
+			if err := restore(i, end, saved); err != nil {
+				return err
+			}
+		}
+	}
+	logger.WithField("metrics", total).Info("Restored aggregation state")
+	return nil
+}
+
+// sameInterval returns true if the state saved at savedAt belongs in
+// the interval that's in progress at now.
+func (s *Server) sameInterval(interval time.Duration, savedAt, now time.Time) bool {
+	if interval != s.interval || now.Sub(savedAt) >= s.interval || now.Before(savedAt) {
+		return false
+	}
+	if s.synchronizeInterval {
+		return savedAt.Truncate(s.interval).Equal(now.Truncate(s.interval))
+	}
+	return true
+}
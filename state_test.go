@@ -0,0 +1,193 @@
+package veneur
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/veneur/forwardrpc"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/samplers/metricpb"
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/tdigest"
+)
+
+func TestWorkerRestoreMetric(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New(), nil)
+	for _, m := range []samplers.UDPMetric{
+		{MetricKey: samplers.MetricKey{Name: "counter", Type: "counter"}, Value: 2.0},
+		{MetricKey: samplers.MetricKey{Name: "counter", Type: "counter"}, Value: 3.0, Scope: samplers.GlobalOnly},
+		{MetricKey: samplers.MetricKey{Name: "gauge", Type: "gauge"}, Value: 4.0},
+		{MetricKey: samplers.MetricKey{Name: "histo", Type: "histogram"}, Value: 1.0},
+		{MetricKey: samplers.MetricKey{Name: "histo", Type: "histogram"}, Value: 5.0},
+		{MetricKey: samplers.MetricKey{Name: "set", Type: "set"}, Value: "a", Scope: samplers.LocalOnly},
+		{MetricKey: samplers.MetricKey{Name: "timer", Type: "timer"}, Value: 7.0, Scope: samplers.GlobalOnly},
+		{MetricKey: samplers.MetricKey{Name: "status", Type: "status"}, Value: ssf.SSFSample_WARNING, Message: "degraded"},
+	} {
+		m.SampleRate = 1.0
+		w.ProcessMetric(&m)
+	}
+	saved, buckets, total, err := w.exportState()
+	require.NoError(t, err)
+	assert.Empty(t, buckets)
+	assert.Equal(t, 7, total)
+	assert.Empty(t, w.Flush().counters, "exporting the state removes it")
+	list := forwardrpc.MetricList{}
+	require.NoError(t, list.Unmarshal(saved.Metrics))
+	exported := list.Metrics
+	assert.Len(t, exported, 6, "everything but the status check is exported")
+	assert.Len(t, saved.Locals, 2, "histograms and timers keep their local values")
+	require.Len(t, saved.StatusChecks, 1)
+
+	restored := NewWorker(2, nil, logrus.New(), nil)
+	for i, m := range exported {
+		var locals *histoLocals
+		if l, ok := saved.Locals[i]; ok {
+			locals = &l
+		}
+		require.NoError(t, restored.restoreMetric(0, m, locals))
+	}
+	restored.restoreStatusCheck(0, saved.StatusChecks[0])
+	wm := restored.Flush()
+	assert.Len(t, wm.counters, 1)
+	assert.Len(t, wm.globalCounters, 1)
+	assert.Len(t, wm.gauges, 1)
+	assert.Len(t, wm.histograms, 1)
+	assert.Len(t, wm.localSets, 1)
+	assert.Len(t, wm.globalTimers, 1)
+
+	require.Len(t, wm.localStatusChecks, 1)
+	for _, check := range wm.localStatusChecks {
+		assert.Equal(t, "status", check.Name)
+		assert.Equal(t, float64(ssf.SSFSample_WARNING), check.Value)
+		assert.Equal(t, "degraded", check.Message)
+	}
+
+	aggregates := samplers.HistogramAggregates{
+		Value: samplers.AggregateMin | samplers.AggregateMax | samplers.AggregateCount | samplers.AggregateSum,
+		Count: 4,
+	}
+	for _, h := range wm.histograms {
+		values := map[string]float64{}
+		for _, m := range h.Flush(10*time.Second, nil, aggregates, false) {
+			values[m.Name] = m.Value
+		}
+		assert.Equal(t, map[string]float64{
+			"histo.min":   1.0,
+			"histo.max":   5.0,
+			"histo.count": 2.0,
+			"histo.sum":   6.0,
+		}, values, "the local values are restored with the digest")
+	}
+
+	byKey := func(metrics []*metricpb.Metric) map[string]*metricpb.Metric {
+		ret := map[string]*metricpb.Metric{}
+		for _, m := range metrics {
+			ret[m.Name+m.Scope.String()] = m
+		}
+		return ret
+	}
+	before, after := byKey(exported), byKey(wm.ExportState(nil))
+	require.Len(t, after, len(before))
+	for key, m := range before {
+		if h := m.GetHistogram(); h != nil {
+			expected := tdigest.NewMergingFromData(h.TDigest)
+			actual := tdigest.NewMergingFromData(after[key].GetHistogram().TDigest)
+			assert.Equal(t, expected.Count(), actual.Count(), key)
+			assert.Equal(t, expected.Quantile(0.5), actual.Quantile(0.5), key)
+			continue
+		}
+		assert.Equal(t, m, after[key], key)
+	}
+}
+
+func TestSaveRestoreState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := globalConfig()
+	config.Interval = "10s"
+	config.AggregationStateFile = filepath.Join(dir, "state")
+
+	server := setupVeneurServer(t, config, nil, nil, nil, nil)
+	server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+		MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "counter"},
+		Value:      5.0,
+		SampleRate: 1.0,
+	})
+	server.Shutdown()
+	_, err = os.Stat(config.AggregationStateFile)
+	require.NoError(t, err, "the state is saved on shutdown")
+
+	config.NumWorkers = 2
+	ch := make(chan []samplers.InterMetric, 20)
+	sink, _ := NewChannelMetricSink(ch)
+	server = setupVeneurServer(t, config, nil, sink, nil, nil)
+	_, err = os.Stat(config.AggregationStateFile)
+	assert.True(t, os.IsNotExist(err), "the state is only restored once")
+
+	server.Flush(context.Background())
+	select {
+	case metrics := <-ch:
+		require.Len(t, metrics, 1)
+		assert.Equal(t, "a.b.c", metrics[0].Name)
+		assert.Equal(t, 5.0, metrics[0].Value)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the restored metrics were not flushed")
+	}
+
+	// state from an earlier interval is discarded:
+	server.Workers[1].ProcessMetric(&samplers.UDPMetric{
+		MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "counter"},
+		Value:      5.0,
+		SampleRate: 1.0,
+	})
+	server.Shutdown()
+	server, err = NewFromConfig(logrus.New(), config)
+	require.NoError(t, err)
+	require.NoError(t, server.restoreState(time.Now().Add(time.Minute)))
+	for _, w := range server.Workers {
+		assert.Empty(t, w.Flush().counters)
+	}
+	_, err = os.Stat(config.AggregationStateFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSaveRestoreStateBuckets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := globalConfig()
+	config.Interval = "10s"
+	config.TimestampLateness = "1m"
+	config.AggregationStateFile = filepath.Join(dir, "state")
+
+	now := time.Now()
+	server := setupVeneurServer(t, config, nil, nil, nil, nil)
+	server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+		MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "counter"},
+		Value:      5.0,
+		SampleRate: 1.0,
+		Timestamp:  now.Add(-30 * time.Second).Unix(),
+	})
+	server.Shutdown()
+
+	server = setupVeneurServer(t, config, nil, nil, nil, nil)
+	defer server.Shutdown()
+	buckets := server.Workers[0].FlushBuckets(now.Add(2*time.Minute), false)
+	require.Len(t, buckets, 1, "the buckets of timestamped metrics are restored")
+	assert.Equal(t, now.Add(-30*time.Second).Truncate(10*time.Second).Add(10*time.Second).Unix(), buckets[0].timestamp)
+	require.Len(t, buckets[0].counters, 1)
+	for key, c := range buckets[0].counters {
+		assert.Equal(t, "a.b.c", key.Name)
+		assert.Equal(t, float64(5), c.Flush(10 * time.Second)[0].Value)
+	}
+}
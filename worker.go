@@ -1,8 +1,10 @@
 package veneur
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -32,6 +34,7 @@ type Worker struct {
 	ImportChan       chan []samplers.JSONMetric
 	ImportMetricChan chan []*metricpb.Metric
 	QuitChan         chan struct{}
+	idleChan         chan chan struct{}
 	processed        int64
 	imported         int64
 	mutex            *sync.Mutex
@@ -39,6 +42,18 @@ type Worker struct {
 	logger           *logrus.Logger
 	wm               WorkerMetrics
 	stats            scopedstatsd.Client
+
+	// interval and lateness control how timestamped samples are
+	// bucketed: a sample from an earlier interval is aggregated into
+	// that interval's bucket, as long as it arrives within lateness of
+	// the interval's end. A zero lateness disables bucketing.
+	interval time.Duration
+	lateness time.Duration
+	buckets  map[int64]WorkerMetrics
+	late     int64
+
+	// limiter caps the number of series per metric name, if it's set.
+	limiter *cardinalityLimiter
 }
 
 // IngestUDP on a Worker feeds the metric into the worker's PacketChan.
@@ -75,6 +90,11 @@ type WorkerMetrics struct {
 	localSets         map[samplers.MetricKey]*samplers.Set
 	localTimers       map[samplers.MetricKey]*samplers.Histo
 	localStatusChecks map[samplers.MetricKey]*samplers.StatusCheck
+
+	// timestamp is the unix timestamp that the metrics should be
+	// flushed with, if they were bucketed into an earlier interval.
+	// Zero means the time of the flush.
+	timestamp int64
 }
 
 // NewWorkerMetrics initializes a WorkerMetrics struct
@@ -170,6 +190,50 @@ func (wm WorkerMetrics) Upsert(mk samplers.MetricKey, Scope samplers.MetricScope
 	return !present
 }
 
+// has returns true if there is an entry for the metric key, in the
+// place that Upsert would create it for the scope.
+func (wm WorkerMetrics) has(mk samplers.MetricKey, scope samplers.MetricScope) (present bool) {
+	switch mk.Type {
+	case counterTypeName:
+		if scope == samplers.GlobalOnly {
+			_, present = wm.globalCounters[mk]
+		} else {
+			_, present = wm.counters[mk]
+		}
+	case gaugeTypeName:
+		if scope == samplers.GlobalOnly {
+			_, present = wm.globalGauges[mk]
+		} else {
+			_, present = wm.gauges[mk]
+		}
+	case histogramTypeName:
+		if scope == samplers.LocalOnly {
+			_, present = wm.localHistograms[mk]
+		} else if scope == samplers.GlobalOnly {
+			_, present = wm.globalHistograms[mk]
+		} else {
+			_, present = wm.histograms[mk]
+		}
+	case setTypeName:
+		if scope == samplers.LocalOnly {
+			_, present = wm.localSets[mk]
+		} else {
+			_, present = wm.sets[mk]
+		}
+	case timerTypeName:
+		if scope == samplers.LocalOnly {
+			_, present = wm.localTimers[mk]
+		} else if scope == samplers.GlobalOnly {
+			_, present = wm.globalTimers[mk]
+		} else {
+			_, present = wm.timers[mk]
+		}
+	case statusTypeName:
+		_, present = wm.localStatusChecks[mk]
+	}
+	return present
+}
+
 // ForwardableMetrics converts all metrics that should be forwarded to
 // metricpb.Metric (protobuf-compatible).
 func (wm WorkerMetrics) ForwardableMetrics(cl *trace.Client) []*metricpb.Metric {
@@ -240,6 +304,7 @@ func NewWorker(id int, cl *trace.Client, logger *logrus.Logger, stats scopedstat
 		ImportChan:       make(chan []samplers.JSONMetric, 32),
 		ImportMetricChan: make(chan []*metricpb.Metric, 32),
 		QuitChan:         make(chan struct{}),
+		idleChan:         make(chan chan struct{}),
 		processed:        0,
 		imported:         0,
 		mutex:            &sync.Mutex{},
@@ -265,6 +330,9 @@ func (w *Worker) Work() {
 			for _, m := range ms {
 				w.ImportMetricGRPC(m)
 			}
+		case done := <-w.idleChan:
+			// everything we took before is processed:
+			close(done)
 		case <-w.QuitChan:
 			// We have been asked to stop.
 			log.WithField("worker", w.id).Error("Stopping")
@@ -287,51 +355,111 @@ func (w *Worker) ProcessMetric(m *samplers.UDPMetric) {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 	w.processed++
-	w.wm.Upsert(m.MetricKey, m.Scope, m.Tags)
+	wm := w.metricsFor(m.Timestamp, time.Now())
+	key, ok := w.upsert(wm, m.MetricKey, m.Scope, m.Tags)
+	if !ok {
+		return
+	}
 
 	switch m.Type {
 	case counterTypeName:
 		if m.Scope == samplers.GlobalOnly {
-			w.wm.globalCounters[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			wm.globalCounters[key].Sample(m.Value.(float64), m.SampleRate)
 		} else {
-			w.wm.counters[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			wm.counters[key].Sample(m.Value.(float64), m.SampleRate)
 		}
 	case gaugeTypeName:
 		if m.Scope == samplers.GlobalOnly {
-			w.wm.globalGauges[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			wm.globalGauges[key].Sample(m.Value.(float64), m.SampleRate)
 		} else {
-			w.wm.gauges[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			wm.gauges[key].Sample(m.Value.(float64), m.SampleRate)
 		}
 	case histogramTypeName:
 		if m.Scope == samplers.LocalOnly {
-			w.wm.localHistograms[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			wm.localHistograms[key].Sample(m.Value.(float64), m.SampleRate)
 		} else if m.Scope == samplers.GlobalOnly {
-			w.wm.globalHistograms[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			wm.globalHistograms[key].Sample(m.Value.(float64), m.SampleRate)
 		} else {
-			w.wm.histograms[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			wm.histograms[key].Sample(m.Value.(float64), m.SampleRate)
 		}
 	case setTypeName:
 		if m.Scope == samplers.LocalOnly {
-			w.wm.localSets[m.MetricKey].Sample(m.Value.(string), m.SampleRate)
+			wm.localSets[key].Sample(m.Value.(string), m.SampleRate)
 		} else {
-			w.wm.sets[m.MetricKey].Sample(m.Value.(string), m.SampleRate)
+			wm.sets[key].Sample(m.Value.(string), m.SampleRate)
 		}
 	case timerTypeName:
 		if m.Scope == samplers.LocalOnly {
-			w.wm.localTimers[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			wm.localTimers[key].Sample(m.Value.(float64), m.SampleRate)
 		} else if m.Scope == samplers.GlobalOnly {
-			w.wm.globalTimers[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			wm.globalTimers[key].Sample(m.Value.(float64), m.SampleRate)
 		} else {
-			w.wm.timers[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			wm.timers[key].Sample(m.Value.(float64), m.SampleRate)
 		}
 	case statusTypeName:
 		v := float64(m.Value.(ssf.SSFSample_Status))
-		w.wm.localStatusChecks[m.MetricKey].Sample(v, m.SampleRate, m.Message, m.HostName)
+		wm.localStatusChecks[key].Sample(v, m.SampleRate, m.Message, m.HostName)
 	default:
 		log.WithField("type", m.Type).Error("Unknown metric type for processing")
 	}
 }
 
+// upsert creates the entry for a metric key like WorkerMetrics.Upsert
+// does, but subject to the cardinality limit. It returns the key that
+// the sample should be aggregated under: If creating a new series
+// would exceed the limit for the metric's name, that's the name's
+// overflow series, or, if the limiter drops samples, upsert returns
+// false.
+func (w *Worker) upsert(wm WorkerMetrics, mk samplers.MetricKey, scope samplers.MetricScope, tags []string) (samplers.MetricKey, bool) {
+	if w.limiter == nil || mk.Type == statusTypeName || wm.has(mk, scope) || w.limiter.admit(mk) {
+		wm.Upsert(mk, scope, tags)
+		return mk, true
+	}
+	if w.limiter.drop {
+		return mk, false
+	}
+	overflow := samplers.MetricKey{Name: mk.Name, Type: mk.Type, JoinedTags: overflowTag}
+	wm.Upsert(overflow, scope, []string{overflowTag})
+	return overflow, true
+}
+
+// metricsFor returns the WorkerMetrics that a sample with the given unix
+// timestamp should be aggregated into. Samples without a timestamp, and
+// samples from the current interval or the future, go into the current
+// interval. Samples from an earlier interval go into that interval's
+// bucket, unless they missed the lateness window, in which case they're
+// counted as late and go into the current interval after all.
+func (w *Worker) metricsFor(timestamp int64, now time.Time) WorkerMetrics {
+	if timestamp == 0 || w.interval <= 0 || w.lateness <= 0 {
+		return w.wm
+	}
+	start := time.Unix(timestamp, 0).Truncate(w.interval)
+	if !start.Before(now.Truncate(w.interval)) {
+		return w.wm
+	}
+	end := start.Add(w.interval)
+	if now.After(end.Add(w.lateness)) {
+		w.late++
+		return w.wm
+	}
+	return w.bucket(end.Unix())
+}
+
+// bucket returns the bucket of timestamped metrics of the interval that
+// ends at the unix timestamp end, and creates it if necessary.
+func (w *Worker) bucket(end int64) WorkerMetrics {
+	wm, ok := w.buckets[end]
+	if !ok {
+		wm = NewWorkerMetrics()
+		wm.timestamp = end
+		if w.buckets == nil {
+			w.buckets = map[int64]WorkerMetrics{}
+		}
+		w.buckets[end] = wm
+	}
+	return wm
+}
+
 // ImportMetric receives a metric from another veneur instance
 func (w *Worker) ImportMetric(other samplers.JSONMetric) {
 	w.mutex.Lock()
@@ -340,32 +468,35 @@ func (w *Worker) ImportMetric(other samplers.JSONMetric) {
 	// we don't increment the processed metric counter here, it was already
 	// counted by the original veneur that sent this to us
 	w.imported++
+	scope := samplers.MixedScope
 	if other.Type == counterTypeName || other.Type == gaugeTypeName {
 		// this is an odd special case -- counters that are imported are global
-		w.wm.Upsert(other.MetricKey, samplers.GlobalOnly, other.Tags)
-	} else {
-		w.wm.Upsert(other.MetricKey, samplers.MixedScope, other.Tags)
+		scope = samplers.GlobalOnly
+	}
+	key, ok := w.upsert(w.wm, other.MetricKey, scope, other.Tags)
+	if !ok {
+		return
 	}
 
 	switch other.Type {
 	case counterTypeName:
-		if err := w.wm.globalCounters[other.MetricKey].Combine(other.Value); err != nil {
+		if err := w.wm.globalCounters[key].Combine(other.Value); err != nil {
 			log.WithError(err).Error("Could not merge counters")
 		}
 	case gaugeTypeName:
-		if err := w.wm.globalGauges[other.MetricKey].Combine(other.Value); err != nil {
+		if err := w.wm.globalGauges[key].Combine(other.Value); err != nil {
 			log.WithError(err).Error("Could not merge gauges")
 		}
 	case setTypeName:
-		if err := w.wm.sets[other.MetricKey].Combine(other.Value); err != nil {
+		if err := w.wm.sets[key].Combine(other.Value); err != nil {
 			log.WithError(err).Error("Could not merge sets")
 		}
 	case histogramTypeName:
-		if err := w.wm.histograms[other.MetricKey].Combine(other.Value); err != nil {
+		if err := w.wm.histograms[key].Combine(other.Value); err != nil {
 			log.WithError(err).Error("Could not merge histograms")
 		}
 	case timerTypeName:
-		if err := w.wm.timers[other.MetricKey].Combine(other.Value); err != nil {
+		if err := w.wm.timers[key].Combine(other.Value); err != nil {
 			log.WithError(err).Error("Could not merge timers")
 		}
 	default:
@@ -392,8 +523,11 @@ func (w *Worker) ImportMetricGRPC(other *metricpb.Metric) (err error) {
 		return fmt.Errorf("gRPC import does not accept local metrics")
 	}
 
-	w.wm.Upsert(key, scope, other.Tags)
 	w.imported++
+	key, ok := w.upsert(w.wm, key, scope, other.Tags)
+	if !ok {
+		return nil
+	}
 
 	switch v := other.GetValue().(type) {
 	case *metricpb.Metric_Counter:
@@ -446,18 +580,58 @@ func (w *Worker) Flush() WorkerMetrics {
 	ret := w.wm
 	processed := w.processed
 	imported := w.imported
+	late := w.late
 
 	w.wm = wm
 	w.processed = 0
 	w.imported = 0
+	w.late = 0
 	w.mutex.Unlock()
 
 	w.stats.Count("worker.metrics_processed_total", processed, []string{}, 1.0)
 	w.stats.Count("worker.metrics_imported_total", imported, []string{}, 1.0)
+	if late > 0 {
+		w.stats.Count("worker.metrics_late_total", late, []string{}, 1.0)
+	}
 
 	return ret
 }
 
+// FlushBuckets removes and returns the buckets of timestamped metrics
+// whose lateness window has passed by now, or all of them if all is
+// true, e.g. because this is the final flush. Each one carries the
+// timestamp of the end of its interval.
+func (w *Worker) FlushBuckets(now time.Time, all bool) []WorkerMetrics {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	var ret []WorkerMetrics
+	for end, wm := range w.buckets {
+		if !all && now.Before(time.Unix(end, 0).Add(w.lateness)) {
+			continue
+		}
+		ret = append(ret, wm)
+		delete(w.buckets, end)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].timestamp < ret[j].timestamp })
+	return ret
+}
+
+// waitIdle waits until the worker has processed the metrics that it took
+// off its channels, or until ctx is done.
+func (w *Worker) waitIdle(ctx context.Context) {
+	done := make(chan struct{})
+	select {
+	case w.idleChan <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
 // Stop tells the worker to stop listening for work requests.
 //
 // Note that the worker will only stop *after* it has finished its work.
@@ -515,9 +689,11 @@ func (ew *EventWorker) Flush() []ssf.SSFSample {
 
 // SpanWorker is similar to a Worker but it collects events and service checks instead of metrics.
 type SpanWorker struct {
-	SpanChan   <-chan *ssf.SSFSpan
-	sinkTags   []map[string]string
-	commonTags map[string]string
+	SpanChan <-chan *ssf.SSFSpan
+	sinkTags []map[string]string
+	// commonTags holds the map[string]string of tags that are added
+	// to each span, which SetCommonTags replaces.
+	commonTags atomic.Value
 	sinks      []sinks.SpanSink
 
 	// cumulative time spent per sink, in nanoseconds
@@ -537,15 +713,21 @@ func NewSpanWorker(sinks []sinks.SpanSink, cl *trace.Client, statsd scopedstatsd
 		}
 	}
 
-	return &SpanWorker{
+	tw := &SpanWorker{
 		SpanChan:        spanChan,
 		sinks:           sinks,
 		sinkTags:        tags,
-		commonTags:      commonTags,
 		cumulativeTimes: make([]int64, len(sinks)),
 		traceClient:     cl,
 		statsd:          scopedstatsd.Ensure(statsd),
 	}
+	tw.SetCommonTags(commonTags)
+	return tw
+}
+
+// SetCommonTags replaces the tags that are added to each span.
+func (tw *SpanWorker) SetCommonTags(commonTags map[string]string) {
+	tw.commonTags.Store(commonTags)
 }
 
 // Work will start the SpanWorker listening for spans.
@@ -559,11 +741,12 @@ func (tw *SpanWorker) Work() {
 			atomic.AddInt64(&tw.capCount, 1)
 		}
 
-		if m.Tags == nil && len(tw.commonTags) != 0 {
-			m.Tags = make(map[string]string, len(tw.commonTags))
+		commonTags, _ := tw.commonTags.Load().(map[string]string)
+		if m.Tags == nil && len(commonTags) != 0 {
+			m.Tags = make(map[string]string, len(commonTags))
 		}
 
-		for k, v := range tw.commonTags {
+		for k, v := range commonTags {
 			if _, has := m.Tags[k]; !has {
 				m.Tags[k] = v
 			}
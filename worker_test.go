@@ -427,3 +427,184 @@ func TestWorkerMetricsForwardableMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestWorkerTimestampBuckets(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New(), nil)
+	w.interval = 10 * time.Second
+	w.lateness = time.Minute
+
+	now := time.Now()
+	counter := func(name string, ts time.Time) *samplers.UDPMetric {
+		m := &samplers.UDPMetric{
+			MetricKey:  samplers.MetricKey{Name: name, Type: "counter"},
+			Value:      1.0,
+			SampleRate: 1.0,
+		}
+		if !ts.IsZero() {
+			m.Timestamp = ts.Unix()
+		}
+		return m
+	}
+	w.ProcessMetric(counter("untimed", time.Time{}))
+	w.ProcessMetric(counter("current", now))
+	w.ProcessMetric(counter("future", now.Add(time.Hour)))
+	w.ProcessMetric(counter("too_late", now.Add(-10*time.Minute)))
+	w.ProcessMetric(counter("late", now.Add(-30*time.Second)))
+	w.ProcessMetric(counter("late", now.Add(-30*time.Second)))
+
+	wm := w.Flush()
+	names := []string{}
+	for key := range wm.counters {
+		names = append(names, key.Name)
+	}
+	assert.ElementsMatch(t, []string{"untimed", "current", "future", "too_late"}, names)
+	assert.Equal(t, int64(0), wm.timestamp)
+
+	// the bucket is held until its lateness window has passed:
+	assert.Empty(t, w.FlushBuckets(now, false))
+	buckets := w.FlushBuckets(now.Add(2*time.Minute), false)
+	require.Len(t, buckets, 1)
+	assert.Equal(t, now.Add(-30*time.Second).Truncate(w.interval).Add(w.interval).Unix(), buckets[0].timestamp)
+	require.Len(t, buckets[0].counters, 1)
+	for key, c := range buckets[0].counters {
+		assert.Equal(t, "late", key.Name)
+		assert.Equal(t, float64(2), c.Flush(w.interval)[0].Value)
+	}
+	assert.Empty(t, w.FlushBuckets(now.Add(2*time.Minute), false))
+
+	// the final flush doesn't wait for the lateness window:
+	w.ProcessMetric(counter("late", now.Add(-30*time.Second)))
+	assert.Len(t, w.FlushBuckets(now, true), 1)
+}
+
+func TestWorkerTimestampBucketsDisabled(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New(), nil)
+	w.interval = 10 * time.Second
+
+	w.ProcessMetric(&samplers.UDPMetric{
+		MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "counter"},
+		Value:      1.0,
+		SampleRate: 1.0,
+		Timestamp:  time.Now().Add(-30 * time.Second).Unix(),
+	})
+	assert.Len(t, w.Flush().counters, 1)
+	assert.Empty(t, w.FlushBuckets(time.Now().Add(time.Hour), false))
+}
+
+func TestWorkerCardinalityLimit(t *testing.T) {
+	limiter, err := newCardinalityLimiter(2, "")
+	require.NoError(t, err)
+	w := NewWorker(1, nil, logrus.New(), nil)
+	w.limiter = limiter
+
+	for _, tag := range []string{"request:1", "request:2", "request:3", "request:4", "request:1"} {
+		m := samplers.NewUDPMetric("a.b.c", "counter", 1.0, []string{tag})
+		w.ProcessMetric(&m)
+	}
+	m := samplers.NewUDPMetric("x.y.z", "counter", 1.0, []string{"request:3"})
+	w.ProcessMetric(&m)
+	// imported metrics count towards the limit, too:
+	w.ImportMetricGRPC(&metricpb.Metric{
+		Name:  "a.b.c",
+		Type:  metricpb.Type_Counter,
+		Tags:  []string{"request:5"},
+		Value: &metricpb.Metric_Counter{Counter: &metricpb.CounterValue{Value: 10}},
+	})
+
+	wm := w.Flush()
+	values := map[string]float64{}
+	for key, c := range wm.counters {
+		values[key.Name+"|"+key.JoinedTags] = c.Flush(time.Second)[0].Value
+	}
+	assert.Equal(t, map[string]float64{
+		"a.b.c|request:1":     2,
+		"a.b.c|request:2":     1,
+		"a.b.c|overflow:true": 2,
+		"x.y.z|request:3":     1,
+	}, values)
+	values = map[string]float64{}
+	for key, c := range wm.globalCounters {
+		values[key.Name+"|"+key.JoinedTags] = c.Flush(time.Second)[0].Value
+	}
+	assert.Equal(t, map[string]float64{"a.b.c|overflow:true": 10}, values)
+
+	assert.Equal(t, []limitedMetric{{name: "a.b.c", samples: 3}}, limiter.reset())
+	assert.Empty(t, limiter.reset())
+}
+
+func TestWorkerCardinalityLimitDrop(t *testing.T) {
+	limiter, err := newCardinalityLimiter(1, "drop")
+	require.NoError(t, err)
+	w := NewWorker(1, nil, logrus.New(), nil)
+	w.limiter = limiter
+
+	for _, tag := range []string{"request:1", "request:2"} {
+		m := samplers.NewUDPMetric("a.b.c", "histogram", 1.0, []string{tag})
+		w.ProcessMetric(&m)
+	}
+	wm := w.Flush()
+	require.Len(t, wm.histograms, 1)
+	for key := range wm.histograms {
+		assert.Equal(t, "request:1", key.JoinedTags)
+	}
+	assert.Equal(t, []limitedMetric{{name: "a.b.c", samples: 1}}, limiter.reset())
+
+	_, err = newCardinalityLimiter(1, "truncate")
+	assert.Error(t, err)
+}
+
+func TestWorkerCardinalityLimitTimestampedBuckets(t *testing.T) {
+	limiter, err := newCardinalityLimiter(1, "")
+	require.NoError(t, err)
+	w := NewWorker(1, nil, logrus.New(), nil)
+	w.limiter = limiter
+	w.interval = 10 * time.Second
+	w.lateness = time.Minute
+
+	// the same series, now and in an earlier interval, is one series:
+	late := time.Now().Add(-20 * time.Second).Unix()
+	for _, ts := range []int64{0, late} {
+		m := samplers.NewUDPMetric("a.b.c", "counter", 1.0, []string{"request:1"})
+		m.Timestamp = ts
+		w.ProcessMetric(&m)
+	}
+	assert.Empty(t, limiter.reset())
+}
+
+func TestMergeOverflowAcrossWorkers(t *testing.T) {
+	limiter, err := newCardinalityLimiter(1, "")
+	require.NoError(t, err)
+	s := &Server{cardinalityLimiter: limiter}
+
+	var wms []WorkerMetrics
+	for i, tags := range [][]string{{"request:1", "request:2"}, {"request:3", "request:4"}} {
+		w := NewWorker(i+1, nil, logrus.New(), nil)
+		w.limiter = limiter
+		for _, tag := range tags {
+			m := samplers.NewUDPMetric("a.b.c", "counter", 1.0, []string{tag})
+			w.ProcessMetric(&m)
+		}
+		wms = append(wms, w.Flush())
+	}
+	wms = append(wms, s.mergeOverflow(wms)...)
+
+	values := map[string]float64{}
+	for _, wm := range wms {
+		for key, c := range wm.counters {
+			values[key.Name+"|"+key.JoinedTags] += c.Flush(time.Second)[0].Value
+		}
+	}
+	overflows := 0
+	for _, wm := range wms {
+		for key := range wm.counters {
+			if key.JoinedTags == overflowTag {
+				overflows++
+			}
+		}
+	}
+	assert.Equal(t, 1, overflows, "each metric name should flush one overflow series")
+	assert.Equal(t, map[string]float64{
+		"a.b.c|request:1":     1,
+		"a.b.c|overflow:true": 3,
+	}, values)
+}
@@ -0,0 +1,87 @@
+package veneur
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/trace/metrics"
+	"github.com/stripe/veneur/zipkin"
+)
+
+// maxZipkinBodyBytes limits the size of the (decompressed) body of a
+// request to the /api/v2/spans endpoint.
+const maxZipkinBodyBytes = 32 << 20
+
+// handleZipkinSpans implements the /api/v2/spans endpoint of the Zipkin
+// v2 collector API, which accepts a list of spans in either JSON or
+// proto3. The spans are converted to SSF and sent to the span workers.
+func handleZipkinSpans(s *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var decode func([]byte) ([]zipkin.Span, error)
+		encoding := "json"
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "", "application/json":
+			decode = zipkin.DecodeJSON
+		case "application/x-protobuf":
+			decode = zipkin.DecodeProto
+			encoding = "proto"
+		default:
+			http.Error(w, fmt.Sprintf("unsupported content type %q", mediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var body io.Reader = http.MaxBytesReader(w, r.Body, maxZipkinBodyBytes)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			body = io.LimitReader(gz, maxZipkinBodyBytes)
+		}
+		payload, err := ioutil.ReadAll(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tags := map[string]string{"encoding": encoding}
+		spans, err := decode(payload)
+		if err != nil {
+			log.WithError(err).WithField("encoding", encoding).Warn("Could not decode zipkin spans")
+			tags["reason"] = "decode"
+			metrics.ReportOne(s.TraceClient, ssf.Count("zipkin.request_error_total", 1, tags))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rejected := 0
+		for _, span := range spans {
+			ssfSpan, err := zipkin.ToSSF(span)
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					logrus.ErrorKey: err,
+					"trace_id":      span.TraceID,
+					"id":            span.ID,
+				}).Debug("Could not convert zipkin span")
+				rejected++
+				continue
+			}
+			s.handleSSF(ssfSpan, "zipkin")
+		}
+		metrics.ReportBatch(s.TraceClient, []*ssf.SSFSample{
+			ssf.Count("zipkin.spans_received_total", float32(len(spans)-rejected), tags),
+			ssf.Count("zipkin.spans_rejected_total", float32(rejected), tags),
+		})
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
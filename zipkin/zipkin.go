@@ -0,0 +1,259 @@
+// Package zipkin converts between Zipkin v2 spans, in their JSON and
+// proto3 encodings, and SSF spans.
+package zipkin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/zipkin/zipkinpb"
+)
+
+const (
+	// TraceIDTag is the span tag that holds the full, hex-encoded
+	// 128-bit Zipkin trace ID of a span.
+	TraceIDTag = "zipkin.trace_id"
+
+	// SpanKindTag holds the lower-case kind of a span (client,
+	// server, producer or consumer), like in OpenTracing.
+	SpanKindTag = "span.kind"
+
+	// PeerServiceTag holds the service name of a span's remote
+	// endpoint.
+	PeerServiceTag = "peer.service"
+
+	// errorTag is the tag that marks a Zipkin span as failed. Its
+	// value is usually the error message.
+	errorTag = "error"
+
+	// unknownService is the service name that Zipkin uses for spans
+	// without a local endpoint.
+	unknownService = "unknown"
+)
+
+// Span is a Zipkin v2 span, as encoded in JSON.
+type Span struct {
+	TraceID        string            `json:"traceId"`
+	ParentID       string            `json:"parentId,omitempty"`
+	ID             string            `json:"id"`
+	Kind           string            `json:"kind,omitempty"`
+	Name           string            `json:"name,omitempty"`
+	Timestamp      int64             `json:"timestamp,omitempty"`
+	Duration       int64             `json:"duration,omitempty"`
+	Debug          bool              `json:"debug,omitempty"`
+	Shared         bool              `json:"shared,omitempty"`
+	LocalEndpoint  *Endpoint         `json:"localEndpoint,omitempty"`
+	RemoteEndpoint *Endpoint         `json:"remoteEndpoint,omitempty"`
+	Annotations    []Annotation      `json:"annotations,omitempty"`
+	Tags           map[string]string `json:"tags,omitempty"`
+}
+
+// Endpoint is the network context of one side of a span.
+type Endpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	IPv4        string `json:"ipv4,omitempty"`
+	IPv6        string `json:"ipv6,omitempty"`
+	Port        int    `json:"port,omitempty"`
+}
+
+// Annotation is a timestamped event in a span.
+type Annotation struct {
+	Timestamp int64  `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+// DecodeJSON decodes a JSON list of spans.
+func DecodeJSON(body []byte) ([]Span, error) {
+	var spans []Span
+	if err := json.Unmarshal(body, &spans); err != nil {
+		return nil, err
+	}
+	return spans, nil
+}
+
+// DecodeProto decodes a proto3 ListOfSpans.
+func DecodeProto(body []byte) ([]Span, error) {
+	list := &zipkinpb.ListOfSpans{}
+	if err := proto.Unmarshal(body, list); err != nil {
+		return nil, err
+	}
+	spans := make([]Span, 0, len(list.Spans))
+	for _, pb := range list.Spans {
+		span := Span{
+			TraceID:        hex.EncodeToString(pb.TraceId),
+			ID:             hex.EncodeToString(pb.Id),
+			Kind:           pb.Kind.String(),
+			Name:           pb.Name,
+			Timestamp:      int64(pb.Timestamp),
+			Duration:       int64(pb.Duration),
+			Debug:          pb.Debug,
+			Shared:         pb.Shared,
+			LocalEndpoint:  endpointFromProto(pb.LocalEndpoint),
+			RemoteEndpoint: endpointFromProto(pb.RemoteEndpoint),
+			Tags:           pb.Tags,
+		}
+		if len(pb.ParentId) > 0 {
+			span.ParentID = hex.EncodeToString(pb.ParentId)
+		}
+		for _, a := range pb.Annotations {
+			span.Annotations = append(span.Annotations, Annotation{
+				Timestamp: int64(a.Timestamp),
+				Value:     a.Value,
+			})
+		}
+		spans = append(spans, span)
+	}
+	return spans, nil
+}
+
+func endpointFromProto(pb *zipkinpb.Endpoint) *Endpoint {
+	if pb == nil {
+		return nil
+	}
+	ep := &Endpoint{ServiceName: pb.ServiceName, Port: int(pb.Port)}
+	if len(pb.Ipv4) == net.IPv4len {
+		ep.IPv4 = net.IP(pb.Ipv4).String()
+	}
+	if len(pb.Ipv6) == net.IPv6len {
+		ep.IPv6 = net.IP(pb.Ipv6).String()
+	}
+	return ep
+}
+
+// ToSSF converts a Zipkin span into an SSF span.
+//
+// SSF IDs are (positive) int64s, so a 128-bit trace ID is cut down to
+// its lower 64 bits, the same as Zipkin does when it's configured to
+// accept both, and the full trace ID is kept in the TraceIDTag tag.
+//
+// The local endpoint's service name becomes the span's service, and
+// the remote endpoint's becomes the PeerServiceTag tag. Spans with an
+// "error" tag are errors. Annotations have no equivalent in SSF, and
+// are dropped.
+func ToSSF(span Span) (*ssf.SSFSpan, error) {
+	traceID, err := parseID(span.TraceID, true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trace ID: %v", err)
+	}
+	id, err := parseID(span.ID, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid span ID: %v", err)
+	}
+	var parentID int64
+	if span.ParentID != "" {
+		if parentID, err = parseID(span.ParentID, false); err != nil {
+			return nil, fmt.Errorf("invalid parent ID: %v", err)
+		}
+	}
+	if span.Timestamp <= 0 {
+		return nil, fmt.Errorf("span %s has no timestamp", span.ID)
+	}
+
+	ret := &ssf.SSFSpan{
+		TraceId:        traceID,
+		Id:             id,
+		ParentId:       parentID,
+		Name:           span.Name,
+		StartTimestamp: span.Timestamp * 1000,
+		EndTimestamp:   (span.Timestamp + span.Duration) * 1000,
+		Service:        unknownService,
+		Tags:           make(map[string]string, len(span.Tags)+3),
+	}
+	if span.LocalEndpoint != nil && span.LocalEndpoint.ServiceName != "" {
+		ret.Service = span.LocalEndpoint.ServiceName
+	}
+	for k, v := range span.Tags {
+		ret.Tags[k] = v
+	}
+	if _, ok := span.Tags[errorTag]; ok {
+		ret.Error = true
+	}
+	if len(span.TraceID) == 32 {
+		ret.Tags[TraceIDTag] = strings.ToLower(span.TraceID)
+	}
+	if span.Kind != "" {
+		ret.Tags[SpanKindTag] = strings.ToLower(span.Kind)
+	}
+	if span.RemoteEndpoint != nil && span.RemoteEndpoint.ServiceName != "" {
+		ret.Tags[PeerServiceTag] = span.RemoteEndpoint.ServiceName
+	}
+	return ret, nil
+}
+
+// parseID parses a hex-encoded 64-bit ID (or a 128-bit one, if long is
+// true) into a positive int64.
+func parseID(id string, long bool) (int64, error) {
+	if len(id) > 16 {
+		if !long || len(id) != 32 {
+			return 0, fmt.Errorf("%q is too long", id)
+		}
+		if _, err := strconv.ParseUint(id[:16], 16, 64); err != nil {
+			return 0, err
+		}
+		id = id[16:]
+	}
+	n, err := strconv.ParseUint(id, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n&math.MaxInt64 == 0 {
+		return 0, fmt.Errorf("%q is zero", id)
+	}
+	return int64(n & math.MaxInt64), nil
+}
+
+// FromSSF converts an SSF span into a Zipkin span, undoing what ToSSF
+// does. Indicator spans are tagged with "indicator".
+func FromSSF(span *ssf.SSFSpan) Span {
+	ret := Span{
+		TraceID:       fmt.Sprintf("%016x", span.TraceId),
+		ID:            fmt.Sprintf("%016x", span.Id),
+		Name:          span.Name,
+		Timestamp:     span.StartTimestamp / 1000,
+		LocalEndpoint: &Endpoint{ServiceName: span.Service},
+		Tags:          make(map[string]string, len(span.Tags)+2),
+	}
+	if span.ParentId != 0 {
+		ret.ParentID = fmt.Sprintf("%016x", span.ParentId)
+	}
+	if d := span.EndTimestamp - span.StartTimestamp; d > 0 {
+		// Zipkin takes a duration of 0 to mean "unknown", so round
+		// sub-microsecond spans up.
+		ret.Duration = (d + 999) / 1000
+	}
+
+	for k, v := range span.Tags {
+		switch k {
+		case TraceIDTag:
+			if _, err := hex.DecodeString(v); err == nil && len(v) == 32 {
+				ret.TraceID = v
+			}
+		case SpanKindTag:
+			switch kind := strings.ToUpper(v); kind {
+			case "CLIENT", "SERVER", "PRODUCER", "CONSUMER":
+				ret.Kind = kind
+			default:
+				ret.Tags[k] = v
+			}
+		case PeerServiceTag:
+			ret.RemoteEndpoint = &Endpoint{ServiceName: v}
+		default:
+			ret.Tags[k] = v
+		}
+	}
+	if _, ok := ret.Tags[errorTag]; span.Error && !ok {
+		ret.Tags[errorTag] = "true"
+	}
+	if span.Indicator {
+		ret.Tags["indicator"] = "true"
+	}
+	return ret
+}
@@ -0,0 +1,172 @@
+package zipkin
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stripe/veneur/ssf"
+	"github.com/stripe/veneur/zipkin/zipkinpb"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	spans, err := DecodeJSON([]byte(`[{
+		"traceId": "463ac35c9f6413ad48485a3953bb6124",
+		"id": "a2fb4a1d1a96d312",
+		"name": "post",
+		"kind": "CLIENT",
+		"timestamp": 1472470996199000,
+		"duration": 207000,
+		"localEndpoint": {"serviceName": "frontend", "ipv4": "127.0.0.1"},
+		"remoteEndpoint": {"serviceName": "backend", "port": 8080},
+		"annotations": [{"timestamp": 1472470996238000, "value": "ws"}],
+		"tags": {"http.path": "/api"}
+	}]`))
+	require.NoError(t, err)
+	assert.Equal(t, []Span{{
+		TraceID:        "463ac35c9f6413ad48485a3953bb6124",
+		ID:             "a2fb4a1d1a96d312",
+		Name:           "post",
+		Kind:           "CLIENT",
+		Timestamp:      1472470996199000,
+		Duration:       207000,
+		LocalEndpoint:  &Endpoint{ServiceName: "frontend", IPv4: "127.0.0.1"},
+		RemoteEndpoint: &Endpoint{ServiceName: "backend", Port: 8080},
+		Annotations:    []Annotation{{Timestamp: 1472470996238000, Value: "ws"}},
+		Tags:           map[string]string{"http.path": "/api"},
+	}}, spans)
+
+	_, err = DecodeJSON([]byte(`{"traceId": "1"}`))
+	assert.Error(t, err)
+}
+
+func TestDecodeProto(t *testing.T) {
+	payload, err := proto.Marshal(&zipkinpb.ListOfSpans{Spans: []*zipkinpb.Span{{
+		TraceId:        []byte{0x46, 0x3a, 0xc3, 0x5c, 0x9f, 0x64, 0x13, 0xad, 0x48, 0x48, 0x5a, 0x39, 0x53, 0xbb, 0x61, 0x24},
+		ParentId:       []byte{0, 0, 0, 0, 0, 0, 0, 1},
+		Id:             []byte{0xa2, 0xfb, 0x4a, 0x1d, 0x1a, 0x96, 0xd3, 0x12},
+		Kind:           zipkinpb.KindServer,
+		Name:           "post",
+		Timestamp:      1472470996199000,
+		Duration:       207000,
+		LocalEndpoint:  &zipkinpb.Endpoint{ServiceName: "backend", Ipv4: []byte{10, 0, 0, 1}},
+		RemoteEndpoint: &zipkinpb.Endpoint{ServiceName: "frontend", Port: 443},
+		Annotations:    []*zipkinpb.Annotation{{Timestamp: 1472470996238000, Value: "ws"}},
+		Tags:           map[string]string{"http.path": "/api"},
+		Shared:         true,
+	}}})
+	require.NoError(t, err)
+
+	spans, err := DecodeProto(payload)
+	require.NoError(t, err)
+	assert.Equal(t, []Span{{
+		TraceID:        "463ac35c9f6413ad48485a3953bb6124",
+		ParentID:       "0000000000000001",
+		ID:             "a2fb4a1d1a96d312",
+		Kind:           "SERVER",
+		Name:           "post",
+		Timestamp:      1472470996199000,
+		Duration:       207000,
+		Shared:         true,
+		LocalEndpoint:  &Endpoint{ServiceName: "backend", IPv4: "10.0.0.1"},
+		RemoteEndpoint: &Endpoint{ServiceName: "frontend", Port: 443},
+		Annotations:    []Annotation{{Timestamp: 1472470996238000, Value: "ws"}},
+		Tags:           map[string]string{"http.path": "/api"},
+	}}, spans)
+
+	_, err = DecodeProto([]byte{0xff, 0xff})
+	assert.Error(t, err)
+}
+
+func TestToSSF(t *testing.T) {
+	span, err := ToSSF(Span{
+		TraceID:        "463AC35C9F6413AD48485A3953BB6124",
+		ParentID:       "0000000000000001",
+		ID:             "a2fb4a1d1a96d312",
+		Kind:           "CLIENT",
+		Name:           "post",
+		Timestamp:      1472470996199000,
+		Duration:       207000,
+		LocalEndpoint:  &Endpoint{ServiceName: "frontend"},
+		RemoteEndpoint: &Endpoint{ServiceName: "backend"},
+		Tags:           map[string]string{"http.path": "/api", "error": "timeout"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &ssf.SSFSpan{
+		TraceId:        0x48485a3953bb6124,
+		ParentId:       1,
+		Id:             0x22fb4a1d1a96d312, // the top bit is cleared
+		Name:           "post",
+		Service:        "frontend",
+		StartTimestamp: 1472470996199000000,
+		EndTimestamp:   1472470996406000000,
+		Error:          true,
+		Tags: map[string]string{
+			"http.path":       "/api",
+			"error":           "timeout",
+			"span.kind":       "client",
+			"peer.service":    "backend",
+			"zipkin.trace_id": "463ac35c9f6413ad48485a3953bb6124",
+		},
+	}, span)
+
+	span, err = ToSSF(Span{TraceID: "1", ID: "2", Name: "x", Timestamp: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "unknown", span.Service)
+	assert.Empty(t, span.Tags)
+
+	for name, bad := range map[string]Span{
+		"short trace ID":    {TraceID: "xyz", ID: "2", Timestamp: 1},
+		"long span ID":      {TraceID: "1", ID: "463ac35c9f6413ad48485a3953bb6124", Timestamp: 1},
+		"zero span ID":      {TraceID: "1", ID: "0000000000000000", Timestamp: 1},
+		"invalid parent ID": {TraceID: "1", ID: "2", ParentID: "-", Timestamp: 1},
+		"no timestamp":      {TraceID: "1", ID: "2"},
+	} {
+		_, err := ToSSF(bad)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestFromSSF(t *testing.T) {
+	orig := Span{
+		TraceID:        "463ac35c9f6413ad48485a3953bb6124",
+		ParentID:       "0000000000000001",
+		ID:             "22fb4a1d1a96d312",
+		Kind:           "SERVER",
+		Name:           "post",
+		Timestamp:      1472470996199000,
+		Duration:       207000,
+		LocalEndpoint:  &Endpoint{ServiceName: "backend"},
+		RemoteEndpoint: &Endpoint{ServiceName: "frontend"},
+		Tags:           map[string]string{"http.path": "/api", "error": "timeout"},
+	}
+	span, err := ToSSF(orig)
+	require.NoError(t, err)
+	assert.Equal(t, orig, FromSSF(span))
+
+	assert.Equal(t, Span{
+		TraceID:       "0000000000000001",
+		ID:            "0000000000000002",
+		Name:          "check",
+		Timestamp:     1,
+		Duration:      1,
+		LocalEndpoint: &Endpoint{ServiceName: "veneur"},
+		Tags: map[string]string{
+			"error":     "true",
+			"indicator": "true",
+			"span.kind": "internal",
+		},
+	}, FromSSF(&ssf.SSFSpan{
+		TraceId:        1,
+		Id:             2,
+		Name:           "check",
+		Service:        "veneur",
+		StartTimestamp: 1000,
+		EndTimestamp:   1001,
+		Error:          true,
+		Indicator:      true,
+		Tags:           map[string]string{"span.kind": "internal"},
+	}))
+}
@@ -0,0 +1,88 @@
+// Package zipkinpb contains the proto3 encoding of Zipkin v2 spans, as
+// accepted by the /api/v2/spans endpoint with a Content-Type of
+// application/x-protobuf.
+//
+// The types mirror zipkin.proto in this directory and rely on the
+// reflection-based marshalers of github.com/golang/protobuf.
+package zipkinpb
+
+import (
+	"github.com/golang/protobuf/proto"
+)
+
+// Kind describes the relationship of a span to the remote side of an
+// RPC or messaging operation.
+type Kind int32
+
+const (
+	KindUnspecified Kind = 0
+	KindClient      Kind = 1
+	KindServer      Kind = 2
+	KindProducer    Kind = 3
+	KindConsumer    Kind = 4
+)
+
+var kindNames = map[Kind]string{
+	KindClient:   "CLIENT",
+	KindServer:   "SERVER",
+	KindProducer: "PRODUCER",
+	KindConsumer: "CONSUMER",
+}
+
+// String returns the name of the kind, as used in the JSON encoding,
+// or "" if it's unspecified.
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+// ListOfSpans is the body of a request to /api/v2/spans.
+type ListOfSpans struct {
+	Spans []*Span `protobuf:"bytes,1,rep,name=spans,proto3" json:"spans,omitempty"`
+}
+
+func (m *ListOfSpans) Reset()         { *m = ListOfSpans{} }
+func (m *ListOfSpans) String() string { return proto.CompactTextString(m) }
+func (*ListOfSpans) ProtoMessage()    {}
+
+// Span is a single operation, identified by its trace ID and ID.
+type Span struct {
+	TraceId        []byte            `protobuf:"bytes,1,opt,name=trace_id,json=traceId,proto3" json:"trace_id,omitempty"`
+	ParentId       []byte            `protobuf:"bytes,2,opt,name=parent_id,json=parentId,proto3" json:"parent_id,omitempty"`
+	Id             []byte            `protobuf:"bytes,3,opt,name=id,proto3" json:"id,omitempty"`
+	Kind           Kind              `protobuf:"varint,4,opt,name=kind,proto3,enum=zipkin.proto3.Span_Kind" json:"kind,omitempty"`
+	Name           string            `protobuf:"bytes,5,opt,name=name,proto3" json:"name,omitempty"`
+	Timestamp      uint64            `protobuf:"fixed64,6,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Duration       uint64            `protobuf:"varint,7,opt,name=duration,proto3" json:"duration,omitempty"`
+	LocalEndpoint  *Endpoint         `protobuf:"bytes,8,opt,name=local_endpoint,json=localEndpoint,proto3" json:"local_endpoint,omitempty"`
+	RemoteEndpoint *Endpoint         `protobuf:"bytes,9,opt,name=remote_endpoint,json=remoteEndpoint,proto3" json:"remote_endpoint,omitempty"`
+	Annotations    []*Annotation     `protobuf:"bytes,10,rep,name=annotations,proto3" json:"annotations,omitempty"`
+	Tags           map[string]string `protobuf:"bytes,11,rep,name=tags,proto3" json:"tags,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Debug          bool              `protobuf:"varint,12,opt,name=debug,proto3" json:"debug,omitempty"`
+	Shared         bool              `protobuf:"varint,13,opt,name=shared,proto3" json:"shared,omitempty"`
+}
+
+func (m *Span) Reset()         { *m = Span{} }
+func (m *Span) String() string { return proto.CompactTextString(m) }
+func (*Span) ProtoMessage()    {}
+
+// Endpoint describes a network context of a span.
+type Endpoint struct {
+	ServiceName string `protobuf:"bytes,1,opt,name=service_name,json=serviceName,proto3" json:"service_name,omitempty"`
+	Ipv4        []byte `protobuf:"bytes,2,opt,name=ipv4,proto3" json:"ipv4,omitempty"`
+	Ipv6        []byte `protobuf:"bytes,3,opt,name=ipv6,proto3" json:"ipv6,omitempty"`
+	Port        int32  `protobuf:"varint,4,opt,name=port,proto3" json:"port,omitempty"`
+}
+
+func (m *Endpoint) Reset()         { *m = Endpoint{} }
+func (m *Endpoint) String() string { return proto.CompactTextString(m) }
+func (*Endpoint) ProtoMessage()    {}
+
+// Annotation is a timestamped event in a span.
+type Annotation struct {
+	Timestamp uint64 `protobuf:"fixed64,1,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Value     string `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+func (m *Annotation) Reset()         { *m = Annotation{} }
+func (m *Annotation) String() string { return proto.CompactTextString(m) }
+func (*Annotation) ProtoMessage()    {}